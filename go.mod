@@ -2,4 +2,7 @@ module github.com/neelance/godockerize
 
 go 1.14
 
-require github.com/urfave/cli/v2 v2.2.0
+require (
+	github.com/urfave/cli/v2 v2.2.0
+	gopkg.in/yaml.v3 v3.0.1
+)
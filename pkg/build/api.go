@@ -0,0 +1,266 @@
+// Package build builds Docker images from Go packages. It is the
+// implementation of the godockerize command, see Main, and can be embedded
+// in other tools with Scan, GenerateDockerfile and Build, which report their
+// progress to the writers of Options.
+package build
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/neelance/godockerize/pkg/dockerfile"
+	"github.com/urfave/cli/v2"
+)
+
+// Options are the settings of GenerateDockerfile and Build. The fields are
+// the most common flags of "godockerize build", Flags takes all others.
+// Unlike the command, the configuration file and the GODOCKERIZE_
+// environment variables are not read.
+type Options struct {
+	Base   string   // base image, empty for alpine
+	Tags   []string // templates like --tag, e.g. "repo/{{.Name}}:latest"
+	Env    []string // NAME=value
+	GOOS   string   // empty for linux
+	GOARCH string   // empty for that of the host
+	Push   bool
+
+	// Flags are more flags of "godockerize build", e.g.
+	// []string{"--engine", "podman", "--strip"}.
+	Flags []string
+
+	// EditDockerfile, if set, may change the Dockerfile of each image
+	// before it is validated and rendered. Images assembled with
+	// --daemonless have no Dockerfile.
+	EditDockerfile func(*dockerfile.Builder) error
+
+	// Output receives the progress messages and the output of the commands
+	// that are run, Stderr the errors of those commands. They default to
+	// os.Stdout and os.Stderr.
+	Output io.Writer
+	Stderr io.Writer
+}
+
+// Spec describes the image of Go packages as declared by their //docker:
+// directives. GenerateDockerfile and Build use its fields instead of the
+// directives, so they may be changed after Scan, and add the settings of
+// Options to them. Directives is for information only; copies, includes and
+// the other directives without a field are still taken from the source.
+type Spec struct {
+	Packages    []string // import paths, the first one is the entrypoint
+	Env         []string
+	Expose      []string
+	Install     []string
+	Run         []string
+	Volumes     []string
+	User        string
+	Healthcheck []string
+	Depends     []string
+
+	// Directives are all directives of the packages in order, including
+	// those of kinds registered with directive.Register.
+	Directives []*directive.Directive
+}
+
+// Result describes a built image.
+type Result struct {
+	ImageID         string
+	Digest          string // of the pushed image
+	Tags            []string
+	BaseImage       string
+	BaseImageDigest string
+}
+
+// Scan loads the main packages matching patterns, like the arguments of
+// "godockerize build", and reads their directives.
+func Scan(ctx context.Context, patterns []string) (*Spec, error) {
+	tc := &toolchain{ctx: ctx, goBin: "go"}
+	packages, err := tc.loadPackages(&goBuildOptions{goos: "linux", goarch: runtime.GOARCH}, patterns)
+	if err != nil {
+		return nil, err
+	}
+	spec := newImageSpec(packages)
+	if err := spec.scanDirectives(tc); err != nil {
+		return nil, err
+	}
+	s := &Spec{
+		Env:         spec.env,
+		Expose:      spec.expose,
+		Install:     spec.install,
+		Run:         spec.run,
+		Volumes:     spec.volumes,
+		User:        spec.user,
+		Healthcheck: spec.healthcheck,
+		Depends:     spec.depends,
+	}
+	for _, pkg := range packages {
+		s.Packages = append(s.Packages, pkg.ImportPath)
+	}
+	for _, d := range spec.directives {
+		s.Directives = append(s.Directives, d.Directive)
+	}
+	return s, nil
+}
+
+// GenerateDockerfile returns the Dockerfile that compiles the packages of
+// spec in its build stage, like "godockerize dockerfile".
+func GenerateDockerfile(ctx context.Context, spec *Spec, opts *Options) ([]byte, error) {
+	c, err := opts.context(ctx, "dockerfile")
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBuilder(c)
+	if err != nil {
+		return nil, err
+	}
+	defer b.cancel()
+	b.vcsLabels = false
+	b.editDockerfile = opts.editDockerfile()
+	b.apiSpec = spec
+	dirs, err := b.packageDirs(spec)
+	if err != nil {
+		return nil, err
+	}
+	return b.generateDockerfile(c, dirs)
+}
+
+// Build builds the image of the packages of spec like "godockerize build".
+// The flag --separate-images is only supported for a single package, the
+// packages of separate images are scanned separately.
+func Build(ctx context.Context, spec *Spec, opts *Options) ([]*Result, error) {
+	c, err := opts.context(ctx, "build")
+	if err != nil {
+		return nil, err
+	}
+	if c.Bool("push") && len(c.StringSlice("tag")) == 0 {
+		return nil, errors.New("pushing requires tags")
+	}
+	if c.Bool("separate-images") && len(spec.Packages) > 1 {
+		return nil, errors.New("a Spec describes a single image, Scan the packages of separate images separately")
+	}
+	b, err := newBuilder(c)
+	if err != nil {
+		return nil, err
+	}
+	defer b.cancel()
+	b.editDockerfile = opts.editDockerfile()
+	b.apiSpec = spec
+	dirs, err := b.packageDirs(spec)
+	if err != nil {
+		return nil, err
+	}
+	results, err := b.buildPatterns(c, dirs)
+	if err != nil {
+		return nil, err
+	}
+	var r []*Result
+	for _, md := range results {
+		r = append(r, &Result{
+			ImageID:         md.ImageID,
+			Digest:          md.Digest,
+			Tags:            md.Tags,
+			BaseImage:       md.BaseImage,
+			BaseImageDigest: md.BaseImageDigest,
+		})
+	}
+	return r, nil
+}
+
+// packageDirs returns the directories of the packages of spec, as the
+// Dockerfile and --build-in-docker take packages as directories.
+func (b *builder) packageDirs(spec *Spec) ([]string, error) {
+	if len(spec.Packages) == 0 {
+		return nil, errors.New("the Spec has no packages")
+	}
+	packages, err := b.tc.loadPackages(b.goOpts, spec.Packages)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, pkg := range packages {
+		dirs = append(dirs, pkg.Dir)
+	}
+	return dirs, nil
+}
+
+// apply replaces what the directives of the packages declare in spec with
+// the fields of s. The first env, install and volumes values come from the
+// flags and the configuration file and are kept.
+func (s *Spec) apply(spec *imageSpec, env, install, volumes int) error {
+	if len(s.Healthcheck) != 0 {
+		if err := checkHealthcheckURL(s.Healthcheck[0]); err != nil {
+			return fmt.Errorf("Healthcheck of Spec: %v", err)
+		}
+	}
+	spec.env = append(spec.env[:env:env], s.Env...)
+	spec.install = append(spec.install[:install:install], s.Install...)
+	spec.volumes = append(spec.volumes[:volumes:volumes], s.Volumes...)
+	spec.expose = append([]string(nil), s.Expose...)
+	spec.run = append([]string(nil), s.Run...)
+	spec.user = s.User
+	spec.healthcheck = nil
+	if len(s.Healthcheck) != 0 {
+		spec.healthcheck = append([]string(nil), s.Healthcheck...)
+	}
+	spec.depends = append([]string(nil), s.Depends...)
+	return nil
+}
+
+func (opts *Options) editDockerfile() func(*dockerfile.Builder) error {
+	if opts == nil {
+		return nil
+	}
+	return opts.EditDockerfile
+}
+
+// context returns the context of the command with the flags for opts, so
+// that the builder is set up exactly like by the command.
+func (opts *Options) context(ctx context.Context, command string) (*cli.Context, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	var args []string
+	if opts.Base != "" {
+		args = append(args, "--base", opts.Base)
+	}
+	for _, t := range opts.Tags {
+		args = append(args, "--tag", t)
+	}
+	for _, v := range opts.Env {
+		args = append(args, "--env", v)
+	}
+	if opts.GOOS != "" {
+		args = append(args, "--goos", opts.GOOS)
+	}
+	if opts.GOARCH != "" {
+		args = append(args, "--goarch", opts.GOARCH)
+	}
+	if opts.Push {
+		args = append(args, "--push")
+	}
+	args = append(args, opts.Flags...)
+
+	flags := buildFlags()
+	set := flag.NewFlagSet(command, flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			return nil, err
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		return nil, err
+	}
+	if set.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected argument %q in Flags", set.Arg(0))
+	}
+	c := cli.NewContext(&cli.App{Name: "godockerize", Writer: opts.Output, ErrWriter: opts.Stderr}, set, nil)
+	c.Context = ctx
+	c.Command = &cli.Command{Name: command, Flags: flags}
+	return c, nil
+}
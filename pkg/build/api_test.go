@@ -0,0 +1,41 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateDockerfileFromSpec(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("testdata", "app")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	spec, err := Scan(context.Background(), []string{"./cmd/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Expose = []string{"9090"}
+	spec.Env = nil
+	var out bytes.Buffer
+	dockerfile, err := GenerateDockerfile(context.Background(), spec, &Options{Output: &out, Stderr: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(dockerfile); !strings.Contains(s, "EXPOSE 9090\n") || strings.Contains(s, "EXPOSE 8080") || strings.Contains(s, "MODE=production") {
+		t.Errorf("the Dockerfile does not use the fields of the Spec:\n%s", s)
+	}
+
+	spec.Healthcheck = []string{"https://localhost:8080/health"}
+	if _, err := GenerateDockerfile(context.Background(), spec, &Options{Output: &out, Stderr: &out}); err == nil {
+		t.Error("GenerateDockerfile with an invalid healthcheck URL did not fail")
+	}
+}
@@ -0,0 +1,362 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// authConfig holds the credentials for a registry, in the form the Docker
+// Engine API expects in the X-Registry-Auth header.
+type authConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// dockerConfigFile is the part of ~/.docker/config.json that is about
+// registry credentials.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// credentials finds the credentials for registries. The explicit ones of
+// --registry-username and --registry-password are used for the registries
+// that images are pushed to, also when pulling from them. Everything else
+// comes from the docker config and its credential helpers (e.g.
+// docker-credential-ecr-login, docker-credential-gcloud or
+// docker-credential-acr-env), as with docker itself.
+type credentials struct {
+	ctx                context.Context
+	username, password string
+
+	mu      sync.Mutex        // for parallel pushes
+	config  *dockerConfigFile // loaded on first use
+	found   map[string]*authConfig
+	targets map[string]bool // registries that images are pushed to
+	dir     string          // temporary engine configuration, if any
+	errOut  io.Writer       // for the errors of credential helpers, os.Stderr if nil
+}
+
+func newCredentials(ctx context.Context, username, password string) *credentials {
+	return &credentials{
+		ctx:      ctx,
+		username: username,
+		password: password,
+		found:    make(map[string]*authConfig),
+		targets:  make(map[string]bool),
+	}
+}
+
+// dockerConfigDir returns the directory of the docker config, which can be
+// changed with DOCKER_CONFIG.
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// registryHost normalizes a key of the docker config, which may be a URL
+// like https://index.docker.io/v1/, to the registry host as in imageRef.
+func registryHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if host == "docker.io" || host == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// serverAddress is the name of the registry in the docker config and for
+// credential helpers.
+func serverAddress(registry string) string {
+	if registry == "registry-1.docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
+
+// pushTo records that image is pushed, so that its registry gets the
+// explicit credentials.
+func (c *credentials) pushTo(image string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return err
+	}
+	c.targets[ref.registry] = true
+	return nil
+}
+
+// lookup returns the credentials for registry, or nil for anonymous access.
+func (c *credentials) lookup(registry string) (*authConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupLocked(registry)
+}
+
+func (c *credentials) lookupLocked(registry string) (*authConfig, error) {
+	if c.targets[registry] && c.username != "" {
+		return &authConfig{Username: c.username, Password: c.password, ServerAddress: serverAddress(registry)}, nil
+	}
+	if auth, ok := c.found[registry]; ok {
+		return auth, nil
+	}
+	auth, err := c.fromConfig(registry)
+	if err != nil {
+		return nil, err
+	}
+	c.found[registry] = auth
+	return auth, nil
+}
+
+func (c *credentials) loadConfig() error {
+	if c.config != nil {
+		return nil
+	}
+	config := &dockerConfigFile{}
+	file := filepath.Join(dockerConfigDir(), "config.json")
+	data, err := readFileIfExists(file)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	c.config = config
+	return nil
+}
+
+func (c *credentials) fromConfig(registry string) (*authConfig, error) {
+	if err := c.loadConfig(); err != nil {
+		return nil, err
+	}
+	for key, helper := range c.config.CredHelpers {
+		if registryHost(key) == registry {
+			return c.fromHelper(helper, key)
+		}
+	}
+	for key, entry := range c.config.Auths {
+		if registryHost(key) != registry {
+			continue
+		}
+		auth := &authConfig{Username: entry.Username, Password: entry.Password, IdentityToken: entry.IdentityToken, ServerAddress: key}
+		if entry.Auth != "" {
+			data, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("docker config: invalid auth of %s", key)
+			}
+			parts := strings.SplitN(string(data), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("docker config: invalid auth of %s", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		if auth.Username != "" || auth.IdentityToken != "" {
+			return auth, nil
+		}
+	}
+	if c.config.CredsStore != "" {
+		return c.fromHelper(c.config.CredsStore, serverAddress(registry))
+	}
+	return nil, nil
+}
+
+// fromHelper asks the credential helper docker-credential-<helper> for the
+// credentials of server.
+func (c *credentials) fromHelper(helper, server string) (*authConfig, error) {
+	name := "docker-credential-" + helper
+	cmd := exec.CommandContext(c.ctx, name, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = c.errOut
+	if c.errOut == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s get %s: %v", name, server, err)
+	}
+	var out struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("%s get %s: %v", name, server, err)
+	}
+	auth := &authConfig{Username: out.Username, Password: out.Secret, ServerAddress: server}
+	if out.Username == "<token>" {
+		auth = &authConfig{IdentityToken: out.Secret, ServerAddress: server}
+	}
+	return auth, nil
+}
+
+// header returns the X-Registry-Auth header for registry, which the daemon
+// requires even if the registry needs no credentials.
+func (c *credentials) header(registry string) (string, error) {
+	auth, err := c.lookup(registry)
+	if err != nil {
+		return "", err
+	}
+	if auth == nil {
+		auth = &authConfig{}
+	}
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// engineEnv returns the environment for an engine command that pushes
+// image, so that it uses the explicit credentials. Those are put into a
+// temporary configuration: an auth file for podman and buildah, a copy of
+// the docker config otherwise, in which the credentials of other
+// registries are resolved because its credential store can't be kept.
+func (c *credentials) engineEnv(e *engine, image string) ([]string, error) {
+	if c.username == "" {
+		return nil, nil
+	}
+	if err := c.pushTo(image); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dir == "" {
+		var err error
+		if c.dir, err = ioutil.TempDir("", "godockerize-auth"); err != nil {
+			return nil, err
+		}
+	}
+
+	auths := make(map[string]map[string]string)
+	add := func(server string, auth *authConfig) {
+		entry := map[string]string{}
+		if auth.IdentityToken != "" {
+			entry["identitytoken"] = auth.IdentityToken
+		} else {
+			entry["auth"] = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		}
+		auths[server] = entry
+	}
+	if e.authFile {
+		for registry := range c.targets {
+			add(serverAddress(registry), &authConfig{Username: c.username, Password: c.password})
+		}
+		file := filepath.Join(c.dir, "auth.json")
+		if err := writeJSONFile(file, map[string]interface{}{"auths": auths}); err != nil {
+			return nil, err
+		}
+		return []string{"REGISTRY_AUTH_FILE=" + file}, nil
+	}
+
+	config := make(map[string]json.RawMessage)
+	src := dockerConfigDir()
+	data, err := readFileIfExists(filepath.Join(src, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Join(src, "config.json"), err)
+		}
+	}
+	if err := c.loadConfig(); err != nil {
+		return nil, err
+	}
+	servers := make(map[string]bool)
+	for key := range c.config.Auths {
+		servers[key] = true
+	}
+	for key := range c.config.CredHelpers {
+		servers[key] = true
+	}
+	for server := range servers {
+		registry := registryHost(server)
+		if c.targets[registry] {
+			continue
+		}
+		auth, err := c.lookupLocked(registry)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			add(server, auth)
+		}
+	}
+	for registry := range c.targets {
+		add(serverAddress(registry), &authConfig{Username: c.username, Password: c.password})
+	}
+	if config["auths"], err = json.Marshal(auths); err != nil {
+		return nil, err
+	}
+	delete(config, "credsStore")
+	delete(config, "credHelpers")
+	if err := writeJSONFile(filepath.Join(c.dir, "config.json"), config); err != nil {
+		return nil, err
+	}
+	// contexts are stored next to the config
+	contexts := filepath.Join(c.dir, "contexts")
+	_, err = os.Lstat(contexts)
+	if fi, serr := os.Stat(filepath.Join(src, "contexts")); os.IsNotExist(err) && serr == nil && fi.IsDir() {
+		if err := os.Symlink(filepath.Join(src, "contexts"), contexts); err != nil {
+			return nil, err
+		}
+	}
+	return []string{"DOCKER_CONFIG=" + c.dir}, nil
+}
+
+// close removes the temporary engine configuration.
+func (c *credentials) close() {
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// readPassword returns the registry password of --registry-password or,
+// with --registry-password-stdin, from the standard input.
+func readPassword(fromStdin bool, password string) (string, error) {
+	if !fromStdin {
+		return password, nil
+	}
+	if password != "" {
+		return "", errors.New("--registry-password and --registry-password-stdin can't be combined")
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("reading password from stdin: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,241 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// bakeTarget is a target of a buildx bake file.
+type bakeTarget struct {
+	name       string
+	context    string
+	dockerfile []byte
+	tags       []string
+	platforms  []string
+	args       map[string]string
+	secrets    []string
+	ssh        bool
+	cacheFrom  []string
+	cacheTo    []string
+}
+
+func doBake(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize bake" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("bake does not support path@version")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	packages, mod, err := loadLocalPackages(b.goOpts, patterns)
+	if err != nil {
+		return err
+	}
+	b.module = mod
+	if b.builderImage == "" {
+		b.builderImage = builderImage(c.String("go-version"), mod)
+	}
+
+	var platforms []string
+	for _, v := range c.StringSlice("platform") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				platforms = append(platforms, p)
+			}
+		}
+	}
+	if len(platforms) > 1 || (len(platforms) == 1 && b.imageOpts.platform == "") {
+		b.goOpts.targetPlatform = true
+	} else if b.imageOpts.platform != "" {
+		platforms = []string{b.imageOpts.platform}
+	}
+
+	file := c.String("file")
+	dir := "."
+	if file != "-" {
+		dir = filepath.Dir(file)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	context, err := filepath.Rel(absDir, mod.Dir)
+	if err != nil {
+		return err
+	}
+
+	buildArgs := make(map[string]string)
+	for _, v := range append(append([]string{}, b.imageOpts.buildArgs...), b.tc.moduleEnv()...) {
+		name, value := parseKeyValue(v)
+		buildArgs[name] = value
+	}
+	secrets := findBuildStageSecrets()
+	if err := b.findLicenses(packages); err != nil {
+		return err
+	}
+
+	var targets []*bakeTarget
+	for _, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return err
+		}
+		if err := b.placeAssets(spec); err != nil {
+			return err
+		}
+		stage, err := goBuildStage(b.builderImage, mod, spec.packages, b.goOpts, b.tc.moduleEnv(), secrets.mounts())
+		if err != nil {
+			return err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return err
+		}
+		image, err := b.imageDockerfile(spec, buildStage)
+		if err != nil {
+			return err
+		}
+		stage.Append(image)
+		dockerfile, err := b.renderDockerfile(stage, "  ")
+		if err != nil {
+			return err
+		}
+		t := &bakeTarget{
+			name:       bakeTargetName(spec.name()),
+			context:    filepath.ToSlash(context),
+			dockerfile: dockerfile,
+			tags:       tags,
+			platforms:  platforms,
+			args:       buildArgs,
+			ssh:        secrets.ssh,
+			cacheFrom:  b.imageOpts.cacheFrom,
+			cacheTo:    b.imageOpts.cacheTo,
+		}
+		if secrets.netrc != "" {
+			t.secrets = append(t.secrets, "id=netrc,src="+secrets.netrc)
+		}
+		targets = append(targets, t)
+	}
+
+	data := writeBakeFile(targets)
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Wrote %s with %d targets\n", file, len(targets))
+	return nil
+}
+
+// bakeTargetName turns a binary name into a valid target name.
+func bakeTargetName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writeBakeFile returns the HCL of a bake file with targets and a default
+// group that builds all of them.
+func writeBakeFile(targets []*bakeTarget) []byte {
+	var buf bytes.Buffer
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+	fmt.Fprintf(&buf, "# Generated by godockerize bake.\n\n")
+	fmt.Fprintf(&buf, "group \"default\" {\n  targets = %s\n}\n", hclList(names))
+	for _, t := range targets {
+		fmt.Fprintf(&buf, "\ntarget %s {\n", hclString(t.name))
+		fmt.Fprintf(&buf, "  context = %s\n", hclString(t.context))
+		fmt.Fprintf(&buf, "  dockerfile-inline = %s\n", hclString(string(t.dockerfile)))
+		if len(t.tags) != 0 {
+			fmt.Fprintf(&buf, "  tags = %s\n", hclList(t.tags))
+		}
+		if len(t.platforms) != 0 {
+			fmt.Fprintf(&buf, "  platforms = %s\n", hclList(t.platforms))
+		}
+		if len(t.args) != 0 {
+			var keys []string
+			for k := range t.args {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(&buf, "  args = {\n")
+			for _, k := range keys {
+				fmt.Fprintf(&buf, "    %s = %s\n", k, hclString(t.args[k]))
+			}
+			fmt.Fprintf(&buf, "  }\n")
+		}
+		if len(t.secrets) != 0 {
+			fmt.Fprintf(&buf, "  secret = %s\n", hclList(t.secrets))
+		}
+		if t.ssh {
+			fmt.Fprintf(&buf, "  ssh = [\"default\"]\n")
+		}
+		if len(t.cacheFrom) != 0 {
+			fmt.Fprintf(&buf, "  cache-from = %s\n", hclList(t.cacheFrom))
+		}
+		if len(t.cacheTo) != 0 {
+			fmt.Fprintf(&buf, "  cache-to = %s\n", hclList(t.cacheTo))
+		}
+		fmt.Fprintf(&buf, "}\n")
+	}
+	return buf.Bytes()
+}
+
+// hclString quotes s as an HCL string literal, in which ${ and %{ would
+// start an interpolation or a directive.
+func hclString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case (r == '$' || r == '%') && strings.HasPrefix(s[i+1:], "{"):
+			b.WriteRune(r)
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func hclList(values []string) string {
+	var quoted []string
+	for _, v := range values {
+		quoted = append(quoted, hclString(v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,443 @@
+package build
+
+import (
+	"debug/elf"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// baseFamily describes how images are set up on a family of base images,
+// e.g. which package manager they use.
+type baseFamily struct {
+	name string
+
+	// Packages installed into every image by default.
+	certsPackage string // CA certificates
+	mimePackage  string // /etc/mime.types
+	tiniPackage  string
+	tini         string // path of tini once tiniPackage is installed; empty starts the entrypoint directly
+
+	shell   bool   // RUN instructions and shell scripts work
+	nonroot string // user that replaces //docker:user because users can't be created
+	static  bool   // binaries must not need a dynamic loader
+	windows bool   // Windows paths, no ownership or permissions for COPY
+
+	// install returns the commands for installing packages. It is nil if
+	// the family has no package manager.
+	install func(packages []string) []string
+
+	// addUser returns the commands that create user[:group] unless it
+	// exists. It is nil if users can't be created with RUN.
+	addUser func(user string) []string
+
+	// bootstrap returns the instructions of a stage that prepares files
+	// for images that have to be populated from elsewhere, and the
+	// instructions of the final stage that take them over. It may be nil.
+	bootstrap func(user string) (stage, final []string)
+}
+
+var alpineFamily = &baseFamily{
+	name:         "alpine",
+	certsPackage: "ca-certificates",
+	mimePackage:  "mailcap",
+	tiniPackage:  "tini",
+	tini:         "/sbin/tini",
+	shell:        true,
+	install:      apkInstall,
+	addUser:      busyboxAddUser,
+}
+
+// debianFamily covers Debian and Ubuntu, which have glibc.
+var debianFamily = &baseFamily{
+	name:         "debian",
+	certsPackage: "ca-certificates",
+	mimePackage:  "media-types",
+	tiniPackage:  "tini",
+	tini:         "/usr/bin/tini",
+	shell:        true,
+	install:      aptInstall,
+	addUser:      shadowAddUser,
+}
+
+// distrolessFamily is gcr.io/distroless: no shell and no package manager, but
+// CA certificates, tzdata and a nonroot user are included.
+var distrolessFamily = &baseFamily{
+	name:    "distroless",
+	nonroot: "nonroot:nonroot",
+}
+
+// wolfiFamily is Chainguard's Wolfi. It uses apk with its own repositories
+// and has no adduser.
+var wolfiFamily = &baseFamily{
+	name:         "wolfi",
+	certsPackage: "ca-certificates-bundle",
+	mimePackage:  "mailcap",
+	tiniPackage:  "tini",
+	tini:         "/usr/bin/tini",
+	shell:        true,
+	install:      wolfiInstall,
+	addUser:      passwdAddUser,
+}
+
+// ubiMinimalFamily is the minimal variant of Red Hat's Universal Base Image,
+// with microdnf. tini is not available from the UBI repositories.
+var ubiMinimalFamily = &baseFamily{
+	name:         "ubi-minimal",
+	certsPackage: "ca-certificates",
+	mimePackage:  "mailcap",
+	shell:        true,
+	install:      rpmInstall("microdnf"),
+	addUser:      rpmAddUser("microdnf"),
+}
+
+// ubiFamily is the standard Universal Base Image, with dnf.
+var ubiFamily = &baseFamily{
+	name:         "ubi",
+	certsPackage: "ca-certificates",
+	mimePackage:  "mailcap",
+	shell:        true,
+	install:      rpmInstall("dnf"),
+	addUser:      rpmAddUser("dnf"),
+}
+
+// windowsFamily covers the Nano Server and Server Core images for Windows
+// containers.
+var windowsFamily = &baseFamily{
+	name:    "windows",
+	nonroot: "ContainerUser",
+	windows: true,
+}
+
+// scratchFamily is the empty image. CA certificates, tzdata, MIME types and
+// the user come from an Alpine stage.
+var scratchFamily = &baseFamily{
+	name:      "scratch",
+	static:    true,
+	bootstrap: scratchBootstrap,
+}
+
+// defaultPackages returns the packages that are installed into every image
+// unless configured otherwise.
+func (f *baseFamily) defaultPackages() []string {
+	var packages []string
+	for _, pkg := range []string{f.certsPackage, f.mimePackage, f.tiniPackage} {
+		if pkg != "" {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+// autoBaseImage is the value of --base that selects the base image for each
+// image with autoBase.
+const autoBaseImage = "auto"
+
+// autoBase picks the smallest base image that works for spec: scratch if the
+// binaries are static and nothing has to be installed or run in the image,
+// else Alpine, or Debian if the binaries need glibc.
+func autoBase(spec *imageSpec, opts *goBuildOptions) string {
+	cgo, static := false, false
+	for _, v := range opts.env {
+		if v == "CGO_ENABLED=1" {
+			cgo = true
+		}
+	}
+	for _, f := range opts.ldflags {
+		if f == "-extldflags=-static" {
+			static = true
+		}
+	}
+	switch {
+	case cgo && !static:
+		return "debian:bookworm-slim"
+	case len(spec.install) != 0 || len(spec.run) != 0 || len(spec.addedInstructions()) != 0 || spec.packages[0].Test:
+		return baseDockerImage
+	}
+	return "scratch"
+}
+
+// baseFamilyOf returns the family of the base image. Unknown images are
+// assumed to be Alpine.
+func baseFamilyOf(image string) *baseFamily {
+	repo := repository(image)
+	switch {
+	case repo == "scratch":
+		return scratchFamily
+	case strings.HasPrefix(repo, "gcr.io/distroless/"):
+		return distrolessFamily
+	case strings.HasPrefix(repo, "cgr.dev/chainguard/wolfi"):
+		return wolfiFamily
+	case strings.HasPrefix(repo, "mcr.microsoft.com/windows/"):
+		return windowsFamily
+	}
+	switch name := path.Base(repo); {
+	case name == "debian", name == "ubuntu":
+		return debianFamily
+	case strings.HasPrefix(name, "ubi") && strings.HasSuffix(name, "-minimal"):
+		return ubiMinimalFamily
+	case name == "ubi8", name == "ubi9", name == "ubi10":
+		return ubiFamily
+	}
+	return alpineFamily
+}
+
+func aptInstall(packages []string) []string {
+	return []string{"apt-get update" +
+		" && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + strings.Join(packages, " ") +
+		" && rm -rf /var/lib/apt/lists/*"}
+}
+
+// wolfiInstall is like apkInstall, but Wolfi is a rolling distribution
+// without an edge repository.
+func wolfiInstall(packages []string) []string {
+	var names []string
+	for _, pkg := range packages {
+		names = append(names, strings.TrimSuffix(pkg, "@edge"))
+	}
+	return []string{"apk add --no-cache " + strings.Join(sortedStringSet(names), " ")}
+}
+
+// passwdAddUser creates a user by editing /etc/passwd and /etc/group
+// directly, for images without tools for it.
+func passwdAddUser(user string) []string {
+	name, group := splitUser(user)
+	if isNumeric(name) {
+		return nil
+	}
+	if group == "" {
+		group = name
+	}
+	var cmds []string
+	gid := group
+	if !isNumeric(group) {
+		cmds = append(cmds, "getent group "+group+" >/dev/null || echo '"+group+":x:"+scratchUID+":' >> /etc/group")
+		gid = "$(getent group " + group + " | cut -d: -f3)"
+	}
+	return append(cmds, "id -u "+name+` >/dev/null 2>&1 || echo "`+name+":x:"+scratchUID+":"+gid+`::/:/sbin/nologin" >> /etc/passwd`)
+}
+
+// rpmInstall returns the install function for the dnf compatible tool.
+func rpmInstall(tool string) func(packages []string) []string {
+	return func(packages []string) []string {
+		return []string{tool + " install -y --nodocs --setopt=install_weak_deps=0 " + strings.Join(packages, " ") + " && " + tool + " clean all"}
+	}
+}
+
+// rpmAddUser is like shadowAddUser, but installs shadow-utils first, which is
+// not part of every image.
+func rpmAddUser(tool string) func(user string) []string {
+	return func(user string) []string {
+		cmds := shadowAddUser(user)
+		if cmds == nil {
+			return nil
+		}
+		return append([]string{rpmInstall(tool)([]string{"shadow-utils"})[0]}, cmds...)
+	}
+}
+
+// busyboxAddUser creates a system user with the adduser and addgroup
+// commands of BusyBox.
+func busyboxAddUser(user string) []string {
+	name, group := splitUser(user)
+	if isNumeric(name) {
+		return nil
+	}
+	if group == "" {
+		group = name
+	}
+	cmd := "adduser -S -D -H -G " + group + " " + name
+	if !isNumeric(group) {
+		cmd = "(getent group " + group + " >/dev/null || addgroup -S " + group + ") && " + cmd
+	}
+	return []string{"id -u " + name + " >/dev/null 2>&1 || { " + cmd + "; }"}
+}
+
+// shadowAddUser creates a system user with useradd and groupadd.
+func shadowAddUser(user string) []string {
+	name, group := splitUser(user)
+	if isNumeric(name) {
+		return nil
+	}
+	if group == "" {
+		group = name
+	}
+	cmd := "useradd --system --no-create-home --shell /usr/sbin/nologin --gid " + group + " " + name
+	if !isNumeric(group) {
+		cmd = "(getent group " + group + " >/dev/null || groupadd --system " + group + ") && " + cmd
+	}
+	return []string{"id -u " + name + " >/dev/null 2>&1 || { " + cmd + "; }"}
+}
+
+// binDir returns the directory of the binaries in the image, in the form
+// used by COPY.
+func (f *baseFamily) binDir() string {
+	if f.windows {
+		return "C:/app/"
+	}
+	return "/usr/local/bin/"
+}
+
+// binPath returns the path of the binary name in the image, in the native
+// form of the image's operating system.
+func (f *baseFamily) binPath(name string) string {
+	if f.windows {
+		return `C:\app\` + name
+	}
+	return "/usr/local/bin/" + name
+}
+
+// bootstrapStage is the name of the stage of baseFamily.bootstrap.
+const bootstrapStage = "bootstrap"
+
+// scratchUID is the ID of users and groups that are written to /etc/passwd
+// and /etc/group directly, e.g. on scratch images.
+const scratchUID = "10001"
+
+func scratchBootstrap(user string) (stage, final []string) {
+	passwd := "root:x:0:0:root:/root:/sbin/nologin\\n"
+	group := "root:x:0:\\n"
+	if name, groupName := splitUser(user); name != "" && !isNumeric(name) {
+		passwd += name + ":x:" + scratchUID + ":" + scratchUID + "::/:/sbin/nologin\\n"
+		if groupName == "" || isNumeric(groupName) {
+			groupName = name
+		}
+		group += groupName + ":x:" + scratchUID + ":\\n"
+	}
+	stage = []string{
+		"FROM " + baseDockerImage + " AS " + bootstrapStage,
+		"RUN apk add --no-cache ca-certificates mailcap tzdata",
+		"RUN mkdir -p /rootfs/etc/ssl/certs /rootfs/usr/share /rootfs/tmp" +
+			" && cp /etc/ssl/certs/ca-certificates.crt /rootfs/etc/ssl/certs/" +
+			" && cp -r /usr/share/zoneinfo /rootfs/usr/share/" +
+			" && cp /etc/mime.types /rootfs/etc/" +
+			" && chmod 1777 /rootfs/tmp" +
+			" && printf '" + passwd + "' > /rootfs/etc/passwd" +
+			" && printf '" + group + "' > /rootfs/etc/group",
+	}
+	final = []string{"COPY --from=" + bootstrapStage + " /rootfs/ /"}
+	return stage, final
+}
+
+// splitUser splits user[:group].
+func splitUser(user string) (name, group string) {
+	parts := strings.SplitN(user, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func apkInstall(packages []string) []string {
+	var cmds []string
+	for _, pkg := range packages {
+		if strings.HasSuffix(pkg, "@edge") {
+			cmds = append(cmds, `echo -e "@edge http://dl-cdn.alpinelinux.org/alpine/edge/main\n@edge http://dl-cdn.alpinelinux.org/alpine/edge/community" >> /etc/apk/repositories`)
+			break
+		}
+	}
+	return append(cmds, "apk add --no-cache "+strings.Join(packages, " "))
+}
+
+// checkBase reports the parts of spec that can't work on its base image.
+func (spec *imageSpec) checkBase() error {
+	f := spec.family
+	if f.windows && spec.usesHealthcheckHelper() {
+		return stageErrorf(stageDirective, "//docker:healthcheck %s: the health check helper is not available for Windows images", spec.healthcheck[0])
+	}
+	if f.install == nil && len(spec.install) != 0 {
+		return stageErrorf(stageDirective, "//docker:install %s: %s base images have no package manager", strings.Join(spec.install, " "), f.name)
+	}
+	if !f.shell {
+		if len(spec.run) != 0 {
+			return stageErrorf(stageDirective, "//docker:run %s: %s base images have no shell", spec.run[0], f.name)
+		}
+		for _, inst := range spec.addedInstructions() {
+			if inst.Cmd == "RUN" && !strings.HasPrefix(inst.Args, "[") {
+				return stageErrorf(stageDirective, "%s of a directive handler or include: %s base images have no shell", inst, f.name)
+			}
+		}
+		if spec.packages[0].Test {
+			return fmt.Errorf("test binary images need a shell, which %s base images don't have", f.name)
+		}
+	}
+	return nil
+}
+
+// checkStatic makes sure that the binaries of packages in dir can run
+// without a dynamic loader, as required by base images like scratch.
+func checkStatic(packages []*goPackage, dir string, family *baseFamily) error {
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		f, err := elf.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		dynamic := false
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_INTERP {
+				dynamic = true
+			}
+		}
+		f.Close()
+		if dynamic {
+			return fmt.Errorf("binary %s is dynamically linked, which does not work on %s base images", name, family.name)
+		}
+	}
+	return nil
+}
+
+// checkBasePolicy makes sure that image matches one of the allowed patterns,
+// if there are any, and none of the denied ones. Patterns are matched with
+// path.Match against the repository, e.g. "gcr.io/distroless/*", or the
+// whole reference, e.g. "alpine:3.*".
+func checkBasePolicy(image string, allowed, denied []string) error {
+	matches := func(pattern string) (bool, error) {
+		for _, s := range []string{repository(image), image} {
+			ok, err := path.Match(pattern, s)
+			if err != nil {
+				return false, fmt.Errorf("invalid base image pattern %q: %v", pattern, err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	for _, pattern := range denied {
+		ok, err := matches(pattern)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fmt.Errorf("base image %s is denied by %s", image, pattern)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		ok, err := matches(pattern)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("base image %s is not allowed, must match one of %s", image, strings.Join(allowed, ", "))
+}
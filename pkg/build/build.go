@@ -0,0 +1,1277 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+	"github.com/urfave/cli/v2"
+)
+
+func doBuild(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize build" requires 1 or more arguments`)
+	}
+	if c.Bool("interactive") {
+		if err := runWizard(c, args.Slice()); err != nil {
+			return err
+		}
+	}
+	if c.Bool("push") && len(c.StringSlice("tag")) == 0 {
+		return errors.New("--push requires --tag")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	results, err := b.buildPatterns(c, args.Slice())
+	if err != nil {
+		return err
+	}
+	return writeResults(c, results, c.Bool("separate-images") || len(b.goVersions) != 0)
+}
+
+// buildPatterns builds the images for the packages matching patterns. It
+// returns no results for a dry run.
+func (b *builder) buildPatterns(c *cli.Context, patterns []string) ([]*buildMetadata, error) {
+	if c.Bool("generate") {
+		if hasVersion(patterns) {
+			return nil, errors.New("--generate does not support path@version")
+		}
+		if err := b.tc.goGenerate(b.goOpts, patterns); err != nil {
+			return nil, b.tc.checkTimeout(stageGenerate, err)
+		}
+	}
+	if b.inDocker {
+		if hasVersion(patterns) {
+			return nil, errors.New("--build-in-docker does not support path@version")
+		}
+		packages, mod, err := loadLocalPackages(b.goOpts, patterns)
+		if err != nil {
+			return nil, err
+		}
+		b.module = mod
+		if len(b.goVersions) == 0 {
+			if b.builderImage == "" {
+				b.builderImage = builderImage(c.String("go-version"), mod)
+			}
+			return b.buildAll(c, packages)
+		}
+
+		// the matrix: one set of images per version
+		if err := b.prepare(c, packages); err != nil {
+			return nil, err
+		}
+		var results []*buildMetadata
+		for _, v := range b.goVersions {
+			b.builderImage = builderImage(v, mod)
+			b.matrixVersion = v
+			r, err := b.buildImages(c, packages)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r...)
+		}
+		return results, nil
+	}
+	if hasVersion(patterns) {
+		var dir string
+		var err error
+		if patterns, dir, err = b.tc.fetchRemote(patterns); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	packages, err := b.tc.loadPackages(b.goOpts, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPrebuilt(b.prebuilt, packages); err != nil {
+		return nil, err
+	}
+	return b.buildAll(c, packages)
+}
+
+// buildAll builds the images for packages after preparing them.
+func (b *builder) buildAll(c *cli.Context, packages []*goPackage) ([]*buildMetadata, error) {
+	if err := b.prepare(c, packages); err != nil {
+		return nil, err
+	}
+	return b.buildImages(c, packages)
+}
+
+// prepare runs everything that is needed once before images are built from
+// packages.
+func (b *builder) prepare(c *cli.Context, packages []*goPackage) error {
+	if b.goOpts.goos == "windows" {
+		for _, pkg := range packages {
+			pkg.Exe = ".exe"
+		}
+	}
+	if !b.dryRun {
+		if err := b.runGates(c, packages); err != nil {
+			return err
+		}
+	}
+	return b.findLicenses(packages)
+}
+
+// findLicenses finds the licenses of the dependencies of packages with
+// --licenses, writes the report and checks them against --deny-license.
+func (b *builder) findLicenses(packages []*goPackage) error {
+	if b.licenses == nil {
+		return nil
+	}
+	var err error
+	if b.modules, err = b.tc.moduleLicenses(b.goOpts, packages); err != nil {
+		return err
+	}
+	if b.licenses.report != "" {
+		if err := writeJSONFile(b.licenses.report, b.modules); err != nil {
+			return err
+		}
+		b.tc.printf("godockerize: Wrote license report %s\n", b.licenses.report)
+	}
+	return b.licenses.check(b.modules)
+}
+
+// buildImages builds the images for packages, one or one per package with
+// --separate-images. It returns no results for a dry run.
+func (b *builder) buildImages(c *cli.Context, packages []*goPackage) ([]*buildMetadata, error) {
+	groups := [][]*goPackage{packages}
+	if c.Bool("separate-images") {
+		groups = nil
+		for _, pkg := range packages {
+			groups = append(groups, []*goPackage{pkg})
+		}
+		for _, tag := range c.StringSlice("tag") {
+			if len(groups) > 1 && !strings.Contains(tag, "{{") {
+				return nil, errors.New(`--separate-images requires a tag template like "repo/{{.Name}}:latest"`)
+			}
+		}
+	}
+
+	var results []*buildMetadata
+	for _, pkgs := range groups {
+		md, err := b.build(pkgs)
+		if err != nil {
+			return nil, err
+		}
+		if md != nil {
+			results = append(results, md)
+		}
+	}
+	return results, nil
+}
+
+// writeResults writes the --iidfile and --metadata-file of the images. The
+// metadata is an array if there can be more than one image.
+func writeResults(c *cli.Context, results []*buildMetadata, multiple bool) error {
+	if len(results) == 0 {
+		return nil // dry run
+	}
+
+	if file := c.String("iidfile"); file != "" {
+		var ids []string
+		for _, md := range results {
+			ids = append(ids, md.ImageID)
+		}
+		if err := ioutil.WriteFile(file, []byte(strings.Join(ids, "\n")), 0666); err != nil {
+			return err
+		}
+	}
+
+	if file := c.String("metadata-file"); file != "" {
+		var v interface{} = results[0]
+		if multiple {
+			v = results
+		}
+		if err := writeJSONFile(file, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// builder builds images with the settings of the build command.
+type builder struct {
+	tc     *toolchain
+	cancel context.CancelFunc
+
+	base      string               // may be autoBaseImage
+	tags      []*template.Template // of --tag, the first one is the name the image is built with
+	env       []string
+	labels    []string
+	cover     bool
+	user      string // overrides //docker:user
+	legacyAdd bool
+	layering  string
+
+	goOpts    *goBuildOptions
+	imageOpts dockerBuildOptions // tag is set per image
+	cache     *buildCache        // nil with --force-rebuild
+	fipsMode  string
+	compress  *compressOptions
+
+	maxBinarySize, maxImageSize int64
+
+	noDefaultPackages bool
+	defaultPackages   []string // nil for the base image's defaults
+	detectPackages    bool
+	inferPorts        bool
+	detectWrites      bool
+	detectBinaries    bool
+	inferHealthcheck  bool
+	envInventory      bool
+	envReport         string
+	envReports        []*envReport // written so far to envReport
+	checkEnv          bool
+
+	allowedBase, deniedBase []string
+	pinBase                 bool
+	pinned                  map[string]string // resolved by --pin-base
+
+	goBuildTimeout, dockerBuildTimeout, pushTimeout time.Duration
+
+	dryRun       bool
+	push         bool
+	parallelPush bool
+	metadata     bool
+
+	// with --build-in-docker
+	inDocker      bool
+	builderImage  string
+	module        *localModule
+	goVersions    []string // the matrix of --go-versions
+	matrixVersion string   // the version of the matrix that is being built
+
+	streamContext bool
+
+	prebuilt map[string]string // binary name to file, from --prebuilt
+	output   *output           // nil for the local image store
+	exported bool              // an image was written to output
+
+	sbom       *sbomOptions    // nil without --sbom
+	binaryInfo []*goBinaryInfo // of the last compile, for the SBOM
+	sign       *signOptions    // nil without --sign
+	scan       *scanOptions    // nil without --scan
+	licenses   *licenseOptions // nil without --licenses
+	modules    []*moduleLicense
+	vcsLabels  bool // OCI annotations from git, disabled by --no-vcs-labels
+
+	editDockerfile func(*dockerfile.Builder) error // set by the library, see Options
+	apiSpec        *Spec                           // set by the library, replaces what the directives declare
+	template       *template.Template              // of --template, nil for the generated Dockerfile
+	includes       [][2]string                     // point and file of --include
+
+	reproducible bool   // --reproducible or verify
+	baseDigest   string // pins the base image of verify to the one of the image
+}
+
+func newBuilder(c *cli.Context) (*builder, error) {
+	tc, err := newToolchain(c)
+	if err != nil {
+		return nil, err
+	}
+	tc.goEnv = append(tc.goEnv, proxyEnv(c)...)
+	if c.Command.Name == "dockerfile" && c.String("file") == "-" {
+		// messages like the selected base image must not end up in the Dockerfile
+		tc.out = tc.stderr()
+	}
+	tc, cancel := tc.withTimeout("timeout", c.Duration("timeout"))
+	b := &builder{
+		tc: tc,
+		cancel: func() {
+			cancel()
+			tc.close()
+		},
+		base:      c.String("base"),
+		env:       c.StringSlice("env"),
+		cover:     c.Bool("cover"),
+		user:      c.String("user"),
+		legacyAdd: c.Bool("legacy-add"),
+		layering:  c.String("layering"),
+		imageOpts: dockerBuildOptions{
+			forceRm:   c.Bool("force-rm"),
+			buildArgs: proxyEnv(c),
+		},
+		goBuildTimeout:     c.Duration("go-build-timeout"),
+		dockerBuildTimeout: c.Duration("docker-build-timeout"),
+		pushTimeout:        c.Duration("push-timeout"),
+		dryRun:             c.Bool("dry-run"),
+		push:               c.Bool("push"),
+		parallelPush:       c.Bool("parallel-push"),
+		metadata:           c.String("metadata-file") != "",
+		inDocker:           c.Bool("build-in-docker") || c.IsSet("go-versions") || c.Command.Name == "bake" || c.Command.Name == "dockerfile" || c.Command.Name == "check",
+		streamContext:      c.Bool("stream-context"),
+		builderImage:       c.String("builder-image"),
+		vcsLabels:          !c.Bool("no-vcs-labels"),
+		reproducible:       c.Bool("reproducible") || c.Command.Name == "verify",
+	}
+	if err := b.init(c); err != nil {
+		b.cancel()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *builder) init(c *cli.Context) error {
+	for _, v := range c.StringSlice("go-versions") {
+		for _, v := range strings.Split(v, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				b.goVersions = append(b.goVersions, v)
+			}
+		}
+	}
+	if len(b.goVersions) != 0 && (b.builderImage != "" || c.IsSet("go-version")) {
+		return errors.New("--go-versions can't be combined with --builder-image or --go-version")
+	}
+
+	if b.streamContext && !b.tc.engine.streamStdin {
+		return fmt.Errorf("--stream-context is not supported by %s", b.tc.engine.name)
+	}
+	if b.tc.engine.name == "buildkit" && !b.inDocker {
+		// fail before compiling rather than when the image is built
+		if _, err := exec.LookPath(b.tc.dockerBin); err != nil {
+			return fmt.Errorf("--engine buildkit builds with buildctl, the client of buildkitd, but %s was not found: install it from https://github.com/moby/buildkit/releases or give its path with --docker-bin", b.tc.dockerBin)
+		}
+	}
+	if b.tc.engine.noStore {
+		if c.Bool("pin-base") {
+			return fmt.Errorf("--pin-base is not supported by %s", b.tc.engine.name)
+		}
+		b.imageOpts.push = b.push
+	}
+	if p := c.String("provenance"); p != "" {
+		if !b.tc.engine.attestations {
+			return fmt.Errorf("--provenance is not supported by %s", b.tc.engine.name)
+		}
+		if p != "min" && p != "max" {
+			return fmt.Errorf("invalid --provenance %q, must be min or max", p)
+		}
+		b.imageOpts.provenance = p
+	}
+	if err := b.initCache(c); err != nil {
+		return err
+	}
+	if b.inDocker && (b.tc.engine.classic || b.tc.engine.daemonless) {
+		return fmt.Errorf("--build-in-docker needs BuildKit, which is not supported by %s", b.tc.engine.name)
+	}
+
+	if b.inDocker {
+		// the toolchain on the host is not used for compiling
+		for _, flag := range []string{"compress", "fips", "prebuilt", "test-binaries", "stream-context", "sbom"} {
+			if c.IsSet(flag) {
+				return fmt.Errorf("--%s is not supported with --build-in-docker", flag)
+			}
+		}
+	} else if version := c.String("go-version"); version != "" {
+		if err := b.tc.requireGoVersion(version); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range c.StringSlice("tag") {
+		t, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return fmt.Errorf("invalid --tag: %v", err)
+		}
+		b.tags = append(b.tags, t)
+	}
+
+	var err error
+	if b.prebuilt, err = parsePrebuilt(c.StringSlice("prebuilt")); err != nil {
+		return err
+	}
+	if b.includes, err = parseIncludes(c.StringSlice("include")); err != nil {
+		return err
+	}
+	if name := c.String("template"); name != "" {
+		if b.tc.engine.daemonless {
+			return errors.New("--template can't be combined with --daemonless, which assembles images without a Dockerfile")
+		}
+		if b.template, err = parseTemplate(name); err != nil {
+			return err
+		}
+	}
+	if b.output, err = parseOutput(c.String("output")); err != nil {
+		return err
+	}
+	if b.sbom, err = parseSBOMOptions(c.String("sbom"), c.String("sbom-dir"), c.Bool("attach-sbom")); err != nil {
+		return err
+	}
+	if b.sbom != nil && b.sbom.attach && !b.push {
+		return errors.New("--attach-sbom requires --push")
+	}
+	if b.sign, err = parseSignOptions(c.Bool("sign"), c.String("sign-key"), c.Bool("no-sign-upload"), b.push); err != nil {
+		return err
+	}
+	b.licenses = parseLicenseOptions(c.Bool("licenses"), c.String("license-report"), c.StringSlice("deny-license"))
+	if c.Bool("scan") {
+		if b.scan, err = parseScanOptions(c.String("scanner"), c.String("severity-threshold"), c.String("scan-dir")); err != nil {
+			return err
+		}
+		if localScanSource(b.tc.engine) == "" && !b.push {
+			return fmt.Errorf("--scan with %s requires --push, the image is scanned in the registry", b.tc.engine.name)
+		}
+	}
+	if b.output != nil && b.output.kind == "binaries" {
+		for _, flag := range []string{"push", "build-in-docker"} {
+			if c.Bool(flag) {
+				return fmt.Errorf("--%s is not supported with --output %s", flag, c.String("output"))
+			}
+		}
+		if b.sbom != nil {
+			return fmt.Errorf("--sbom is not supported with --output %s", c.String("output"))
+		}
+	}
+	if b.output != nil && b.output.kind != "binaries" && b.tc.engine.noStore && !b.tc.engine.daemonless && b.push {
+		return fmt.Errorf("--push can't be combined with --output %s with %s", c.String("output"), b.tc.engine.name)
+	}
+	if b.tc.engine.daemonless && !b.push && b.output == nil && !b.dryRun && c.Command.Name != "verify" {
+		return errors.New("--daemonless requires --push or --output, as there is no local image store")
+	}
+	if b.compress, err = parseCompress(c.String("compress")); err != nil {
+		return err
+	}
+	if s := c.String("max-binary-size"); s != "" {
+		if b.maxBinarySize, err = parseSize(s); err != nil {
+			return err
+		}
+	}
+	if s := c.String("max-image-size"); s != "" {
+		if b.maxImageSize, err = parseSize(s); err != nil {
+			return err
+		}
+		if b.tc.engine.noHistory {
+			return fmt.Errorf("--max-image-size is not supported by %s", b.tc.engine.name)
+		}
+	}
+
+	switch b.layering {
+	case layeringSingle, layeringPerBinary, layeringGrouped:
+	default:
+		return fmt.Errorf("invalid --layering %q, must be single, per-binary or grouped", b.layering)
+	}
+
+	switch mod := c.String("mod"); mod {
+	case "", "readonly", "vendor", "mod":
+	default:
+		return fmt.Errorf("invalid --mod %q, must be readonly, vendor or mod", mod)
+	}
+
+	archEnv := archLevelEnv(c)
+	for _, v := range archEnv {
+		b.labels = append(b.labels, labelPrefix+strings.ToLower(v))
+	}
+
+	var fipsEnv, fipsLdflags []string
+	if c.Bool("fips") {
+		if b.fipsMode, fipsEnv, fipsLdflags, err = b.tc.fipsMode(); err != nil {
+			return err
+		}
+		b.labels = append(b.labels, labelPrefix+"fips="+b.fipsMode)
+	}
+
+	cacheDir, err := resolveCacheDir(c.String("cache-dir"))
+	if err != nil {
+		return err
+	}
+	if c.IsSet("cache-dir") {
+		b.tc.goEnv = append(b.tc.goEnv, "GOCACHE="+filepath.Join(cacheDir, "go-build"))
+	}
+	if !c.Bool("force-rebuild") && !b.dryRun && !b.inDocker {
+		if b.cache, err = openBuildCache(cacheDir); err != nil {
+			return err
+		}
+	}
+
+	b.goOpts = &goBuildOptions{
+		goos:     c.String("goos"),
+		goarch:   c.String("goarch"),
+		mod:      c.String("mod"),
+		pgo:      c.String("pgo"),
+		cover:    b.cover,
+		env:      append(archEnv, fipsEnv...),
+		force:    c.Bool("force-rebuild"),
+		strip:    c.Bool("strip"),
+		tests:    c.Bool("test-binaries"),
+		trimpath: b.reproducible,
+		ldflags:  fipsLdflags,
+		parallel: c.Int("parallel"),
+		cache:    b.cache,
+
+		stripReport: c.Bool("strip-report"),
+	}
+
+	b.noDefaultPackages = c.Bool("no-default-packages")
+	if c.IsSet("default-packages") {
+		b.defaultPackages = []string{}
+		for _, v := range c.StringSlice("default-packages") {
+			b.defaultPackages = append(b.defaultPackages, strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })...)
+		}
+	}
+	b.detectPackages = c.Bool("detect-packages")
+	b.inferPorts = c.Bool("infer-ports")
+	b.detectWrites = c.Bool("detect-writes")
+	b.detectBinaries = c.Bool("detect-binaries")
+	b.inferHealthcheck = c.Bool("infer-healthcheck")
+	b.envInventory = c.Bool("env-inventory")
+	b.envReport = c.String("env-report")
+	b.checkEnv = c.Bool("check-env")
+	if b.detectPackages && b.inDocker {
+		return errors.New("--detect-packages is not supported with --build-in-docker")
+	}
+
+	b.allowedBase = c.StringSlice("allowed-base")
+	b.deniedBase = c.StringSlice("denied-base")
+	b.pinBase = c.Bool("pin-base")
+	// the base is checked against the policy and pinned by spec, as the
+	// configuration file may give each package another one
+	if b.base == autoBaseImage && b.goOpts.goos != "linux" {
+		return fmt.Errorf("--base %s requires --goos linux", autoBaseImage)
+	}
+
+	if c.IsSet("goos") || c.IsSet("goarch") {
+		b.imageOpts.platform = dockerPlatform(c.String("goos"), c.String("goarch"), c.String("goarm"))
+	}
+
+	return nil
+}
+
+// runGates runs the analysis and tests requested by flags, which have to
+// pass before anything is built.
+func (b *builder) runGates(c *cli.Context, packages []*goPackage) error {
+	if c.Bool("vet") {
+		if err := b.tc.goVet(b.goOpts, packages); err != nil {
+			return b.tc.checkTimeout(stageCheck, err)
+		}
+	}
+	for _, check := range c.StringSlice("check") {
+		if err := b.tc.runCheck(b.goOpts, packages, check); err != nil {
+			return b.tc.checkTimeout(stageCheck, err)
+		}
+	}
+	if c.Bool("test") || c.Bool("test-module") {
+		if err := b.tc.goTest(b.goOpts, packages, c.Bool("test-module"), c.String("test-args")); err != nil {
+			return b.tc.checkTimeout(stageTest, err)
+		}
+	}
+	return nil
+}
+
+// spec returns the specification of the image containing packages.
+func (b *builder) spec(packages []*goPackage) (*imageSpec, error) {
+	spec := newImageSpec(packages)
+	spec.env = append(spec.env, b.env...)
+	spec.labels = append(spec.labels, b.labels...)
+	spec.labels = append(spec.labels, imageLabel+"="+packages[0].ImportPath)
+	spec.env = append(spec.env, projectCfg.packageList(packages[0].ImportPath, "env")...)
+	spec.install = append(spec.install, projectCfg.packageList(packages[0].ImportPath, "install")...)
+	if b.cover {
+		spec.env = append(spec.env, "GOCOVERDIR="+coverDir)
+		spec.volumes = append(spec.volumes, coverDir)
+		spec.labels = append(spec.labels, labelPrefix+"cover=true")
+	}
+	spec.legacyAdd = b.legacyAdd
+	spec.noChmod = b.tc.engine.classic
+	spec.layering = b.layering
+	// the directives add to what the flags and the configuration file set
+	env, install, volumes := len(spec.env), len(spec.install), len(spec.volumes)
+	if err := spec.scanDirectives(b.tc); err != nil {
+		return nil, err
+	}
+	if b.apiSpec != nil {
+		if err := b.apiSpec.apply(spec, env, install, volumes); err != nil {
+			return nil, err
+		}
+	}
+	if b.inferPorts {
+		if err := b.addInferredPorts(spec); err != nil {
+			return nil, err
+		}
+	}
+	if b.envInventory || b.envReport != "" || b.checkEnv {
+		if err := b.addEnvInventory(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, inc := range b.includes {
+		if err := spec.addInclude(inc[0], inc[1]); err != nil {
+			return nil, fmt.Errorf("--include %s: %v", inc[0], err)
+		}
+	}
+	if b.vcsLabels {
+		spec.labels = addMissingLabels(spec.labels, b.tc.vcsLabels(packages))
+	}
+	if b.licenses != nil {
+		if summary := licenseSummary(b.modules, packages); summary != "" {
+			spec.labels = append(spec.labels, labelPrefix+"licenses="+summary)
+		}
+	}
+	if b.user != "" {
+		spec.user = b.user
+	}
+	if user := projectCfg.packageSetting(packages[0].ImportPath, "user"); user != "" {
+		spec.user = user
+	}
+	// every base goes through resolveBase for the policy and --pin-base
+	spec.base = b.base
+	base := projectCfg.packageSetting(packages[0].ImportPath, "base")
+	var err error
+	switch {
+	case base == autoBaseImage && b.goOpts.goos != "linux":
+		return nil, fmt.Errorf("base %s of %s in %s requires --goos linux", autoBaseImage, packages[0].ImportPath, projectCfg.file)
+	case base == autoBaseImage:
+		spec.base = base
+	case base != "":
+		if spec.base, err = b.resolveBase(base); err != nil {
+			return nil, fmt.Errorf("base of %s in %s: %v", packages[0].ImportPath, projectCfg.file, err)
+		}
+	case spec.base != autoBaseImage:
+		if spec.base, err = b.resolveBase(spec.base); err != nil {
+			return nil, err
+		}
+	}
+	if spec.base == autoBaseImage {
+		if spec.base, err = b.resolveBase(autoBase(spec, b.goOpts)); err != nil {
+			return nil, err
+		}
+		b.tc.printf("godockerize: Selected base image %s\n", spec.base)
+	}
+	spec.family = baseFamilyOf(spec.base)
+	if spec.family.windows != (b.goOpts.goos == "windows") {
+		return nil, fmt.Errorf("--goos %s does not match the %s base image %s", b.goOpts.goos, spec.family.name, spec.base)
+	}
+	if b.inferHealthcheck {
+		if err := b.addInferredHealthcheck(spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := spec.checkBase(); err != nil {
+		return nil, err
+	}
+	if b.detectWrites {
+		if err := b.suggestWritableDirs(spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.selectDefaultPackages(spec); err != nil {
+		return nil, err
+	}
+	if b.detectBinaries {
+		if err := b.suggestPrograms(spec); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// selectDefaultPackages applies --no-default-packages, --default-packages
+// and --detect-packages to spec.
+func (b *builder) selectDefaultPackages(spec *imageSpec) error {
+	switch {
+	case b.noDefaultPackages:
+		spec.defaults = []string{}
+		return nil
+	case b.defaultPackages != nil:
+		spec.defaults = b.defaultPackages
+		return nil
+	case !b.detectPackages:
+		return nil
+	}
+
+	deps, err := b.tc.deps(b.goOpts, spec.packages)
+	if err != nil {
+		return err
+	}
+	f := spec.family
+	spec.defaults = []string{}
+	for _, pkg := range f.defaultPackages() {
+		switch {
+		case pkg == f.certsPackage && !deps["crypto/x509"]:
+			b.tc.printf("godockerize: Not installing %s, crypto/x509 is not used\n", pkg)
+		case pkg == f.mimePackage && !deps["mime"]:
+			b.tc.printf("godockerize: Not installing %s, mime is not used\n", pkg)
+		default:
+			spec.defaults = append(spec.defaults, pkg)
+		}
+	}
+	return nil
+}
+
+// resolveBase checks image against the base image policy and pins it with
+// --pin-base.
+func (b *builder) resolveBase(image string) (string, error) {
+	if err := checkBasePolicy(image, b.allowedBase, b.deniedBase); err != nil {
+		return "", err
+	}
+	if !b.pinBase || image == "scratch" {
+		return image, nil
+	}
+	if pinned, ok := b.pinned[image]; ok {
+		return pinned, nil
+	}
+	pinned, err := pinImage(b.tc, image)
+	if err != nil {
+		return "", err
+	}
+	if b.pinned == nil {
+		b.pinned = make(map[string]string)
+	}
+	b.pinned[image] = pinned
+	return pinned, nil
+}
+
+// imageTags executes the --tag templates for spec.
+func (b *builder) imageTags(spec *imageSpec) ([]string, error) {
+	var tags []string
+	for _, t := range b.tags {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, struct{ Name, ImportPath, GoVersion string }{
+			Name:       spec.name(),
+			ImportPath: spec.packages[0].ImportPath,
+			GoVersion:  b.matrixVersion,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid --tag: %v", err)
+		}
+		tag := buf.String()
+		if b.matrixVersion != "" && !strings.Contains(t.Root.String(), ".GoVersion") {
+			// images of different versions must not overwrite each other
+			tag = versionSuffixedTag(tag, "go"+b.matrixVersion)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// versionSuffixedTag appends suffix to the tag of ref, e.g. "repo:latest"
+// becomes "repo:latest-go1.22" and "repo" becomes "repo:go1.22".
+func versionSuffixedTag(ref, suffix string) string {
+	if repo := repository(ref); repo != ref {
+		return ref + "-" + suffix
+	}
+	return ref + ":" + suffix
+}
+
+// build builds and optionally pushes the image containing packages. It
+// returns nil for a dry run or if only binaries are written.
+func (b *builder) build(packages []*goPackage) (*buildMetadata, error) {
+	spec, err := b.spec(packages)
+	if err != nil {
+		return nil, err
+	}
+	if b.output != nil && b.output.kind == "binaries" {
+		if b.dryRun {
+			return nil, nil
+		}
+		return nil, b.writeBinaries(packages, spec, b.output.dest)
+	}
+	if b.tc.engine.daemonless {
+		if err := spec.checkDaemonless(); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.placeAssets(spec); err != nil {
+		return nil, err
+	}
+
+	var df *dockerfile.Builder
+	if b.inDocker {
+		if df, err = goBuildStage(b.builderImage, b.module, packages, b.goOpts, b.tc.moduleEnv(), findBuildStageSecrets().mounts()); err != nil {
+			return nil, err
+		}
+		image, err := b.imageDockerfile(spec, buildStage)
+		if err != nil {
+			return nil, err
+		}
+		df.Append(image)
+	} else if df, err = b.imageDockerfile(spec, ""); err != nil {
+		return nil, err
+	}
+	dockerfile, err := b.renderDockerfile(df, "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	b.tc.printf("godockerize: Generated Dockerfile:\n")
+	fmt.Fprint(b.tc.stdout(), string(dockerfile))
+
+	if b.dryRun {
+		return nil, nil
+	}
+
+	tmpdir, err := ioutil.TempDir("", "godockerize")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "Dockerfile"), dockerfile, 0777); err != nil {
+		return nil, err
+	}
+	if b.goOpts.tests {
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, testRunner), testRunnerScript, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	imageOpts := b.imageOpts
+	tags, err := b.imageTags(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) != 0 {
+		imageOpts.tag, imageOpts.extraTags = tags[0], tags[1:]
+	}
+	if b.push {
+		for _, tag := range tags {
+			if err := b.tc.creds.pushTo(tag); err != nil {
+				return nil, err
+			}
+		}
+	}
+	event := newHookEvent(packages, spec, b.tc.engine.name, tags, dockerfile)
+	if err := b.runHooks(hookPreBuild, event); err != nil {
+		return nil, err
+	}
+	if b.push && b.imageOpts.push {
+		// the image is pushed by the build
+		if err := b.runHooks(hookPrePush, event); err != nil {
+			return nil, err
+		}
+	}
+	if b.output != nil {
+		if b.output.kind == "docker-archive" && b.exported {
+			return nil, fmt.Errorf("--output %s:%s can only hold one image, use oci:DIR for several", b.output.kind, b.output.dest)
+		}
+		b.exported = true
+		if b.tc.engine.noStore && !b.tc.engine.daemonless {
+			imageOpts.archive = b.archivePath(tmpdir)
+		}
+	}
+	var imageID string
+	if b.inDocker {
+		imageID, err = b.buildInDocker(tmpdir, &imageOpts)
+	} else {
+		manifest := newContextManifest(tmpdir)
+		for _, pkg := range packages {
+			manifest.addFile(pkg.binaryName())
+		}
+		if b.goOpts.tests {
+			manifest.addFile(testRunner)
+		}
+		if spec.usesHealthcheckHelper() {
+			manifest.addFile(healthcheckHelper)
+		}
+		for _, a := range spec.copies {
+			manifest.addAsset(a.context, a.src)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, ".dockerignore"), manifest.dockerignore(), 0666); err != nil {
+			return nil, err
+		}
+		switch {
+		case b.tc.engine.daemonless:
+			imageID, err = b.buildDaemonless(packages, spec, manifest, tags)
+		case b.streamContext || b.tc.api != nil:
+			imageOpts.stream = manifest
+			imageID, err = b.buildOnHost(packages, spec, dockerfile, manifest, &imageOpts)
+		default:
+			if err := manifest.materialize(); err != nil {
+				return nil, err
+			}
+			imageID, err = b.buildOnHost(packages, spec, dockerfile, manifest, &imageOpts)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.output != nil && !b.tc.engine.daemonless {
+		if err := b.exportImage(imageID, imageOpts.tag, tmpdir); err != nil {
+			return nil, stageErrorf(stageDockerBuild, "writing %s: %v", b.output.dest, err)
+		}
+	}
+
+	if err := reportImageSize(b.tc, imageID, b.maxImageSize); err != nil {
+		return nil, err
+	}
+
+	// the image is scanned before it is pushed unless it can only be
+	// scanned in the registry
+	if b.scan != nil && localScanSource(b.tc.engine) != "" {
+		if err := b.scanImage(spec, imageID, ""); err != nil {
+			return nil, err
+		}
+	}
+	event.ImageID = imageID
+	if err := b.runHooks(hookPostBuild, event); err != nil {
+		return nil, err
+	}
+	if b.push && !b.imageOpts.push {
+		if err := b.runHooks(hookPrePush, event); err != nil {
+			return nil, err
+		}
+		if err := b.pushAll(tags, pushImage); err != nil {
+			return nil, err
+		}
+	}
+	if b.push && len(tags) > 1 {
+		if err := verifyDigests(b.tc, imageID, tags); err != nil {
+			return nil, err
+		}
+	}
+	if b.push && projectCfg.hasHooks(hookPostPush) {
+		if event.Digest, err = repoDigest(b.tc, imageID, tags[0]); err != nil {
+			return nil, err
+		}
+		if err := b.runHooks(hookPostPush, event); err != nil {
+			return nil, err
+		}
+	}
+	if b.scan != nil && localScanSource(b.tc.engine) == "" {
+		ref := tags[0]
+		digest, err := repoDigest(b.tc, imageID, ref)
+		if err != nil {
+			return nil, err
+		}
+		if digest != "" {
+			ref = repository(ref) + "@" + digest
+		}
+		if err := b.scanImage(spec, imageID, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	sbomFile := ""
+	if b.sbom != nil {
+		if sbomFile, err = b.writeSBOM(spec, imageID, tags); err != nil {
+			return nil, err
+		}
+	}
+	if b.sign != nil {
+		if err := b.signImage(imageID, tags); err != nil {
+			return nil, err
+		}
+	}
+
+	if !b.metadata {
+		return &buildMetadata{ImageID: imageID}, nil
+	}
+	var md *buildMetadata
+	if b.inDocker {
+		md, err = collectMetadata(b.tc, imageID, tags, spec.base, "", b.builderImage, packages)
+	} else {
+		md, err = collectMetadata(b.tc, imageID, tags, spec.base, tmpdir, "", packages)
+	}
+	if err != nil {
+		return nil, err
+	}
+	md.SBOM = sbomFile
+	return md, nil
+}
+
+// pushAll pushes the image to each of tags with push, all at the same time
+// with --parallel-push.
+func (b *builder) pushAll(tags []string, push func(tc *toolchain, tag string) error) error {
+	ptc, cancel := b.tc.withTimeout("push-timeout", b.pushTimeout)
+	defer cancel()
+	errs := make([]error, len(tags))
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		if !b.parallelPush {
+			if errs[i] = push(ptc, tag); errs[i] != nil {
+				break
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			errs[i] = push(ptc, tag)
+		}(i, tag)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return ptc.checkTimeout(stagePush, err)
+		}
+	}
+	return nil
+}
+
+// verifyDigests makes sure that the image got the same digest in all
+// registries it was pushed to. Engines that don't know the digest of a
+// push are not checked.
+func verifyDigests(tc *toolchain, imageID string, tags []string) error {
+	first := ""
+	for _, tag := range tags {
+		digest, err := repoDigest(tc, imageID, tag)
+		if err != nil {
+			return stageErrorf(stagePush, "resolving digest of %s: %v", tag, err)
+		}
+		if digest == "" {
+			continue
+		}
+		if first == "" {
+			first = repository(tag) + "@" + digest
+			continue
+		}
+		if !strings.HasSuffix(first, "@"+digest) {
+			return stageErrorf(stagePush, "digests of pushed images differ: %s and %s@%s", first, repository(tag), digest)
+		}
+	}
+	return nil
+}
+
+// buildOnHost compiles packages into the directory of manifest and builds
+// the image with dockerfile from the context of manifest.
+func (b *builder) buildOnHost(packages []*goPackage, spec *imageSpec, dockerfile []byte, manifest *contextManifest, imageOpts *dockerBuildOptions) (string, error) {
+	bins, err := b.compile(packages, spec, manifest.dir)
+	if err != nil {
+		return "", err
+	}
+	key, err := imageKey(dockerfile, bins, manifest)
+	if err != nil {
+		return "", err
+	}
+
+	dtc, cancel := b.tc.withTimeout("docker-build-timeout", b.dockerBuildTimeout)
+	imageID, err := buildImageCached(dtc, manifest.dir, imageOpts, b.cache, key)
+	cancel()
+	if err != nil {
+		return "", dtc.checkTimeout(stageDockerBuild, err)
+	}
+	return imageID, nil
+}
+
+// placeAssets decides where the //docker:copy assets of spec are in the build
+// context. With --build-in-docker the context is the module, so they have to
+// be inside of it.
+func (b *builder) placeAssets(spec *imageSpec) error {
+	for i := range spec.copies {
+		a := &spec.copies[i]
+		if !b.inDocker {
+			a.context = fmt.Sprintf("assets/%d/%s", i, filepath.Base(a.src))
+			continue
+		}
+		rel, err := filepath.Rel(b.module.Dir, a.src)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return stageErrorf(stageDirective, "//docker:copy %s: must be inside module %s with --build-in-docker", a.src, b.module.Dir)
+		}
+		a.context = filepath.ToSlash(rel)
+	}
+	return nil
+}
+
+// compile puts the final binaries of packages into dir, either by building
+// them or from --prebuilt.
+func (b *builder) compile(packages []*goPackage, spec *imageSpec, dir string) ([]builtBinary, error) {
+	bins := make([]builtBinary, len(packages))
+	var toBuild []*goPackage
+	var toBuildIndex []int
+	for i, pkg := range packages {
+		name := pkg.binaryName()
+		file, ok := b.prebuilt[name]
+		if !ok {
+			toBuild = append(toBuild, pkg)
+			toBuildIndex = append(toBuildIndex, i)
+			continue
+		}
+		var err error
+		if bins[i], err = copyPrebuilt(b.tc, name, file, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(toBuild) != 0 {
+		gtc, cancel := b.tc.withTimeout("go-build-timeout", b.goBuildTimeout)
+		built, err := gtc.buildBinaries(toBuild, dir, b.goOpts)
+		cancel()
+		if err != nil {
+			return nil, gtc.checkTimeout(stageGoBuild, &stageError{stage: stageGoBuild, err: err})
+		}
+		for i, bin := range built {
+			bins[toBuildIndex[i]] = bin
+		}
+	}
+
+	if b.sbom != nil {
+		// compressed binaries have no readable build information
+		b.binaryInfo = nil
+		for _, pkg := range packages {
+			info, err := b.tc.readBuildInfo(dir, pkg.binaryName())
+			if err != nil {
+				return nil, err
+			}
+			b.binaryInfo = append(b.binaryInfo, info)
+		}
+	}
+	if b.fipsMode != "" {
+		if err := b.tc.verifyFIPS(packages, dir, b.fipsMode); err != nil {
+			return nil, err
+		}
+	}
+	if spec.usesHealthcheckHelper() {
+		gtc, cancel := b.tc.withTimeout("go-build-timeout", b.goBuildTimeout)
+		err := gtc.buildHealthcheckHelper(dir, b.goOpts)
+		cancel()
+		if err != nil {
+			return nil, gtc.checkTimeout(stageGoBuild, err)
+		}
+	}
+	if spec.family.static && b.goOpts.goos == "linux" {
+		if err := checkStatic(packages, dir, spec.family); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.compress != nil {
+		if err := b.tc.compressBinaries(packages, dir, b.compress, spec.noCompress); err != nil {
+			return nil, err
+		}
+		for i, pkg := range packages {
+			if !spec.noCompress[pkg.ImportPath] {
+				bins[i].key += "+" + b.compress.String()
+			}
+		}
+	}
+	if err := reportBinarySizes(b.tc, packages, bins, dir, b.maxBinarySize); err != nil {
+		return nil, err
+	}
+	return bins, nil
+}
+
+// writeBinaries compiles packages and copies the binaries to dir instead of
+// building an image.
+func (b *builder) writeBinaries(packages []*goPackage, spec *imageSpec, dir string) error {
+	tmpdir, err := ioutil.TempDir("", "godockerize")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if _, err := b.compile(packages, spec, tmpdir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		// a link could point into the cache
+		if err := copyFileContents(filepath.Join(tmpdir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		b.tc.printf("godockerize: Wrote %s\n", filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// buildInDocker builds the image with the Dockerfile in dir, which compiles
+// the binaries in its build stage. The module is the build context.
+func (b *builder) buildInDocker(dir string, imageOpts *dockerBuildOptions) (string, error) {
+	imageOpts.contextDir = b.module.Dir
+	imageOpts.buildArgs = append(imageOpts.buildArgs, b.tc.moduleEnv()...)
+	secrets := findBuildStageSecrets()
+	if secrets.netrc != "" {
+		imageOpts.secrets = append(imageOpts.secrets, "id=netrc,src="+secrets.netrc)
+	}
+	imageOpts.ssh = secrets.ssh
+
+	// the go build timeout does not apply, compiling is part of the Docker build
+	dtc, cancel := b.tc.withTimeout("docker-build-timeout", b.dockerBuildTimeout)
+	imageID, err := buildImage(dtc, dir, imageOpts)
+	cancel()
+	if err != nil {
+		return "", dtc.checkTimeout(stageDockerBuild, err)
+	}
+	return imageID, nil
+}
+
+func writeJSONFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(data, '\n'), 0666)
+}
+
+// initCache sets up --cache-from and --cache-to. Without BuildKit or with
+// only repositories as caches, just the registry type can be used, and the
+// Docker Engine API can't export a cache at all.
+func (b *builder) initCache(c *cli.Context) error {
+	e := b.tc.engine
+	for _, v := range []struct {
+		flag string
+		dst  *[]string
+	}{
+		{"cache-from", &b.imageOpts.cacheFrom},
+		{"cache-to", &b.imageOpts.cacheTo},
+	} {
+		for _, value := range c.StringSlice(v.flag) {
+			if e.daemonless || (e.api && v.flag == "cache-to") {
+				return fmt.Errorf("--%s is not supported by %s", v.flag, e.name)
+			}
+			opt, err := cacheOption(v.flag, value)
+			if err != nil {
+				return err
+			}
+			if (e.refCache || e.api) && cacheRef(opt) == "" {
+				return fmt.Errorf("--%s %s is not supported by %s, which only takes a repository", v.flag, value, e.name)
+			}
+			*v.dst = append(*v.dst, opt)
+		}
+	}
+	return nil
+}
+
+// archivePath returns where the image is saved in the format of "docker
+// save" for --output.
+func (b *builder) archivePath(tmpdir string) string {
+	if b.output.kind == "docker-archive" {
+		return b.output.dest
+	}
+	return filepath.Join(tmpdir, "image.tar")
+}
+
+// exportImage writes the image to --output, saving it from the image store
+// of the engine if it has one.
+func (b *builder) exportImage(id, tag, tmpdir string) error {
+	archive := b.archivePath(tmpdir)
+	if !b.tc.engine.noStore {
+		name := tag
+		if name == "" {
+			name = id
+		}
+		if err := saveImage(b.tc, name, archive); err != nil {
+			return err
+		}
+	}
+	if b.output.kind == "oci" {
+		unpacked := filepath.Join(tmpdir, "image")
+		if err := importDockerArchive(archive, b.output.dest, unpacked); err != nil {
+			return err
+		}
+		b.tc.printf("godockerize: Wrote image to OCI layout %s\n", b.output.dest)
+		return nil
+	}
+	b.tc.printf("godockerize: Wrote image to docker archive %s\n", b.output.dest)
+	return nil
+}
@@ -0,0 +1,114 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildctlBuild builds the image with buildctl, which talks to buildkitd
+// directly. There is no image store, so the image is pushed by the build
+// itself if opts.push is set. The repo digest of a pushed image is recorded
+// in tc.pushed and the ID of the image is its config digest.
+//
+// buildctl is run like the other engines' commands instead of using
+// github.com/moby/buildkit/client: that would add gRPC, containerd and a Go
+// version far newer than that of go.mod to every build of godockerize, and
+// buildctl already serves the local context, secrets and the SSH agent to
+// buildkitd. newBuilder reports a missing buildctl before compiling.
+func buildctlBuild(tc *toolchain, dir string, opts *dockerBuildOptions) (string, error) {
+	context := dir
+	if opts.contextDir != "" {
+		context = opts.contextDir
+	}
+	metadataFile := filepath.Join(dir, "buildctl-metadata.json")
+	args := []string{"build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context=" + context,
+		"--local", "dockerfile=" + dir,
+		"--metadata-file", metadataFile,
+	}
+	if opts.platform != "" {
+		args = append(args, "--opt", "platform="+opts.platform)
+	}
+	for _, arg := range opts.buildArgs {
+		if !strings.Contains(arg, "=") {
+			arg += "=" + os.Getenv(arg)
+		}
+		args = append(args, "--opt", "build-arg:"+arg)
+	}
+	if opts.provenance != "" {
+		args = append(args, "--opt", "attest:provenance=mode="+opts.provenance)
+	}
+	for _, secret := range opts.secrets {
+		args = append(args, "--secret", secret)
+	}
+	if opts.ssh {
+		args = append(args, "--ssh", "default")
+	}
+	for _, opt := range opts.cacheFrom {
+		args = append(args, "--import-cache", opt)
+	}
+	for _, opt := range opts.cacheTo {
+		args = append(args, "--export-cache", opt)
+	}
+	output := "type=image"
+	if opts.archive != "" {
+		output = "type=docker,dest=" + opts.archive
+	}
+	if tags := opts.tags(); len(tags) != 0 {
+		name := "name=" + strings.Join(tags, ",")
+		if len(tags) > 1 {
+			name = `"` + name + `"` // the option is CSV
+		}
+		output += "," + name
+		if opts.push {
+			output += ",push=true"
+			for _, tag := range tags {
+				if tc.insecure(tag) {
+					output += ",registry.insecure=true"
+					break
+				}
+			}
+		}
+	}
+	args = append(args, "--output", output)
+
+	cmd := tc.dockerCmd(args...)
+	if opts.push {
+		var err error
+		if cmd, err = tc.pushCmd(opts.tag, args...); err != nil {
+			return "", stageErrorf(stagePush, "%v", err)
+		}
+	}
+	cmd.Dir = dir
+	cmd.Stdout = tc.stdout()
+	cmd.Stderr = tc.stderr()
+	if err := cmd.Run(); err != nil {
+		return "", stageErrorf(stageDockerBuild, "buildctl build: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return "", err
+	}
+	var md struct {
+		ConfigDigest string `json:"containerimage.config.digest"`
+		Digest       string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		return "", fmt.Errorf("%s: %v", metadataFile, err)
+	}
+	if md.ConfigDigest == "" {
+		return "", fmt.Errorf("%s: missing image digest", metadataFile)
+	}
+	if opts.push && md.Digest != "" {
+		for _, tag := range opts.tags() {
+			tc.pushed[md.ConfigDigest] = append(tc.pushed[md.ConfigDigest], repository(tag)+"@"+md.Digest)
+		}
+	}
+	return md.ConfigDigest, nil
+}
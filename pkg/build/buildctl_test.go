@@ -0,0 +1,81 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeBuildctl is a buildctl that writes its arguments to the file args next
+// to it and the metadata of an image to the file of --metadata-file.
+const fakeBuildctl = `#!/bin/sh
+printf '%s\n' "$@" > "$(dirname "$0")/args"
+while [ $# -gt 0 ]; do
+	if [ "$1" = --metadata-file ]; then
+		echo '{"containerimage.config.digest": "sha256:c0ffee", "containerimage.digest": "sha256:d16e57"}' > "$2"
+	fi
+	shift
+done
+`
+
+func TestBuildctlBuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake buildctl is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "buildctl")
+	if err := ioutil.WriteFile(bin, []byte(fakeBuildctl), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tc := &toolchain{ctx: context.Background(), engine: engines["buildkit"], dockerBin: bin, pushed: make(map[string][]string)}
+	opts := &dockerBuildOptions{
+		tag:       "registry.example.com/app:1",
+		extraTags: []string{"registry.example.com/app:latest"},
+		platform:  "linux/arm64",
+		buildArgs: []string{"GOPROXY=https://proxy.example.com"},
+		secrets:   []string{"id=netrc,src=/home/me/.netrc"},
+		ssh:       true,
+	}
+	id, err := buildctlBuild(tc, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "sha256:c0ffee" {
+		t.Errorf("got image ID %q, want the config digest sha256:c0ffee", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context=" + dir,
+		"--local", "dockerfile=" + dir,
+		"--metadata-file", filepath.Join(dir, "buildctl-metadata.json"),
+		"--opt", "platform=linux/arm64",
+		"--opt", "build-arg:GOPROXY=https://proxy.example.com",
+		"--secret", "id=netrc,src=/home/me/.netrc",
+		"--ssh", "default",
+		"--output", `type=image,"name=registry.example.com/app:1,registry.example.com/app:latest"`,
+	}
+	if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got arguments\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestBuildkitRequiresBuildctl(t *testing.T) {
+	err := runInDir(t, filepath.Join("testdata", "app"), "build", "--engine", "buildkit", "--docker-bin", "/nonexistent/buildctl", "--tag", "registry.example.com/app", "--push", "./cmd/app")
+	if err == nil || !strings.Contains(err.Error(), "/nonexistent/buildctl was not found") {
+		t.Errorf("got %v, want an error that buildctl was not found", err)
+	}
+}
@@ -0,0 +1,224 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildCache remembers binaries and images by a hash of everything that went
+// into them, so that unchanged ones are not built again.
+type buildCache struct {
+	dir string
+}
+
+// resolveCacheDir returns the absolute path of the directory given by --cache-dir,
+// defaulting to godockerize in the user's cache directory.
+func resolveCacheDir(dir string) (string, error) {
+	if dir == "" {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(userDir, "godockerize"), nil
+	}
+	return filepath.Abs(dir)
+}
+
+func openBuildCache(dir string) (*buildCache, error) {
+	bc := &buildCache{dir: dir}
+	for _, sub := range []string{"bin", "images"} {
+		if err := os.MkdirAll(filepath.Join(bc.dir, sub), 0777); err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// getBinary links or copies the binary with the given key to out and reports
+// whether it was found.
+func (bc *buildCache) getBinary(key, out string) bool {
+	return copyFile(filepath.Join(bc.dir, "bin", key), out) == nil
+}
+
+func (bc *buildCache) putBinary(key, file string) error {
+	return copyFile(file, filepath.Join(bc.dir, "bin", key))
+}
+
+// getImage returns the ID of the image built for key, if any.
+func (bc *buildCache) getImage(key string) (string, bool) {
+	id, err := ioutil.ReadFile(filepath.Join(bc.dir, "images", key))
+	if err != nil {
+		return "", false
+	}
+	return string(id), true
+}
+
+func (bc *buildCache) putImage(key, id string) error {
+	return writeFileAtomic(filepath.Join(bc.dir, "images", key), []byte(id))
+}
+
+// binaryKey hashes the transitive sources of pkg together with the build
+// flags and the go environment. Files of the standard library are covered by
+// the Go version and files of module dependencies by their version.
+func (t *toolchain) binaryKey(pkg *goPackage, opts *goBuildOptions, goEnv []byte) (string, error) {
+	h := sha256.New()
+	h.Write(goEnv)
+	flags := opts.flags(pkg)
+	fmt.Fprintf(h, "flags %q test %v\n", flags, opts.tests)
+	if pgo := opts.pgoProfile(pkg); pgo != "" {
+		if err := hashFile(h, pgo); err != nil {
+			return "", err
+		}
+	}
+
+	args := append([]string{"list", "-deps", "-json"}, flags...)
+	if opts.tests {
+		args = append(args, "-test")
+	}
+	cmd := t.goBuildCmd(opts, append(args, pkg.ImportPath)...)
+	cmd.Stderr = t.stderr()
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(out)
+	for {
+		var dep struct {
+			ImportPath string
+			Dir        string
+			Standard   bool
+			Module     *struct {
+				Path    string
+				Version string
+				Sum     string
+				Replace *struct{}
+			}
+			GoFiles, CgoFiles, CFiles, CXXFiles, HFiles, SFiles, SysoFiles, EmbedFiles []string
+		}
+		if err := dec.Decode(&dep); err == io.EOF {
+			break
+		} else if err != nil {
+			cmd.Wait()
+			return "", err
+		}
+
+		fmt.Fprintf(h, "package %s\n", dep.ImportPath)
+		switch {
+		case dep.Standard:
+		case opts.tests && strings.HasSuffix(dep.ImportPath, ".test"):
+			// generated by the go command from the other packages
+		case dep.Module != nil && dep.Module.Version != "" && dep.Module.Replace == nil:
+			fmt.Fprintf(h, "module %s@%s %s\n", dep.Module.Path, dep.Module.Version, dep.Module.Sum)
+		default:
+			for _, files := range [][]string{dep.GoFiles, dep.CgoFiles, dep.CFiles, dep.CXXFiles, dep.HFiles, dep.SFiles, dep.SysoFiles, dep.EmbedFiles} {
+				for _, name := range files {
+					fmt.Fprintf(h, "file %s\n", name)
+					if err := hashFile(h, filepath.Join(dep.Dir, name)); err != nil {
+						cmd.Wait()
+						return "", err
+					}
+				}
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// imageKey hashes the Dockerfile, the binaries and the assets that make up
+// the build context.
+func imageKey(dockerfile []byte, bins []builtBinary, manifest *contextManifest) (string, error) {
+	h := sha256.New()
+	h.Write(dockerfile)
+	for _, b := range bins {
+		fmt.Fprintf(h, "binary %s\n", b.key)
+	}
+	if err := manifest.hashAssets(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stableGoEnv removes the settings that differ between invocations of
+// "go env" from its output.
+func stableGoEnv(env []byte) []byte {
+	var out []byte
+	for _, line := range bytes.SplitAfter(env, []byte("\n")) {
+		// contains a random temporary directory
+		if bytes.Contains(line, []byte("GOGCCFLAGS=")) {
+			continue
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+func hashFile(h hash.Hash, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// copyFile hard links src to dst, or copies it if that is not possible.
+func copyFile(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFileContents(src, dst)
+}
+
+// copyFileContents copies src to dst, replacing dst atomically.
+func copyFileContents(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
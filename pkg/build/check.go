@@ -0,0 +1,155 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doCheck(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize check" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("check does not support path@version")
+	}
+	file := c.String("dockerfile")
+	committed, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	// like for the dockerfile command, which wrote the committed file
+	b.vcsLabels = false
+
+	generated, err := b.generateDockerfile(c, patterns)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(committed, generated) {
+		b.tc.printf("godockerize: %s is up to date\n", file)
+		return nil
+	}
+	io.WriteString(b.tc.stdout(), unifiedDiff(file, "generated", string(committed), string(generated)))
+	return stageErrorf(stageCheck, "%s is out of date, regenerate it with \"godockerize dockerfile -f %s\"", file, file)
+}
+
+// unifiedDiff returns the differences between the lines of a and b in the
+// unified format with three lines of context.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	linesA := splitLines(a)
+	linesB := splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// linesA[i:] and linesB[j:]
+	lcs := make([][]int, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			switch {
+			case linesA[i] == linesB[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // line numbers in a and b before the edit
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			edits = append(edits, edit{' ', linesA[i], i, j})
+			i++
+			j++
+		case j == len(linesB) || (i < len(linesA) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', linesA[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', linesB[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		// a hunk: from context lines before the change to context lines
+		// after the last change that is not separated by more than twice
+		// the context
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for n := k; n < len(edits) && n-end <= 2*context; n++ {
+			if edits[n].op != ' ' {
+				end = n
+			}
+		}
+		end += context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		var countA, countB int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[start].i, countA), hunkRange(edits[start].j, countB))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
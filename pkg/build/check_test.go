@@ -0,0 +1,190 @@
+package build
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// runInDir runs godockerize with args in dir.
+func runInDir(t *testing.T, dir string, args ...string) error {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	return newApp().Run(append([]string{"godockerize"}, args...))
+}
+
+// setenv sets the environment variable name for the rest of the test.
+func setenv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// copyTestApp copies testdata/app into a temporary directory, which it
+// returns, for tests that change its files.
+func copyTestApp(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = filepath.Walk(filepath.Join("testdata", "app"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, "app", strings.TrimPrefix(path, filepath.Join("testdata", "app")))
+		if fi.IsDir() {
+			return os.MkdirAll(dest, 0777)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, data, 0666)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDockerfileGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "app", "Dockerfile")
+	if *update {
+		out, err := filepath.Abs(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runInDir(t, filepath.Join("testdata", "app"), "dockerfile", "--file", out, "./cmd/app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "Dockerfile")
+	if err := runInDir(t, filepath.Join("testdata", "app"), "dockerfile", "--file", out, "./cmd/app"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("generated Dockerfile differs from %s, run go test -update:\n%s", golden, unifiedDiff(golden, "generated", string(want), string(got)))
+	}
+}
+
+func TestCheckIndependentOfEnvironment(t *testing.T) {
+	home, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	netrc := filepath.Join(home, ".netrc")
+	if err := ioutil.WriteFile(netrc, []byte("machine example.com login x password y\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// none of these may end up in the Dockerfile
+	setenv(t, "HOME", home)
+	setenv(t, "NETRC", netrc)
+	setenv(t, "SSH_AUTH_SOCK", filepath.Join(home, "agent.sock"))
+	setenv(t, "GOPRIVATE", "example.com/private")
+	setenv(t, "GODOCKERIZE_GOARCH", "arm64")
+
+	if err := runInDir(t, filepath.Join("testdata", "app"), "check", "./cmd/app"); err != nil {
+		t.Errorf("check: %v", err)
+	}
+}
+
+func TestCheckOutOfDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	committed := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(committed, []byte(dockerfileHeader+"FROM alpine\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	err = runInDir(t, filepath.Join("testdata", "app"), "check", "--dockerfile", committed, "./cmd/app")
+	var se *stageError
+	if !errors.As(err, &se) || se.stage != stageCheck {
+		t.Errorf("check of an outdated Dockerfile: got %v, want an error of stage %s", err, stageCheck)
+	}
+}
+
+func TestDockerfileIndependentOfModTimes(t *testing.T) {
+	dir := copyTestApp(t)
+	app := filepath.Join(dir, "app")
+
+	render := func(first, second string, hoursApart time.Duration) string {
+		now := time.Now()
+		for i, pkg := range []string{first, second} {
+			mtime := now.Add(time.Duration(i) * hoursApart * time.Hour)
+			if err := os.Chtimes(filepath.Join(app, "cmd", pkg, "main.go"), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out := filepath.Join(dir, "Dockerfile")
+		if err := runInDir(t, app, "dockerfile", "--layering", "per-binary", "--file", out, "./cmd/app", "./cmd/health"); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	want := render("app", "health", 1)
+	if got := render("health", "app", 1); got != want {
+		t.Errorf("the Dockerfile changed after touching the sources:\n%s", unifiedDiff("before", "after", want, got))
+	}
+	if strings.Index(want, "app /usr/local/bin/") > strings.Index(want, "health /usr/local/bin/") {
+		t.Errorf("the binaries are not copied in the order of the packages:\n%s", want)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", "--- a\n+++ b\n"},
+		{"a\nb\nc\n", "a\nx\nc\n", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"", "a\n", "--- a\n+++ b\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- a\n+++ b\n@@ -1 +0,0 @@\n-a\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "1\n2\n3\n4\n5\n6\n7\n8\n9\nx\n", "--- a\n+++ b\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+x\n"},
+	}
+	for _, test := range tests {
+		if got := unifiedDiff("a", "b", test.a, test.b); got != test.want {
+			t.Errorf("unifiedDiff(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
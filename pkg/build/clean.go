@@ -0,0 +1,152 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// imageLabel marks the images that godockerize builds with the import path
+// of their entrypoint, so that godockerize clean --images can find them.
+const imageLabel = labelPrefix + "package"
+
+func doClean(c *cli.Context) error {
+	dir, err := resolveCacheDir(c.String("cache-dir"))
+	if err != nil {
+		return err
+	}
+	// only what godockerize puts there, --cache-dir may be shared
+	var dirs []string
+	for _, sub := range []string{"bin", "images", "go-build"} {
+		dirs = append(dirs, filepath.Join(dir, sub))
+	}
+	if c.Bool("toolchains") {
+		toolchains, err := downloadedToolchains(&toolchain{ctx: c.Context, goBin: c.String("go-bin")})
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, toolchains...)
+	}
+
+	var total int64
+	for _, d := range dirs {
+		size, err := diskUsage(d)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		total += size
+		if c.Bool("dry-run") {
+			fmt.Printf("godockerize: Would remove %s (%s)\n", d, formatSize(size))
+			continue
+		}
+		if err := removeAll(d); err != nil {
+			return err
+		}
+		fmt.Printf("godockerize: Removed %s (%s)\n", d, formatSize(size))
+	}
+	if !c.Bool("dry-run") {
+		fmt.Printf("godockerize: Reclaimed %s\n", formatSize(total))
+	}
+
+	if c.Bool("images") {
+		return pruneImages(c)
+	}
+	return nil
+}
+
+// downloadedToolchains returns the directories in the module cache of the Go
+// toolchains that GOTOOLCHAIN downloaded. The go command shares them between
+// all projects, so they are not only those of --go-version.
+func downloadedToolchains(tc *toolchain) ([]string, error) {
+	out, err := tc.goCmd("env", "GOMODCACHE").Output()
+	if err != nil {
+		return nil, fmt.Errorf("go env GOMODCACHE: %v", err)
+	}
+	modcache := strings.TrimSpace(string(out))
+	if modcache == "" {
+		return nil, nil
+	}
+	dirs, err := filepath.Glob(filepath.Join(modcache, "golang.org", "toolchain@*"))
+	if err != nil {
+		return nil, err
+	}
+	return append(dirs, filepath.Join(modcache, "cache", "download", "golang.org", "toolchain")), nil
+}
+
+// pruneImages removes the dangling images that godockerize built, i.e.
+// those whose tags moved to newer builds.
+func pruneImages(c *cli.Context) error {
+	tc, err := newToolchain(c)
+	if err != nil {
+		return err
+	}
+	defer tc.close()
+	if tc.engine.noStore || tc.engine.name == "buildah" {
+		return fmt.Errorf("--images is not supported by %s", tc.engine.name)
+	}
+	if c.Bool("dry-run") && tc.api != nil {
+		ids, err := tc.api.danglingImages(tc.ctx, imageLabel)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Printf("godockerize: Would remove image %s\n", id)
+		}
+		return nil
+	}
+	if c.Bool("dry-run") {
+		out, err := tc.dockerCmd("image", "ls", "--filter", "dangling=true", "--filter", "label="+imageLabel, "--format", "{{.ID}}").Output()
+		if err != nil {
+			return err
+		}
+		for _, id := range strings.Fields(string(out)) {
+			fmt.Printf("godockerize: Would remove image %s\n", id)
+		}
+		return nil
+	}
+	if tc.api != nil {
+		reclaimed, err := tc.api.pruneImages(tc.ctx, imageLabel)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("godockerize: Reclaimed %s of images\n", formatSize(reclaimed))
+		return nil
+	}
+	cmd := tc.dockerCmd("image", "prune", "--force", "--filter", "label="+imageLabel)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// diskUsage returns the size of the files in the directory tree at path.
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// removeAll is os.RemoveAll for trees with read-only directories, like those
+// of the module cache.
+func removeAll(path string) error {
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(p, 0777)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
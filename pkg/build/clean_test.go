@@ -0,0 +1,46 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanToolchains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	modcache := filepath.Join(dir, "mod")
+	toolchain := filepath.Join(modcache, "golang.org", "toolchain@v0.0.1-go1.22.1.linux-amd64")
+	module := filepath.Join(modcache, "example.com", "dep@v1.0.0")
+	cached := filepath.Join(dir, "cache", "bin")
+	for _, d := range []string{toolchain, module, cached} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, "file"), []byte("x"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setenv(t, "GOMODCACHE", modcache)
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	if err := newApp().Run([]string{"godockerize", "clean", "--cache-dir", filepath.Join(dir, "cache")}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(cached) || !exists(toolchain) {
+		t.Errorf("without --toolchains: cache removed %v, toolchain kept %v, want only the cache removed", !exists(cached), exists(toolchain))
+	}
+	if err := newApp().Run([]string{"godockerize", "clean", "--cache-dir", filepath.Join(dir, "cache"), "--toolchains"}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(toolchain) || !exists(module) {
+		t.Errorf("with --toolchains: toolchain removed %v, module kept %v", !exists(toolchain), exists(module))
+	}
+}
@@ -0,0 +1,116 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// The scripts ask godockerize itself for the completions of the command line
+// typed so far, with --generate-bash-completion as the last argument.
+const bashCompletion = `# bash completion for godockerize, generated by "godockerize completion bash"
+_godockerize() {
+  local cur opts
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == "-"* ]]; then
+    opts=$( "${COMP_WORDS[@]:0:$COMP_CWORD}" "$cur" --generate-bash-completion 2>/dev/null )
+  else
+    opts=$( "${COMP_WORDS[@]:0:$COMP_CWORD}" --generate-bash-completion 2>/dev/null )
+  fi
+  COMPREPLY=( $(compgen -W "${opts}" -- "$cur") )
+  return 0
+}
+complete -o bashdefault -o default -F _godockerize godockerize
+`
+
+const zshCompletion = `#compdef godockerize
+# zsh completion for godockerize, generated by "godockerize completion zsh"
+_godockerize() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+compdef _godockerize godockerize
+`
+
+func doCompletion(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return errors.New(`"godockerize completion" requires exactly 1 argument: bash, zsh or fish`)
+	}
+	switch shell := c.Args().First(); shell {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		script, err := c.App.ToFishCompletion()
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		// the packages are not known statically
+		var commands []string
+		for _, cmd := range c.App.Commands {
+			if cmd.BashComplete != nil {
+				commands = append(commands, cmd.Name)
+			}
+		}
+		fmt.Printf("complete -c godockerize -n '__fish_seen_subcommand_from %s' -f -a '(set -l cmd (commandline -opc); $cmd --generate-bash-completion 2>/dev/null)'\n", strings.Join(commands, " "))
+	default:
+		return fmt.Errorf("unsupported shell %q, must be bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+// completePackages returns the completion of cmd, which takes packages as
+// arguments: its flags after a dash and the main packages of the module in
+// the current directory otherwise.
+func completePackages(cmd *cli.Command) cli.BashCompleteFunc {
+	return func(c *cli.Context) {
+		if len(os.Args) > 2 && strings.HasPrefix(os.Args[len(os.Args)-2], "-") {
+			cli.DefaultCompleteWithFlags(cmd)(c)
+			return
+		}
+		tc := &toolchain{ctx: c.Context, goBin: c.String("go-bin")}
+		if tc.goBin == "" {
+			tc.goBin = "go"
+		}
+		out, err := tc.goCmd("list", "-e", "-f", `{{if eq .Name "main"}}{{.Dir}}{{end}}`, "./...").Output()
+		if err != nil {
+			return
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			return
+		}
+		for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if dir == "" {
+				continue
+			}
+			rel, err := filepath.Rel(wd, dir)
+			if err != nil {
+				continue
+			}
+			if rel == "." {
+				fmt.Fprintln(c.App.Writer, ".")
+				continue
+			}
+			fmt.Fprintln(c.App.Writer, "./"+filepath.ToSlash(rel))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// composeService is a service of the file written by godockerize compose.
+type composeService struct {
+	name        string
+	image       string
+	ports       []string
+	environment []string // NAME=value
+	volumes     []string // named volume:path
+	dependsOn   []string
+}
+
+func doCompose(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize compose" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("compose does not support path@version")
+	}
+	if len(c.StringSlice("tag")) == 0 {
+		return errors.New(`compose requires a tag template like "repo/{{.Name}}:latest" for the images of the services`)
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	file := c.String("file")
+	stdout := os.Stdout
+	if file == "-" {
+		// messages like the selected base image must not end up in the file
+		os.Stdout = os.Stderr
+	}
+	services, err := b.composeServices(patterns)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	data := []byte(composeFile(services))
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Wrote %s\n", file)
+	return nil
+}
+
+// composeServices returns one service per package matching patterns, with
+// the image that godockerize build --separate-images would tag for it.
+func (b *builder) composeServices(patterns []string) ([]*composeService, error) {
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*composeService
+	published := make(map[string]string) // host port to service
+	names := make(map[string]bool)
+	var depends []foundDirective
+	for _, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return nil, err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return nil, err
+		}
+		s := &composeService{
+			name:      strings.TrimSuffix(spec.name(), pkg.Exe),
+			image:     tags[0],
+			dependsOn: sortedStringSet(spec.depends),
+		}
+		if names[s.name] {
+			return nil, fmt.Errorf("more than one package has the binary name %s", s.name)
+		}
+		names[s.name] = true
+
+		for _, port := range sortedStringSet(spec.expose) {
+			hostPort := strings.SplitN(port, "/", 2)[0]
+			if other, ok := published[hostPort]; ok {
+				fmt.Fprintf(os.Stderr, "godockerize: Not publishing port %s of %s, it is published by %s\n", port, s.name, other)
+				continue
+			}
+			published[hostPort] = s.name
+			s.ports = append(s.ports, hostPort+":"+port)
+		}
+		s.environment = sortedStringSet(spec.env)
+		for _, v := range sortedStringSet(spec.volumes) {
+			s.volumes = append(s.volumes, s.name+strings.Replace(v, "/", "-", -1)+":"+v)
+		}
+		for _, d := range spec.directives {
+			if d.Name == "depends" {
+				depends = append(depends, d)
+			}
+		}
+		services = append(services, s)
+	}
+
+	for _, d := range depends {
+		for _, name := range d.Fields() {
+			if !names[name] {
+				return nil, stageErrorf(stageDirective, "%s: //docker:depends %s is not one of the services %s", d.Pos, name, strings.Join(sortedStringSet(keysOf(names)), ", "))
+			}
+		}
+	}
+	return services, nil
+}
+
+// composeFile returns the docker-compose.yaml of services. The environment
+// of each service can be overridden from the environment of docker compose,
+// with the image's values as defaults.
+func composeFile(services []*composeService) string {
+	var out strings.Builder
+	out.WriteString("# Generated by godockerize compose.\n")
+	out.WriteString("services:\n")
+	var volumes []string
+	for _, s := range services {
+		fmt.Fprintf(&out, "  %s:\n", s.name)
+		fmt.Fprintf(&out, "    image: %s\n", yamlString(s.image))
+		if len(s.ports) != 0 {
+			out.WriteString("    ports:\n")
+			for _, p := range s.ports {
+				fmt.Fprintf(&out, "      - %s\n", yamlString(p))
+			}
+		}
+		if len(s.environment) != 0 {
+			out.WriteString("    environment:\n")
+			for _, v := range s.environment {
+				kv := strings.SplitN(v, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				value := "${" + kv[0] + ":-" + strings.Replace(kv[1], "$", "$$", -1) + "}"
+				fmt.Fprintf(&out, "      %s: %s\n", kv[0], yamlString(value))
+			}
+		}
+		if len(s.volumes) != 0 {
+			out.WriteString("    volumes:\n")
+			for _, v := range s.volumes {
+				fmt.Fprintf(&out, "      - %s\n", yamlString(v))
+				volumes = append(volumes, strings.SplitN(v, ":", 2)[0])
+			}
+		}
+		if len(s.dependsOn) != 0 {
+			out.WriteString("    depends_on:\n")
+			for _, d := range s.dependsOn {
+				fmt.Fprintf(&out, "      - %s\n", d)
+			}
+		}
+	}
+	if len(volumes) != 0 {
+		out.WriteString("volumes:\n")
+		for _, v := range volumes {
+			fmt.Fprintf(&out, "  %s: {}\n", v)
+		}
+	}
+	return out.String()
+}
+
+// yamlString quotes s as a YAML string, which accepts the escapes of Go.
+func yamlString(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+func keysOf(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
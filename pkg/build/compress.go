@@ -0,0 +1,81 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compressOptions is parsed from --compress, e.g. "upx" or "upx:9".
+type compressOptions struct {
+	level string // upx option selecting the compression level, e.g. -9 or --best
+}
+
+func parseCompress(s string) (*compressOptions, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if parts[0] != "upx" {
+		return nil, fmt.Errorf("unsupported compression %q, only upx is supported", parts[0])
+	}
+	opts := &compressOptions{}
+	if len(parts) == 2 {
+		switch level := parts[1]; level {
+		case "best", "brute", "ultra-brute":
+			opts.level = "--" + level
+		case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+			opts.level = "-" + level
+		default:
+			return nil, fmt.Errorf("invalid upx compression level %q", level)
+		}
+	}
+	return opts, nil
+}
+
+// String describes the compression for cache keys.
+func (opts *compressOptions) String() string {
+	return "upx" + opts.level
+}
+
+// compressBinaries runs upx on the binaries of packages in dir, except for
+// those in skip, and reports the sizes.
+func (t *toolchain) compressBinaries(packages []*goPackage, dir string, opts *compressOptions, skip map[string]bool) error {
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		if skip[pkg.ImportPath] {
+			t.printf("godockerize: Not compressing %s (nocompress directive)\n", name)
+			continue
+		}
+
+		file := filepath.Join(dir, name)
+		before, err := fileSize(file)
+		if err != nil {
+			return err
+		}
+
+		// Write to a new file instead of compressing in place, since the
+		// binary may be a hard link into the build cache.
+		args := []string{"-q", "-o", file + ".upx"}
+		if opts.level != "" {
+			args = append(args, opts.level)
+		}
+		cmd := t.command("upx", append(args, file)...)
+		cmd.Stderr = t.stderr()
+		if err := cmd.Run(); err != nil {
+			os.Remove(file + ".upx")
+			return fmt.Errorf("upx %s: %v", name, err)
+		}
+		if err := os.Rename(file+".upx", file); err != nil {
+			return err
+		}
+
+		after, err := fileSize(file)
+		if err != nil {
+			return err
+		}
+		t.printf("godockerize: Compressed %s: %s -> %s (%d%%)\n", name, formatSize(before), formatSize(after), after*100/before)
+	}
+	return nil
+}
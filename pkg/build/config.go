@@ -0,0 +1,421 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// projectConfig is the content of the configuration file in the root of the
+// module. Its keys are defaults for the flags, which the command line and the
+// environment variables of flags, e.g. GODOCKERIZE_BASE, override. Sections
+// for single packages override those defaults for the images with the
+// package as entrypoint.
+// Directives add to env and install, but base and user are only taken from
+// them if neither flags nor the configuration set them. The keys of the
+// profile selected by --profile replace the top-level ones.
+type projectConfig struct {
+	file string
+	configSettings
+	packages map[string]map[string][]string // settings by import path, see packageKeys
+	profiles map[string]*configSettings
+	handlers map[string][]string // commands of directive handlers by directive name
+	hooks    map[string][]string // shell commands by hook, see hookNames
+	explicit map[string]bool     // flags that were given, which the sections don't override
+}
+
+// configSettings are the keys of the top level or a profile.
+type configSettings struct {
+	flags   map[string][]string // by flag name
+	install []string            // packages installed in every image
+}
+
+// packageKeys are the keys that the section of a package may set.
+var packageKeys = map[string]bool{"base": true, "user": true, "env": true, "install": true}
+
+// projectCfg is loaded before the commands that take the flags of build run.
+var projectCfg *projectConfig
+
+// applyProjectConfig sets the flags of the command that were not given to
+// the values of the configuration file, if there is one.
+func applyProjectConfig(c *cli.Context) error {
+	projectCfg = nil
+	file := findProjectConfig()
+	if file == "" {
+		if c.IsSet("profile") {
+			return fmt.Errorf("--profile %s requires a %s", c.String("profile"), configFile)
+		}
+		return nil
+	}
+	cfg, err := loadProjectConfig(file)
+	if err != nil {
+		return err
+	}
+	profile := c.String("profile")
+	if !c.IsSet("profile") && len(cfg.flags["profile"]) != 0 {
+		profile = cfg.flags["profile"][0]
+	}
+	if profile != "" {
+		p, ok := cfg.profiles[profile]
+		if !ok && len(cfg.profiles) == 0 {
+			return fmt.Errorf("%s has no profiles, --profile %s is not defined", file, profile)
+		}
+		if !ok {
+			return fmt.Errorf("%s has no profile %q, only %s", file, profile, strings.Join(cfg.profileNames(), ", "))
+		}
+		for k, v := range p.flags {
+			cfg.flags[k] = v
+		}
+		if p.install != nil {
+			cfg.install = p.install
+		}
+	}
+	cfg.explicit = make(map[string]bool)
+	for _, f := range c.Command.Flags {
+		name := f.Names()[0]
+		if c.IsSet(name) {
+			cfg.explicit[name] = true
+			continue
+		}
+		for _, v := range cfg.flags[name] {
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("%s: invalid %s %q: %v", file, name, v, err)
+			}
+		}
+	}
+	projectCfg = cfg
+	return nil
+}
+
+// envPrefix starts the environment variables that every flag can be set with,
+// e.g. GODOCKERIZE_BASE for --base.
+const envPrefix = "GODOCKERIZE_"
+
+// addEnvVars adds the environment variable of envPrefix to flags, before the
+// ones they already have, e.g. DOCKER_HOST.
+func addEnvVars(flags []cli.Flag) {
+	for _, f := range flags {
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Names()[0], "-", "_", -1))
+		switch f := f.(type) {
+		case *cli.BoolFlag:
+			f.EnvVars = append([]string{env}, f.EnvVars...)
+		case *cli.DurationFlag:
+			f.EnvVars = append([]string{env}, f.EnvVars...)
+		case *cli.IntFlag:
+			f.EnvVars = append([]string{env}, f.EnvVars...)
+		case *cli.StringFlag:
+			f.EnvVars = append([]string{env}, f.EnvVars...)
+		case *cli.StringSliceFlag:
+			f.EnvVars = append([]string{env}, f.EnvVars...)
+		}
+	}
+}
+
+// usesProjectConfig reports whether cmd has flags of build, which the
+// configuration file can set.
+func usesProjectConfig(cmd *cli.Command) bool {
+	for _, f := range cmd.Flags {
+		if isBuildFlag(f.Names()[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBuildFlag(name string) bool {
+	for _, f := range buildFlags() {
+		if f.Names()[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findProjectConfig looks for the configuration file in the current
+// directory and its parents up to the root of the module.
+func findProjectConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		if file := filepath.Join(dir, configFile); fileExists(file) {
+			return file
+		}
+		if fileExists(filepath.Join(dir, "go.mod")) {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func loadProjectConfig(file string) (*projectConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", file, err)
+	}
+	cfg := &projectConfig{
+		file:           file,
+		configSettings: configSettings{flags: make(map[string][]string)},
+		packages:       make(map[string]map[string][]string),
+		profiles:       make(map[string]*configSettings),
+		handlers:       make(map[string][]string),
+		hooks:          make(map[string][]string),
+	}
+	for _, key := range root.keys {
+		v := root.mapping[key]
+		switch {
+		case key == "profiles":
+			if v.mapping == nil && v.values() != nil {
+				return nil, fmt.Errorf("%s:%d: profiles must map names to settings", file, v.line)
+			}
+			for _, name := range v.keys {
+				profile := v.mapping[name]
+				if profile.mapping == nil && profile.values() != nil {
+					return nil, fmt.Errorf("%s:%d: the settings of profile %s must be a mapping", file, profile.line, name)
+				}
+				s := &configSettings{flags: make(map[string][]string)}
+				for _, k := range profile.keys {
+					if k == "profile" || k == "packages" || k == "profiles" || k == "directives" || k == "hooks" {
+						return nil, fmt.Errorf("%s:%d: %s can't be set in a profile", file, profile.mapping[k].line, k)
+					}
+					if err := s.set(file, k, profile.mapping[k]); err != nil {
+						return nil, err
+					}
+				}
+				cfg.profiles[name] = s
+			}
+		case key == "directives":
+			if v.mapping == nil && v.values() != nil {
+				return nil, fmt.Errorf("%s:%d: directives must map names to handler commands", file, v.line)
+			}
+			for _, name := range v.keys {
+				h := v.mapping[name]
+				if h.mapping != nil || h.isList || h.scalar == "" {
+					return nil, fmt.Errorf("%s:%d: the handler of directive %s must be a command", file, h.line, name)
+				}
+				args := strings.Fields(h.scalar)
+				if strings.Contains(args[0], "/") && !filepath.IsAbs(args[0]) {
+					args[0] = filepath.Join(filepath.Dir(file), args[0])
+				}
+				cfg.handlers[name] = args
+			}
+		case key == "hooks":
+			if v.mapping == nil && v.values() != nil {
+				return nil, fmt.Errorf("%s:%d: hooks must map %s to commands", file, v.line, hookList())
+			}
+			for _, name := range v.keys {
+				if !isHook(name) {
+					return nil, fmt.Errorf("%s:%d: unknown hook %q, only %s", file, v.mapping[name].line, name, hookList())
+				}
+				if cfg.hooks[name], err = v.mapping[name].scalars(file); err != nil {
+					return nil, err
+				}
+			}
+		case key == "packages":
+			if v.mapping == nil && v.values() != nil {
+				return nil, fmt.Errorf("%s:%d: packages must map import paths to settings", file, v.line)
+			}
+			for _, path := range v.keys {
+				section := v.mapping[path]
+				if section.mapping == nil && section.values() != nil {
+					return nil, fmt.Errorf("%s:%d: the settings of %s must be a mapping", file, section.line, path)
+				}
+				settings := make(map[string][]string)
+				for _, k := range section.keys {
+					if !packageKeys[k] {
+						return nil, fmt.Errorf("%s:%d: %s can't be set for a single package, only base, user, env and install", file, section.mapping[k].line, k)
+					}
+					if settings[k], err = section.mapping[k].scalars(file); err != nil {
+						return nil, err
+					}
+				}
+				cfg.packages[path] = settings
+			}
+		default:
+			if err := cfg.set(file, key, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func (s *configSettings) set(file, key string, v *yamlValue) error {
+	values, err := v.scalars(file)
+	if err != nil {
+		return err
+	}
+	switch {
+	case key == "install":
+		s.install = values
+	case isBuildFlag(key):
+		s.flags[key] = values
+	default:
+		return fmt.Errorf("%s:%d: unknown key %q, the keys are the flags of godockerize build, install, directives, hooks, packages and profiles", file, v.line, key)
+	}
+	return nil
+}
+
+func (cfg *projectConfig) profileNames() []string {
+	var names []string
+	for name := range cfg.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packageSetting returns base or user for the image with the entrypoint
+// importPath from its section, or "" if the flag was given.
+func (cfg *projectConfig) packageSetting(importPath, key string) string {
+	if cfg == nil || cfg.explicit[key] || len(cfg.packages[importPath][key]) == 0 {
+		return ""
+	}
+	return cfg.packages[importPath][key][0]
+}
+
+// packageList returns env or install for the image with the entrypoint
+// importPath, which add to those of the flags and directives.
+func (cfg *projectConfig) packageList(importPath, key string) []string {
+	if cfg == nil {
+		return nil
+	}
+	var values []string
+	if key == "install" {
+		values = append(values, cfg.install...)
+	}
+	return append(values, cfg.packages[importPath][key]...)
+}
+
+// yamlValue is a node of the configuration file, which consists of
+// mappings, lists of scalars and scalars.
+type yamlValue struct {
+	line    int
+	scalar  string
+	list    []string
+	isList  bool
+	keys    []string // of mapping, in order
+	mapping map[string]*yamlValue
+}
+
+// values returns the scalar or list, nil for an empty value or a mapping.
+func (v *yamlValue) values() []string {
+	if v.isList {
+		return v.list
+	}
+	if v.scalar == "" {
+		return nil
+	}
+	return []string{v.scalar}
+}
+
+func (v *yamlValue) scalars(file string) ([]string, error) {
+	if v.mapping != nil {
+		return nil, fmt.Errorf("%s:%d: expected a value or a list, not a mapping", file, v.line)
+	}
+	return v.values(), nil
+}
+
+// parseYAML parses the configuration file with gopkg.in/yaml.v3 and
+// rejects what the configuration can't hold, like lists of mappings. Errors
+// start with the line number.
+func parseYAML(data []byte) (*yamlValue, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, yamlError(err)
+	}
+	if len(doc.Content) == 0 {
+		return &yamlValue{line: 1, mapping: make(map[string]*yamlValue)}, nil
+	}
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		if root.Tag == "!!null" {
+			return &yamlValue{line: 1, mapping: make(map[string]*yamlValue)}, nil
+		}
+		return nil, fmt.Errorf("%d: expected key: value", root.Line)
+	}
+	return convertYAML(root)
+}
+
+// yamlError turns an error of yaml.Unmarshal like "yaml: line 3: found
+// character that cannot start any token" into "3: found character ...".
+func yamlError(err error) error {
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	if strings.HasPrefix(msg, "line ") {
+		return errors.New(strings.TrimPrefix(msg, "line "))
+	}
+	return fmt.Errorf("1: %s", msg)
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+func convertYAML(n *yaml.Node) (*yamlValue, error) {
+	v := &yamlValue{line: n.Line}
+	n = resolveAlias(n)
+	switch n.Kind {
+	case yaml.ScalarNode:
+		v.scalar = yamlScalar(n)
+	case yaml.SequenceNode:
+		v.isList = true
+		for _, item := range n.Content {
+			item = resolveAlias(item)
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%d: lists may only contain values, not lists or mappings", item.Line)
+			}
+			v.list = append(v.list, yamlScalar(item))
+		}
+	case yaml.MappingNode:
+		v.mapping = make(map[string]*yamlValue)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := resolveAlias(n.Content[i])
+			if k.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%d: keys must be values, not lists or mappings", k.Line)
+			}
+			if k.Tag == "!!merge" {
+				return nil, fmt.Errorf("%d: merge keys are not supported", k.Line)
+			}
+			if _, ok := v.mapping[k.Value]; ok {
+				return nil, fmt.Errorf("%d: duplicate key %q", k.Line, k.Value)
+			}
+			value, err := convertYAML(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			value.line = k.Line
+			v.keys = append(v.keys, k.Value)
+			v.mapping[k.Value] = value
+		}
+	default:
+		return nil, fmt.Errorf("%d: unsupported YAML", n.Line)
+	}
+	return v, nil
+}
+
+// yamlScalar returns the value of the scalar n, "" for null.
+func yamlScalar(n *yaml.Node) string {
+	if n.Tag == "!!null" {
+		return ""
+	}
+	return n.Value
+}
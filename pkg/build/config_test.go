@@ -0,0 +1,171 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string][]string // values of the top-level keys
+	}{
+		{"empty", "", map[string][]string{}},
+		{"comments only", "# nothing\n---\n", map[string][]string{}},
+		{"scalars", "base: alpine:3.19\nuser: 'app'\ntag: \"x # y\" # comment\n", map[string][]string{
+			"base": {"alpine:3.19"}, "user": {"app"}, "tag": {"x # y"},
+		}},
+		{"null", "base:\nuser: ~\n", map[string][]string{"base": nil, "user": nil}},
+		{"block list", "install:\n  - git\n  - \"curl\"\n", map[string][]string{"install": {"git", "curl"}}},
+		{"flow list with commas", "label: [\"a=b,c\", d=e]\n", map[string][]string{"label": {"a=b,c", "d=e"}}},
+		{"block scalar", "check: |\n  go vet\n", map[string][]string{"check": {"go vet\n"}}},
+		{"anchors", "base: &b alpine\nbuilder-image: *b\n", map[string][]string{"base": {"alpine"}, "builder-image": {"alpine"}}},
+		{"number and bool", "parallel: 4\nstrip: false\n", map[string][]string{"parallel": {"4"}, "strip": {"false"}}},
+	}
+	for _, test := range tests {
+		root, err := parseYAML([]byte(test.in))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := make(map[string][]string)
+		for _, k := range root.keys {
+			got[k] = root.mapping[k].values()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLNested(t *testing.T) {
+	root, err := parseYAML([]byte("packages:\n  example.com/a:\n    base: scratch\n  example.com/b: {user: app}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages := root.mapping["packages"]
+	if !reflect.DeepEqual(packages.keys, []string{"example.com/a", "example.com/b"}) {
+		t.Fatalf("got keys %q", packages.keys)
+	}
+	if got := packages.mapping["example.com/a"].mapping["base"]; got.scalar != "scratch" || got.line != 3 {
+		t.Errorf("got base %q in line %d, want scratch in line 3", got.scalar, got.line)
+	}
+	if got := packages.mapping["example.com/b"].mapping["user"].scalar; got != "app" {
+		t.Errorf("got user %q, want app", got)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"base: a\nbase: b\n", `2: duplicate key "base"`},
+		{"install:\n  - name: git\n", "2: lists may only contain values"},
+		{"install: [[git]]\n", "1: lists may only contain values"},
+		{"- git\n", "1: expected key: value"},
+		{"base: [alpine\n", "1: did not find expected"},
+		{"base: a\n\tuser: b\n", "2: found a tab character"},
+		{"a: &a {b: c}\nd:\n  <<: *a\n", "3: merge keys are not supported"},
+		{"[a]: b\n", "1: keys must be values"},
+	}
+	for _, test := range tests {
+		_, err := parseYAML([]byte(test.in))
+		if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("parseYAML(%q): got error %v, want %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestLoadProjectConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, configFile)
+	write := func(s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`base: alpine:3.19
+env: ["A=b,c"]
+install: [git]
+packages:
+  example.com/app/cmd/app:
+    user: app
+profiles:
+  prod:
+    base: gcr.io/distroless/static
+directives:
+  migrate: ./tools/migrate --check
+`)
+	cfg, err := loadProjectConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.flags["env"]; !reflect.DeepEqual(got, []string{"A=b,c"}) {
+		t.Errorf("got env %q", got)
+	}
+	if got := cfg.install; !reflect.DeepEqual(got, []string{"git"}) {
+		t.Errorf("got install %q", got)
+	}
+	if got := cfg.packageSetting("example.com/app/cmd/app", "user"); got != "app" {
+		t.Errorf("got user %q", got)
+	}
+	if got := cfg.profiles["prod"].flags["base"]; !reflect.DeepEqual(got, []string{"gcr.io/distroless/static"}) {
+		t.Errorf("got base of profile prod %q", got)
+	}
+	if got, want := cfg.handlers["migrate"], []string{filepath.Join(dir, "tools", "migrate"), "--check"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got handler %q, want %q", got, want)
+	}
+
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"bogus: 1\n", `1: unknown key "bogus"`},
+		{"base:\n  a: b\n", "1: expected a value or a list, not a mapping"},
+		{"packages:\n  example.com/app:\n    tag: x\n", "3: tag can't be set for a single package"},
+		{"profiles:\n  prod:\n    hooks: {}\n", "3: hooks can't be set in a profile"},
+		{"directives:\n  migrate: [a, b]\n", "2: the handler of directive migrate must be a command"},
+	} {
+		write(test.in)
+		_, err := loadProjectConfig(file)
+		if want := file + ":" + test.want; err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", test.in, err, want)
+		}
+	}
+}
+
+func TestConfigBasePolicy(t *testing.T) {
+	app := filepath.Join(copyTestApp(t), "app")
+	config := "packages:\n  example.com/app/cmd/health:\n    base: debian:12\n"
+	if err := ioutil.WriteFile(filepath.Join(app, configFile), []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"dockerfile", "--file", filepath.Join(app, "health.Dockerfile"), "./cmd/health"}
+
+	err := runInDir(t, app, append([]string{"dockerfile", "--allowed-base", "alpine:*"}, args[1:]...)...)
+	if err == nil || !strings.Contains(err.Error(), "base of example.com/app/cmd/health in "+filepath.Join(app, configFile)) || !strings.Contains(err.Error(), "debian:12") {
+		t.Errorf("base of the configuration that the policy does not allow: got %v", err)
+	}
+	if err := runInDir(t, app, append([]string{"dockerfile", "--denied-base", "debian:*"}, args[1:]...)...); err == nil {
+		t.Error("base of the configuration that the policy denies was accepted")
+	}
+	if err := runInDir(t, app, append([]string{"dockerfile", "--allowed-base", "debian:*"}, args[1:]...)...); err != nil {
+		t.Errorf("base of the configuration that the policy allows: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(app, "health.Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "FROM debian:12\n") {
+		t.Errorf("the Dockerfile does not use the base of the configuration:\n%s", data)
+	}
+}
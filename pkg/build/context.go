@@ -0,0 +1,169 @@
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// contextManifest lists everything that makes up the build context of an
+// image, so that nothing else ends up in it.
+type contextManifest struct {
+	dir     string // the directory with the Dockerfile and the binaries
+	entries []contextEntry
+}
+
+type contextEntry struct {
+	name  string // slash-separated path in the context
+	src   string // file or directory on the host
+	asset bool   // from a //docker:copy directive rather than generated
+}
+
+func newContextManifest(dir string) *contextManifest {
+	m := &contextManifest{dir: dir}
+	m.addFile("Dockerfile")
+	m.addFile(".dockerignore")
+	return m
+}
+
+// addFile adds the file name in m.dir.
+func (m *contextManifest) addFile(name string) {
+	m.entries = append(m.entries, contextEntry{name: name, src: filepath.Join(m.dir, name)})
+}
+
+func (m *contextManifest) addAsset(name, src string) {
+	m.entries = append(m.entries, contextEntry{name: name, src: src, asset: true})
+}
+
+// dockerignore returns a .dockerignore that excludes everything but the
+// entries of m.
+func (m *contextManifest) dockerignore() []byte {
+	var b strings.Builder
+	b.WriteString("*\n")
+	for _, e := range m.entries {
+		fmt.Fprintf(&b, "!%s\n", e.name)
+	}
+	return []byte(b.String())
+}
+
+// materialize puts the assets into m.dir, so that it can be used as the
+// build context. Files are hard linked where possible.
+func (m *contextManifest) materialize() error {
+	for _, e := range m.entries {
+		if !e.asset {
+			continue
+		}
+		err := walkEntry(e, func(name, src string, fi os.FileInfo) error {
+			dst := filepath.Join(m.dir, filepath.FromSlash(name))
+			switch {
+			case fi.IsDir():
+				return os.MkdirAll(dst, 0777)
+			case fi.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(src)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(target, dst)
+			default:
+				if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+					return err
+				}
+				return copyFile(src, dst)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTar writes the build context as a tar archive to w, reading the
+// files from where they are instead of copying them first.
+func (m *contextManifest) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, e := range m.entries {
+		err := walkEntry(e, func(name, src string, fi os.FileInfo) error {
+			var link string
+			if fi.Mode()&os.ModeSymlink != 0 {
+				var err error
+				if link, err = os.Readlink(src); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(fi, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = name
+			if fi.IsDir() {
+				hdr.Name += "/"
+			}
+			// ownership in the image does not come from the context
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(src)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// hashAssets writes the names and contents of all assets to h.
+func (m *contextManifest) hashAssets(h hash.Hash) error {
+	for _, e := range m.entries {
+		if !e.asset {
+			continue
+		}
+		err := walkEntry(e, func(name, src string, fi os.FileInfo) error {
+			fmt.Fprintf(h, "asset %s %v\n", name, fi.Mode())
+			if fi.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Readlink(src)
+				fmt.Fprintf(h, "link %s\n", target)
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				return hashFile(h, src)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkEntry calls fn for e.src and, if it is a directory, everything below
+// it, with the corresponding names in the context. Symbolic links are not
+// followed.
+func walkEntry(e contextEntry, fn func(name, src string, fi os.FileInfo) error) error {
+	return filepath.Walk(e.src, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(e.src, src)
+		if err != nil {
+			return err
+		}
+		return fn(path.Join(e.name, filepath.ToSlash(rel)), src, fi)
+	})
+}
@@ -0,0 +1,485 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkDaemonless makes sure that the image of spec can be assembled
+// without running anything in it, i.e. without RUN instructions.
+func (spec *imageSpec) checkDaemonless() error {
+	switch {
+	case spec.family.windows:
+		return errors.New("--daemonless does not support Windows images")
+	case spec.family.bootstrap != nil:
+		return fmt.Errorf("--daemonless can't build the bootstrap stage of %s images, use a distroless base image instead", spec.family.name)
+	case len(spec.run) != 0:
+		return errors.New("--daemonless can't execute //docker:run commands")
+	case len(spec.addedInstructions()) != 0:
+		return errors.New("--daemonless can't add the Dockerfile instructions of directive handlers and includes")
+	}
+	if install := append(append([]string{}, spec.defaultPackages()...), spec.install...); len(install) != 0 && spec.family.install != nil {
+		return fmt.Errorf("--daemonless can't install packages (%s), use --no-default-packages or a distroless base image", strings.Join(sortedStringSet(install), ", "))
+	}
+	if user := spec.imageUser(); user != "" && spec.family.addUser != nil {
+		return fmt.Errorf("--daemonless can't add user %s to a %s image, use a distroless base image", user, spec.family.name)
+	}
+	return nil
+}
+
+// assembledImage is an image put together from the layers of a base image
+// and generated layers.
+type assembledImage struct {
+	base     *imageRef // where the base layers are, nil for scratch
+	layers   []*layerBlob
+	config   []byte
+	manifest []byte
+	desc     ociDescriptor // of the manifest
+}
+
+// configDigest returns the digest of the config, which is the ID of the
+// image.
+func (img *assembledImage) configDigest() string {
+	return sha256Digest(img.config)
+}
+
+// buildDaemonless compiles packages into the directory of manifest and
+// appends them as layers to the base image fetched from its registry. The
+// image is pushed to tags and written to the OCI layout of --output under
+// the first one as requested.
+func (b *builder) buildDaemonless(packages []*goPackage, spec *imageSpec, manifest *contextManifest, tags []string) (string, error) {
+	if _, err := b.compile(packages, spec, manifest.dir); err != nil {
+		return "", err
+	}
+
+	dtc, cancel := b.tc.withTimeout("docker-build-timeout", b.dockerBuildTimeout)
+	defer cancel()
+	b.tc.printf("godockerize: Assembling image...\n")
+	rc := newRegistryClient(dtc)
+	img, err := b.assembleImage(rc, packages, spec, manifest.dir)
+	if err != nil {
+		return "", dtc.checkTimeout(stageDockerBuild, stageErrorf(stageDockerBuild, "assembling image: %v", err))
+	}
+
+	if b.output != nil {
+		tag := ""
+		if len(tags) != 0 {
+			tag = tags[0]
+		}
+		if err := b.writeAssembledImage(rc, img, manifest.dir, tag); err != nil {
+			return "", stageErrorf(stageDockerBuild, "writing %s: %v", b.output.dest, err)
+		}
+	}
+
+	id := img.configDigest()
+	if b.imageOpts.push {
+		err := b.pushAll(tags, func(tc *toolchain, tag string) error {
+			b.tc.printf("godockerize: Pushing %s...\n", tag)
+			ref, err := parseImageRef(tag)
+			if err != nil {
+				return stageErrorf(stagePush, "%v", err)
+			}
+			if err := pushAssembledImage(tc, img, ref); err != nil {
+				return stageErrorf(stagePush, "pushing %s: %v", tag, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, tag := range tags {
+			b.tc.pushed[id] = append(b.tc.pushed[id], repository(tag)+"@"+img.desc.Digest)
+		}
+	}
+	return id, nil
+}
+
+// assembleImage puts together the image of spec from the base image and
+// layers for the assets and binaries in dir, like the instructions of
+// spec.dockerfile.
+func (b *builder) assembleImage(rc *registryClient, packages []*goPackage, spec *imageSpec, dir string) (*assembledImage, error) {
+	p := b.imageOpts.platform
+	if p == "" {
+		p = dockerPlatform(b.goOpts.goos, b.goOpts.goarch, "")
+	}
+	platform := strings.SplitN(p, "/", 3)
+	img := &assembledImage{}
+	config := &imageConfig{OS: platform[0], Architecture: platform[1]}
+	if len(platform) == 3 {
+		config.Variant = platform[2]
+	}
+	manifestType, layerType, configType := mediaTypeOCIManifest, mediaTypeOCILayer, mediaTypeOCIConfig
+	labels := append([]string(nil), spec.labels...)
+
+	if spec.base != "scratch" {
+		ref, err := parseImageRef(spec.base)
+		if err != nil {
+			return nil, err
+		}
+		if ref.digest == "" {
+			ref.digest = b.baseDigest
+		}
+		base, baseDigest, err := fetchBaseManifest(rc, ref, config)
+		if err != nil {
+			return nil, err
+		}
+		if b.reproducible {
+			// a tag of the base image moves, verify needs the digest
+			labels = append(labels, ociAnnotationPrefix+"base.name="+spec.base, ociAnnotationPrefix+"base.digest="+baseDigest)
+		}
+		b.tc.pushed[spec.base] = []string{repository(spec.base) + "@" + baseDigest}
+		r, err := rc.getBlob(ref, base.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(r).Decode(config)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("config of %s: %v", spec.base, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(base.Layers) {
+			return nil, fmt.Errorf("config of %s does not match its layers", spec.base)
+		}
+		for i, l := range base.Layers {
+			img.layers = append(img.layers, &layerBlob{desc: l, diffID: config.RootFS.DiffIDs[i]})
+		}
+		img.base = ref
+		if base.MediaType == mediaTypeDockerManifest {
+			manifestType, layerType, configType = mediaTypeDockerManifest, mediaTypeDockerLayer, mediaTypeDockerConfig
+		}
+	}
+	config.RootFS.Type = "layers"
+	created := layerTime.UTC().Format("2006-01-02T15:04:05Z")
+	config.Created = created
+
+	// the same instructions as in spec.dockerfile
+	cc := &config.Config
+	addHistory := func(createdBy string, layer *layerBlob) {
+		item := imageHistoryItem{Created: created, CreatedBy: createdBy + " # godockerize", EmptyLayer: layer == nil}
+		config.History = append(config.History, item)
+		if layer != nil {
+			img.layers = append(img.layers, layer)
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.diffID)
+		}
+	}
+	if len(spec.env) != 0 {
+		for _, v := range sortedStringSet(spec.env) {
+			cc.Env = setEnv(cc.Env, v)
+		}
+		addHistory("ENV "+strings.Join(sortedStringSet(spec.env), " "), nil)
+	}
+	if len(spec.expose) != 0 {
+		if cc.ExposedPorts == nil {
+			cc.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range spec.expose {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cc.ExposedPorts[port] = struct{}{}
+		}
+		addHistory("EXPOSE "+strings.Join(sortedStringSet(spec.expose), " "), nil)
+	}
+	if len(spec.volumes) != 0 {
+		if cc.Volumes == nil {
+			cc.Volumes = make(map[string]struct{})
+		}
+		for _, v := range spec.volumes {
+			cc.Volumes[v] = struct{}{}
+		}
+		addHistory("VOLUME "+strings.Join(sortedStringSet(spec.volumes), " "), nil)
+	}
+	if len(labels) != 0 {
+		if cc.Labels == nil {
+			cc.Labels = make(map[string]string)
+		}
+		for _, l := range labels {
+			k, v := parseKeyValue(l)
+			cc.Labels[k] = v
+		}
+		addHistory("LABEL "+strings.Join(sortedStringSet(labels), " "), nil)
+	}
+
+	n := 0
+	newLayer := func(files []layerFile) (*layerBlob, error) {
+		n++
+		return writeLayer(filepath.Join(dir, fmt.Sprintf("layer-%d.tar.gz", n)), files, layerType)
+	}
+	for _, a := range spec.copies {
+		files, err := assetFiles(a, cc.WorkingDir)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := newLayer(files)
+		if err != nil {
+			return nil, err
+		}
+		addHistory(fmt.Sprintf("COPY %s %s", a.context, a.dest), layer)
+	}
+
+	user := spec.imageUser()
+	if user != "" {
+		cc.User = user
+		addHistory("USER "+user, nil)
+	}
+	if cmd := spec.healthcheckCommand(); cmd != nil {
+		cc.Healthcheck = &healthConfig{Test: append([]string{"CMD"}, cmd...)}
+		addHistory("HEALTHCHECK CMD "+execForm(cmd), nil)
+	}
+	entrypoint := spec.name()
+	if packages[0].Test {
+		entrypoint = testRunner
+	}
+	cc.Entrypoint = []string{spec.family.binPath(entrypoint)}
+	cc.Cmd = nil
+	addHistory(fmt.Sprintf("ENTRYPOINT [%q]", cc.Entrypoint[0]), nil)
+
+	// the owner can only be set for numeric users, as there is no passwd to
+	// look names up in, the binaries are readable and executable by all
+	uid, gid := numericOwner(user)
+	binDir := strings.TrimPrefix(spec.family.binDir(), "/")
+	// in the order of the Dockerfile: the test runner, the health check
+	// helper and the binaries
+	var layers [][]string
+	if packages[0].Test {
+		layers = append(layers, []string{testRunner})
+	}
+	if spec.usesHealthcheckHelper() {
+		layers = append(layers, []string{healthcheckHelper})
+	}
+	for _, group := range spec.binaryLayers() {
+		var names []string
+		for _, pkg := range group {
+			names = append(names, pkg.binaryName())
+		}
+		layers = append(layers, names)
+	}
+	for _, names := range layers {
+		var files []layerFile
+		for _, name := range names {
+			files = append(files, layerFile{name: binDir + name, src: filepath.Join(dir, name), mode: 0755, uid: uid, gid: gid})
+		}
+		layer, err := newLayer(files)
+		if err != nil {
+			return nil, err
+		}
+		addHistory(fmt.Sprintf("COPY %s %s", strings.Join(names, " "), spec.family.binDir()), layer)
+	}
+
+	var err error
+	if img.config, err = json.Marshal(config); err != nil {
+		return nil, err
+	}
+	m := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		Config:        ociDescriptor{MediaType: configType, Digest: sha256Digest(img.config), Size: int64(len(img.config))},
+	}
+	for _, l := range img.layers {
+		m.Layers = append(m.Layers, l.desc)
+	}
+	if img.manifest, err = json.Marshal(m); err != nil {
+		return nil, err
+	}
+	img.desc = ociDescriptor{MediaType: manifestType, Digest: sha256Digest(img.manifest), Size: int64(len(img.manifest))}
+	return img, nil
+}
+
+// fetchBaseManifest returns the manifest of ref for the platform of config
+// and the digest of the manifest or index that ref refers to.
+func fetchBaseManifest(rc *registryClient, ref *imageRef, config *imageConfig) (*ociManifest, string, error) {
+	data, mediaType, digest, err := rc.getManifest(ref, ref.reference())
+	if err != nil {
+		return nil, "", err
+	}
+	if mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerList {
+		var index ociIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, "", fmt.Errorf("index of %s: %v", ref, err)
+		}
+		var found *ociDescriptor
+		for i, m := range index.Manifests {
+			p := m.Platform
+			if p == nil || p.OS != config.OS || p.Architecture != config.Architecture {
+				continue
+			}
+			if p.Variant == config.Variant || (config.Variant == "" && found == nil) {
+				found = &index.Manifests[i]
+			}
+		}
+		if found == nil {
+			return nil, "", fmt.Errorf("%s has no image for %s/%s", ref, config.OS, config.Architecture)
+		}
+		if data, mediaType, _, err = rc.getManifest(ref, found.Digest); err != nil {
+			return nil, "", err
+		}
+	}
+	if mediaType != mediaTypeOCIManifest && mediaType != mediaTypeDockerManifest {
+		return nil, "", fmt.Errorf("%s: unsupported manifest type %s", ref, mediaType)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("manifest of %s: %v", ref, err)
+	}
+	m.MediaType = mediaType
+	return &m, digest, nil
+}
+
+// assetFiles returns the files that COPY puts into the image for a.
+func assetFiles(a copyAsset, workdir string) ([]layerFile, error) {
+	dest := a.dest
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", workdir, dest)
+	}
+	fi, err := os.Lstat(a.src)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() && strings.HasSuffix(a.dest, "/") {
+		dest = path.Join(dest, filepath.Base(a.src))
+	}
+	dest = strings.TrimPrefix(path.Clean(dest), "/")
+
+	var files []layerFile
+	err = walkEntry(contextEntry{name: dest, src: a.src}, func(name, src string, fi os.FileInfo) error {
+		lf := layerFile{name: name, src: src, mode: fi.Mode()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			lf.link = target
+		}
+		if name != "" && name != "." {
+			files = append(files, lf)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// numericOwner returns the uid and gid of a user given as uid[:gid], and
+// root otherwise.
+func numericOwner(user string) (int, int) {
+	name, group := splitUser(user)
+	if !isNumeric(name) {
+		return 0, 0
+	}
+	var uid, gid int
+	fmt.Sscan(name, &uid)
+	gid = uid
+	if isNumeric(group) {
+		fmt.Sscan(group, &gid)
+	}
+	return uid, gid
+}
+
+// pushAssembledImage pushes the blobs of img that the repository of ref
+// does not have yet and then the manifest.
+func pushAssembledImage(tc *toolchain, img *assembledImage, ref *imageRef) error {
+	rc := newRegistryClient(tc)
+	for _, l := range img.layers {
+		if err := pushLayer(rc, img, l, ref); err != nil {
+			return err
+		}
+	}
+	configDigest := img.configDigest()
+	if ok, err := rc.blobExists(ref, configDigest); err != nil {
+		return err
+	} else if !ok {
+		if err := rc.uploadBlob(ref, configDigest, int64(len(img.config)), openBytes(img.config), nil); err != nil {
+			return err
+		}
+	}
+	if err := rc.putManifest(ref, img.desc.MediaType, img.manifest); err != nil {
+		return err
+	}
+	tc.printf("godockerize: Pushed %s@%s\n", repository(ref.String()), img.desc.Digest)
+	return nil
+}
+
+func pushLayer(rc *registryClient, img *assembledImage, l *layerBlob, ref *imageRef) error {
+	if ok, err := rc.blobExists(ref, l.desc.Digest); err != nil || ok {
+		return err
+	}
+	open := func() (io.ReadCloser, error) {
+		return os.Open(l.file)
+	}
+	if l.file == "" {
+		// mounted if the base image is in the same registry, else copied
+		if img.base.registry == ref.registry {
+			if err := rc.uploadBlob(ref, l.desc.Digest, l.desc.Size, nil, img.base); err == nil {
+				return nil
+			}
+		}
+		open = func() (io.ReadCloser, error) {
+			return rc.getBlob(img.base, l.desc.Digest)
+		}
+	}
+	return rc.uploadBlob(ref, l.desc.Digest, l.desc.Size, open, nil)
+}
+
+// writeAssembledImage writes img to the OCI layout or docker archive of
+// --output. The archive is put together in an OCI layout in dir.
+func (b *builder) writeAssembledImage(rc *registryClient, img *assembledImage, dir, tag string) error {
+	if b.output.kind == "oci" {
+		if err := writeOCIImage(rc, img, b.output.dest, tag); err != nil {
+			return err
+		}
+		b.tc.printf("godockerize: Wrote image to OCI layout %s\n", b.output.dest)
+		return nil
+	}
+	layout := filepath.Join(dir, "oci")
+	if err := writeOCIImage(rc, img, layout, tag); err != nil {
+		return err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(img.manifest, &m); err != nil {
+		return err
+	}
+	if err := writeDockerArchive(layout, b.output.dest, &m, tag); err != nil {
+		return err
+	}
+	b.tc.printf("godockerize: Wrote image to docker archive %s\n", b.output.dest)
+	return nil
+}
+
+// writeOCIImage stores img with all its blobs in the OCI layout dir under
+// the name tag.
+func writeOCIImage(rc *registryClient, img *assembledImage, dir, tag string) error {
+	layout, err := openOCILayout(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range img.layers {
+		if layout.hasBlob(l.desc.Digest) {
+			continue
+		}
+		var r io.ReadCloser
+		if l.file != "" {
+			r, err = os.Open(l.file)
+		} else {
+			r, err = rc.getBlob(img.base, l.desc.Digest)
+		}
+		if err != nil {
+			return err
+		}
+		err = layout.writeBlob(l.desc.Digest, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, blob := range [][]byte{img.config, img.manifest} {
+		if err := layout.writeBlob(sha256Digest(blob), strings.NewReader(string(blob))); err != nil {
+			return err
+		}
+	}
+	return layout.addManifest(img.desc, tag)
+}
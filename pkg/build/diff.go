@@ -0,0 +1,451 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// existingImage is an image that diff compares a build with, from the local
+// image store or a registry.
+type existingImage struct {
+	id        string // digest of the config
+	config    *imageConfig
+	openLayer func(i int) (io.ReadCloser, error) // the i-th layer as uncompressed tar
+}
+
+// imageChange is a difference between an existing image and a build, e.g.
+// {"expose", "+8080/tcp"}.
+type imageChange struct {
+	what, detail string
+}
+
+func doDiff(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 2 {
+		return errors.New(`"godockerize diff" requires an image and 1 or more packages`)
+	}
+	image := args.First()
+	patterns := args.Tail()
+	if hasVersion(patterns) {
+		return errors.New("diff does not support path@version")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	spec, err := b.spec(packages)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "godockerize")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	rc := newRegistryClient(b.tc)
+	img, err := b.openExistingImage(rc, image, tmpdir)
+	if err != nil {
+		return err
+	}
+	var index *apkIndex
+	if spec.family == alpineFamily && !c.Bool("no-index") {
+		index = &apkIndex{ctx: c.Context, base: spec.base, arch: apkArch(b.goOpts.goarch)}
+	}
+	changes, err := b.diffImage(rc, spec, img, index, tmpdir)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Printf("godockerize: %s is up to date\n", image)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, ch := range changes {
+		fmt.Fprintf(w, "%s\t%s\n", ch.what, ch.detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if c.Bool("exit-code") {
+		return stageErrorf(stageCheck, "%s differs from a build in %d ways", image, len(changes))
+	}
+	fmt.Printf("godockerize: %s differs from a build in %d ways\n", image, len(changes))
+	return nil
+}
+
+// openExistingImage opens image from the image store of the engine if it is
+// there, else from its registry.
+func (b *builder) openExistingImage(rc *registryClient, image, tmpdir string) (*existingImage, error) {
+	if !b.tc.engine.noStore && imageExists(b.tc, image) {
+		return openSavedImage(b.tc, image, tmpdir)
+	}
+
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	p := b.imageOpts.platform
+	if p == "" {
+		p = dockerPlatform(b.goOpts.goos, b.goOpts.goarch, "")
+	}
+	platform := strings.SplitN(p, "/", 3)
+	config := &imageConfig{OS: platform[0], Architecture: platform[1]}
+	if len(platform) == 3 {
+		config.Variant = platform[2]
+	}
+	m, _, err := fetchBaseManifest(rc, ref, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeConfigBlob(rc, ref, m, config); err != nil {
+		return nil, err
+	}
+	return &existingImage{
+		id:     m.Config.Digest,
+		config: config,
+		openLayer: func(i int) (io.ReadCloser, error) {
+			r, err := rc.getBlob(ref, m.Layers[i].Digest)
+			if err != nil {
+				return nil, err
+			}
+			return uncompressedLayer(r)
+		},
+	}, nil
+}
+
+// openSavedImage exports image from the engine into tmpdir.
+func openSavedImage(tc *toolchain, image, tmpdir string) (*existingImage, error) {
+	file := filepath.Join(tmpdir, "image.tar")
+	if err := saveImage(tc, image, file); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(tmpdir, "image")
+	if err := untar(file, dir); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []dockerArchiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("%s: invalid manifest.json", file)
+	}
+	e := entries[0]
+	data, err = ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(e.Config)))
+	if err != nil {
+		return nil, err
+	}
+	config := &imageConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("config of %s: %v", image, err)
+	}
+	return &existingImage{
+		id:     sha256Digest(data),
+		config: config,
+		openLayer: func(i int) (io.ReadCloser, error) {
+			f, err := os.Open(filepath.Join(dir, filepath.FromSlash(e.Layers[i])))
+			if err != nil {
+				return nil, err
+			}
+			return uncompressedLayer(f)
+		},
+	}, nil
+}
+
+func decodeConfigBlob(rc *registryClient, ref *imageRef, m *ociManifest, config *imageConfig) error {
+	r, err := rc.getBlob(ref, m.Config.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(config); err != nil {
+		return fmt.Errorf("config of %s: %v", ref, err)
+	}
+	return nil
+}
+
+// uncompressedLayer returns the tar of a layer that may be gzipped.
+func uncompressedLayer(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, r}, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, r}, nil
+}
+
+// diffImage compares img with what a build of spec would produce now: the
+// base image, the configuration, the binaries and the installed packages.
+func (b *builder) diffImage(rc *registryClient, spec *imageSpec, img *existingImage, index *apkIndex, tmpdir string) ([]imageChange, error) {
+	var changes []imageChange
+	add := func(what, format string, args ...interface{}) {
+		changes = append(changes, imageChange{what, fmt.Sprintf(format, args...)})
+	}
+	cc := &img.config.Config
+
+	// the base image is unchanged if its current layers are the first
+	// layers of img
+	base := &imageConfig{OS: img.config.OS, Architecture: img.config.Architecture, Variant: img.config.Variant}
+	baseLayers := 0
+	if spec.base != "scratch" && spec.family.bootstrap == nil {
+		ref, err := parseImageRef(spec.base)
+		if err != nil {
+			return nil, err
+		}
+		m, digest, err := fetchBaseManifest(rc, ref, base)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfigBlob(rc, ref, m, base); err != nil {
+			return nil, err
+		}
+		if hasPrefix(img.config.RootFS.DiffIDs, base.RootFS.DiffIDs) {
+			baseLayers = len(base.RootFS.DiffIDs)
+		} else {
+			add("base", "%s has changed, it is now %s", spec.base, digest)
+		}
+	}
+
+	env := append([]string{}, base.Config.Env...)
+	for _, v := range sortedStringSet(spec.env) {
+		env = setEnv(env, v)
+	}
+	diffSets(add, "env", env, cc.Env)
+
+	var ports []string
+	for _, port := range spec.expose {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		ports = append(ports, port)
+	}
+	diffSets(add, "expose", append(keys(base.Config.ExposedPorts), ports...), keys(cc.ExposedPorts))
+	diffSets(add, "volume", append(keys(base.Config.Volumes), spec.volumes...), keys(cc.Volumes))
+
+	labels := make(map[string]string)
+	for k, v := range base.Config.Labels {
+		labels[k] = v
+	}
+	for _, l := range spec.labels {
+		k, v := parseKeyValue(l)
+		labels[k] = v
+	}
+	var wantLabels, haveLabels []string
+	for k, v := range labels {
+		wantLabels = append(wantLabels, k+"="+v)
+	}
+	for k, v := range cc.Labels {
+		haveLabels = append(haveLabels, k+"="+v)
+	}
+	diffSets(add, "label", wantLabels, haveLabels)
+
+	if user := spec.imageUser(); user != cc.User {
+		add("user", "%q instead of %q", user, cc.User)
+	}
+	entrypoint := spec.name()
+	if spec.packages[0].Test {
+		entrypoint = testRunner
+	}
+	want := []string{spec.family.binPath(entrypoint)}
+	if spec.useTini() {
+		want = []string{spec.family.tini, "--", want[0]}
+	}
+	if strings.Join(want, "\x00") != strings.Join(cc.Entrypoint, "\x00") {
+		add("entrypoint", "%q instead of %q", want, cc.Entrypoint)
+	}
+
+	// the files that are compared, in the layers on top of the base image
+	binDir := strings.TrimPrefix(spec.family.binDir(), "/")
+	dbFile := ""
+	q, hasQuery := packageQueries[spec.family.name]
+	if hasQuery && q.cmd[0] == "cat" {
+		dbFile = strings.TrimPrefix(q.cmd[1], "/")
+	}
+	binaries := make(map[string]string) // name to digest
+	var db []byte
+	for i := baseLayers; i < len(img.config.RootFS.DiffIDs); i++ {
+		r, err := img.openLayer(i)
+		if err != nil {
+			return nil, err
+		}
+		err = scanLayer(r, func(name string, tr io.Reader) error {
+			switch {
+			case name == dbFile:
+				var err error
+				db, err = ioutil.ReadAll(tr)
+				return err
+			case path.Dir(name)+"/" == binDir:
+				h := sha256.New()
+				if _, err := io.Copy(h, tr); err != nil {
+					return err
+				}
+				binaries[path.Base(name)] = hashDigest(h)
+			}
+			return nil
+		})
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %v", i, err)
+		}
+	}
+
+	if b.inDocker {
+		add("binaries", "not compared, they are compiled in Docker")
+	} else {
+		dir := filepath.Join(tmpdir, "bin")
+		if err := os.Mkdir(dir, 0777); err != nil {
+			return nil, err
+		}
+		if _, err := b.compile(spec.packages, spec, dir); err != nil {
+			return nil, err
+		}
+		for _, pkg := range spec.packages {
+			name := pkg.binaryName()
+			have, ok := binaries[name]
+			if !ok {
+				add("binary", "%s is not in the image", name)
+				continue
+			}
+			f, err := os.Open(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			if hashDigest(h) != have {
+				add("binary", "%s has changed", name)
+			}
+		}
+	}
+
+	if db != nil && spec.family.install != nil {
+		installed := make(map[string]string)
+		for _, p := range q.parse(db) {
+			installed[p.name] = p.version
+		}
+		for _, name := range sortedStringSet(append(append([]string{}, spec.defaultPackages()...), spec.install...)) {
+			if i := strings.IndexAny(name, "=<>~"); i != -1 {
+				name = name[:i]
+			}
+			edge := strings.HasSuffix(name, "@edge")
+			name = strings.TrimSuffix(name, "@edge")
+			version, ok := installed[name]
+			if !ok {
+				add("package", "%s is not installed", name)
+				continue
+			}
+			if index == nil {
+				continue
+			}
+			latest, ok, err := index.lookup(name, edge)
+			if err != nil {
+				return nil, fmt.Errorf("%v (use --no-index to skip comparing package versions)", err)
+			}
+			if ok && latest != "" && latest != version {
+				add("package", "%s %s is installed, %s is available", name, version, latest)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// scanLayer calls fn for each regular file in the layer tar r, with its
+// slash-separated path without leading slash.
+func scanLayer(r io.Reader, fn func(name string, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(strings.TrimPrefix(path.Clean("/"+hdr.Name), "/"), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// diffSets reports the elements of want that are missing from have with a
+// "+" and the ones that have in addition with a "-".
+func diffSets(add func(what, format string, args ...interface{}), what string, want, have []string) {
+	wantSet := make(map[string]bool)
+	for _, s := range want {
+		wantSet[s] = true
+	}
+	haveSet := make(map[string]bool)
+	for _, s := range have {
+		haveSet[s] = true
+	}
+	for _, s := range sortedStringSet(want) {
+		if !haveSet[s] {
+			add(what, "+%s", s)
+		}
+	}
+	for _, s := range sortedStringSet(have) {
+		if !wantSet[s] {
+			add(what, "-%s", s)
+		}
+	}
+}
+
+func keys(m map[string]struct{}) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
+func hasPrefix(s, prefix []string) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
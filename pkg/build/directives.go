@@ -0,0 +1,39 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/urfave/cli/v2"
+)
+
+func doDirectives(c *cli.Context) error {
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Version    int               `json:"version"`
+			Directives []*directive.Kind `json:"directives"`
+		}{directive.SchemaVersion, directive.Kinds()})
+	}
+	for i, d := range directive.Kinds() {
+		if i != 0 {
+			fmt.Println()
+		}
+		if d.Args == "" {
+			fmt.Printf("//docker:%s\n", d.Name)
+		} else {
+			fmt.Printf("//docker:%s %s\n", d.Name, d.Args)
+		}
+		fmt.Printf("    %s\n", d.Description)
+		if d.Repeatable {
+			fmt.Println("    It can be given more than once.")
+		}
+		for _, e := range d.Examples {
+			fmt.Printf("    e.g. %s\n", e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// dockerBuildOptions configures how the image is built.
+type dockerBuildOptions struct {
+	tag       string
+	extraTags []string // further names of the image, e.g. in other registries
+	platform  string   // e.g. linux/arm64; empty means the daemon's platform
+	forceRm   bool
+	buildArgs []string // NAME=value; the proxy variables are predefined and don't need an ARG instruction
+
+	contextDir string   // build context if it is not the directory of the Dockerfile
+	secrets    []string // BuildKit secrets in id=...,src=... form
+	ssh        bool     // forward the SSH agent
+
+	stream *contextManifest // send the context as a tar stream instead of the directory
+
+	push       bool   // push with the build, for engines without image store
+	provenance string // mode of the provenance attestation, if any
+	archive    string // write the image in the format of "docker save" to this file, for engines without image store
+
+	cacheFrom, cacheTo []string // BuildKit cache imports and exports, see cacheOption
+}
+
+// cacheOption parses a --cache-from or --cache-to value in BuildKit's form,
+// e.g. type=registry,ref=IMAGE or type=local,src=DIR, where a plain image
+// reference is short for the former. Local caches are made absolute, as the
+// engine does not run in the current directory.
+func cacheOption(flag, s string) (string, error) {
+	if !strings.Contains(s, "=") {
+		return "type=registry,ref=" + s, nil
+	}
+	fields := strings.Split(s, ",")
+	attrs := make(map[string]string)
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("invalid --%s %q", flag, s)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	switch attrs["type"] {
+	case "registry":
+		if attrs["ref"] == "" {
+			return "", fmt.Errorf("invalid --%s %q: missing ref", flag, s)
+		}
+	case "local":
+		key := "src"
+		if flag == "cache-to" {
+			key = "dest"
+		}
+		if attrs[key] == "" {
+			return "", fmt.Errorf("invalid --%s %q: missing %s", flag, s, key)
+		}
+		for i, f := range fields {
+			if strings.HasPrefix(f, key+"=") {
+				abs, err := filepath.Abs(attrs[key])
+				if err != nil {
+					return "", err
+				}
+				fields[i] = key + "=" + abs
+			}
+		}
+	default:
+		return "", fmt.Errorf("invalid --%s %q: type must be registry or local", flag, s)
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// cacheRef returns the repository of a registry cache, or "" for other
+// types.
+func cacheRef(opt string) string {
+	if !strings.HasPrefix(opt, "type=registry,") {
+		return ""
+	}
+	for _, f := range strings.Split(opt, ",") {
+		if strings.HasPrefix(f, "ref=") {
+			return strings.TrimPrefix(f, "ref=")
+		}
+	}
+	return ""
+}
+
+// tags returns all names of the image.
+func (o *dockerBuildOptions) tags() []string {
+	if o.tag == "" {
+		return nil
+	}
+	return append([]string{o.tag}, o.extraTags...)
+}
+
+// buildImage builds the Docker image from the context in dir and returns its
+// ID.
+func buildImage(tc *toolchain, dir string, opts *dockerBuildOptions) (string, error) {
+	tc.printf("godockerize: Building Docker image...\n")
+	if tc.engine.noStore {
+		return buildctlBuild(tc, dir, opts)
+	}
+	if tc.api != nil {
+		id, err := tc.api.build(tc.ctx, opts, tc.stdout())
+		if err != nil {
+			return "", stageErrorf(stageDockerBuild, "docker build: %v", err)
+		}
+		return id, nil
+	}
+	iidfile := filepath.Join(dir, "iidfile")
+	args := append([]string{"build", "--iidfile", iidfile}, tc.engine.buildFlags...)
+	for _, tag := range opts.tags() {
+		args = append(args, "-t", tag)
+	}
+	if opts.platform != "" {
+		args = append(args, "--platform", opts.platform)
+	}
+	if opts.forceRm && !tc.engine.noForceRm {
+		args = append(args, "--force-rm")
+	}
+	for _, arg := range opts.buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	for _, secret := range opts.secrets {
+		args = append(args, "--secret", secret)
+	}
+	if opts.ssh {
+		args = append(args, "--ssh", "default")
+	}
+	for _, v := range []struct {
+		flag string
+		opts []string
+	}{
+		{"--cache-from", opts.cacheFrom},
+		{"--cache-to", opts.cacheTo},
+	} {
+		for _, opt := range v.opts {
+			if tc.engine.refCache {
+				opt = cacheRef(opt)
+			}
+			args = append(args, v.flag, opt)
+		}
+	}
+	switch {
+	case opts.contextDir != "":
+		args = append(args, "-f", filepath.Join(dir, "Dockerfile"), opts.contextDir)
+	case opts.stream != nil:
+		args = append(args, "-")
+	default:
+		args = append(args, ".")
+	}
+	cmd := tc.dockerCmd(args...)
+	cmd.Dir = dir
+	if opts.contextDir != "" && tc.engine.buildKitEnv {
+		// needed for RUN --mount
+		cmd.Env = append(cmd.Env, "DOCKER_BUILDKIT=1")
+	}
+	cmd.Stdout = tc.stdout()
+	cmd.Stderr = tc.stderr()
+
+	var streamErr chan error
+	var pr *io.PipeReader
+	if opts.stream != nil {
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		cmd.Stdin = pr
+		streamErr = make(chan error, 1)
+		go func() {
+			err := opts.stream.writeTar(pw)
+			pw.CloseWithError(err)
+			streamErr <- err
+		}()
+	}
+	err := cmd.Run()
+	if streamErr != nil {
+		pr.Close() // unblocks the writer if docker did not read everything
+		if serr := <-streamErr; serr != nil && serr != io.ErrClosedPipe {
+			return "", stageErrorf(stageDockerBuild, "sending build context: %v", serr)
+		}
+	}
+	if err != nil {
+		return "", stageErrorf(stageDockerBuild, "docker build: %v", err)
+	}
+
+	id, err := ioutil.ReadFile(iidfile)
+	if err != nil {
+		return "", err
+	}
+	// podman writes the ID without the algorithm
+	return "sha256:" + strings.TrimPrefix(strings.TrimSpace(string(id)), "sha256:"), nil
+}
+
+// buildImageCached is like buildImage, but reuses the image that was built
+// for the same key if it still exists. A nil cache always builds, and so do
+// engines without image store, which cache by themselves.
+func buildImageCached(tc *toolchain, dir string, opts *dockerBuildOptions, cache *buildCache, key string) (string, error) {
+	if cache == nil || tc.engine.noStore {
+		return buildImage(tc, dir, opts)
+	}
+
+	if id, ok := cache.getImage(key); ok && imageExists(tc, id) {
+		tc.printf("godockerize: Docker image is up to date\n")
+		for _, tag := range opts.tags() {
+			if err := tagImage(tc, id, tag); err != nil {
+				return "", stageErrorf(stageDockerBuild, "docker tag: %v", err)
+			}
+		}
+		return id, nil
+	}
+
+	id, err := buildImage(tc, dir, opts)
+	if err != nil {
+		return "", err
+	}
+	return id, cache.putImage(key, id)
+}
+
+func imageExists(tc *toolchain, id string) bool {
+	if tc.api != nil {
+		_, err := tc.api.inspectImage(tc.ctx, id)
+		return err == nil
+	}
+	return tc.dockerCmd("image", "inspect", id).Run() == nil
+}
+
+func tagImage(tc *toolchain, id, tag string) error {
+	if tc.api != nil {
+		return tc.api.tag(tc.ctx, id, tag)
+	}
+	return tc.dockerCmd("tag", id, tag).Run()
+}
+
+// dockerPlatform returns the Docker platform for a Go target, e.g.
+// "linux/arm/v7".
+func dockerPlatform(goos, goarch, goarm string) string {
+	platform := goos + "/" + goarch
+	if goarch == "arm" && goarm != "" {
+		platform += "/v" + strings.SplitN(goarm, ",", 2)[0]
+	}
+	return platform
+}
+
+func pushImage(tc *toolchain, tag string) error {
+	tc.printf("godockerize: Pushing %s...\n", tag)
+	if tc.api != nil {
+		if err := tc.api.push(tc.ctx, tag, tc.creds, tc.stdout()); err != nil {
+			return stageErrorf(stagePush, "docker push %s: %v", tag, err)
+		}
+		return nil
+	}
+	cmd, err := tc.pushCmd(tag, "push", tag)
+	if err != nil {
+		return stageErrorf(stagePush, "docker push %s: %v", tag, err)
+	}
+	cmd.Stdout = tc.stdout()
+	cmd.Stderr = tc.stderr()
+	if err := cmd.Run(); err != nil {
+		return stageErrorf(stagePush, "docker push %s: %v", tag, err)
+	}
+	return nil
+}
+
+// pinImage pulls image and returns it with the digest it resolved to, e.g.
+// "alpine:3.12@sha256:...", so that later builds use exactly the same image.
+func pinImage(tc *toolchain, image string) (string, error) {
+	if strings.Contains(image, "@") {
+		return image, nil
+	}
+	if err := pullImage(tc, image); err != nil {
+		return "", stageErrorf(stageDockerBuild, "docker pull %s: %v", image, err)
+	}
+	digest, err := repoDigest(tc, image, image)
+	if err != nil {
+		return "", stageErrorf(stageDockerBuild, "resolving digest of %s: %v", image, err)
+	}
+	if digest == "" {
+		return "", stageErrorf(stageDockerBuild, "no digest for %s", image)
+	}
+	tc.printf("godockerize: Pinned base image %s to %s\n", image, digest)
+	return image + "@" + digest, nil
+}
+
+func pullImage(tc *toolchain, image string) error {
+	if tc.api != nil {
+		return tc.api.pull(tc.ctx, image, tc.creds)
+	}
+	return tc.dockerCmd("pull", "-q", image).Run()
+}
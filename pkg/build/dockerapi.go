@@ -0,0 +1,435 @@
+package build
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockerAPI talks to the Docker daemon over its HTTP API, without the docker
+// command. Builds use the classic builder, since BuildKit needs a session
+// that is only available through gRPC, and Dockerfiles that need BuildKit
+// are rejected before the build, see renderDockerfile.
+//
+// The few endpoints are called directly instead of through the Docker SDK,
+// github.com/docker/docker/client, whose dependencies are larger than
+// godockerize and require a Go version far newer than that of go.mod. The
+// SDK would not make BuildKit available either.
+type dockerAPI struct {
+	client *http.Client
+	base   string // URL the paths of the API are relative to
+}
+
+// newDockerAPI connects to host, e.g. unix:///var/run/docker.sock or
+// tcp://host:2376, which defaults like the docker command. TLS is configured
+// by DOCKER_TLS_VERIFY and DOCKER_CERT_PATH, also like the docker command.
+func newDockerAPI(host string) (*dockerAPI, error) {
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --docker-host %q: %v", host, err)
+	}
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	a := &dockerAPI{client: &http.Client{Transport: tr}}
+	switch u.Scheme {
+	case "unix":
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", u.Path)
+		}
+		a.base = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" || u.Scheme == "https" {
+			if tr.TLSClientConfig, err = dockerTLSConfig(); err != nil {
+				return nil, err
+			}
+			scheme = "https"
+		}
+		a.base = scheme + "://" + u.Host
+	default:
+		return nil, fmt.Errorf("invalid --docker-host %q, must be unix:// or tcp://", host)
+	}
+	return a, nil
+}
+
+// dockerTLSConfig loads ca.pem, cert.pem and key.pem from DOCKER_CERT_PATH,
+// defaulting to ~/.docker. The client certificate is optional.
+func dockerTLSConfig() (*tls.Config, error) {
+	dir := os.Getenv("DOCKER_CERT_PATH")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	cfg := &tls.Config{}
+	ca, err := readFileIfExists(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: no certificates found", filepath.Join(dir, "ca.pem"))
+		}
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if fileExists(certFile) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// apiError is an error response of the daemon.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func isNotFound(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == http.StatusNotFound
+}
+
+// do sends a request and returns the response if it succeeded. The caller
+// has to close its body.
+func (a *dockerAPI) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := a.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &apiError{status: resp.StatusCode, message: e.Message}
+	}
+	return resp, nil
+}
+
+// getJSON decodes the response to a GET request into v.
+func (a *dockerAPI) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := a.do(ctx, "GET", path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonMessage is an element of the progress stream of builds, pushes and
+// pulls.
+type jsonMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// readMessages prints the progress stream r to w and returns the error it
+// ends with, if any. aux is called for messages with auxiliary data.
+func readMessages(r io.Reader, w io.Writer, aux func(json.RawMessage) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m jsonMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case m.ErrorDetail != nil && m.ErrorDetail.Message != "":
+			return errors.New(m.ErrorDetail.Message)
+		case m.Error != "":
+			return errors.New(m.Error)
+		case m.Aux != nil && aux != nil:
+			if err := aux(m.Aux); err != nil {
+				return err
+			}
+		case m.Stream != "":
+			io.WriteString(w, m.Stream)
+		case m.Status != "" && m.ID != "":
+			fmt.Fprintf(w, "%s: %s\n", m.ID, m.Status)
+		case m.Status != "":
+			fmt.Fprintln(w, m.Status)
+		}
+	}
+}
+
+// build sends the context of opts.stream to the daemon and returns the ID of
+// the image.
+func (a *dockerAPI) build(ctx context.Context, opts *dockerBuildOptions, w io.Writer) (string, error) {
+	if opts.stream == nil || opts.contextDir != "" || len(opts.secrets) != 0 || opts.ssh {
+		return "", errors.New("only builds from a context manifest are supported by the Docker API")
+	}
+	q := url.Values{}
+	q.Set("dockerfile", "Dockerfile")
+	for _, tag := range opts.tags() {
+		q.Add("t", tag)
+	}
+	if opts.platform != "" {
+		q.Set("platform", opts.platform)
+	}
+	if opts.forceRm {
+		q.Set("forcerm", "1")
+	}
+	if len(opts.buildArgs) != 0 {
+		args := make(map[string]string)
+		for _, arg := range opts.buildArgs {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 1 {
+				parts = append(parts, os.Getenv(parts[0]))
+			}
+			args[parts[0]] = parts[1]
+		}
+		data, err := json.Marshal(args)
+		if err != nil {
+			return "", err
+		}
+		q.Set("buildargs", string(data))
+	}
+	if len(opts.cacheFrom) != 0 {
+		var refs []string
+		for _, opt := range opts.cacheFrom {
+			refs = append(refs, cacheRef(opt))
+		}
+		data, err := json.Marshal(refs)
+		if err != nil {
+			return "", err
+		}
+		q.Set("cachefrom", string(data))
+	}
+
+	pr, pw := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		err := opts.stream.writeTar(pw)
+		pw.CloseWithError(err)
+		streamErr <- err
+	}()
+	resp, err := a.do(ctx, "POST", "/build", q, http.Header{"Content-Type": {"application/x-tar"}}, pr)
+	pr.Close() // unblocks the writer if the daemon did not read everything
+	if serr := <-streamErr; serr != nil && serr != io.ErrClosedPipe {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return "", fmt.Errorf("sending build context: %v", serr)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var id string
+	err = readMessages(resp.Body, w, func(raw json.RawMessage) error {
+		var aux struct {
+			ID string `json:"ID"`
+		}
+		if json.Unmarshal(raw, &aux) == nil && aux.ID != "" {
+			id = aux.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", errors.New("the daemon did not return the ID of the image")
+	}
+	return id, nil
+}
+
+// apiImage is the part of an image's inspect output that is used.
+type apiImage struct {
+	ID          string `json:"Id"`
+	RepoDigests []string
+	Size        int64
+}
+
+func (a *dockerAPI) inspectImage(ctx context.Context, image string) (*apiImage, error) {
+	var img apiImage
+	if err := a.getJSON(ctx, "/images/"+image+"/json", &img); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// imageLayer is an entry of the history of an image.
+type imageLayer struct {
+	Size      int64
+	CreatedBy string
+}
+
+// history returns the layers of image, the most recent first.
+func (a *dockerAPI) history(ctx context.Context, image string) ([]imageLayer, error) {
+	var layers []imageLayer
+	if err := a.getJSON(ctx, "/images/"+image+"/history", &layers); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// splitTag splits an image reference into repository and tag, which
+// defaults to latest.
+func splitTag(ref string) (string, string) {
+	repo := repository(ref)
+	tag := strings.TrimPrefix(ref, repo)
+	if i := strings.Index(tag, "@"); i != -1 {
+		tag = tag[:i]
+	}
+	if tag = strings.TrimPrefix(tag, ":"); tag == "" {
+		tag = "latest"
+	}
+	return repo, tag
+}
+
+func (a *dockerAPI) tag(ctx context.Context, image, ref string) error {
+	repo, tag := splitTag(ref)
+	resp, err := a.do(ctx, "POST", "/images/"+image+"/tag", url.Values{"repo": {repo}, "tag": {tag}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// registryAuth returns the X-Registry-Auth header for ref.
+func registryAuth(creds *credentials, ref string) (http.Header, error) {
+	r, err := parseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := creds.header(r.registry)
+	if err != nil {
+		return nil, err
+	}
+	return http.Header{"X-Registry-Auth": {auth}}, nil
+}
+
+func (a *dockerAPI) push(ctx context.Context, ref string, creds *credentials, w io.Writer) error {
+	repo, tag := splitTag(ref)
+	header, err := registryAuth(creds, ref)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(ctx, "POST", "/images/"+repo+"/push", url.Values{"tag": {tag}}, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readMessages(resp.Body, w, nil)
+}
+
+func (a *dockerAPI) pull(ctx context.Context, ref string, creds *credentials) error {
+	repo, tag := splitTag(ref)
+	header, err := registryAuth(creds, ref)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(ctx, "POST", "/images/create", url.Values{"fromImage": {repo}, "tag": {tag}}, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readMessages(resp.Body, ioutil.Discard, nil)
+}
+
+// save writes the image in the format of "docker save" to file.
+func (a *dockerAPI) save(ctx context.Context, image, file string) error {
+	resp, err := a.do(ctx, "GET", "/images/get", url.Values{"names": {image}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// danglingImages returns the IDs of the dangling images that have the label.
+func (a *dockerAPI) danglingImages(ctx context.Context, label string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"dangling": {"true"}, "label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	var images []struct {
+		ID string `json:"Id"`
+	}
+	if err := a.getJSON(ctx, "/images/json?"+url.Values{"filters": {string(filters)}}.Encode(), &images); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, img := range images {
+		ids = append(ids, img.ID)
+	}
+	return ids, nil
+}
+
+// pruneImages removes the dangling images that have the label and returns
+// the space that was reclaimed.
+func (a *dockerAPI) pruneImages(ctx context.Context, label string) (int64, error) {
+	filters, err := json.Marshal(map[string][]string{"dangling": {"true"}, "label": {label}})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := a.do(ctx, "POST", "/images/prune", url.Values{"filters": {string(filters)}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		SpaceReclaimed int64
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.SpaceReclaimed, err
+}
@@ -0,0 +1,187 @@
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// fakeDaemon implements the endpoints of the Docker Engine API that
+// dockerAPI uses and records the builds.
+type fakeDaemon struct {
+	id       string // of the image it builds
+	mu       sync.Mutex
+	requests []string // method and path
+	query    map[string][]string
+	context  map[string]*tar.Header
+	files    map[string]string // contents of the small files of the context
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/build":
+		d.query = r.URL.Query()
+		d.context = make(map[string]*tar.Header)
+		d.files = make(map[string]string)
+		tr := tar.NewReader(r.Body)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d.context[h.Name] = h
+			if h.Size < 4096 {
+				data, _ := ioutil.ReadAll(tr)
+				d.files[h.Name] = string(data)
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]string{"stream": "Step 1/1 : FROM alpine\n"})
+		enc.Encode(map[string]interface{}{"aux": map[string]string{"ID": d.id}})
+	case r.Method == "GET" && r.URL.Path == "/images/"+d.id+"/json":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Id": d.id, "Size": 1234})
+	case r.Method == "GET" && r.URL.Path == "/images/"+d.id+"/history":
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"Size": 1234, "CreatedBy": "COPY app /usr/local/bin/"}})
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/push"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"errorDetail": map[string]string{"message": "denied: requested access to the resource is denied"}})
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/tag"):
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such image"})
+	}
+}
+
+func startFakeDaemon(t *testing.T) (*fakeDaemon, string) {
+	t.Helper()
+	// images of other daemons, which godockerize may have cached, are unknown
+	d := &fakeDaemon{id: fmt.Sprintf("sha256:%064x", time.Now().UnixNano())}
+	s := httptest.NewServer(d)
+	t.Cleanup(s.Close)
+	return d, "tcp://" + strings.TrimPrefix(s.URL, "http://")
+}
+
+func TestDockerAPIBuild(t *testing.T) {
+	d, host := startFakeDaemon(t)
+	a, err := newDockerAPI(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"Dockerfile": "FROM alpine\n", ".dockerignore": "*\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &dockerBuildOptions{
+		tag:       "registry.example.com/app",
+		platform:  "linux/arm64",
+		buildArgs: []string{"MODE=production"},
+		cacheFrom: []string{"type=registry,ref=registry.example.com/app:cache"},
+		stream:    newContextManifest(dir),
+	}
+	id, err := a.build(context.Background(), opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != d.id {
+		t.Errorf("got ID %q, want %s", id, d.id)
+	}
+	for k, want := range map[string]string{
+		"t":          "registry.example.com/app",
+		"platform":   "linux/arm64",
+		"buildargs":  `{"MODE":"production"}`,
+		"cachefrom":  `["registry.example.com/app:cache"]`,
+		"dockerfile": "Dockerfile",
+	} {
+		if got := strings.Join(d.query[k], ","); got != want {
+			t.Errorf("got %s=%q, want %q", k, got, want)
+		}
+	}
+	if d.files["Dockerfile"] != "FROM alpine\n" {
+		t.Errorf("got Dockerfile %q in the context", d.files["Dockerfile"])
+	}
+
+	// BuildKit features are rejected instead of ignored
+	opts.secrets = []string{"id=netrc,src=/home/me/.netrc"}
+	if _, err := a.build(context.Background(), opts, ioutil.Discard); err == nil {
+		t.Error("build with a secret did not fail")
+	}
+}
+
+func TestDockerAPIErrors(t *testing.T) {
+	_, host := startFakeDaemon(t)
+	a, err := newDockerAPI(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := a.inspectImage(ctx, "missing"); !isNotFound(err) || err.Error() != "No such image" {
+		t.Errorf("inspect of a missing image: got %v, want the daemon's not found error", err)
+	}
+	creds := newCredentials(ctx, "", "")
+	err = a.push(ctx, "registry.example.com/app:1", creds, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("push: got %v, want the error of the progress stream", err)
+	}
+	if err := a.tag(ctx, "sha256:c0ffee", "registry.example.com/app:1"); err != nil {
+		t.Errorf("tag: %v", err)
+	}
+	if _, err := newDockerAPI("ssh://host"); err == nil {
+		t.Error("newDockerAPI accepted ssh://")
+	}
+}
+
+func TestDockerAPIRejectsBuildKitDockerfile(t *testing.T) {
+	b := &builder{tc: &toolchain{engine: engines["docker-api"]}}
+	df := &dockerfile.Builder{}
+	df.Add("FROM", "alpine")
+	df.Add("RUN", "--mount=type=cache,target=/var/cache/apk apk add git")
+	_, err := b.renderDockerfile(df, "")
+	want := "docker-api builds without BuildKit: instruction 2 (RUN): --mount requires BuildKit"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestDockerAPIImage(t *testing.T) {
+	d, host := startFakeDaemon(t)
+	err := runInDir(t, filepath.Join("testdata", "app"), "build", "--engine", "docker-api", "--docker-host", host, "--tag", "registry.example.com/app", "./cmd/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(d.files["Dockerfile"], "--chmod") {
+		t.Errorf("the Dockerfile for the classic builder uses COPY --chmod:\n%s", d.files["Dockerfile"])
+	}
+	h := d.context["app"]
+	if h == nil {
+		t.Fatalf("the binary is missing from the context, which has %v", d.requests)
+	}
+	if h.Mode&0111 != 0111 {
+		t.Errorf("the binary has mode %o in the context, want it to be executable", h.Mode)
+	}
+}
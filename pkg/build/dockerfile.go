@@ -0,0 +1,144 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+	"github.com/urfave/cli/v2"
+)
+
+const dockerfileHeader = "# Generated by godockerize dockerfile.\n"
+
+func doDockerfile(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize dockerfile" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("dockerfile does not support path@version")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	// the revision would make a committed Dockerfile outdated by every commit
+	b.vcsLabels = false
+
+	file := c.String("file")
+	data, err := b.generateDockerfile(c, patterns)
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		return err
+	}
+	b.tc.printf("godockerize: Wrote %s\n", file)
+	return nil
+}
+
+// dockerfileFlags are the flags of the dockerfile and check commands that
+// give what the build stage needs in addition to the module, together with
+// --netrc, --goprivate, --gonosumdb, --goflags and --goproxy. The generated
+// file depends only on them, not on the environment it is generated in.
+func dockerfileFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "ssh",
+			Usage: "mount the SSH agent into the build stage for private modules, to be built with \"docker build --ssh default\"",
+		},
+		&cli.StringSliceFlag{
+			Name:  "module-arg",
+			Usage: "setting of the go command that the build stage takes as build argument, one of " + strings.Join(moduleEnvVars, ", "),
+		},
+	}
+}
+
+// generateDockerfile returns the Dockerfile for the image of the packages
+// matching patterns, which compiles them in its build stage like
+// --build-in-docker, without indentation. The binaries are built for the
+// platform that the image is built for, and secrets and build arguments
+// come from flags only, so that the file is the same wherever it is
+// generated.
+func (b *builder) generateDockerfile(c *cli.Context, patterns []string) ([]byte, error) {
+	var args []string
+	for _, name := range c.StringSlice("module-arg") {
+		if !isModuleEnvVar(name) {
+			return nil, fmt.Errorf("invalid --module-arg %q, must be one of %s", name, strings.Join(moduleEnvVars, ", "))
+		}
+		args = append(args, name)
+	}
+	// only the names of settings given with flags, the values are build arguments
+	for _, v := range b.tc.goEnv {
+		if name := strings.SplitN(v, "=", 2)[0]; isModuleEnvVar(name) {
+			args = append(args, name)
+		}
+	}
+	mounts := buildStageMounts{netrc: c.String("netrc") != "", ssh: c.Bool("ssh")}
+	b.goOpts.targetPlatform = true
+
+	packages, mod, err := loadLocalPackages(b.goOpts, patterns)
+	if err != nil {
+		return nil, err
+	}
+	b.module = mod
+	if b.builderImage == "" {
+		b.builderImage = builderImage(c.String("go-version"), mod)
+	}
+	if err := b.findLicenses(packages); err != nil {
+		return nil, err
+	}
+	spec, err := b.spec(packages)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.placeAssets(spec); err != nil {
+		return nil, err
+	}
+	stage, err := goBuildStage(b.builderImage, mod, packages, b.goOpts, args, mounts)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := b.imageDockerfile(spec, buildStage)
+	if err != nil {
+		return nil, err
+	}
+	stage.Append(image)
+	data, err := b.renderDockerfile(stage, "")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(dockerfileHeader), data...), nil
+}
+
+// renderDockerfile lets the library change df, see Options.EditDockerfile,
+// and renders it with each line prefixed by indent.
+func (b *builder) renderDockerfile(df *dockerfile.Builder, indent string) ([]byte, error) {
+	if b.editDockerfile != nil {
+		if err := b.editDockerfile(df); err != nil {
+			return nil, err
+		}
+	}
+	if err := df.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Dockerfile: %v", err)
+	}
+	if b.tc.engine.classic {
+		// e.g. RUN --mount of a template or plugin, which would fail in
+		// the middle of the build
+		if err := df.ValidateClassic(); err != nil {
+			return nil, fmt.Errorf("%s builds without BuildKit: %v", b.tc.engine.name, err)
+		}
+	}
+	return df.Render(indent), nil
+}
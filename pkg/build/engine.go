@@ -0,0 +1,196 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// engine is the container tool that builds, tags and pushes images. They
+// share most of Docker's command line, the differences are recorded here.
+type engine struct {
+	name          string
+	bin           string // command, if it is not the name
+	hostFlag      string // global option for --docker-host, empty if there is no daemon
+	contextFlag   string // global option for --docker-context, empty if there are no contexts
+	namespaceFlag string // global option for --containerd-namespace
+	streamStdin   bool   // "build -" reads a tar of the build context from stdin
+	buildKitEnv   bool   // RUN --mount needs DOCKER_BUILDKIT=1
+	buildFlags    []string
+	noForceRm     bool                // BuildKit always removes intermediate containers
+	commands      map[string][]string // replacements for docker's subcommands, e.g. "image inspect"
+	pushSave      bool                // exports with "push IMAGE docker-archive:FILE" as there is no "save"
+	noHistory     bool                // there is no "history" and "image inspect" has no size
+	digestsFmt    string              // template for "image inspect" that prints the repo digests as JSON
+	dockerEnv     bool                // DOCKER_HOST and DOCKER_CONTEXT apply
+	api           bool                // talks to the daemon with the Docker Engine API instead of a command
+	classic       bool                // builds without BuildKit, so there is no RUN --mount and COPY --chmod
+	noStore       bool                // has no image store, images are only pushed by the build
+	attestations  bool                // supports --provenance
+	daemonless    bool                // assembles images itself from registries, see --daemonless
+	authFile      bool                // reads registry credentials from REGISTRY_AUTH_FILE instead of the docker config
+	insecureFlag  string              // push option for --insecure-registry, empty if only the daemon can be configured
+	caFlag        string              // push option for a directory with the certificate of --registry-ca
+	refCache      bool                // --cache-from and --cache-to only take repositories
+	noRun         bool                // can't run containers, e.g. to read the package database of an image
+}
+
+var engines = map[string]*engine{
+	"docker": {
+		name:        "docker",
+		hostFlag:    "--host",
+		contextFlag: "--context",
+		streamStdin: true,
+		buildKitEnv: true,
+		dockerEnv:   true,
+	},
+	"docker-api": {
+		name:      "docker-api",
+		dockerEnv: true,
+		api:       true,
+		classic:   true,
+	},
+	// podman runs rootless without a daemon; --url and --connection select a
+	// remote service instead. Images are built in Docker's format, since the
+	// default OCI format drops the instructions it does not know, e.g.
+	// HEALTHCHECK.
+	"podman": {
+		name:         "podman",
+		hostFlag:     "--url",
+		contextFlag:  "--connection",
+		buildFlags:   []string{"--format", "docker"},
+		authFile:     true,
+		insecureFlag: "--tls-verify=false",
+		caFlag:       "--cert-dir",
+		refCache:     true,
+	},
+	// buildah needs no daemon and no privileges, e.g. in a Kubernetes pod.
+	// Unlike podman it does not cache layers by default. Its inspect only
+	// knows the digest of the image itself.
+	"buildah": {
+		name:       "buildah",
+		buildFlags: []string{"--format", "docker", "--layers"},
+		commands: map[string][]string{
+			"build":         {"bud"},
+			"image inspect": {"inspect", "--type", "image"},
+		},
+		pushSave:     true,
+		noHistory:    true,
+		noRun:        true,
+		digestsFmt:   `["{{.FromImageDigest}}"]`,
+		authFile:     true,
+		insecureFlag: "--tls-verify=false",
+		caFlag:       "--cert-dir",
+		refCache:     true,
+	},
+	// nerdctl builds with buildkitd into a containerd image store, e.g. that
+	// of k3s with --docker-host /run/k3s/containerd/containerd.sock and
+	// --containerd-namespace k8s.io.
+	"nerdctl": {
+		name:          "nerdctl",
+		hostFlag:      "--address",
+		namespaceFlag: "--namespace",
+		noForceRm:     true,
+		insecureFlag:  "--insecure-registry",
+	},
+	// buildkit builds with buildctl against buildkitd, selected by
+	// --docker-host or BUILDKIT_HOST.
+	"buildkit": {
+		name:         "buildkit",
+		bin:          "buildctl",
+		hostFlag:     "--addr",
+		noHistory:    true,
+		noStore:      true,
+		attestations: true,
+	},
+	// daemonless is selected by --daemonless rather than by --engine.
+	"daemonless": {
+		name:       "daemonless",
+		noHistory:  true,
+		noStore:    true,
+		daemonless: true,
+	},
+}
+
+// command returns the default command of e.
+func (e *engine) command() string {
+	if e.bin != "" {
+		return e.bin
+	}
+	return e.name
+}
+
+// args translates the arguments of a docker command for e.
+func (e *engine) args(args []string) []string {
+	if len(args) >= 2 {
+		if cmd, ok := e.commands[args[0]+" "+args[1]]; ok {
+			return append(append([]string{}, cmd...), args[2:]...)
+		}
+	}
+	if len(args) >= 1 {
+		if cmd, ok := e.commands[args[0]]; ok {
+			return append(append([]string{}, cmd...), args[1:]...)
+		}
+	}
+	return args
+}
+
+// repoDigestsFormat returns the template for "image inspect" that prints the
+// repo digests of an image as a JSON array.
+func (e *engine) repoDigestsFormat() string {
+	if e.digestsFmt != "" {
+		return e.digestsFmt
+	}
+	return "{{json .RepoDigests}}"
+}
+
+// engineNames returns the supported values of --engine.
+func engineNames() string {
+	var names []string
+	for name, e := range engines {
+		if e.daemonless {
+			continue
+		}
+		names = append(names, name)
+	}
+	return strings.Join(sortedStringSet(names), ", ")
+}
+
+// selectEngine returns the engine for --engine. With "auto" it is derived
+// from --docker-bin if that is set, else it is the first of docker, podman,
+// buildah and nerdctl that is installed.
+func selectEngine(name, bin string, binSet, daemonless bool) (*engine, error) {
+	if daemonless {
+		if name != "auto" {
+			return nil, errors.New("--daemonless can't be combined with --engine")
+		}
+		return engines["daemonless"], nil
+	}
+	if name == "auto" {
+		switch {
+		case binSet:
+			name = "docker"
+			base := strings.TrimSuffix(filepath.Base(bin), ".exe")
+			for n, e := range engines {
+				if e.command() == base {
+					name = n
+				}
+			}
+		default:
+			name = "docker"
+			for _, n := range []string{"docker", "podman", "buildah", "nerdctl"} {
+				if _, err := exec.LookPath(n); err == nil {
+					name = n
+					break
+				}
+			}
+		}
+	}
+	e, ok := engines[name]
+	if !ok || e.daemonless {
+		return nil, fmt.Errorf("invalid --engine %q, must be auto or one of %s", name, engineNames())
+	}
+	return e, nil
+}
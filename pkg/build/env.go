@@ -0,0 +1,184 @@
+package build
+
+import (
+	"go/ast"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envLabel lists the environment variables that the binaries of an image
+// read, with --env-inventory.
+const envLabel = labelPrefix + "env"
+
+// envVar is an environment variable that a program reads, found by
+// inventoryEnv.
+type envVar struct {
+	Name    string   `json:"name"`
+	Default string   `json:"default,omitempty"` // of a struct tag or the image
+	Sources []string `json:"sources"`           // where and how it is read, e.g. "main.go:12:5 os.Getenv"
+}
+
+// envReport is an image in the file of --env-report.
+type envReport struct {
+	Image     string    `json:"image"` // name of the entrypoint binary
+	Packages  []string  `json:"packages"`
+	Variables []*envVar `json:"variables"`
+}
+
+// runtimeEnv are variables that the Go runtime and standard library read,
+// which --check-env accepts in //docker:env.
+var runtimeEnv = map[string]bool{
+	"GODEBUG": true, "GOGC": true, "GOMAXPROCS": true, "GOMEMLIMIT": true, "GOTRACEBACK": true,
+	"TZ": true, "ZONEINFO": true, "HOME": true, "PATH": true, "TMPDIR": true,
+	"HTTP_PROXY": true, "HTTPS_PROXY": true, "NO_PROXY": true, "http_proxy": true, "https_proxy": true, "no_proxy": true,
+	"SSL_CERT_FILE": true, "SSL_CERT_DIR": true,
+}
+
+// inventoryEnv looks for os.Getenv and os.LookupEnv with constant names and
+// for struct fields with envconfig or env tags, as read by
+// github.com/kelseyhightower/envconfig and github.com/caarlos0/env.
+func inventoryEnv(packages []*goPackage) ([]*envVar, error) {
+	byName := make(map[string]*envVar)
+	for _, pkg := range packages {
+		a, err := analyzeSource(pkg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range a.files {
+			a.findEnv(f)
+		}
+		for _, v := range a.env {
+			if existing, ok := byName[v.Name]; ok {
+				existing.Sources = append(existing.Sources, v.Sources...)
+				if existing.Default == "" {
+					existing.Default = v.Default
+				}
+				continue
+			}
+			byName[v.Name] = v
+		}
+	}
+	var vars []*envVar
+	for _, v := range byName {
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars, nil
+}
+
+// findEnv records the environment variables that f reads.
+func (a *sourceAnalyzer) findEnv(f *ast.File) {
+	osPkg := importName(f, "os")
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			for _, fn := range []string{"Getenv", "LookupEnv"} {
+				if call, ok := isCall(n, osPkg, fn); ok && len(call.Args) == 1 {
+					if name, ok := a.value(call.Args[0], 0); ok && name != "" {
+						a.addEnv(name, "", "os."+fn, call)
+					}
+				}
+			}
+		case *ast.Field:
+			if n.Tag == nil {
+				break
+			}
+			tag, err := strconv.Unquote(n.Tag.Value)
+			if err != nil {
+				break
+			}
+			st := reflect.StructTag(tag)
+			for _, t := range []struct{ name, def string }{{"envconfig", "default"}, {"env", "envDefault"}} {
+				v, ok := st.Lookup(t.name)
+				if !ok {
+					continue
+				}
+				name := strings.Split(v, ",")[0]
+				if name == "" || name == "-" {
+					continue
+				}
+				a.addEnv(name, st.Get(t.def), t.name+" tag", n)
+			}
+		}
+		return true
+	})
+}
+
+func (a *sourceAnalyzer) addEnv(name, def, how string, n ast.Node) {
+	a.env = append(a.env, &envVar{
+		Name:    name,
+		Default: def,
+		Sources: []string{relPath(a.fset.Position(n.Pos()).String()) + " " + how},
+	})
+}
+
+// addEnvInventory applies --env-inventory, --env-report and --check-env to
+// spec: the variables that its binaries read, including in dependencies, are
+// listed in a label and a report, and every variable of //docker:env has to
+// be one of them.
+func (b *builder) addEnvInventory(spec *imageSpec) error {
+	packages, err := b.tc.sourcePackages(b.goOpts, spec.packages, false)
+	if err != nil {
+		return err
+	}
+	vars, err := inventoryEnv(packages)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]*envVar)
+	for _, v := range vars {
+		known[v.Name] = v
+	}
+	for _, kv := range spec.env {
+		parts := strings.SplitN(kv, "=", 2)
+		if v, ok := known[parts[0]]; ok && len(parts) == 2 && parts[1] != "" {
+			v.Default = parts[1]
+		}
+	}
+
+	if b.checkEnv {
+		for _, d := range spec.directives {
+			if d.Name != "env" {
+				continue
+			}
+			for _, kv := range d.Fields() {
+				name := strings.SplitN(kv, "=", 2)[0]
+				if known[name] == nil && !runtimeEnv[name] {
+					return stageErrorf(stageDirective, "%s: //docker:env %s is not read by the program", d.Pos, name)
+				}
+			}
+		}
+	}
+
+	if b.envInventory && len(vars) != 0 {
+		var names []string
+		b.tc.printf("godockerize: Environment variables of %s:\n", spec.name())
+		for _, v := range vars {
+			names = append(names, v.Name)
+			if v.Default != "" {
+				b.tc.printf("  %s (default %q): %s\n", v.Name, v.Default, strings.Join(v.Sources, ", "))
+			} else {
+				b.tc.printf("  %s: %s\n", v.Name, strings.Join(v.Sources, ", "))
+			}
+		}
+		spec.labels = append(spec.labels, envLabel+"="+strings.Join(names, ","))
+	}
+
+	if b.envReport != "" {
+		r := &envReport{Image: spec.name(), Variables: vars}
+		for _, pkg := range spec.packages {
+			r.Packages = append(r.Packages, pkg.ImportPath)
+		}
+		if r.Variables == nil {
+			r.Variables = []*envVar{}
+		}
+		// the file lists all images built so far
+		b.envReports = append(b.envReports, r)
+		if err := writeJSONFile(b.envReport, b.envReports); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInventoryEnv(t *testing.T) {
+	pkg := sourcePackage(t, `package main
+import "os"
+const dbURL = "DB_" + "URL"
+type config struct {
+	Port  int    `+"`envconfig:\"PORT\" default:\"8080\"`"+`
+	Debug bool   `+"`env:\"DEBUG,required\"`"+`
+	Skip  string `+"`env:\"-\"`"+`
+}
+func main() {
+	os.Getenv(dbURL)
+	os.LookupEnv("DEBUG")
+	os.Getenv(os.Args[1])
+}`)
+	vars, err := inventoryEnv([]*goPackage{pkg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		name, def string
+		sources   int
+	}
+	var got []result
+	for _, v := range vars {
+		got = append(got, result{v.Name, v.Default, len(v.Sources)})
+	}
+	want := []result{{"DB_URL", "", 1}, {"DEBUG", "", 2}, {"PORT", "8080", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestEnvInventoryOutput(t *testing.T) {
+	tests := []struct {
+		pkg        string
+		wantOutput string
+		wantLabels []string
+	}{
+		{"example.com/app/cmd/app", "godockerize: Environment variables of app:\n  MODE: " + filepath.Join("testdata", "app", "cmd", "app", "main.go") + ":15:6 os.Getenv\n", []string{envLabel + "=MODE"}},
+		// no header without variables
+		{"example.com/app/cmd/health", "", nil},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		b := &builder{
+			tc:           &toolchain{ctx: context.Background(), goBin: "go", dir: filepath.Join("testdata", "app"), out: &out},
+			goOpts:       &goBuildOptions{},
+			envInventory: true,
+		}
+		spec := &imageSpec{packages: []*goPackage{{ImportPath: test.pkg}}}
+		if err := b.addEnvInventory(spec); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.wantOutput {
+			t.Errorf("%s: got output %q, want %q", test.pkg, out.String(), test.wantOutput)
+		}
+		if !reflect.DeepEqual(spec.labels, test.wantLabels) {
+			t.Errorf("%s: got labels %q, want %q", test.pkg, spec.labels, test.wantLabels)
+		}
+	}
+}
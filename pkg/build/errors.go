@@ -0,0 +1,82 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Stages of a build that fail with their own exit status.
+const (
+	stageDirective   = "directive"
+	stageGenerate    = "generate"
+	stageTest        = "test"
+	stageCheck       = "check"
+	stageGoBuild     = "go-build"
+	stageDockerBuild = "docker-build"
+	stagePush        = "push"
+	stageScan        = "scan"
+	stageHook        = "hook"
+	stageInterrupted = "interrupted"
+)
+
+var exitCodes = map[string]int{
+	stageDirective:   2,
+	stageGoBuild:     3,
+	stageDockerBuild: 4,
+	stagePush:        5,
+	stageGenerate:    6,
+	stageTest:        7,
+	stageCheck:       8,
+	stageScan:        9,
+	stageHook:        10,
+	stageInterrupted: 130,
+}
+
+// stageError is an error that occurred in a particular stage of the build.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+func stageErrorf(stage, format string, args ...interface{}) error {
+	return &stageError{stage: stage, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit status for err: the status of its stage or 1.
+func exitCode(err error) int {
+	var se *stageError
+	if errors.As(err, &se) {
+		return exitCodes[se.stage]
+	}
+	return 1
+}
+
+// reportError prints err to stderr, as JSON if asJSON is set, and returns
+// the exit status for it.
+func reportError(err error, asJSON bool) int {
+	code := exitCode(err)
+	if !asJSON {
+		fmt.Fprintf(os.Stderr, "godockerize: %s\n", err)
+		return code
+	}
+
+	report := struct {
+		Error    string `json:"error"`
+		Stage    string `json:"stage,omitempty"`
+		ExitCode int    `json:"exitCode"`
+	}{
+		Error:    err.Error(),
+		ExitCode: code,
+	}
+	var se *stageError
+	if errors.As(err, &se) {
+		report.Stage = se.stage
+	}
+	json.NewEncoder(os.Stderr).Encode(report)
+	return code
+}
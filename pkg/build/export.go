@@ -0,0 +1,247 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dockerArchiveEntry is an element of manifest.json in an archive written by
+// "docker save".
+type dockerArchiveEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// saveImage writes the image to file in the format of "docker save". The
+// name is the tag of the image, or its ID if it has none.
+func saveImage(tc *toolchain, name, file string) error {
+	tc.printf("godockerize: Saving %s...\n", name)
+	if tc.api != nil {
+		return tc.api.save(tc.ctx, name, file)
+	}
+	var cmd []string
+	if tc.engine.pushSave {
+		cmd = []string{"push", name, "docker-archive:" + file}
+	} else {
+		cmd = []string{"save", "-o", file, name}
+	}
+	c := tc.dockerCmd(cmd...)
+	c.Stdout = tc.stdout()
+	c.Stderr = tc.stderr()
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("docker %s: %v", cmd[0], err)
+	}
+	return nil
+}
+
+// importDockerArchive adds the images in the docker archive file to the
+// OCI layout dir, named by their first tag. The archive is unpacked into tmp.
+func importDockerArchive(file, dir, tmp string) error {
+	if err := untar(file, tmp); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	var entries []dockerArchiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: manifest.json: %v", file, err)
+	}
+	layout, err := openOCILayout(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		config, err := addBlobFile(layout, filepath.Join(tmp, filepath.FromSlash(e.Config)), mediaTypeOCIConfig)
+		if err != nil {
+			return err
+		}
+		m := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest, Config: config}
+		for _, l := range e.Layers {
+			layer, err := addBlobFile(layout, filepath.Join(tmp, filepath.FromSlash(l)), "")
+			if err != nil {
+				return err
+			}
+			m.Layers = append(m.Layers, layer)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		desc := ociDescriptor{MediaType: mediaTypeOCIManifest, Digest: sha256Digest(data), Size: int64(len(data))}
+		if err := layout.writeBlob(desc.Digest, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		name := ""
+		if len(e.RepoTags) != 0 {
+			name = e.RepoTags[0]
+		}
+		if err := layout.addManifest(desc, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBlobFile stores the contents of file in layout. An empty mediaType
+// means a layer, which may be compressed or not.
+func addBlobFile(layout *ociLayout, file, mediaType string) (ociDescriptor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if mediaType == "" {
+		mediaType = "application/vnd.oci.image.layer.v1.tar"
+		if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			mediaType = mediaTypeOCILayer
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	h := sha256.New()
+	if err := hashFile(h, file); err != nil {
+		return ociDescriptor{}, err
+	}
+	desc := ociDescriptor{MediaType: mediaType, Digest: hashDigest(h), Size: fi.Size()}
+	if !layout.hasBlob(desc.Digest) {
+		if err := layout.writeBlob(desc.Digest, br); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// writeDockerArchive writes the OCI layout of dir together with a
+// manifest.json for the image with the manifest m to file, which is what
+// newer versions of "docker save" produce and what "docker load" accepts.
+func writeDockerArchive(dir, file string, m *ociManifest, tag string) error {
+	entry := dockerArchiveEntry{RepoTags: []string{}}
+	blobName := func(digest string) string {
+		return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+	}
+	entry.Config = blobName(m.Config.Digest)
+	for _, l := range m.Layers {
+		entry.Layers = append(entry.Layers, blobName(l.Digest))
+	}
+	if tag != "" {
+		entry.RepoTags = append(entry.RepoTags, tag)
+	}
+	manifestJSON, err := json.Marshal([]dockerArchiveEntry{entry})
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(f, dir, manifestJSON)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func writeArchive(w io.Writer, dir string, manifestJSON []byte) error {
+	tw := tar.NewWriter(w)
+	err := walkEntry(contextEntry{name: ".", src: dir}, func(name, src string, fi os.FileInfo) error {
+		if name == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.ModTime = layerTime
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			return copyInto(tw, src)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifestJSON)), ModTime: layerTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// untar extracts the regular files and directories of the tar archive file
+// into dir. Names that would end up outside of dir are rejected.
+func untar(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid name %q", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+				return err
+			}
+			out, err := os.Create(dst)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FIPS modes: the Go Cryptographic Module of Go 1.24 and later, or
+// BoringCrypto for older versions.
+const (
+	fipsGo140        = "fips140"
+	fipsBoringCrypto = "boringcrypto"
+)
+
+// fipsMode returns the FIPS mode supported by the go command, its build
+// environment and additional linker flags.
+func (t *toolchain) fipsMode() (mode string, env []string, ldflags []string, err error) {
+	version, err := t.goVersion()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if minor, ok := goMinorVersion(version); ok && minor >= 24 {
+		return fipsGo140, []string{"GOFIPS140=latest"}, nil, nil
+	}
+	// BoringCrypto requires cgo, so link statically to keep the binary
+	// independent of the C library of the base image.
+	return fipsBoringCrypto, []string{"GOEXPERIMENT=boringcrypto", "CGO_ENABLED=1"}, []string{"-linkmode=external", "-extldflags=-static"}, nil
+}
+
+// goMinorVersion returns 22 for "go1.22.5".
+func goMinorVersion(version string) (int, bool) {
+	fields := strings.Split(strings.TrimPrefix(version, "go"), ".")
+	if len(fields) < 2 || fields[0] != "1" {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(strings.TrimRightFunc(fields[1], func(r rune) bool { return r < '0' || r > '9' }))
+	return minor, err == nil
+}
+
+// verifyFIPS checks the build information of the binaries in dir to make
+// sure that they were built with the FIPS crypto of mode.
+func (t *toolchain) verifyFIPS(packages []*goPackage, dir, mode string) error {
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		out, err := t.goCmd("version", "-m", filepath.Join(dir, name)).Output()
+		if err != nil {
+			return fmt.Errorf("go version -m %s: %v", name, err)
+		}
+		ok := false
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) != 2 || fields[0] != "build" {
+				continue
+			}
+			switch mode {
+			case fipsGo140:
+				ok = ok || strings.HasPrefix(fields[1], "GOFIPS140=") && fields[1] != "GOFIPS140=off"
+			case fipsBoringCrypto:
+				ok = ok || strings.HasPrefix(fields[1], "GOEXPERIMENT=") && strings.Contains(fields[1], "boringcrypto")
+			}
+		}
+		if !ok {
+			return fmt.Errorf("binary %s was not built with %s crypto", name, mode)
+		}
+		t.printf("godockerize: Binary %s uses %s crypto\n", name, mode)
+	}
+	return nil
+}
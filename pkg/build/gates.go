@@ -0,0 +1,69 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// goTest runs "go test" for packages, or for all packages of their modules
+// if wholeModule is set, on the host platform. args are passed through to
+// the go command, e.g. "-race -count=1".
+func (t *toolchain) goTest(opts *goBuildOptions, packages []*goPackage, wholeModule bool, args string) error {
+	var targets []string
+	for _, pkg := range packages {
+		if wholeModule && pkg.Module != nil {
+			targets = append(targets, pkg.Module.Path+"/...")
+			continue
+		}
+		targets = append(targets, pkg.ImportPath)
+	}
+
+	t.printf("godockerize: Running go tests...\n")
+	testArgs := append([]string{"test"}, opts.listFlags()...)
+	testArgs = append(testArgs, strings.Fields(args)...)
+	cmd := t.goCmd(append(testArgs, sortedStringSet(targets)...)...)
+	cmd.Stdout = t.stdout()
+	cmd.Stderr = t.stderr()
+	if err := cmd.Run(); err != nil {
+		return &stageError{stage: stageTest, err: fmt.Errorf("go test: %v", err)}
+	}
+	return nil
+}
+
+// goVet runs "go vet" for packages on the target platform.
+func (t *toolchain) goVet(opts *goBuildOptions, packages []*goPackage) error {
+	t.printf("godockerize: Running go vet...\n")
+	args := append([]string{"vet"}, opts.listFlags()...)
+	for _, pkg := range packages {
+		args = append(args, pkg.ImportPath)
+	}
+	cmd := t.goBuildCmd(opts, args...)
+	cmd.Stdout = t.stdout()
+	cmd.Stderr = t.stderr()
+	if err := cmd.Run(); err != nil {
+		return &stageError{stage: stageCheck, err: fmt.Errorf("go vet: %v", err)}
+	}
+	return nil
+}
+
+// runCheck runs the shell command check with the import paths of packages
+// appended as arguments, e.g. "staticcheck" or "golangci-lint run". It sees
+// the same environment as the go command.
+func (t *toolchain) runCheck(opts *goBuildOptions, packages []*goPackage, check string) error {
+	t.printf("godockerize: Running %s...\n", check)
+	args := []string{"-c", check + ` "$@"`, "sh"}
+	for _, pkg := range packages {
+		args = append(args, pkg.ImportPath)
+	}
+	cmd := t.command("sh", args...)
+	cmd.Dir = t.dir
+	cmd.Env = append(cmd.Env, t.goEnv...)
+	cmd.Env = append(cmd.Env, "GOOS="+opts.goos, "GOARCH="+opts.goarch, "CGO_ENABLED=0")
+	cmd.Env = append(cmd.Env, opts.env...)
+	cmd.Stdout = t.stdout()
+	cmd.Stderr = t.stderr()
+	if err := cmd.Run(); err != nil {
+		return &stageError{stage: stageCheck, err: fmt.Errorf("%s: %v", check, err)}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// archLevelVars are the micro-architecture variables of the go command that
+// are exposed as flags, e.g. --goamd64 for GOAMD64.
+var archLevelVars = []string{"GOARM", "GOARM64", "GOAMD64", "GO386", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64"}
+
+func archLevelFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, v := range archLevelVars {
+		flags = append(flags, &cli.StringFlag{
+			Name:  strings.ToLower(v),
+			Usage: v + " micro-architecture level for the binaries",
+		})
+	}
+	return flags
+}
+
+// archLevelEnv returns the micro-architecture variables set by flags in
+// NAME=value form.
+func archLevelEnv(c *cli.Context) []string {
+	var env []string
+	for _, v := range archLevelVars {
+		if value := c.String(strings.ToLower(v)); value != "" {
+			env = append(env, v+"="+value)
+		}
+	}
+	return env
+}
+
+// goBuildOptions configures how the binaries are compiled.
+type goBuildOptions struct {
+	goos   string
+	goarch string
+	mod    string // -mod: readonly, vendor or mod; empty means the go command's default
+	pgo    string // profile for -pgo; empty means default.pgo of the main package, if any
+	cover  bool
+	env    []string // additional environment, e.g. GOAMD64=v3
+	force  bool     // rebuild everything, bypassing all caches
+	strip  bool     // omit the symbol table and DWARF information
+	tests  bool     // build test binaries with "go test -c"
+
+	stripReport bool // also link unstripped binaries to report what strip saves
+
+	trimpath bool // remove file system paths from the binaries, see --reproducible
+
+	// take GOOS and GOARCH from the platform of a multi-platform build
+	// inside Docker instead of goos and goarch
+	targetPlatform bool
+
+	ldflags []string // additional linker flags
+
+	parallel int         // maximum number of concurrent builds
+	cache    *buildCache // nil disables skipping of unchanged binaries
+}
+
+// buildBinaries builds the binaries of packages into dir, at most
+// opts.parallel at a time. The output of each build is prefixed with the
+// binary's name if there is more than one.
+func (t *toolchain) buildBinaries(packages []*goPackage, dir string, opts *goBuildOptions) ([]builtBinary, error) {
+	parallel := opts.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var goEnv []byte
+	if opts.cache != nil {
+		// the go environment covers the Go version, the target platform and
+		// all other settings that affect the output
+		cmd := t.goBuildCmd(opts, "env")
+		cmd.Stderr = t.stderr()
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, err
+		}
+		goEnv = stableGoEnv(out)
+	}
+
+	var (
+		bins = make([]builtBinary, len(packages))
+		mu   sync.Mutex // serializes writes to the writers of t
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, parallel)
+		errs = make([]error, len(packages))
+	)
+	for i, pkg := range packages {
+		name := pkg.binaryName()
+		prefix := ""
+		if len(packages) > 1 {
+			prefix = "[" + name + "] "
+		}
+		stdout := &prefixWriter{mu: &mu, w: t.stdout(), prefix: prefix}
+		stderr := &prefixWriter{mu: &mu, w: t.stderr(), prefix: prefix}
+
+		wg.Add(1)
+		go func(i int, pkg *goPackage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			out := filepath.Join(dir, name)
+			if opts.cache == nil {
+				fmt.Fprintf(stdout, "godockerize: Building Go binary %s...\n", name)
+				bins[i].unstrippedSize, errs[i] = t.buildBinary(pkg, out, opts, stdout, stderr)
+			} else {
+				bins[i], errs[i] = t.buildCachedBinary(pkg, out, opts, goEnv, stdout, stderr)
+			}
+			stdout.flush()
+			stderr.flush()
+		}(i, pkg)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("building %s: %v", packages[i].ImportPath, err)
+		}
+	}
+	return bins, nil
+}
+
+// builtBinary describes the result of building a binary.
+type builtBinary struct {
+	key            string // cache key, empty if caching is disabled
+	unstrippedSize int64  // size without --strip, 0 if unknown
+}
+
+func (t *toolchain) buildCachedBinary(pkg *goPackage, out string, opts *goBuildOptions, goEnv []byte, stdout, stderr io.Writer) (builtBinary, error) {
+	name := filepath.Base(out)
+	key, err := t.binaryKey(pkg, opts, goEnv)
+	if err != nil {
+		return builtBinary{}, err
+	}
+	if opts.cache.getBinary(key, out) {
+		fmt.Fprintf(stdout, "godockerize: Go binary %s is up to date\n", name)
+		return builtBinary{key: key}, nil
+	}
+
+	fmt.Fprintf(stdout, "godockerize: Building Go binary %s...\n", name)
+	unstrippedSize, err := t.buildBinary(pkg, out, opts, stdout, stderr)
+	if err != nil {
+		return builtBinary{}, err
+	}
+	return builtBinary{key: key, unstrippedSize: unstrippedSize}, opts.cache.putBinary(key, out)
+}
+
+// buildBinary builds pkg to out. With opts.strip and opts.stripReport it
+// also builds an unstripped binary for comparison and returns its size.
+func (t *toolchain) buildBinary(pkg *goPackage, out string, opts *goBuildOptions, stdout, stderr io.Writer) (int64, error) {
+	if err := t.goBuild(pkg, out, opts, stdout, stderr); err != nil {
+		return 0, err
+	}
+	if !opts.strip || !opts.stripReport {
+		return 0, nil
+	}
+
+	// only linking is repeated, everything else comes from the Go build cache
+	unstripped := *opts
+	unstripped.strip = false
+	ref := out + ".unstripped"
+	defer os.Remove(ref)
+	if err := t.goBuild(pkg, ref, &unstripped, stdout, stderr); err != nil {
+		return 0, err
+	}
+	return fileSize(ref)
+}
+
+func (t *toolchain) goBuild(pkg *goPackage, out string, opts *goBuildOptions, stdout, stderr io.Writer) error {
+	args := []string{"build", "-o", out}
+	if opts.tests {
+		args = []string{"test", "-c", "-o", out}
+	}
+	args = append(args, opts.flags(pkg)...)
+	cmd := t.goBuildCmd(opts, append(args, pkg.ImportPath)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// goGenerate runs "go generate" for the packages matched by args, with its
+// output going to the terminal.
+func (t *toolchain) goGenerate(opts *goBuildOptions, args []string) error {
+	t.printf("godockerize: Running go generate...\n")
+	cmd := t.goBuildCmd(opts, append(append([]string{"generate"}, opts.listFlags()...), args...)...)
+	cmd.Stdout = t.stdout()
+	cmd.Stderr = t.stderr()
+	if err := cmd.Run(); err != nil {
+		return &stageError{stage: stageGenerate, err: fmt.Errorf("go generate: %v", err)}
+	}
+	return nil
+}
+
+// goBuildCmd returns a go command with the environment for building the
+// binaries.
+func (t *toolchain) goBuildCmd(opts *goBuildOptions, args ...string) *exec.Cmd {
+	cmd := t.goCmd(args...)
+	cmd.Env = append(cmd.Env,
+		"GOOS="+opts.goos,
+		"GOARCH="+opts.goarch,
+		"CGO_ENABLED=0",
+	)
+	cmd.Env = append(cmd.Env, opts.env...)
+	return cmd
+}
+
+// listFlags returns the flags that affect which packages and files are
+// selected.
+func (opts *goBuildOptions) listFlags() []string {
+	flags := []string{"-tags", "dist"}
+	if opts.mod != "" {
+		flags = append(flags, "-mod", opts.mod)
+	}
+	return flags
+}
+
+// flags returns the build flags for pkg.
+func (opts *goBuildOptions) flags(pkg *goPackage) []string {
+	flags := append([]string{"-buildmode", "exe"}, opts.listFlags()...)
+	if opts.force {
+		flags = append(flags, "-a")
+	}
+	if pgo := opts.pgoProfile(pkg); pgo != "" {
+		flags = append(flags, "-pgo", pgo)
+	}
+	if opts.cover {
+		flags = append(flags, "-cover")
+	}
+	if opts.trimpath {
+		flags = append(flags, "-trimpath")
+	}
+	var ldflags []string
+	if opts.strip {
+		ldflags = append(ldflags, "-s", "-w")
+	}
+	ldflags = append(ldflags, opts.ldflags...)
+	if len(ldflags) != 0 {
+		flags = append(flags, "-ldflags", strings.Join(ldflags, " "))
+	}
+	return flags
+}
+
+// pgoProfile returns the absolute path of the profile to use for pkg, or ""
+// if there is none. Go only picks up default.pgo by itself since 1.21, so it
+// is passed explicitly.
+func (opts *goBuildOptions) pgoProfile(pkg *goPackage) string {
+	if opts.pgo != "" {
+		if abs, err := filepath.Abs(opts.pgo); err == nil {
+			return abs
+		}
+		return opts.pgo
+	}
+	if profile := filepath.Join(pkg.Dir, "default.pgo"); fileExists(profile) {
+		return profile
+	}
+	return ""
+}
+
+// prefixWriter writes each line with a prefix to w. Only complete lines are
+// written, so the output of concurrent builds does not get mixed up.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+}
+
+// flush writes a trailing incomplete line, if any.
+func (pw *prefixWriter) flush() {
+	if len(pw.buf) != 0 {
+		pw.writeLine(append(pw.buf, '\n'))
+		pw.buf = nil
+	}
+}
+
+func (pw *prefixWriter) writeLine(line []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if _, err := io.WriteString(pw.w, pw.prefix); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(line)
+	return err
+}
+
+func fileExists(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && !fi.IsDir()
+}
@@ -0,0 +1,45 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestBuildBinaryStripReport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds binaries")
+	}
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tc := &toolchain{ctx: context.Background(), goBin: "go", dir: filepath.Join("testdata", "app")}
+	pkg := &goPackage{ImportPath: "example.com/app/cmd/app", Name: "main"}
+
+	for _, report := range []bool{false, true} {
+		out := filepath.Join(dir, "app")
+		opts := &goBuildOptions{goos: runtime.GOOS, goarch: runtime.GOARCH, strip: true, stripReport: report}
+		unstripped, err := tc.buildBinary(pkg, out, opts, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := fileSize(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case !report && unstripped != 0:
+			t.Errorf("without --strip-report: got unstripped size %d, want none", unstripped)
+		case report && unstripped <= size:
+			t.Errorf("with --strip-report: got unstripped size %d for a binary of %d", unstripped, size)
+		}
+		if fileExists(out + ".unstripped") {
+			t.Errorf("the unstripped binary was left behind")
+		}
+	}
+}
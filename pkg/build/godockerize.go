@@ -0,0 +1,974 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const baseDockerImage = "alpine:3.12"
+
+// labelPrefix namespaces the image labels set by godockerize.
+const labelPrefix = "io.github.neelance.godockerize."
+
+// coverDir is where binaries built with --cover write their coverage data.
+const coverDir = "/var/lib/godockerize/cover"
+
+// Main runs the godockerize command with the arguments of the process and
+// exits with the code of the stage that failed, if any.
+func Main() {
+	app := newApp()
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnSignal(cancel)
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if ctx.Err() != nil {
+			err = &stageError{stage: stageInterrupted, err: errors.New("interrupted")}
+		}
+		os.Exit(reportError(err, jsonErrors))
+	}
+}
+
+// newApp returns the command line interface of godockerize.
+func newApp() *cli.App {
+	app := &cli.App{
+		Name:    "godockerize",
+		Usage:   "build Docker images from Go packages",
+		Version: currentVersion().Version,
+		// commands that take packages complete them, see completePackages
+		EnableBashCompletion: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json-errors",
+				Usage: "print errors as JSON to stderr",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			jsonErrors = c.Bool("json-errors")
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:        "build",
+				Usage:       "build a Docker image from Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Build compiles and installs the packages by the import paths to /usr/local/bin\n   in the docker image. The first package is used as the entrypoint. Patterns like\n   ./cmd/... select all main packages they match. Packages given as path@version are\n   fetched like by \"go install path@version\".",
+				Flags: append(buildFlags(),
+					&cli.BoolFlag{
+						Name:  "interactive",
+						Usage: "ask for the tag, base image and user if nothing sets them, with suggestions derived from the packages, and save the answers to " + configFile,
+					},
+				),
+				Action: doBuild,
+			},
+			{
+				Name:        "bake",
+				Usage:       "write a buildx bake file for building the images of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Bake writes a docker-bake.hcl with one target per package and a default group\n   of all of them. Each target compiles its package inside Docker like\n   --build-in-docker, so \"docker buildx bake\" builds the images with the\n   directives and flags that godockerize build would use.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "bake file to write, - for the standard output",
+						Value:   "docker-bake.hcl",
+					},
+					&cli.StringSliceFlag{
+						Name:  "platform",
+						Usage: "platforms of the targets, e.g. linux/amd64,linux/arm64 (default: that of --goos and --goarch if set)",
+					},
+				),
+				Action: doBake,
+			},
+			{
+				Name:        "dockerfile",
+				Usage:       "generate the Dockerfile for the image of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Dockerfile writes the Dockerfile that godockerize build --build-in-docker would\n   use, without any other output, e.g. for committing it or for other builders.\n   It compiles the packages in its build stage, so the module is its context.",
+				Flags: append(append(buildFlags(), dockerfileFlags()...),
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "Dockerfile to write, - for the standard output",
+						Value:   "-",
+					},
+				),
+				Action: doDockerfile,
+			},
+			{
+				Name:        "init",
+				Usage:       "add starter //docker: directives to Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Init looks for listen addresses, environment variables, file paths and flags in\n   the packages and adds a commented block of //docker: directives for them to\n   the file with the main function. It also writes a starter .godockerize.yaml to\n   the root of the module, unless there already is one.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the directives",
+					},
+					&cli.StringFlag{
+						Name:  "go-bin",
+						Usage: "go command used to list the packages",
+						Value: "go",
+					},
+				},
+				Action: doInit,
+			},
+			{
+				Name:        "migrate",
+				Usage:       "translate a Dockerfile to //docker: directives of a Go package",
+				ArgsUsage:   "Dockerfile package",
+				Description: "Migrate reads a handwritten Dockerfile and adds its EXPOSE, ENV, RUN, USER,\n   VOLUME and HEALTHCHECK instructions as //docker: directives to the file of the\n   package with the main function. Package installations of RUN become\n   //docker:install. Only the last stage is translated, the others usually build the\n   binary. Instructions that can't be translated are reported.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the directives",
+					},
+					&cli.StringFlag{
+						Name:  "go-bin",
+						Usage: "go binary to use",
+						Value: "go",
+					},
+				},
+				Action: doMigrate,
+			},
+			{
+				Name:        "lint",
+				Usage:       "check the //docker: directives of Go packages without building",
+				ArgsUsage:   "[packages]",
+				Description: "Lint checks the syntax of all directives of the packages, that ports, users and\n   environment variables are valid, that packages to install exist in the Alpine\n   release of the base image and that the directives don't conflict. It prints\n   the problems and fails if there are any.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "format of the report, text or json",
+						Value: "text",
+					},
+					&cli.StringFlag{
+						Name:  "base",
+						Usage: "base Docker image that the directives are checked against",
+						Value: baseDockerImage,
+					},
+					&cli.BoolFlag{
+						Name:  "no-index",
+						Usage: "don't download the Alpine package index to check //docker:install",
+					},
+					&cli.StringFlag{
+						Name:  "goos",
+						Usage: "target operating system that selects the files of the packages",
+						Value: "linux",
+					},
+					&cli.StringFlag{
+						Name:  "goarch",
+						Usage: "target architecture that selects the files and the package index",
+						Value: runtime.GOARCH,
+					},
+					&cli.StringFlag{
+						Name:  "go-bin",
+						Usage: "go command used to list the packages",
+						Value: "go",
+					},
+				},
+				Action: doLint,
+			},
+			{
+				Name:        "inspect",
+				Usage:       "show the directives of Go packages and the resulting image configuration",
+				ArgsUsage:   "[packages]",
+				Description: "Inspect lists every //docker: directive of the packages with the file and line\n   it comes from, followed by the configuration of the image that godockerize\n   build would produce with the same flags, which override the directives.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "format of the report, table or json",
+						Value: "table",
+					},
+				),
+				Action: doInspect,
+			},
+			{
+				Name:        "check",
+				Usage:       "check that a committed Dockerfile matches the directives of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Check generates the Dockerfile like godockerize dockerfile with the same flags\n   and compares it to --dockerfile. If they differ, it prints a diff and fails,\n   e.g. in CI when directives were changed without regenerating the Dockerfile.",
+				Flags: append(append(buildFlags(), dockerfileFlags()...),
+					&cli.StringFlag{
+						Name:  "dockerfile",
+						Usage: "committed Dockerfile to compare",
+						Value: "Dockerfile",
+					},
+				),
+				Action: doCheck,
+			},
+			{
+				Name:        "diff",
+				Usage:       "compare an existing image with a build of Go packages",
+				ArgsUsage:   "image [packages]",
+				Description: "Diff compares the image, from the local image store or its registry, with what\n   godockerize build would produce now with the same flags: whether the base image\n   has been updated, the environment, ports, volumes, labels, user and entrypoint,\n   the compiled binaries and the versions of the installed Alpine packages.",
+				Flags: append(buildFlags(),
+					&cli.BoolFlag{
+						Name:  "no-index",
+						Usage: "don't download the Alpine package index to compare package versions",
+					},
+					&cli.BoolFlag{
+						Name:  "exit-code",
+						Usage: "fail if there are differences",
+					},
+				),
+				Action: doDiff,
+			},
+			{
+				Name:        "verify",
+				Usage:       "check that an image in a registry is a reproducible build of Go packages",
+				ArgsUsage:   "image [packages]",
+				Description: "Verify rebuilds the image like godockerize build --reproducible, from the same\n   base image digest as recorded in the labels of the image, and compares the\n   result with the image layer by layer. It fails unless the rebuild has the same\n   digest, so the image can be trusted to contain nothing but the source.",
+				Flags:       buildFlags(),
+				Action:      doVerify,
+			},
+			{
+				Name:        "run",
+				Usage:       "build the image of Go packages and run it",
+				ArgsUsage:   "[packages] [-- args]",
+				Description: "Run builds the image like godockerize build and runs it in the foreground with\n   its exposed ports published on the same ports of the host and its volumes\n   mounted from new temporary directories. Arguments after -- are passed to the\n   entrypoint. The container is removed when it exits.",
+				Flags:       append(buildFlags(), runFlags()...),
+				Action:      doRun,
+			},
+			{
+				Name:        "watch",
+				Usage:       "rebuild and restart the image of Go packages when their sources change",
+				ArgsUsage:   "[packages] [-- args]",
+				Description: "Watch builds and runs the image like godockerize run, in the background, and\n   follows its output. When a source file of the packages or of their dependencies\n   outside of the standard library changes, the changed binaries are rebuilt and\n   the container is replaced with one of the new image, or with --hot-copy the\n   binaries are copied into the running container, which is restarted.",
+				Flags: append(append(buildFlags(), runFlags()...),
+					&cli.BoolFlag{
+						Name:  "hot-copy",
+						Usage: "copy changed binaries into the running container and restart it instead of building a new image",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "how often the source files are checked for changes",
+						Value: 500 * time.Millisecond,
+					},
+				),
+				Action: doWatch,
+			},
+			{
+				Name:        "compose",
+				Usage:       "generate a docker-compose.yaml with one service per Go package",
+				ArgsUsage:   "[packages]",
+				Description: "Compose writes a docker-compose.yaml with a service for each package, named\n   after its binary, that runs the image godockerize build --separate-images tags\n   with the same --tag template. The exposed ports are published on the same ports\n   of the host, the environment of the image can be overridden from the\n   environment of docker compose, volumes are named volumes and //docker:depends\n   SERVICE... makes a service depend on others.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "compose file to write, - for the standard output",
+						Value:   "docker-compose.yaml",
+					},
+				),
+				Action: doCompose,
+			},
+			{
+				Name:        "kubernetes",
+				Aliases:     []string{"k8s"},
+				Usage:       "generate Kubernetes manifests for the images of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Kubernetes writes a Deployment for each package, named after its binary, that\n   runs the image godockerize build --separate-images tags with the same --tag\n   template, and a Service for its exposed ports. The environment, the user of the\n   image and //docker:healthcheck, as liveness and readiness probe, are taken over.\n   With --hpa-max-replicas, a HorizontalPodAutoscaler scales the Deployment.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "file to write the manifests to, - for the standard output",
+						Value:   "-",
+					},
+					&cli.StringFlag{
+						Name:  "namespace",
+						Usage: "namespace of the resources (default: the one kubectl uses)",
+					},
+					&cli.IntFlag{
+						Name:  "replicas",
+						Usage: "number of pods, the minimum with --hpa-max-replicas",
+						Value: 1,
+					},
+					&cli.StringFlag{
+						Name:  "cpu-request",
+						Usage: "CPU requested for each container, e.g. 100m",
+					},
+					&cli.StringFlag{
+						Name:  "memory-request",
+						Usage: "memory requested for each container, e.g. 64Mi",
+					},
+					&cli.IntFlag{
+						Name:  "hpa-max-replicas",
+						Usage: "add a HorizontalPodAutoscaler that scales up to this number of pods (requires --cpu-request)",
+					},
+					&cli.IntFlag{
+						Name:  "hpa-cpu-percent",
+						Usage: "average CPU utilization, relative to --cpu-request, that the HorizontalPodAutoscaler aims for",
+						Value: 80,
+					},
+				),
+				Action: doKubernetes,
+			},
+			{
+				Name:        "helm",
+				Usage:       "generate Helm charts for the images of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Helm writes a minimal chart for each package, named after its binary, with a\n   Deployment of the image godockerize build --separate-images tags with the same\n   --tag template and a Service for its exposed ports. The values for the image,\n   replicas, environment, ports, health check and user are seeded from the\n   directives. Existing charts are left alone unless --force is given.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory to write the charts to",
+						Value: "charts",
+					},
+					&cli.StringFlag{
+						Name:  "chart-version",
+						Usage: "version of the charts",
+						Value: "0.1.0",
+					},
+					&cli.IntFlag{
+						Name:  "replicas",
+						Usage: "default number of pods",
+						Value: 1,
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "overwrite existing charts",
+					},
+				),
+				Action: doHelm,
+			},
+			{
+				Name:        "nomad",
+				Usage:       "generate a Nomad job for the images of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Nomad writes a job with a group for each package, named after its binary, whose\n   task runs the image godockerize build --separate-images tags with the same --tag\n   template with the docker driver. The exposed ports and the environment of the\n   image are taken over.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "file to write the job to, - for the standard output",
+						Value:   "-",
+					},
+					&cli.StringFlag{
+						Name:  "job",
+						Usage: "name of the job (default: the name of the first binary)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "datacenter",
+						Usage: "datacenter to run the job in; repeat it for more",
+						Value: cli.NewStringSlice("dc1"),
+					},
+					&cli.IntFlag{
+						Name:  "count",
+						Usage: "number of instances of each group",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "cpu",
+						Usage: "CPU of each task in MHz",
+						Value: 100,
+					},
+					&cli.IntFlag{
+						Name:  "memory",
+						Usage: "memory of each task in MB",
+						Value: 128,
+					},
+				),
+				Action: doNomad,
+			},
+			{
+				Name:        "quadlet",
+				Usage:       "generate podman quadlet units for the images of Go packages",
+				ArgsUsage:   "[packages]",
+				Description: "Quadlet writes a NAME.container unit for each package, named after its binary,\n   that runs the image godockerize build --separate-images tags with the same --tag\n   template as a systemd service with podman. The exposed ports are published on\n   the same ports of the host and the environment, volumes and user of the image\n   are taken over. Copy the units to /etc/containers/systemd/ or\n   ~/.config/containers/systemd/ and run systemctl daemon-reload.",
+				Flags: append(buildFlags(),
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory to write the units to",
+						Value: ".",
+					},
+					&cli.StringFlag{
+						Name:  "restart",
+						Usage: "Restart= setting of the services",
+						Value: "always",
+					},
+				),
+				Action: doQuadlet,
+			},
+			{
+				Name:        "push",
+				Usage:       "push previously built images",
+				ArgsUsage:   "[tags]",
+				Description: "Push pushes images that godockerize build created without --push. With\n   --metadata-file, the images recorded in the file are pushed to all of their\n   tags, or to the given ones, and the file is updated with the digest. The\n   digest of each pushed tag is printed and written to --digest-file.",
+				Flags: append(selectFlags("registry-username", "registry-password", "registry-password-stdin", "insecure-registry", "registry-ca", "push-timeout", "engine", "docker-bin", "docker-host", "docker-context", "containerd-namespace"),
+					&cli.StringFlag{
+						Name:  "metadata-file",
+						Usage: "push the images recorded in the file written by godockerize build --metadata-file",
+					},
+					&cli.IntFlag{
+						Name:  "retries",
+						Usage: "how often a failed push is retried, waiting twice as long each time",
+						Value: 3,
+					},
+					&cli.StringFlag{
+						Name:  "digest-file",
+						Usage: "write the pushed images as REPOSITORY@DIGEST, one per line, to the file",
+					},
+				),
+				Action: doPush,
+			},
+			{
+				Name:        "clean",
+				Usage:       "remove the caches of godockerize",
+				Description: "Clean removes the binaries and image IDs that godockerize caches in --cache-dir,\n   including GOCACHE if it is there. With --toolchains, it also removes the Go\n   toolchains in the module cache, which the go command downloads for\n   --go-version but also for other projects. With --images, it also removes the\n   dangling images that godockerize built, i.e. those whose tags have moved on to\n   newer builds.",
+				Flags: append(selectFlags("cache-dir", "go-bin", "engine", "docker-bin", "docker-host", "docker-context", "containerd-namespace"),
+					&cli.BoolFlag{
+						Name:  "images",
+						Usage: "also remove the dangling images built by godockerize",
+					},
+					&cli.BoolFlag{
+						Name:  "toolchains",
+						Usage: "also remove the Go toolchains that GOTOOLCHAIN downloaded into the module cache, including those of other projects",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print what would be removed",
+					},
+				),
+				Action: doClean,
+			},
+			{
+				Name:        "directives",
+				Usage:       "list the supported //docker: directives",
+				Description: "Directives lists the //docker: comments that godockerize understands with the\n   grammar of their arguments and examples. With --json, the list is printed as a\n   versioned schema for editors and linters.\n\n   Other directives, e.g. //docker:fetch, are passed to a handler: the command\n   given for them in the directives section of .godockerize.yaml or else\n   godockerize-directive-fetch on PATH. It gets the arguments of the directive on\n   its command line and a JSON description on stdin, and may print a JSON object\n   with \"dockerfile\" instructions for the final stage and \"env\", \"expose\",\n   \"install\", \"volumes\" and \"labels\" lists.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the directives as JSON",
+					},
+				},
+				Action: doDirectives,
+			},
+			{
+				Name:        "version",
+				Usage:       "print the version of godockerize",
+				Description: "Version prints the version of godockerize, the commit and date it was built\n   from, the Go version it was built with and the version of the directive\n   schema of godockerize directives. Please include it in bug reports.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the version as JSON",
+					},
+				},
+				Action: doVersion,
+			},
+			{
+				Name:        "completion",
+				Usage:       "generate a shell completion script",
+				ArgsUsage:   "bash|zsh|fish",
+				Description: "Completion prints a script that completes the commands and flags of godockerize\n   and the main packages of the module in the current directory, e.g.\n\n   source <(godockerize completion bash)\n   godockerize completion zsh > \"${fpath[1]}/_godockerize\"\n   godockerize completion fish > ~/.config/fish/completions/godockerize.fish",
+				Action:      doCompletion,
+			},
+		},
+	}
+	addEnvVars(app.Flags)
+	for _, cmd := range app.Commands {
+		addEnvVars(cmd.Flags)
+		if strings.Contains(cmd.ArgsUsage, "[packages]") {
+			cmd.BashComplete = completePackages(cmd)
+		}
+		if usesProjectConfig(cmd) {
+			cmd.Before = applyProjectConfig
+		}
+	}
+	return app
+}
+
+// buildFlags are the flags of the build command, which the commands that
+// describe builds share.
+func buildFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "tag",
+			Aliases: []string{"t"},
+			Usage:   "output Docker image name and optionally a tag in the 'name:tag' format, a template with {{.Name}} and {{.ImportPath}} of the entrypoint package; repeat it for more names, e.g. in other registries",
+		},
+		&cli.StringFlag{
+			Name:  "profile",
+			Usage: "profile of " + configFile + " whose keys replace the top-level ones, e.g. prod",
+		},
+		&cli.StringFlag{
+			Name:  "base",
+			Usage: "base Docker image name, or auto to pick scratch, alpine or debian-slim by what the image needs",
+			Value: baseDockerImage,
+		},
+		&cli.StringSliceFlag{
+			Name:  "allowed-base",
+			Usage: "pattern of base images that may be used, e.g. gcr.io/distroless/*; all others are rejected",
+		},
+		&cli.StringSliceFlag{
+			Name:  "denied-base",
+			Usage: "pattern of base images that must not be used",
+		},
+		&cli.BoolFlag{
+			Name:  "pin-base",
+			Usage: "resolve the base image to its current digest and use that in the Dockerfile",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "user[:group] that runs the entrypoint and owns the binaries, overrides //docker:user",
+		},
+		&cli.BoolFlag{
+			Name:  "legacy-add",
+			Usage: "add the binaries with plain ADD instructions as older versions did (no --chown and --chmod, which need BuildKit)",
+		},
+		&cli.StringFlag{
+			Name:  "layering",
+			Usage: "how the binaries are split into image layers: single, per-binary or grouped (one layer per module); the layers are in the order of the packages, so list those that change least often first",
+			Value: "per-binary",
+		},
+		&cli.StringFlag{
+			Name:  "template",
+			Usage: "Go text/template file that renders the image stage of the Dockerfile from the resolved directives and flags: .Base, .Install, .InstallCommands, .AddUserCommands, .Env, .Expose, .Volumes, .Labels, .Run, .Fragments, .Includes (by point), .User, .Copies, .Healthcheck, .Entrypoint, .BinDir, .BinaryCopy, .Binaries (.Name, .ImportPath, .Source, .Path) and .Dockerfile, the generated one; with the functions join and execForm",
+		},
+		&cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "point=file inserts the Dockerfile instructions of file into the image stage at point: after-from (before packages are installed), before-user or after-binaries; like //docker:include",
+		},
+		&cli.BoolFlag{
+			Name:  "no-default-packages",
+			Usage: "don't install CA certificates, MIME types and tini; the entrypoint is started directly",
+		},
+		&cli.StringSliceFlag{
+			Name:  "default-packages",
+			Usage: "packages to install instead of the base image's defaults (e.g. ca-certificates,mailcap,tini on Alpine)",
+		},
+		&cli.BoolFlag{
+			Name:  "detect-packages",
+			Usage: "only install CA certificates and MIME types if the binaries use crypto/x509 and mime",
+		},
+		&cli.BoolFlag{
+			Name:  "infer-ports",
+			Usage: "expose the ports of constant listen addresses of net.Listen, http.ListenAndServe and http.Server in the packages and their dependencies in the same modules",
+		},
+		&cli.BoolFlag{
+			Name:  "infer-healthcheck",
+			Usage: "check the health with the http:// URL of a /healthz or /health handler of the packages if they have no //docker:healthcheck",
+		},
+		&cli.BoolFlag{
+			Name:  "detect-writes",
+			Usage: "print the directories that the packages write to with constant paths and suggest directives that make them writable for the user of the image",
+		},
+		&cli.BoolFlag{
+			Name:  "detect-binaries",
+			Usage: "print the programs that the packages and their dependencies run with exec.Command and suggest the Alpine packages that provide them",
+		},
+		&cli.BoolFlag{
+			Name:  "env-inventory",
+			Usage: "print the environment variables that os.Getenv, os.LookupEnv and envconfig or env struct tags of the binaries read and list them in the label " + envLabel,
+		},
+		&cli.StringFlag{
+			Name:  "env-report",
+			Usage: "write the environment variables that the binaries read, with their defaults and sources, to `FILE` as JSON",
+		},
+		&cli.BoolFlag{
+			Name:  "check-env",
+			Usage: "fail if a variable of //docker:env is not read by the binaries or the Go runtime",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "additional environment variables for the Dockerfile",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print generated Dockerfile",
+		},
+		&cli.BoolFlag{
+			Name:  "separate-images",
+			Usage: "build one image per package instead of one image containing all binaries",
+		},
+		&cli.BoolFlag{
+			Name:  "push",
+			Usage: "push the image after building (requires --tag)",
+		},
+		&cli.BoolFlag{
+			Name:  "parallel-push",
+			Usage: "push to all tags at the same time instead of one after the other",
+		},
+		&cli.StringFlag{
+			Name:  "registry-username",
+			Usage: "username for the registry that images are pushed to (default: the credentials of docker login and credential helpers)",
+		},
+		&cli.StringFlag{
+			Name:  "registry-password",
+			Usage: "password or token for --registry-username",
+		},
+		&cli.BoolFlag{
+			Name:  "registry-password-stdin",
+			Usage: "read the password for --registry-username from the standard input",
+		},
+		&cli.StringSliceFlag{
+			Name:  "insecure-registry",
+			Usage: "registry host[:port] to push to without verifying its certificate, or with plain http if it has none (podman, buildah, nerdctl, buildkit and --daemonless)",
+		},
+		&cli.StringFlag{
+			Name:  "registry-ca",
+			Usage: "PEM file with the certificate authority of a registry with a self-signed certificate (podman, buildah and --daemonless)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cache-from",
+			Usage: "import the build cache from type=registry,ref=IMAGE (or just IMAGE) or type=local,src=DIR",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cache-to",
+			Usage: "export the build cache to type=registry,ref=IMAGE[,mode=max] (or just IMAGE) or type=local,dest=DIR[,mode=max]",
+		},
+		&cli.StringFlag{
+			Name:  "provenance",
+			Usage: "attach a provenance attestation with mode min or max (buildkit engine only)",
+		},
+		&cli.BoolFlag{
+			Name:  "force-rm",
+			Usage: "always remove intermediate containers, also if the build fails or is interrupted",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the whole build, e.g. 30m",
+		},
+		&cli.DurationFlag{
+			Name:  "go-build-timeout",
+			Usage: "maximum duration of building the Go binaries",
+		},
+		&cli.DurationFlag{
+			Name:  "docker-build-timeout",
+			Usage: "maximum duration of building the Docker image",
+		},
+		&cli.DurationFlag{
+			Name:  "push-timeout",
+			Usage: "maximum duration of pushing the image",
+		},
+		&cli.StringFlag{
+			Name:  "iidfile",
+			Usage: "write the image ID to the file",
+		},
+		&cli.StringFlag{
+			Name:  "metadata-file",
+			Usage: "write build result metadata as JSON to the file",
+		},
+		&cli.StringFlag{
+			Name:  "sbom",
+			Usage: "write a software bill of materials of the Go modules and OS packages in the image, spdx or cyclonedx",
+		},
+		&cli.StringFlag{
+			Name:  "sbom-dir",
+			Value: ".",
+			Usage: "directory for the --sbom files, which are named after the entrypoint binary",
+		},
+		&cli.BoolFlag{
+			Name:  "attach-sbom",
+			Usage: "push the --sbom as an artifact that refers to the image",
+		},
+		&cli.BoolFlag{
+			Name:  "sign",
+			Usage: "sign the pushed image with cosign, keyless unless --sign-key is given",
+		},
+		&cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "cosign key file or KMS URI for --sign; COSIGN_PASSWORD is passed on",
+		},
+		&cli.BoolFlag{
+			Name:  "no-sign-upload",
+			Usage: "write the signature of --sign to REPO.sig in the current directory instead of pushing it",
+		},
+		&cli.BoolFlag{
+			Name:  "no-vcs-labels",
+			Usage: "don't add the org.opencontainers.image labels for the source, revision, time and version from git",
+		},
+		&cli.BoolFlag{
+			Name:  "licenses",
+			Usage: "find the licenses of the Go module dependencies and add them as a label",
+		},
+		&cli.StringFlag{
+			Name:  "license-report",
+			Usage: "write the licenses of the Go module dependencies as JSON to the file, implies --licenses",
+		},
+		&cli.StringSliceFlag{
+			Name:  "deny-license",
+			Usage: "fail if a Go module dependency has the license, an SPDX identifier like AGPL-3.0 or a pattern like GPL-*; implies --licenses",
+		},
+		&cli.BoolFlag{
+			Name:  "scan",
+			Usage: "scan the image for vulnerabilities before it is pushed and fail if any reach --severity-threshold",
+		},
+		&cli.StringFlag{
+			Name:  "scanner",
+			Value: "trivy",
+			Usage: "scanner for --scan, trivy or grype",
+		},
+		&cli.StringFlag{
+			Name:  "severity-threshold",
+			Value: "HIGH",
+			Usage: "lowest severity that fails --scan: LOW, MEDIUM, HIGH or CRITICAL",
+		},
+		&cli.StringFlag{
+			Name:  "scan-dir",
+			Value: ".",
+			Usage: "directory for the reports of --scan, which are named after the entrypoint binary",
+		},
+		&cli.StringFlag{
+			Name:  "go-bin",
+			Usage: "go command used to build the binaries",
+			Value: "go",
+		},
+		&cli.StringFlag{
+			Name:  "go-version",
+			Usage: "required go version, e.g. 1.22.x or 1.22.5 (exact versions are downloaded if needed)",
+		},
+		&cli.BoolFlag{
+			Name:  "generate",
+			Usage: "run go generate for the packages before compiling them",
+		},
+		&cli.BoolFlag{
+			Name:  "vet",
+			Usage: "run go vet for the packages and only build the image if it reports nothing",
+		},
+		&cli.StringSliceFlag{
+			Name:  "check",
+			Usage: "shell command that has to succeed before building, called with the packages' import paths as arguments, e.g. staticcheck",
+		},
+		&cli.BoolFlag{
+			Name:  "test",
+			Usage: "run go test for the packages and only build the image if the tests pass",
+		},
+		&cli.BoolFlag{
+			Name:  "test-module",
+			Usage: "like --test, but for all packages of the packages' modules",
+		},
+		&cli.StringFlag{
+			Name:  "test-args",
+			Usage: "additional arguments for go test, e.g. \"-race -count=1\"",
+		},
+		&cli.BoolFlag{
+			Name:  "test-binaries",
+			Usage: "build an image with the test binaries (go test -c) of the packages instead of commands, its entrypoint runs all of them",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "write the result elsewhere instead of the local image store: binaries:DIR copies the compiled binaries to DIR, oci:DIR adds the image to the OCI layout DIR and docker-archive:FILE writes it in the format of docker save, in addition to the local image store",
+		},
+		&cli.StringSliceFlag{
+			Name:  "prebuilt",
+			Usage: "use an existing binary instead of compiling it, as name=path; directives are still taken from the package's source",
+		},
+		&cli.BoolFlag{
+			Name:  "stream-context",
+			Usage: "send the build context to Docker as a stream instead of assembling it in a temporary directory",
+		},
+		&cli.BoolFlag{
+			Name:  "build-in-docker",
+			Usage: "compile in a build stage of the Dockerfile instead of with the local go toolchain; packages must be directories of one module",
+		},
+		&cli.StringSliceFlag{
+			Name:  "go-versions",
+			Usage: "build with each of the comma-separated Go versions inside Docker (implies --build-in-docker); tags get a -go<version> suffix unless the template uses {{.GoVersion}}",
+		},
+		&cli.StringFlag{
+			Name:  "builder-image",
+			Usage: "image of the build stage with --build-in-docker (default golang:<version> from --go-version or go.mod)",
+		},
+		&cli.StringFlag{
+			Name:  "goprivate",
+			Usage: "GOPRIVATE patterns of modules that are fetched directly and not checked against the checksum database",
+		},
+		&cli.StringFlag{
+			Name:  "gonosumdb",
+			Usage: "GONOSUMDB patterns of modules that are not checked against the checksum database",
+		},
+		&cli.StringFlag{
+			Name:  "goflags",
+			Usage: "GOFLAGS for the go command",
+		},
+		&cli.StringFlag{
+			Name:  "netrc",
+			Usage: "netrc file with credentials for fetching private modules",
+		},
+		&cli.StringFlag{
+			Name:  "goproxy",
+			Usage: "GOPROXY for fetching modules, e.g. an internal Athens proxy",
+		},
+		&cli.StringFlag{
+			Name:  "gomodcache",
+			Usage: "persistent module cache directory shared between builds",
+		},
+		&cli.StringFlag{
+			Name:  "goos",
+			Usage: "target operating system of the binaries and the image",
+			Value: "linux",
+		},
+		&cli.StringFlag{
+			Name:  "goarch",
+			Usage: "target architecture of the binaries and the image (default: the host's architecture)",
+			Value: runtime.GOARCH,
+		},
+		&cli.StringFlag{
+			Name:  "gowork",
+			Usage: "go.work file of the workspace the packages are resolved in, or \"off\" (default: found by the go command)",
+		},
+		&cli.StringFlag{
+			Name:  "mod",
+			Usage: "module download mode: readonly, vendor (build from the vendor directory without network access) or mod",
+		},
+		&cli.StringFlag{
+			Name:  "pgo",
+			Usage: "profile for profile-guided optimization (default: default.pgo in the main package, if present)",
+		},
+		&cli.BoolFlag{
+			Name:  "cover",
+			Usage: "build coverage-instrumented binaries that write to a volume declared in the image",
+		},
+		&cli.BoolFlag{
+			Name:  "force-rebuild",
+			Usage: "rebuild all binaries and the image even if nothing changed (also picks up updates of the base image)",
+		},
+		&cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "directory for cached binaries and images, also used as GOCACHE (default: godockerize in the user cache directory; GOCACHE is taken from the environment)",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "maximum number of binaries to build concurrently",
+			Value: runtime.NumCPU(),
+		},
+		&cli.BoolFlag{
+			Name:  "strip",
+			Usage: "omit the symbol table and debug information from the binaries (-ldflags=\"-s -w\")",
+		},
+		&cli.BoolFlag{
+			Name:  "strip-report",
+			Usage: "also link every binary without --strip to report the size it saves, which doubles the link time",
+		},
+		&cli.StringFlag{
+			Name:  "max-binary-size",
+			Usage: "fail if a binary is larger than this, e.g. 20MB",
+		},
+		&cli.StringFlag{
+			Name:  "max-image-size",
+			Usage: "fail if the image is larger than this, e.g. 80MB",
+		},
+		&cli.BoolFlag{
+			Name:  "fips",
+			Usage: "build with FIPS 140 validated crypto (GOFIPS140, or GOEXPERIMENT=boringcrypto before Go 1.24)",
+		},
+		&cli.StringFlag{
+			Name:  "compress",
+			Usage: "compress the binaries with upx[:level], level is 1-9, best, brute or ultra-brute (packages can opt out with //docker:nocompress)",
+		},
+		&cli.StringFlag{
+			Name:    "http-proxy",
+			Usage:   "proxy for HTTP requests of go and docker build",
+			EnvVars: []string{"HTTP_PROXY", "http_proxy"},
+		},
+		&cli.StringFlag{
+			Name:    "https-proxy",
+			Usage:   "proxy for HTTPS requests of go and docker build",
+			EnvVars: []string{"HTTPS_PROXY", "https_proxy"},
+		},
+		&cli.StringFlag{
+			Name:    "no-proxy",
+			Usage:   "hosts that are accessed without proxy",
+			EnvVars: []string{"NO_PROXY", "no_proxy"},
+		},
+		&cli.StringFlag{
+			Name:  "engine",
+			Usage: "container engine that builds the image: docker, podman, buildah, nerdctl, docker-api (the Docker Engine API, no docker command needed), buildkit (buildctl against buildkitd) or auto (the first of docker, podman, buildah and nerdctl that is installed)",
+			Value: "auto",
+		},
+		&cli.BoolFlag{
+			Name:  "daemonless",
+			Usage: "assemble the image from the base image in its registry and layers with the binaries, without any container engine; requires --push or --output oci:DIR and a base image that needs no RUN instructions",
+		},
+		&cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "build an image that godockerize verify can rebuild bit for bit: implies --daemonless, compiles with -trimpath and records the digest of the base image in labels",
+		},
+		&cli.StringFlag{
+			Name:  "docker-bin",
+			Usage: "command of the container engine (default: the engine's name)",
+		},
+		&cli.StringFlag{
+			Name:    "docker-host",
+			Usage:   "Docker daemon socket to connect to (podman: service URL, nerdctl: containerd socket, buildkit: buildkitd address)",
+			EnvVars: []string{"DOCKER_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "docker-context",
+			Usage:   "Docker context to use (podman: connection)",
+			EnvVars: []string{"DOCKER_CONTEXT"},
+		},
+		&cli.StringFlag{
+			Name:    "containerd-namespace",
+			Usage:   "containerd namespace to store the image in with nerdctl, e.g. k8s.io for Kubernetes",
+			EnvVars: []string{"CONTAINERD_NAMESPACE"},
+		},
+	}, archLevelFlags()...)
+}
+
+// selectFlags returns the flags of buildFlags with the given names, for
+// commands that don't build but talk to the same engine or registries.
+func selectFlags(names ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, f := range buildFlags() {
+		for _, name := range names {
+			if f.Names()[0] == name {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+// runFlags are the flags of the commands that run the image they build.
+func runFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "run-env",
+			Usage: "environment variable NAME=value for the container, overrides the image's",
+		},
+		&cli.StringSliceFlag{
+			Name:  "run-opt",
+			Usage: "additional option for docker run, e.g. --network=host",
+		},
+	}
+}
+
+// jsonErrors is set by the --json-errors flag.
+var jsonErrors bool
+
+// proxyEnv returns the proxy settings in NAME=value form, in upper and lower
+// case since tools differ in which one they honor.
+func proxyEnv(c *cli.Context) []string {
+	var env []string
+	for _, v := range []struct{ flag, name string }{
+		{"http-proxy", "HTTP_PROXY"},
+		{"https-proxy", "HTTPS_PROXY"},
+		{"no-proxy", "NO_PROXY"},
+	} {
+		if value := c.String(v.flag); value != "" {
+			env = append(env, v.name+"="+value, strings.ToLower(v.name)+"="+value)
+		}
+	}
+	return env
+}
+
+func sortedStringSet(in []string) []string {
+	set := make(map[string]struct{})
+	for _, s := range in {
+		set[s] = struct{}{}
+	}
+	var out []string
+	for s := range set {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
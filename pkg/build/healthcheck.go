@@ -0,0 +1,299 @@
+package build
+
+import (
+	"encoding/base64"
+	"fmt"
+	"go/ast"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// healthcheckHelper is the binary that //docker:healthcheck with an http://
+// URL runs. It is built from healthcheckHelperSource for the platform of the
+// image and only needs the network, so it works on scratch and distroless
+// images, which have neither curl nor wget.
+const healthcheckHelper = "godockerize-healthcheck"
+
+// healthcheckHelperSource speaks just enough HTTP/1.0 to check the status,
+// as net/http would make the binary several times larger.
+const healthcheckHelperSource = `// Command godockerize-healthcheck requests an http:// URL and fails unless
+// the response has a 2xx or 3xx status.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: godockerize-healthcheck http://host:port/path")
+		os.Exit(2)
+	}
+	if err := check(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func check(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: %s\r\nUser-Agent: godockerize-healthcheck\r\n\r\n", u.RequestURI(), u.Host); err != nil {
+		return err
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("invalid response %q", status)
+	}
+	if len(fields[1]) != 3 || fields[1] < "200" || fields[1] > "399" {
+		return fmt.Errorf("%s: %s", rawurl, strings.TrimSpace(status))
+	}
+	return nil
+}
+`
+
+// healthRoutes are the paths of HTTP handlers that --infer-healthcheck
+// turns into a health check.
+var healthRoutes = map[string]bool{"/healthz": true, "/health": true}
+
+// healthcheckURL returns the URL of //docker:healthcheck, or "" if it gives
+// a command.
+func healthcheckURL(args []string) string {
+	if len(args) == 1 && strings.HasPrefix(args[0], "http://") {
+		return args[0]
+	}
+	return ""
+}
+
+// checkHealthcheckURL makes sure that the helper can request s.
+func checkHealthcheckURL(s string) error {
+	if strings.HasPrefix(s, "https://") {
+		return fmt.Errorf("%s: only http:// URLs are supported", s)
+	}
+	if !strings.HasPrefix(s, "http://") {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s: the URL has no host", s)
+	}
+	return nil
+}
+
+// usesHealthcheckHelper reports whether healthcheckHelper has to be added to
+// the image.
+func (spec *imageSpec) usesHealthcheckHelper() bool {
+	return healthcheckURL(spec.healthcheck) != ""
+}
+
+// healthcheckStage is the name of the stage that builds healthcheckHelper
+// for images whose binaries are built in a stage.
+const healthcheckStage = "healthcheck"
+
+// healthcheckCopy returns the instruction that puts healthcheckHelper into
+// the image, from the build context or, if fromStage is set, from
+// healthcheckStage.
+func (spec *imageSpec) healthcheckCopy(fromStage string) string {
+	if fromStage != "" {
+		return fmt.Sprintf("%s /out/%s %s", spec.binaryCopy(healthcheckStage), healthcheckHelper, spec.family.binDir())
+	}
+	return fmt.Sprintf("%s %s %s", spec.binaryCopy(""), healthcheckHelper, spec.family.binDir())
+}
+
+// healthcheckBuildStage returns the stage that builds healthcheckHelper from its
+// source with the Go image, like goBuildStage.
+func healthcheckBuildStage(image string, opts *goBuildOptions) *dockerfile.Builder {
+	df := &dockerfile.Builder{}
+	env := "CGO_ENABLED=0 GOOS=" + opts.goos + " GOARCH=" + opts.goarch
+	if opts.targetPlatform {
+		df.Addf("FROM", "--platform=$BUILDPLATFORM %s AS %s", image, healthcheckStage)
+		df.Add("ARG", "TARGETOS TARGETARCH")
+		env = "CGO_ENABLED=0 GOOS=$TARGETOS GOARCH=$TARGETARCH"
+	} else {
+		df.Addf("FROM", "%s AS %s", image, healthcheckStage)
+	}
+	df.Add("WORKDIR", "/src")
+	df.Addf("RUN", "echo %s | base64 -d > main.go && echo 'module %s' > go.mod && %s go build -trimpath -ldflags \"-s -w\" -o /out/ .",
+		base64.StdEncoding.EncodeToString([]byte(healthcheckHelperSource)), healthcheckHelper, env)
+	return df
+}
+
+// addInferredHealthcheck gives spec an HTTP health check for
+// --infer-healthcheck if it has none and its packages handle one of
+// healthRoutes. The port is that of the HTTP server that serves the handler,
+// or the only port that the packages listen on or the image exposes.
+func (b *builder) addInferredHealthcheck(spec *imageSpec) error {
+	if spec.healthcheck != nil || spec.family.windows {
+		return nil
+	}
+	packages, err := b.tc.sourcePackages(b.goOpts, spec.packages, true)
+	if err != nil {
+		return err
+	}
+	var route, pos, mux string
+	var ports, local []inferredPort // of all packages and of that with the route
+	for _, pkg := range packages {
+		a, err := analyzeSource(pkg)
+		if err != nil {
+			return err
+		}
+		for _, f := range a.files {
+			a.findListeners(f)
+		}
+		ports = append(ports, a.ports...)
+		if route != "" {
+			continue
+		}
+		for _, f := range a.files {
+			if route, pos, mux = a.findHealthRoute(f); route != "" {
+				local = a.ports
+				break
+			}
+		}
+	}
+	if route == "" {
+		return nil
+	}
+	servers := local
+	if mux == defaultServeMux {
+		// the servers of all packages can use it
+		servers = ports
+	}
+
+	port := healthPort(mux, servers, ports, spec.expose)
+	if port == "" {
+		b.tc.printf("godockerize: Not adding a health check for %s at %s, the port is unknown\n", route, pos)
+		return nil
+	}
+	u := "http://localhost:" + port + route
+	b.tc.printf("godockerize: Checking the health of %s with %s, handled at %s\n", spec.name(), u, pos)
+	spec.healthcheck = []string{u}
+	return nil
+}
+
+// healthPort returns the port of the HTTP servers among servers that serve
+// mux, if there is exactly one, or else the only TCP port of ports and
+// expose, or "".
+func healthPort(mux string, servers, ports []inferredPort, expose []string) string {
+	served := make(map[string]bool)
+	for _, p := range servers {
+		if mux != "" && p.handler == mux && strings.HasPrefix(p.call, "http.") {
+			served[p.port] = true
+		}
+	}
+	all := make(map[string]bool)
+	for _, p := range ports {
+		if !strings.HasSuffix(p.port, "/udp") {
+			all[p.port] = true
+		}
+	}
+	for _, p := range expose {
+		if !strings.Contains(p, "/") || strings.HasSuffix(p, "/tcp") {
+			all[strings.TrimSuffix(p, "/tcp")] = true
+		}
+	}
+	for _, candidates := range []map[string]bool{served, all} {
+		if len(candidates) != 1 {
+			continue
+		}
+		for p := range candidates {
+			if strings.Contains(p, "-") {
+				// a range of //docker:expose
+				return ""
+			}
+			return p
+		}
+	}
+	return ""
+}
+
+// findHealthRoute returns the first of healthRoutes that f registers a
+// handler for with Handle, HandleFunc or the Get methods of common routers,
+// where, and the handlerName of the mux or router.
+func (a *sourceAnalyzer) findHealthRoute(f *ast.File) (route, pos, mux string) {
+	httpPkg := importName(f, "net/http")
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || route != "" || len(call.Args) < 2 {
+			return route == ""
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch sel.Sel.Name {
+		case "Handle", "HandleFunc", "Get", "GET", "Any":
+		default:
+			return true
+		}
+		s, ok := a.value(call.Args[0], 0)
+		if !ok {
+			return true
+		}
+		// patterns of Go 1.22 start with the method
+		s = strings.TrimPrefix(s, "GET ")
+		if healthRoutes[s] {
+			route, pos = s, relPath(a.fset.Position(call.Pos()).String())
+			mux = handlerName(sel.X, httpPkg)
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == httpPkg {
+				// http.Handle and http.HandleFunc
+				mux = defaultServeMux
+			}
+		}
+		return route == ""
+	})
+	return route, pos, mux
+}
+
+// buildHealthcheckHelper compiles healthcheckHelper into dir for the
+// platform of opts.
+func (t *toolchain) buildHealthcheckHelper(dir string, opts *goBuildOptions) error {
+	src, err := ioutil.TempDir("", "godockerize-healthcheck")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(src)
+	if err := ioutil.WriteFile(filepath.Join(src, "go.mod"), []byte("module "+healthcheckHelper+"\n\ngo 1.14\n"), 0666); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "main.go"), []byte(healthcheckHelperSource), 0666); err != nil {
+		return err
+	}
+	cmd := t.goBuildCmd(&goBuildOptions{goos: opts.goos, goarch: opts.goarch}, "build", "-trimpath", "-ldflags", "-s -w", "-o", filepath.Join(dir, healthcheckHelper), ".")
+	cmd.Dir = src
+	cmd.Env = append(cmd.Env, "GOFLAGS=", "GO111MODULE=on")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return stageErrorf(stageGoBuild, "building %s: %v\n%s", healthcheckHelper, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindHealthRoute(t *testing.T) {
+	tests := []struct {
+		src                string
+		wantRoute, wantMux string
+	}{
+		{`http.HandleFunc("/healthz", h)`, "/healthz", defaultServeMux},
+		{`http.Handle("/health", h)`, "/health", defaultServeMux},
+		{`mux.HandleFunc("GET /healthz", h)`, "/healthz", "mux"},
+		{`r.Get(path, h)`, "/health", "r"},
+		{`router.GET("/healthz", h)`, "/healthz", "router"},
+		{`s.mux.Handle("/healthz", h)`, "/healthz", ""},
+		{`http.HandleFunc("/", h); http.HandleFunc("/ready", h)`, "", ""},
+		{`http.HandleFunc("/healthz")`, "", ""},
+	}
+	for _, test := range tests {
+		src := "package main\nimport \"net/http\"\nconst path = \"/health\"\nfunc main() {\n" + test.src + "\n}\n"
+		a, err := analyzeSource(sourcePackage(t, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		route, pos, mux := a.findHealthRoute(a.files[0])
+		if route != test.wantRoute || mux != test.wantMux {
+			t.Errorf("%s: got %q, %q, want %q, %q", test.src, route, mux, test.wantRoute, test.wantMux)
+		}
+		if route != "" && !strings.HasSuffix(pos, "main.go:5:1") {
+			t.Errorf("%s: got position %s, want main.go:5:1", test.src, pos)
+		}
+	}
+}
+
+func TestHealthPort(t *testing.T) {
+	listener := inferredPort{port: "7070", call: "net.Listen"}
+	defaultServer := inferredPort{port: "9090", call: "http.ListenAndServe", handler: defaultServeMux}
+	muxServer := inferredPort{port: "8080", call: "http.Server", handler: "mux"}
+	unknownServer := inferredPort{port: "8081", call: "http.Server"}
+	udp := inferredPort{port: "53/udp", call: "net.ListenPacket"}
+	tests := []struct {
+		name    string
+		mux     string
+		servers []inferredPort
+		expose  []string
+		want    string
+	}{
+		{"server of the default mux", defaultServeMux, []inferredPort{listener, defaultServer}, nil, "9090"},
+		{"server of the mux", "mux", []inferredPort{listener, muxServer, defaultServer}, nil, "8080"},
+		{"no server of the mux", "other", []inferredPort{listener, muxServer}, nil, ""},
+		{"unknown handler", "mux", []inferredPort{listener, unknownServer}, nil, ""},
+		{"only port", "mux", []inferredPort{unknownServer, udp}, nil, "8081"},
+		{"only exposed port", defaultServeMux, nil, []string{"8000/tcp", "53/udp"}, "8000"},
+		{"exposed and listened on", "mux", []inferredPort{unknownServer}, []string{"8081"}, "8081"},
+		{"several exposed ports", defaultServeMux, nil, []string{"8000", "8001"}, ""},
+		{"range", defaultServeMux, nil, []string{"8000-8010"}, ""},
+		{"nothing", defaultServeMux, nil, nil, ""},
+	}
+	for _, test := range tests {
+		if got := healthPort(test.mux, test.servers, test.servers, test.expose); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInferHealthcheckPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "Dockerfile")
+	if err := runInDir(t, filepath.Join("testdata", "app"), "dockerfile", "--infer-healthcheck", "--file", out, "./cmd/health"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `HEALTHCHECK CMD ["/usr/local/bin/godockerize-healthcheck", "http://localhost:9090/health"]`
+	if !strings.Contains(string(data), want) {
+		t.Errorf("health check of the server on port 9090 missing:\n%s", data)
+	}
+}
@@ -0,0 +1,220 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doHelm(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize helm" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("helm does not support path@version")
+	}
+	if len(c.StringSlice("tag")) == 0 {
+		return errors.New(`helm requires a tag template like "repo/{{.Name}}:latest" for the images of the charts`)
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(spec.name(), pkg.Exe)
+		dir := filepath.Join(c.String("dir"), name)
+		if _, err := os.Stat(dir); err == nil && !c.Bool("force") {
+			// the chart is a starting point that is meant to be edited
+			fmt.Printf("godockerize: Skipping %s, it already exists (use --force to overwrite it)\n", dir)
+			continue
+		}
+		files := []struct{ name, content string }{
+			{"Chart.yaml", helmChart(spec, name, tags[0], c.String("chart-version"))},
+			{"values.yaml", helmValues(spec, tags[0], c.Int("replicas"))},
+			{"templates/deployment.yaml", helmDeployment},
+			{"templates/service.yaml", helmService},
+		}
+		for _, f := range files {
+			path := filepath.Join(dir, filepath.FromSlash(f.name))
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(f.content), 0666); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("godockerize: Wrote %s\n", dir)
+	}
+	return nil
+}
+
+// imageTag returns the tag of ref, which defaults to latest.
+func imageTag(ref string) string {
+	repo := repository(ref)
+	if strings.HasPrefix(ref, repo+":") {
+		return strings.SplitN(ref[len(repo)+1:], "@", 2)[0]
+	}
+	return "latest"
+}
+
+func helmChart(spec *imageSpec, name, image, version string) string {
+	var out strings.Builder
+	out.WriteString("apiVersion: v2\n")
+	fmt.Fprintf(&out, "name: %s\n", name)
+	fmt.Fprintf(&out, "description: %s\n", yamlString(spec.packages[0].ImportPath+", built by godockerize"))
+	out.WriteString("type: application\n")
+	fmt.Fprintf(&out, "version: %s\n", version)
+	fmt.Fprintf(&out, "appVersion: %s\n", yamlString(imageTag(image)))
+	return out.String()
+}
+
+// helmValues returns the values.yaml of the chart of spec, with the settings
+// of the image as defaults.
+func helmValues(spec *imageSpec, image string, replicas int) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "replicaCount: %d\n\n", replicas)
+	out.WriteString("image:\n")
+	fmt.Fprintf(&out, "  repository: %s\n", yamlString(repository(image)))
+	fmt.Fprintf(&out, "  tag: %s\n", yamlString(imageTag(image)))
+	out.WriteString("  pullPolicy: IfNotPresent\n\n")
+
+	out.WriteString("# environment variables NAME: value, which override those of the image\n")
+	if len(spec.env) == 0 {
+		out.WriteString("env: {}\n\n")
+	} else {
+		out.WriteString("env:\n")
+		for _, v := range sortedStringSet(spec.env) {
+			if kv := strings.SplitN(v, "=", 2); len(kv) == 2 {
+				fmt.Fprintf(&out, "  %s: %s\n", kv[0], yamlString(kv[1]))
+			}
+		}
+		out.WriteString("\n")
+	}
+
+	ports := k8sPorts(spec)
+	if len(ports) == 0 {
+		out.WriteString("ports: []\n\n")
+	} else {
+		out.WriteString("ports:\n")
+		for _, p := range ports {
+			fmt.Fprintf(&out, "  - name: %s\n    containerPort: %s\n    protocol: %s\n", p.name, p.port, p.protocol)
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("service:\n  type: ClusterIP\n\n")
+
+	out.WriteString("# command that checks the health of the container, used for the liveness and\n# readiness probes\n")
+	if cmd := spec.healthcheckCommand(); cmd == nil {
+		out.WriteString("healthcheck: []\n\n")
+	} else {
+		out.WriteString("healthcheck:\n")
+		for _, arg := range cmd {
+			fmt.Fprintf(&out, "  - %s\n", yamlString(arg))
+		}
+		out.WriteString("\n")
+	}
+
+	out.WriteString("resources: {}\n\n")
+	out.WriteString("securityContext:\n  allowPrivilegeEscalation: false\n")
+	writeK8sUser(&out, spec, "  ")
+	return out.String()
+}
+
+const helmDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}-{{ .Chart.Name }}
+  labels:
+    app.kubernetes.io/name: {{ .Chart.Name }}
+    app.kubernetes.io/instance: {{ .Release.Name }}
+spec:
+  replicas: {{ .Values.replicaCount }}
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: {{ .Chart.Name }}
+      app.kubernetes.io/instance: {{ .Release.Name }}
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: {{ .Chart.Name }}
+        app.kubernetes.io/instance: {{ .Release.Name }}
+    spec:
+      containers:
+        - name: {{ .Chart.Name }}
+          image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+          imagePullPolicy: {{ .Values.image.pullPolicy }}
+          {{- with .Values.ports }}
+          ports:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+          {{- if .Values.env }}
+          env:
+            {{- range $name, $value := .Values.env }}
+            - name: {{ $name }}
+              value: {{ $value | quote }}
+            {{- end }}
+          {{- end }}
+          {{- with .Values.healthcheck }}
+          livenessProbe:
+            exec:
+              command:
+                {{- toYaml . | nindent 16 }}
+          readinessProbe:
+            exec:
+              command:
+                {{- toYaml . | nindent 16 }}
+          {{- end }}
+          {{- with .Values.resources }}
+          resources:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+          {{- with .Values.securityContext }}
+          securityContext:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+`
+
+const helmService = `{{- if .Values.ports }}
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}-{{ .Chart.Name }}
+  labels:
+    app.kubernetes.io/name: {{ .Chart.Name }}
+    app.kubernetes.io/instance: {{ .Release.Name }}
+spec:
+  type: {{ .Values.service.type }}
+  selector:
+    app.kubernetes.io/name: {{ .Chart.Name }}
+    app.kubernetes.io/instance: {{ .Release.Name }}
+  ports:
+    {{- range .Values.ports }}
+    - name: {{ .name }}
+      port: {{ .containerPort }}
+      targetPort: {{ .name }}
+      protocol: {{ .protocol }}
+    {{- end }}
+{{- end }}
+`
@@ -0,0 +1,90 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Hooks of the configuration file, which run for each image that is built.
+const (
+	hookPreBuild  = "pre-build"  // before the image is built
+	hookPostBuild = "post-build" // after it is built and scanned locally
+	hookPrePush   = "pre-push"   // before it is pushed
+	hookPostPush  = "post-push"  // after it is pushed, with its digest
+)
+
+var hookNames = []string{hookPreBuild, hookPostBuild, hookPrePush, hookPostPush}
+
+// hookEvent describes the build and is written as JSON to the stdin of
+// hooks.
+type hookEvent struct {
+	Hook       string   `json:"hook"`
+	Packages   []string `json:"packages"` // import paths, the first one is the entrypoint
+	Tags       []string `json:"tags"`
+	Base       string   `json:"base"`
+	Engine     string   `json:"engine"`
+	Dockerfile string   `json:"dockerfile,omitempty"`
+	ImageID    string   `json:"imageID,omitempty"` // from post-build on
+	Digest     string   `json:"digest,omitempty"`  // in post-push
+}
+
+func isHook(name string) bool {
+	for _, h := range hookNames {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHooks reports whether the configuration has commands for hook.
+func (cfg *projectConfig) hasHooks(hook string) bool {
+	return cfg != nil && len(cfg.hooks[hook]) != 0
+}
+
+// runHooks runs the commands of hook with sh in the directory of the
+// configuration file. The first one that fails aborts the build.
+func (b *builder) runHooks(hook string, ev *hookEvent) error {
+	if !projectCfg.hasHooks(hook) {
+		return nil
+	}
+	ev.Hook = hook
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	for _, command := range projectCfg.hooks[hook] {
+		b.tc.printf("godockerize: Running %s hook: %s\n", hook, command)
+		cmd := exec.CommandContext(b.tc.ctx, "sh", "-c", command)
+		cmd.Dir = filepath.Dir(projectCfg.file)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = b.tc.stdout()
+		cmd.Stderr = b.tc.stderr()
+		if err := cmd.Run(); err != nil {
+			return stageErrorf(stageHook, "%s hook %q: %v", hook, command, err)
+		}
+	}
+	return nil
+}
+
+// newHookEvent returns the event for the image of packages, without hook.
+func newHookEvent(packages []*goPackage, spec *imageSpec, engine string, tags []string, dockerfile []byte) *hookEvent {
+	ev := &hookEvent{
+		Tags:       append([]string{}, tags...),
+		Base:       spec.base,
+		Engine:     engine,
+		Dockerfile: string(dockerfile),
+	}
+	for _, pkg := range packages {
+		ev.Packages = append(ev.Packages, pkg.ImportPath)
+	}
+	return ev
+}
+
+// hookList returns the hooks for the message of an unknown hook.
+func hookList() string {
+	return strings.Join(hookNames, ", ")
+}
@@ -0,0 +1,314 @@
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ociDescriptor refers to a blob by digest, as in manifests and indexes.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"` // the manifest an artifact refers to
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// imageConfig is the configuration blob of an image. Fields that are not
+// listed here are dropped when it is rewritten.
+type imageConfig struct {
+	Created      string             `json:"created,omitempty"`
+	Architecture string             `json:"architecture"`
+	OS           string             `json:"os"`
+	Variant      string             `json:"variant,omitempty"`
+	Config       containerConfig    `json:"config"`
+	RootFS       imageRootFS        `json:"rootfs"`
+	History      []imageHistoryItem `json:"history,omitempty"`
+}
+
+type containerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Healthcheck  *healthConfig       `json:"Healthcheck,omitempty"`
+}
+
+type healthConfig struct {
+	Test []string `json:"Test,omitempty"`
+}
+
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type imageHistoryItem struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// layerTime is the modification time of the files in generated layers, so
+// that the same binaries always result in the same layer.
+var layerTime = time.Unix(0, 0)
+
+// layerFile is a file or directory in a generated layer.
+type layerFile struct {
+	name     string // slash-separated path in the image without leading slash
+	src      string // on the host, empty for directories that are only created
+	mode     os.FileMode
+	uid, gid int
+	link     string // target of a symbolic link
+}
+
+// layerBlob is a compressed layer, either generated into file or only
+// available from the registry of the base image.
+type layerBlob struct {
+	desc   ociDescriptor
+	diffID string
+	file   string
+}
+
+// writeLayer writes files as a gzipped tar to file in the order given,
+// adding the parent directories of each, and describes it with mediaType.
+func writeLayer(file string, files []layerFile, mediaType string) (*layerBlob, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	compressed := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, compressed))
+	uncompressed := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(gz, uncompressed))
+
+	dirs := make(map[string]bool)
+	for _, lf := range files {
+		for dir := path.Dir(lf.name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	var parents []string
+	for dir := range dirs {
+		parents = append(parents, dir)
+	}
+	for _, dir := range sortedStringSet(parents) {
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: layerTime, Format: tar.FormatPAX}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lf := range files {
+		hdr := &tar.Header{Name: lf.name, Mode: int64(lf.mode.Perm()), Uid: lf.uid, Gid: lf.gid, ModTime: layerTime, Format: tar.FormatPAX}
+		switch {
+		case lf.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, lf.link
+		case lf.src == "" || lf.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			if dirs[lf.name] {
+				continue
+			}
+		default:
+			fi, err := os.Stat(lf.src)
+			if err != nil {
+				return nil, err
+			}
+			hdr.Typeflag, hdr.Size = tar.TypeReg, fi.Size()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyInto(tw, lf.src); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &layerBlob{
+		desc:   ociDescriptor{MediaType: mediaType, Digest: hashDigest(compressed), Size: fi.Size()},
+		diffID: hashDigest(uncompressed),
+		file:   file,
+	}, f.Close()
+}
+
+func copyInto(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func hashDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// parseKeyValue splits an ENV or LABEL argument like FOO=bar or
+// FOO="a b" into key and value.
+func parseKeyValue(s string) (string, string) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	value := parts[1]
+	if strings.HasPrefix(value, `"`) {
+		if v, err := strconv.Unquote(value); err == nil {
+			value = v
+		}
+	}
+	return parts[0], value
+}
+
+// setEnv sets the variable of the NAME=value v in env, as ENV does.
+func setEnv(env []string, v string) []string {
+	name, value := parseKeyValue(v)
+	for i, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
+
+// ociLayout is a directory in the OCI image layout format, which can hold
+// several images.
+type ociLayout struct {
+	dir string
+}
+
+func openOCILayout(dir string) (*ociLayout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0777); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`+"\n"), 0666); err != nil {
+		return nil, err
+	}
+	return &ociLayout{dir: dir}, nil
+}
+
+// blobPath returns where the blob with digest is stored.
+func (l *ociLayout) blobPath(digest string) (string, error) {
+	hexPart, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, "blobs", "sha256", hexPart), nil
+}
+
+func (l *ociLayout) hasBlob(digest string) bool {
+	p, err := l.blobPath(digest)
+	return err == nil && fileExists(p)
+}
+
+// writeBlob stores the contents of r, which must have digest.
+func (l *ociLayout) writeBlob(digest string, r io.Reader) error {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && hashDigest(h) != digest {
+		err = fmt.Errorf("blob %s has digest %s", digest, hashDigest(h))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// addManifest adds desc to index.json under the reference name, e.g. the
+// tag of the image, replacing an earlier entry of the same name.
+func (l *ociLayout) addManifest(desc ociDescriptor, name string) error {
+	file := filepath.Join(l.dir, "index.json")
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	data, err := readFileIfExists(file)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if name != "" {
+		desc.Annotations = map[string]string{"org.opencontainers.image.ref.name": name}
+	}
+	manifests := index.Manifests[:0]
+	for _, m := range index.Manifests {
+		if name == "" || m.Annotations["org.opencontainers.image.ref.name"] != name {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+	data, err = json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(data, '\n'))
+}
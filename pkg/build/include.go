@@ -0,0 +1,71 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// Points of the image stage where --include and //docker:include insert
+// Dockerfile snippets.
+const (
+	includeAfterFrom     = "after-from"     // before the packages are installed
+	includeBeforeUser    = "before-user"    // after the assets are copied
+	includeAfterBinaries = "after-binaries" // at the end
+)
+
+var includePoints = []string{includeAfterFrom, includeBeforeUser, includeAfterBinaries}
+
+func checkIncludePoint(point string) error {
+	for _, p := range includePoints {
+		if p == point {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown point %q, only %s", point, strings.Join(includePoints, ", "))
+}
+
+// parseIncludes parses the point=file values of --include.
+func parseIncludes(values []string) ([][2]string, error) {
+	var includes [][2]string
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --include %q, must be point=file", v)
+		}
+		if err := checkIncludePoint(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid --include %q: %v", v, err)
+		}
+		includes = append(includes, [2]string{parts[0], parts[1]})
+	}
+	return includes, nil
+}
+
+// addInclude reads the Dockerfile snippet in file and inserts it at point.
+func (spec *imageSpec) addInclude(point, file string) error {
+	if err := checkIncludePoint(point); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	instructions, err := parseFragment(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	spec.includes[point] = append(spec.includes[point], instructions...)
+	return nil
+}
+
+// addedInstructions returns the instructions of directive handlers and
+// includes, which are put into the image as they are.
+func (spec *imageSpec) addedInstructions() []dockerfile.Instruction {
+	instructions := append([]dockerfile.Instruction{}, spec.fragments...)
+	for _, point := range includePoints {
+		instructions = append(instructions, spec.includes[point]...)
+	}
+	return instructions
+}
@@ -0,0 +1,310 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// buildStage is the name of the stage that compiles the binaries with
+// --build-in-docker.
+const buildStage = "build"
+
+// localModule is the module that is used as the Docker build context with
+// --build-in-docker.
+type localModule struct {
+	Dir       string
+	Path      string
+	GoVersion string // from the go directive, e.g. "1.22"
+}
+
+// loadLocalPackages resolves package directories without the go command,
+// which may not be installed when building inside Docker. All packages have
+// to be part of the same module.
+func loadLocalPackages(opts *goBuildOptions, args []string) ([]*goPackage, *localModule, error) {
+	ctxt := build.Default
+	ctxt.GOOS = opts.goos
+	ctxt.GOARCH = opts.goarch
+	ctxt.CgoEnabled = false
+	ctxt.BuildTags = []string{"dist"}
+
+	var mod *localModule
+	var packages []*goPackage
+	for _, arg := range args {
+		pattern := isPattern(arg)
+		dir := arg
+		if pattern {
+			if !strings.HasSuffix(arg, "/...") {
+				return nil, nil, fmt.Errorf("%s: only patterns of the form dir/... are supported with --build-in-docker", arg)
+			}
+			dir = strings.TrimSuffix(arg, "/...")
+		}
+		if !build.IsLocalImport(dir) && !filepath.IsAbs(dir) {
+			return nil, nil, fmt.Errorf("%s: packages must be given as directories with --build-in-docker", arg)
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m, err := findModule(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mod == nil {
+			mod = m
+		} else if m.Dir != mod.Dir {
+			return nil, nil, fmt.Errorf("%s is not in module %s, all packages must be in the same module with --build-in-docker", arg, mod.Path)
+		}
+
+		var dirs []string
+		if pattern {
+			err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					if name := fi.Name(); p != dir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" || fileExists(filepath.Join(p, "go.mod"))) {
+						return filepath.SkipDir
+					}
+					dirs = append(dirs, p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			dirs = []string{dir}
+		}
+
+		found := false
+		for _, d := range dirs {
+			bp, err := ctxt.ImportDir(d, 0)
+			if _, ok := err.(*build.NoGoError); ok && pattern {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			rel, err := filepath.Rel(mod.Dir, d)
+			if err != nil {
+				return nil, nil, err
+			}
+			pkg := &goPackage{
+				ImportPath: path.Join(mod.Path, filepath.ToSlash(rel)),
+				Name:       bp.Name,
+				Dir:        d,
+				GoFiles:    bp.GoFiles,
+				Module:     &goModule{Path: mod.Path, Dir: mod.Dir, Main: true},
+			}
+			if pkg.Name != "main" {
+				if pattern {
+					continue
+				}
+				return nil, nil, fmt.Errorf("%s is not a main package", pkg.ImportPath)
+			}
+			packages = append(packages, pkg)
+			found = true
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("pattern %s matches no main packages", arg)
+		}
+	}
+	return packages, mod, nil
+}
+
+// findModule finds the module containing dir by looking for its go.mod.
+func findModule(dir string) (*localModule, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		data, err := readFileIfExists(filepath.Join(d, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			mod := &localModule{Dir: d}
+			s := bufio.NewScanner(bytes.NewReader(data))
+			for s.Scan() {
+				fields := strings.Fields(s.Text())
+				if len(fields) == 2 && fields[0] == "module" {
+					mod.Path = strings.Trim(fields[1], `"`)
+				}
+				if len(fields) == 2 && fields[0] == "go" {
+					mod.GoVersion = fields[1]
+				}
+			}
+			if mod.Path == "" {
+				return nil, fmt.Errorf("%s: missing module directive", filepath.Join(d, "go.mod"))
+			}
+			return mod, nil
+		}
+		if filepath.Dir(d) == d {
+			return nil, fmt.Errorf("%s is not inside a Go module", dir)
+		}
+	}
+}
+
+func readFileIfExists(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// builderImage returns the golang image used for compiling, matching the
+// version required by --go-version or else the go directive of the module.
+func builderImage(goVersion string, mod *localModule) string {
+	if goVersion == "" {
+		goVersion = mod.GoVersion
+	}
+	goVersion = strings.TrimSuffix(strings.TrimSuffix(goVersion, ".x"), ".0")
+	if goVersion == "" {
+		return "golang"
+	}
+	return "golang:" + goVersion
+}
+
+// buildStageSecrets are the credentials for private modules that are
+// mounted into the build stage, if available. They are not stored in any
+// layer of the image.
+type buildStageSecrets struct {
+	netrc string // path of the netrc file
+	ssh   bool   // forward the SSH agent
+}
+
+// buildStageMounts are the secrets that the build stage mounts.
+type buildStageMounts struct {
+	netrc bool // the secret with the ID netrc as /root/.netrc
+	ssh   bool
+}
+
+// mounts returns the mounts for the secrets that are available.
+func (s buildStageSecrets) mounts() buildStageMounts {
+	return buildStageMounts{netrc: s.netrc != "", ssh: s.ssh}
+}
+
+func findBuildStageSecrets() buildStageSecrets {
+	var s buildStageSecrets
+	netrc := os.Getenv("NETRC")
+	if netrc == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			netrc = filepath.Join(home, ".netrc")
+		}
+	}
+	if fileExists(netrc) {
+		s.netrc = netrc
+	}
+	s.ssh = os.Getenv("SSH_AUTH_SOCK") != ""
+	return s
+}
+
+// goBuildStage generates the stage that compiles the binaries of packages
+// inside Docker. The build context is the module's directory. Settings for
+// private modules and proxies in goEnv (NAME=value or NAME) are passed as
+// build arguments, so they are not part of the image.
+func goBuildStage(image string, mod *localModule, packages []*goPackage, opts *goBuildOptions, goEnv []string, secrets buildStageMounts) (*dockerfile.Builder, error) {
+	df := &dockerfile.Builder{}
+	var names []string
+	if opts.targetPlatform {
+		// cross-compile on the platform of the builder
+		df.Addf("FROM", "--platform=$BUILDPLATFORM %s AS %s", image, buildStage)
+		names = append(names, "TARGETOS", "TARGETARCH")
+	} else {
+		df.Addf("FROM", "%s AS %s", image, buildStage)
+	}
+	for _, v := range goEnv {
+		names = append(names, strings.SplitN(v, "=", 2)[0])
+	}
+	if len(names) != 0 {
+		df.Add("ARG", strings.Join(sortedStringSet(names), " "))
+	}
+	df.Add("WORKDIR", "/src")
+
+	mounts := "--mount=type=cache,target=/go/pkg/mod"
+	if secrets.netrc {
+		mounts += " --mount=type=secret,id=netrc,target=/root/.netrc"
+	}
+	if secrets.ssh {
+		mounts += " --mount=type=ssh"
+	}
+	if opts.mod != "vendor" {
+		df.Add("COPY", "go.* ./")
+		df.Addf("RUN", "%s go mod download", mounts)
+	}
+	df.Add("COPY", ". .")
+
+	env := []string{"CGO_ENABLED=0", "GOOS=" + opts.goos, "GOARCH=" + opts.goarch}
+	if opts.targetPlatform {
+		env = []string{"CGO_ENABLED=0", "GOOS=$TARGETOS", "GOARCH=$TARGETARCH"}
+	}
+	env = append(env, opts.env...)
+	build := []string{"go", "build", "-o", "/out/"}
+	flags := opts.flags(packages[0])
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		if f == "-pgo" {
+			// the go command picks up default.pgo by itself, only an
+			// explicit profile has to be mapped into the build context
+			i++
+			if opts.pgo == "" {
+				continue
+			}
+			rel, err := filepath.Rel(mod.Dir, flags[i])
+			if err != nil || strings.HasPrefix(rel, "..") {
+				return nil, fmt.Errorf("--pgo profile %s must be inside module %s with --build-in-docker", flags[i], mod.Dir)
+			}
+			build = append(build, "-pgo", "/src/"+filepath.ToSlash(rel))
+			continue
+		}
+		if strings.ContainsAny(f, " \"'$") {
+			f = fmt.Sprintf("%q", f)
+		}
+		build = append(build, f)
+	}
+	for _, pkg := range packages {
+		rel := strings.TrimPrefix(strings.TrimPrefix(pkg.ImportPath, mod.Path), "/")
+		build = append(build, "./"+rel)
+	}
+	df.Addf("RUN", "%s --mount=type=cache,target=/root/.cache/go-build %s %s", mounts, strings.Join(env, " "), strings.Join(build, " "))
+	return df, nil
+}
+
+// moduleEnvVars are the settings of the go command for fetching modules that
+// are passed into the build stage.
+var moduleEnvVars = []string{"GOPROXY", "GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOINSECURE", "GOFLAGS"}
+
+func isModuleEnvVar(name string) bool {
+	for _, v := range moduleEnvVars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleEnv returns the moduleEnvVars set by flags or in the environment in
+// NAME=value form.
+func (t *toolchain) moduleEnv() []string {
+	var env []string
+	for _, name := range moduleEnvVars {
+		value := os.Getenv(name)
+		for _, v := range t.goEnv {
+			if strings.HasPrefix(v, name+"=") {
+				value = v[len(name)+1:]
+			}
+		}
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
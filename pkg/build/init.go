@@ -0,0 +1,331 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/urfave/cli/v2"
+)
+
+// configFile is the name of the project configuration in the root of the
+// module.
+const configFile = ".godockerize.yaml"
+
+// packageFindings is what init learned about a main package from its
+// source.
+type packageFindings struct {
+	ports    []string // that the program listens on for other hosts
+	loopback []string // addresses on localhost, which are not exposed
+	env      []string // variables that the program reads
+	files    []string // absolute paths of files and directories
+	flags    []string // command-line flags, e.g. "-addr (default :8080)"
+}
+
+var listenAddrPattern = regexp.MustCompile(`^(\[[0-9a-fA-F:]*\]|[A-Za-z0-9.-]*):([0-9]{1,5})$`)
+
+// filePrefixes are the directories in which paths are likely files of the
+// program rather than e.g. routes of an HTTP server.
+var filePrefixes = []string{"/etc/", "/var/", "/opt/", "/srv/", "/data/", "/usr/share/", "/run/", "/config/"}
+
+func doInit(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize init" requires 1 or more arguments`)
+	}
+	tc := &toolchain{ctx: c.Context, goBin: c.String("go-bin")}
+	packages, err := tc.loadPackages(&goBuildOptions{goos: "linux", goarch: runtime.GOARCH}, args.Slice())
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		f, err := analyzePackage(pkg)
+		if err != nil {
+			return err
+		}
+		if err := insertDirectives(pkg, f.directiveBlock(), c.Bool("dry-run")); err != nil {
+			return err
+		}
+	}
+
+	dir := "."
+	if m := packages[0].Module; m != nil && m.Dir != "" {
+		dir = m.Dir
+	}
+	file := filepath.Join(dir, configFile)
+	if c.Bool("dry-run") || fileExists(file) {
+		return nil
+	}
+	if err := ioutil.WriteFile(file, starterConfig(packages), 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Wrote %s\n", file)
+	return nil
+}
+
+// analyzePackage looks for listen addresses, environment variables, file
+// paths and flags in the Go files of pkg.
+func analyzePackage(pkg *goPackage) (*packageFindings, error) {
+	f := &packageFindings{}
+	fset := token.NewFileSet()
+	for _, name := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		flagPkg := ""
+		for _, imp := range file.Imports {
+			if imp.Path.Value == `"flag"` {
+				flagPkg = "flag"
+				if imp.Name != nil {
+					flagPkg = imp.Name.Name
+				}
+			}
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.BasicLit:
+				if s, ok := stringLiteral(n); ok {
+					f.addLiteral(s)
+				}
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok {
+					break
+				}
+				x, ok := sel.X.(*ast.Ident)
+				if !ok {
+					break
+				}
+				switch {
+				case x.Name == "os" && (sel.Sel.Name == "Getenv" || sel.Sel.Name == "LookupEnv") && len(n.Args) == 1:
+					if s, ok := stringLiteral(n.Args[0]); ok {
+						f.env = append(f.env, s)
+					}
+				case x.Name == flagPkg && flagPkg != "":
+					f.addFlag(sel.Sel.Name, n.Args)
+				}
+			}
+			return true
+		})
+	}
+	f.ports = sortedStringSet(f.ports)
+	f.loopback = sortedStringSet(f.loopback)
+	f.env = sortedStringSet(f.env)
+	f.files = sortedStringSet(f.files)
+	return f, nil
+}
+
+func stringLiteral(e ast.Expr) (string, bool) {
+	lit, ok := e.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+func (f *packageFindings) addLiteral(s string) {
+	if m := listenAddrPattern.FindStringSubmatch(s); m != nil {
+		port, err := strconv.Atoi(m[2])
+		if err != nil || port < 1 || port > 65535 {
+			return
+		}
+		switch m[1] {
+		case "localhost", "127.0.0.1", "[::1]":
+			f.loopback = append(f.loopback, s)
+		default:
+			f.ports = append(f.ports, m[2])
+		}
+		return
+	}
+	if strings.ContainsAny(s, " \t\n%*") {
+		return
+	}
+	for _, prefix := range filePrefixes {
+		if strings.HasPrefix(s, prefix) && len(s) > len(prefix) {
+			f.files = append(f.files, s)
+			return
+		}
+	}
+}
+
+// addFlag records the flag defined by a call of the function fn of package
+// flag, e.g. String("addr", ":8080", "listen address") or
+// StringVar(&addr, ...).
+func (f *packageFindings) addFlag(fn string, args []ast.Expr) {
+	if strings.HasSuffix(fn, "Var") {
+		if len(args) == 0 {
+			return
+		}
+		args = args[1:]
+	}
+	switch strings.TrimSuffix(fn, "Var") {
+	case "String", "Int", "Int64", "Uint", "Uint64", "Bool", "Duration", "Float64":
+	default:
+		return
+	}
+	if len(args) < 2 {
+		return
+	}
+	name, ok := stringLiteral(args[0])
+	if !ok {
+		return
+	}
+	flag := "-" + name
+	if lit, ok := args[1].(*ast.BasicLit); ok && lit.Value != `""` && lit.Value != "0" {
+		flag += " (default " + lit.Value + ")"
+	}
+	f.flags = append(f.flags, flag)
+}
+
+// directiveBlock returns the comment with the directives that init suggests
+// for the findings. Only the ports are certain enough to be enabled.
+func (f *packageFindings) directiveBlock() []byte {
+	var b bytes.Buffer
+	b.WriteString("// Image settings for godockerize, generated by \"godockerize init\". The\n")
+	b.WriteString("// suggestions are disabled, remove the \"// \" in front of them to use them.\n")
+	if len(f.ports) != 0 {
+		b.WriteString("//\n")
+		fmt.Fprintf(&b, "//docker:expose %s\n", strings.Join(f.ports, " "))
+	}
+	if len(f.loopback) != 0 {
+		fmt.Fprintf(&b, "//\n// Only reachable inside of the container: %s\n", strings.Join(f.loopback, ", "))
+	}
+	if len(f.env) != 0 {
+		b.WriteString("//\n// Environment variables that the program reads:\n")
+		for _, v := range f.env {
+			fmt.Fprintf(&b, "// //docker:env %s=\n", v)
+		}
+	}
+	if len(f.files) != 0 {
+		b.WriteString("//\n// Files that the program uses, to be copied into the image or mounted:\n")
+		for _, file := range f.files {
+			fmt.Fprintf(&b, "// //docker:copy %s %s\n", filepath.Base(file), file)
+		}
+	}
+	if len(f.flags) != 0 {
+		b.WriteString("//\n// Flags of the program, which can be passed with \"docker run IMAGE -flag\":\n")
+		for _, flag := range f.flags {
+			fmt.Fprintf(&b, "//   %s\n", flag)
+		}
+	}
+	b.WriteString("//\n// Run the program as an unprivileged user:\n")
+	b.WriteString("// //docker:user app\n")
+	return b.Bytes()
+}
+
+// insertDirectives adds the comment block with directives to the file of pkg
+// with the main function, after its imports. It fails for a package that
+// already has directives rather than adding a second block.
+func insertDirectives(pkg *goPackage, block []byte, dryRun bool) error {
+	fset := token.NewFileSet()
+	var target *ast.File
+	var targetName string
+	for _, name := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		if len(directive.ScanFile(fset, file)) != 0 {
+			return fmt.Errorf("%s already has //docker: directives", pkg.ImportPath)
+		}
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+				target, targetName = file, filepath.Join(pkg.Dir, name)
+			}
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("%s has no main function", pkg.ImportPath)
+	}
+
+	if dryRun {
+		fmt.Printf("godockerize: Directives for %s:\n", targetName)
+		os.Stdout.Write(block)
+		return nil
+	}
+
+	end := target.Name.End()
+	for _, decl := range target.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			end = d.End()
+		}
+	}
+	data, err := ioutil.ReadFile(targetName)
+	if err != nil {
+		return err
+	}
+	offset := fset.Position(end).Offset
+	if i := bytes.IndexByte(data[offset:], '\n'); i != -1 {
+		offset += i + 1
+	} else {
+		offset = len(data)
+	}
+	var out bytes.Buffer
+	out.Write(data[:offset])
+	out.WriteString("\n")
+	out.Write(block)
+	if !bytes.HasPrefix(data[offset:], []byte("\n")) {
+		out.WriteString("\n")
+	}
+	out.Write(data[offset:])
+	if err := ioutil.WriteFile(targetName, out.Bytes(), 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Added directives to %s\n", targetName)
+	return nil
+}
+
+// starterConfig returns a project configuration in which everything is
+// commented out, as a starting point.
+func starterConfig(packages []*goPackage) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Configuration of godockerize, generated by \"godockerize init\".\n")
+	b.WriteString("# The keys are the flags of \"godockerize build\", which override them, as\n")
+	b.WriteString("# do their environment variables, e.g. GODOCKERIZE_BASE for base.\n")
+	b.WriteString("# The sections of packages override the keys for their images, and\n")
+	b.WriteString("# directives add to env and install.\n")
+	b.WriteString("#\n")
+	b.WriteString("# base: " + baseDockerImage + "\n")
+	b.WriteString("# tag:\n")
+	b.WriteString("#   - registry.example.com/{{.Name}}:latest\n")
+	b.WriteString("# env:\n")
+	b.WriteString("#   - LOG_LEVEL=info\n")
+	b.WriteString("# install:\n")
+	b.WriteString("#   - ca-certificates\n")
+	b.WriteString("# goflags: -trimpath\n")
+	b.WriteString("#\n")
+	b.WriteString("# Profiles selected with --profile, whose keys replace the ones above:\n")
+	b.WriteString("# profiles:\n")
+	b.WriteString("#   dev:\n")
+	b.WriteString("#     tag: dev/{{.Name}}\n")
+	b.WriteString("#   prod:\n")
+	b.WriteString("#     strip: true\n")
+	b.WriteString("#\n")
+	b.WriteString("# Shell commands run for each image, with a JSON description of the\n")
+	b.WriteString("# build on stdin; a failing one aborts the build:\n")
+	b.WriteString("# hooks:\n")
+	b.WriteString("#   pre-push: ./scripts/check-policy\n")
+	b.WriteString("#   post-push:\n")
+	b.WriteString("#     - curl -fsS -d @- https://deploy.example.com/images\n")
+	b.WriteString("#\n")
+	b.WriteString("# Settings for single packages:\n")
+	b.WriteString("# packages:\n")
+	for _, pkg := range packages {
+		b.WriteString("#   " + pkg.ImportPath + ":\n")
+		b.WriteString("#     base: gcr.io/distroless/static\n")
+	}
+	return b.Bytes()
+}
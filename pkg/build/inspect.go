@@ -0,0 +1,274 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// inspectResult is what inspect reports about an image.
+type inspectResult struct {
+	Directives []inspectDirective `json:"directives"`
+	Config     effectiveConfig    `json:"config"`
+}
+
+type inspectDirective struct {
+	Directive string `json:"directive"`
+	Args      string `json:"args,omitempty"`
+	Package   string `json:"package"`
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+}
+
+// effectiveConfig is the configuration of an image after merging the
+// directives and the flags.
+type effectiveConfig struct {
+	Entrypoint  string        `json:"entrypoint"`
+	Binaries    []string      `json:"binaries"`
+	Tags        []string      `json:"tags,omitempty"`
+	Base        string        `json:"base"`
+	BaseFamily  string        `json:"baseFamily"`
+	User        string        `json:"user,omitempty"`
+	Env         []string      `json:"env,omitempty"`
+	Expose      []string      `json:"expose,omitempty"`
+	Install     []string      `json:"install,omitempty"` // including the default packages
+	Run         []string      `json:"run,omitempty"`
+	Fragments   []string      `json:"fragments,omitempty"` // instructions of directive handlers
+	Includes    []string      `json:"includes,omitempty"`  // point: instruction
+	Volumes     []string      `json:"volumes,omitempty"`
+	Labels      []string      `json:"labels,omitempty"`
+	Copies      []inspectCopy `json:"copies,omitempty"`
+	Healthcheck []string      `json:"healthcheck,omitempty"`
+	Layering    string        `json:"layering"`
+	Flags       []string      `json:"flags,omitempty"` // set on the command line or by environment variables
+}
+
+type inspectCopy struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+func doInspect(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize inspect" requires 1 or more arguments`)
+	}
+	format := c.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid --format %q, must be table or json", format)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("inspect does not support path@version")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	// messages like the selected base image must not end up in the report
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	results, err := b.inspect(c, patterns)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if c.Bool("separate-images") {
+			return enc.Encode(results)
+		}
+		return enc.Encode(results[0])
+	}
+	for i, r := range results {
+		if i != 0 {
+			fmt.Println()
+		}
+		if err := r.writeTable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspect returns the directives and effective configuration of each image
+// that a build of the packages matching patterns would produce.
+func (b *builder) inspect(c *cli.Context, patterns []string) ([]*inspectResult, error) {
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := [][]*goPackage{packages}
+	if c.Bool("separate-images") {
+		groups = nil
+		for _, pkg := range packages {
+			groups = append(groups, []*goPackage{pkg})
+		}
+	}
+	var flags []string
+	for _, name := range c.FlagNames() {
+		if name != "format" {
+			flags = append(flags, name)
+		}
+	}
+	var results []*inspectResult
+	for _, pkgs := range groups {
+		spec, err := b.spec(pkgs)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, newInspectResult(spec, tags, flags))
+	}
+	return results, nil
+}
+
+// loadPatterns loads the packages matching patterns like a build would, for
+// commands that only look at them.
+func (b *builder) loadPatterns(patterns []string) ([]*goPackage, error) {
+	var packages []*goPackage
+	var err error
+	if b.inDocker {
+		packages, b.module, err = loadLocalPackages(b.goOpts, patterns)
+	} else {
+		packages, err = b.tc.loadPackages(b.goOpts, patterns)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.goOpts.goos == "windows" {
+		for _, pkg := range packages {
+			pkg.Exe = ".exe"
+		}
+	}
+	if err := b.findLicenses(packages); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+func newInspectResult(spec *imageSpec, tags, flags []string) *inspectResult {
+	r := &inspectResult{Directives: []inspectDirective{}}
+	for _, d := range spec.directives {
+		r.Directives = append(r.Directives, inspectDirective{
+			Directive: d.Name,
+			Args:      d.Args,
+			Package:   d.pkg,
+			File:      d.Pos.Filename,
+			Line:      d.Pos.Line,
+		})
+	}
+
+	cfg := &r.Config
+	cfg.Entrypoint = spec.family.binPath(spec.name())
+	for _, pkg := range spec.packages {
+		cfg.Binaries = append(cfg.Binaries, spec.family.binPath(pkg.binaryName()))
+	}
+	cfg.Tags = tags
+	cfg.Base = spec.base
+	cfg.BaseFamily = spec.family.name
+	cfg.User = spec.imageUser()
+	cfg.Env = sortedStringSet(spec.env)
+	cfg.Expose = sortedStringSet(spec.expose)
+	if spec.family.install != nil {
+		cfg.Install = sortedStringSet(append(append([]string{}, spec.defaultPackages()...), spec.install...))
+	}
+	cfg.Run = spec.run
+	for _, inst := range spec.fragments {
+		cfg.Fragments = append(cfg.Fragments, inst.String())
+	}
+	cfg.Volumes = sortedStringSet(spec.volumes)
+	cfg.Labels = sortedStringSet(spec.labels)
+	for _, point := range includePoints {
+		for _, inst := range spec.includes[point] {
+			cfg.Includes = append(cfg.Includes, point+": "+inst.String())
+		}
+	}
+	for _, a := range spec.copies {
+		cfg.Copies = append(cfg.Copies, inspectCopy{Source: a.src, Destination: a.dest})
+	}
+	cfg.Healthcheck = spec.healthcheckCommand()
+	cfg.Layering = spec.layering
+	if cfg.Layering == "" {
+		cfg.Layering = layeringPerBinary
+	}
+	cfg.Flags = sortedStringSet(flags)
+	return r
+}
+
+// writeTable prints r as two tables, the directives with their origin and
+// the effective configuration.
+func (r *inspectResult) writeTable() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTIVE\tARGS\tORIGIN")
+	for _, d := range r.Directives {
+		fmt.Fprintf(w, "%s\t%s\t%s:%d\n", d.Directive, d.Args, relPath(d.File), d.Line)
+	}
+	fmt.Fprintln(w)
+
+	cfg := &r.Config
+	row := func(key string, values ...string) {
+		if len(values) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s\t%s\n", key, values[0])
+		for _, v := range values[1:] {
+			fmt.Fprintf(w, "\t%s\n", v)
+		}
+	}
+	fmt.Fprintln(w, "SETTING\tVALUE")
+	row("entrypoint", cfg.Entrypoint)
+	row("binaries", cfg.Binaries...)
+	row("tags", cfg.Tags...)
+	row("base", cfg.Base+" ("+cfg.BaseFamily+")")
+	if cfg.User != "" {
+		row("user", cfg.User)
+	}
+	row("env", cfg.Env...)
+	row("expose", cfg.Expose...)
+	row("install", cfg.Install...)
+	row("run", cfg.Run...)
+	row("fragments", cfg.Fragments...)
+	row("includes", cfg.Includes...)
+	row("volumes", cfg.Volumes...)
+	row("labels", cfg.Labels...)
+	for _, a := range cfg.Copies {
+		row("copy", relPath(a.Source)+" -> "+a.Destination)
+	}
+	if cfg.Healthcheck != nil {
+		row("healthcheck", strings.Join(cfg.Healthcheck, " "))
+	}
+	row("layering", cfg.Layering)
+	if len(cfg.Flags) != 0 {
+		row("flags", "--"+strings.Join(cfg.Flags, " --"))
+	}
+	return w.Flush()
+}
+
+// relPath returns name relative to the working directory if it is below it.
+func relPath(name string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return name
+	}
+	rel, err := filepath.Rel(wd, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return name
+	}
+	return rel
+}
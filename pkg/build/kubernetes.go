@@ -0,0 +1,242 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// k8sOptions are the settings of the kubernetes command.
+type k8sOptions struct {
+	namespace      string
+	replicas       int
+	cpuRequest     string
+	memoryRequest  string
+	hpaMaxReplicas int // no HorizontalPodAutoscaler if 0
+	hpaCPUPercent  int
+}
+
+func doKubernetes(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize kubernetes" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("kubernetes does not support path@version")
+	}
+	if len(c.StringSlice("tag")) == 0 {
+		return errors.New(`kubernetes requires a tag template like "repo/{{.Name}}:latest" for the images of the deployments`)
+	}
+	opts := &k8sOptions{
+		namespace:      c.String("namespace"),
+		replicas:       c.Int("replicas"),
+		cpuRequest:     c.String("cpu-request"),
+		memoryRequest:  c.String("memory-request"),
+		hpaMaxReplicas: c.Int("hpa-max-replicas"),
+		hpaCPUPercent:  c.Int("hpa-cpu-percent"),
+	}
+	if opts.replicas < 1 {
+		return errors.New("--replicas must be at least 1")
+	}
+	if opts.hpaMaxReplicas != 0 {
+		if opts.hpaMaxReplicas < opts.replicas {
+			return errors.New("--hpa-max-replicas must not be less than --replicas")
+		}
+		if opts.cpuRequest == "" {
+			return errors.New("--hpa-max-replicas requires --cpu-request, the utilization is relative to it")
+		}
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	file := c.String("file")
+	stdout := os.Stdout
+	if file == "-" {
+		// messages like the selected base image must not end up in the manifests
+		os.Stdout = os.Stderr
+	}
+	data, err := b.kubernetesManifests(patterns, opts)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Wrote %s\n", file)
+	return nil
+}
+
+// kubernetesManifests returns a Deployment for each package matching
+// patterns, running the image that godockerize build --separate-images
+// would tag for it, and a Service for the ports it exposes.
+func (b *builder) kubernetesManifests(patterns []string, opts *k8sOptions) ([]byte, error) {
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var out strings.Builder
+	out.WriteString("# Generated by godockerize kubernetes.\n")
+	for i, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return nil, err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return nil, err
+		}
+		if i != 0 {
+			out.WriteString("---\n")
+		}
+		writeK8sManifests(&out, spec, tags[0], opts)
+	}
+	return []byte(out.String()), nil
+}
+
+// k8sPort is an exposed port of an image, as Kubernetes and Nomad name them.
+type k8sPort struct {
+	name     string // unique within the pod
+	port     string
+	protocol string // TCP, UDP or SCTP
+}
+
+func k8sPorts(spec *imageSpec) []k8sPort {
+	var ports []k8sPort
+	for _, p := range sortedStringSet(spec.expose) {
+		parts := strings.SplitN(p, "/", 2)
+		protocol := "tcp"
+		if len(parts) == 2 {
+			protocol = strings.ToLower(parts[1])
+		}
+		if strings.Contains(parts[0], "-") {
+			fmt.Fprintf(os.Stderr, "godockerize: Skipping port range %s of %s, only single ports are supported\n", p, spec.name())
+			continue
+		}
+		ports = append(ports, k8sPort{name: protocol + "-" + parts[0], port: parts[0], protocol: strings.ToUpper(protocol)})
+	}
+	return ports
+}
+
+func writeK8sManifests(out *strings.Builder, spec *imageSpec, image string, opts *k8sOptions) {
+	name := strings.TrimSuffix(spec.name(), spec.packages[0].Exe)
+	ports := k8sPorts(spec)
+	metadata := func() {
+		out.WriteString("metadata:\n")
+		fmt.Fprintf(out, "  name: %s\n", name)
+		if opts.namespace != "" {
+			fmt.Fprintf(out, "  namespace: %s\n", opts.namespace)
+		}
+		out.WriteString("  labels:\n")
+		fmt.Fprintf(out, "    app.kubernetes.io/name: %s\n", name)
+	}
+
+	out.WriteString("apiVersion: apps/v1\nkind: Deployment\n")
+	metadata()
+	out.WriteString("spec:\n")
+	if opts.hpaMaxReplicas == 0 {
+		fmt.Fprintf(out, "  replicas: %d\n", opts.replicas)
+	}
+	out.WriteString("  selector:\n    matchLabels:\n")
+	fmt.Fprintf(out, "      app.kubernetes.io/name: %s\n", name)
+	out.WriteString("  template:\n    metadata:\n      labels:\n")
+	fmt.Fprintf(out, "        app.kubernetes.io/name: %s\n", name)
+	out.WriteString("    spec:\n      containers:\n")
+	fmt.Fprintf(out, "        - name: %s\n", name)
+	fmt.Fprintf(out, "          image: %s\n", yamlString(image))
+	if len(ports) != 0 {
+		out.WriteString("          ports:\n")
+		for _, p := range ports {
+			fmt.Fprintf(out, "            - name: %s\n              containerPort: %s\n              protocol: %s\n", p.name, p.port, p.protocol)
+		}
+	}
+	if len(spec.env) != 0 {
+		out.WriteString("          env:\n")
+		for _, v := range sortedStringSet(spec.env) {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			fmt.Fprintf(out, "            - name: %s\n              value: %s\n", kv[0], yamlString(kv[1]))
+		}
+	}
+	if opts.cpuRequest != "" || opts.memoryRequest != "" {
+		out.WriteString("          resources:\n            requests:\n")
+		if opts.cpuRequest != "" {
+			fmt.Fprintf(out, "              cpu: %s\n", yamlString(opts.cpuRequest))
+		}
+		if opts.memoryRequest != "" {
+			fmt.Fprintf(out, "              memory: %s\n", yamlString(opts.memoryRequest))
+		}
+	}
+	if cmd := spec.healthcheckCommand(); cmd != nil {
+		for _, probe := range []string{"livenessProbe", "readinessProbe"} {
+			fmt.Fprintf(out, "          %s:\n            exec:\n              command:\n", probe)
+			for _, arg := range cmd {
+				fmt.Fprintf(out, "                - %s\n", yamlString(arg))
+			}
+		}
+	}
+	out.WriteString("          securityContext:\n            allowPrivilegeEscalation: false\n")
+	writeK8sUser(out, spec, "            ")
+
+	if len(ports) != 0 {
+		out.WriteString("---\napiVersion: v1\nkind: Service\n")
+		metadata()
+		out.WriteString("spec:\n  selector:\n")
+		fmt.Fprintf(out, "    app.kubernetes.io/name: %s\n", name)
+		out.WriteString("  ports:\n")
+		for _, p := range ports {
+			fmt.Fprintf(out, "    - name: %s\n      port: %s\n      targetPort: %s\n      protocol: %s\n", p.name, p.port, p.name, p.protocol)
+		}
+	}
+
+	if opts.hpaMaxReplicas != 0 {
+		out.WriteString("---\napiVersion: autoscaling/v2\nkind: HorizontalPodAutoscaler\n")
+		metadata()
+		out.WriteString("spec:\n  scaleTargetRef:\n    apiVersion: apps/v1\n    kind: Deployment\n")
+		fmt.Fprintf(out, "    name: %s\n", name)
+		fmt.Fprintf(out, "  minReplicas: %d\n  maxReplicas: %d\n", opts.replicas, opts.hpaMaxReplicas)
+		out.WriteString("  metrics:\n    - type: Resource\n      resource:\n        name: cpu\n        target:\n          type: Utilization\n")
+		fmt.Fprintf(out, "          averageUtilization: %d\n", opts.hpaCPUPercent)
+	}
+}
+
+// writeK8sUser adds the user of the image to a security context, with each
+// line indented by indent. Kubernetes can only check that a user is not root
+// if it is numeric, so a named user is noted instead.
+func writeK8sUser(out *strings.Builder, spec *imageSpec, indent string) {
+	user := spec.imageUser()
+	if user == "" {
+		return
+	}
+	name, group := splitUser(user)
+	if spec.family == distrolessFamily && user == distrolessFamily.nonroot {
+		name, group = "65532", "65532" // the IDs of nonroot in distroless
+	}
+	if !isNumeric(name) {
+		fmt.Fprintf(out, "%s# the image runs as user %s, set runAsUser to its ID to enforce runAsNonRoot\n", indent, user)
+		return
+	}
+	if name != "0" {
+		fmt.Fprintf(out, "%srunAsNonRoot: true\n", indent)
+	}
+	fmt.Fprintf(out, "%srunAsUser: %s\n", indent, name)
+	if isNumeric(group) {
+		fmt.Fprintf(out, "%srunAsGroup: %s\n", indent, group)
+	}
+}
@@ -0,0 +1,185 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const unknownLicense = "UNKNOWN"
+
+// moduleLicense is an entry of the --license-report: a Go module that the
+// binaries depend on with the licenses found in its files.
+type moduleLicense struct {
+	Path     string   `json:"path"`
+	Version  string   `json:"version,omitempty"`
+	Licenses []string `json:"licenses"` // SPDX identifiers, UNKNOWN if no file was recognized
+	Files    []string `json:"files,omitempty"`
+	UsedBy   []string `json:"usedBy"` // binaries
+}
+
+// licenseOptions are the settings of --licenses.
+type licenseOptions struct {
+	report string   // file for the report, may be empty
+	deny   []string // patterns of denied licenses, e.g. AGPL-* or UNKNOWN
+}
+
+func parseLicenseOptions(enabled bool, report string, deny []string) *licenseOptions {
+	var patterns []string
+	for _, v := range deny {
+		for _, v := range strings.Split(v, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				patterns = append(patterns, v)
+			}
+		}
+	}
+	if !enabled && report == "" && len(patterns) == 0 {
+		return nil
+	}
+	return &licenseOptions{report: report, deny: patterns}
+}
+
+// moduleLicenses finds the licenses of the modules that packages depend on,
+// except for the main module, from the module cache.
+func (t *toolchain) moduleLicenses(opts *goBuildOptions, packages []*goPackage) ([]*moduleLicense, error) {
+	var mods []*moduleLicense
+	byPath := make(map[string]*moduleLicense)
+	for _, pkg := range packages {
+		args := append([]string{"list", "-deps", "-f", `{{with .Module}}{{if not .Main}}{{.Path}}{{"\t"}}{{.Version}}{{"\t"}}{{.Dir}}{{end}}{{end}}`}, opts.listFlags()...)
+		out, err := t.goBuildCmd(opts, append(args, pkg.ImportPath)...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("go list -deps %s: %v", pkg.ImportPath, err)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) != 3 {
+				continue
+			}
+			m, ok := byPath[fields[0]]
+			if !ok {
+				m = &moduleLicense{Path: fields[0], Version: fields[1]}
+				if m.Licenses, m.Files, err = detectLicenses(fields[2]); err != nil {
+					return nil, err
+				}
+				byPath[m.Path] = m
+				mods = append(mods, m)
+			}
+			if len(m.UsedBy) == 0 || m.UsedBy[len(m.UsedBy)-1] != pkg.binaryName() {
+				m.UsedBy = append(m.UsedBy, pkg.binaryName())
+			}
+		}
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Path < mods[j].Path })
+	return mods, nil
+}
+
+// detectLicenses recognizes the license files in the root of the module in
+// dir. A module may have several, e.g. for dual licensing.
+func detectLicenses(dir string) ([]string, []string, error) {
+	if dir == "" {
+		return []string{unknownLicense}, nil, nil // not downloaded, e.g. vendored
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var licenses, files []string
+	for _, fi := range infos {
+		name := strings.ToLower(fi.Name())
+		if fi.IsDir() || !(strings.HasPrefix(name, "license") || strings.HasPrefix(name, "licence") || strings.HasPrefix(name, "copying")) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, fi.Name())
+		if id := classifyLicense(string(data)); id != unknownLicense {
+			licenses = append(licenses, id)
+		}
+	}
+	if len(licenses) == 0 {
+		return []string{unknownLicense}, files, nil
+	}
+	return sortedStringSet(licenses), files, nil
+}
+
+// licensePatterns recognize common licenses by phrases of their texts. The
+// more specific ones come first, e.g. the AGPL contains the name of the GPL.
+var licensePatterns = []struct {
+	id      string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"gnu affero general public license"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"EPL-2.0", []string{"eclipse public license", "2.0"}},
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "may be used to endorse or promote products"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+}
+
+func classifyLicense(text string) string {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	for _, p := range licensePatterns {
+		matched := true
+		for _, phrase := range p.phrases {
+			if !strings.Contains(text, phrase) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return p.id
+		}
+	}
+	return unknownLicense
+}
+
+// check fails if a module has a license that is denied.
+func (o *licenseOptions) check(mods []*moduleLicense) error {
+	var denied []string
+	for _, m := range mods {
+		for _, l := range m.Licenses {
+			for _, pattern := range o.deny {
+				if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(l)); ok {
+					denied = append(denied, fmt.Sprintf("%s %s (%s, used by %s)", m.Path, m.Version, l, strings.Join(m.UsedBy, ", ")))
+				}
+			}
+		}
+	}
+	if len(denied) != 0 {
+		return &stageError{stage: stageCheck, err: errors.New("denied licenses:\n  " + strings.Join(denied, "\n  "))}
+	}
+	return nil
+}
+
+// licenseSummary returns the licenses of the modules used by the binaries of
+// packages, for the label of their image.
+func licenseSummary(mods []*moduleLicense, packages []*goPackage) string {
+	binaries := make(map[string]bool)
+	for _, pkg := range packages {
+		binaries[pkg.binaryName()] = true
+	}
+	var licenses []string
+	for _, m := range mods {
+		for _, b := range m.UsedBy {
+			if binaries[b] {
+				licenses = append(licenses, m.Licenses...)
+				break
+			}
+		}
+	}
+	return strings.Join(sortedStringSet(licenses), ",")
+}
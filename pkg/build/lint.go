@@ -0,0 +1,439 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/urfave/cli/v2"
+)
+
+// lintFinding is a problem with a directive found by lint.
+type lintFinding struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Directive string `json:"directive"`
+	Message   string `json:"message"`
+}
+
+func (f *lintFinding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", f.File, f.Line, f.Column, f.Message)
+}
+
+var (
+	envNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	userNamePattern   = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+	exposePattern     = regexp.MustCompile(`^([0-9]+)(-([0-9]+))?(/(tcp|udp|sctp))?$`)
+	apkPackagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+._-]*$`)
+)
+
+func doLint(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize lint" requires 1 or more arguments`)
+	}
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid --format %q, must be text or json", format)
+	}
+	opts := &goBuildOptions{goos: c.String("goos"), goarch: c.String("goarch")}
+	tc := &toolchain{ctx: c.Context, goBin: c.String("go-bin")}
+	packages, err := tc.loadPackages(opts, args.Slice())
+	if err != nil {
+		return err
+	}
+
+	l := &linter{
+		family: baseFamilyOf(c.String("base")),
+		env:    make(map[string]string),
+		expose: make(map[string]bool),
+		dests:  make(map[string]bool),
+	}
+	if l.family == alpineFamily && !c.Bool("no-index") {
+		l.index = &apkIndex{ctx: c.Context, base: c.String("base"), arch: apkArch(opts.goarch)}
+	}
+	for _, pkg := range packages {
+		if err := l.lintPackage(pkg); err != nil {
+			return err
+		}
+	}
+
+	if format == "json" {
+		findings := l.findings
+		if findings == nil {
+			findings = []*lintFinding{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range l.findings {
+			fmt.Println(f)
+		}
+	}
+	if len(l.findings) != 0 {
+		return stageErrorf(stageDirective, "lint found %d problems", len(l.findings))
+	}
+	return nil
+}
+
+// linter checks the directives of packages and collects the findings. State
+// is kept across packages, since they end up in the same image.
+type linter struct {
+	family   *baseFamily
+	index    *apkIndex // nil if packages are not checked
+	findings []*lintFinding
+
+	user   string            // first //docker:user
+	env    map[string]string // variable to value
+	expose map[string]bool
+	dests  map[string]bool // of //docker:copy
+
+	healthcheck bool // seen //docker:healthcheck
+}
+
+func (l *linter) lintPackage(pkg *goPackage) error {
+	var paths []string
+	for _, name := range pkg.GoFiles {
+		paths = append(paths, filepath.Join(pkg.Dir, name))
+	}
+	directives, err := directive.ParseFiles(token.NewFileSet(), paths)
+	if err != nil {
+		return err
+	}
+	for _, d := range directives {
+		if err := l.lintDirective(pkg, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linter) lintDirective(pkg *goPackage, d *directive.Directive) error {
+	args := d.Fields()
+	report := func(format string, a ...interface{}) {
+		l.findings = append(l.findings, &lintFinding{
+			File:      d.Pos.Filename,
+			Line:      d.Pos.Line,
+			Column:    d.Pos.Column,
+			Directive: d.Name,
+			Message:   directive.Prefix + d.Name + ": " + fmt.Sprintf(format, a...),
+		})
+	}
+
+	switch d.Name {
+	case "env":
+		if len(args) == 0 {
+			report("requires NAME=value")
+		}
+		for _, arg := range args {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 || !envNamePattern.MatchString(kv[0]) {
+				report("%q is not of the form NAME=value", arg)
+				continue
+			}
+			if v, ok := l.env[kv[0]]; ok && v != kv[1] {
+				report("conflicting values %q and %q for %s", v, kv[1], kv[0])
+				continue
+			}
+			l.env[kv[0]] = kv[1]
+		}
+	case "expose":
+		if len(args) == 0 {
+			report("requires a port")
+		}
+		for _, arg := range args {
+			if msg := checkPort(arg); msg != "" {
+				report("%s", msg)
+				continue
+			}
+			if l.expose[arg] {
+				report("port %s is exposed twice", arg)
+			}
+			l.expose[arg] = true
+		}
+	case "install":
+		if len(args) == 0 {
+			report("requires a package")
+		}
+		if l.family.install == nil {
+			report("%s base images have no package manager", l.family.name)
+			break
+		}
+		for _, arg := range args {
+			name := arg
+			if i := strings.IndexAny(name, "=<>~"); i != -1 {
+				name = name[:i]
+			}
+			edge := strings.HasSuffix(name, "@edge")
+			name = strings.TrimSuffix(name, "@edge")
+			if l.family != alpineFamily {
+				continue
+			}
+			if !apkPackagePattern.MatchString(name) {
+				report("invalid package name %q", arg)
+				continue
+			}
+			if l.index == nil {
+				continue
+			}
+			_, ok, err := l.index.lookup(name, edge)
+			if err != nil {
+				return fmt.Errorf("%v (use --no-index to skip the check)", err)
+			}
+			if !ok {
+				report("package %s does not exist in %s", name, l.index.describe(edge))
+			}
+		}
+	case "run":
+		if len(args) == 0 {
+			report("requires a command")
+		}
+		if !l.family.shell {
+			report("%s base images have no shell", l.family.name)
+		}
+	case "user":
+		if len(args) != 1 {
+			report("requires exactly one user")
+			break
+		}
+		name, group := splitUser(args[0])
+		if !validUser(name) || (strings.Contains(args[0], ":") && !validUser(group)) {
+			report("invalid user[:group] %q", args[0])
+			break
+		}
+		if l.user != "" && l.user != args[0] {
+			report("conflicting users %s and %s", l.user, args[0])
+			break
+		}
+		l.user = args[0]
+	case "copy":
+		if len(args) != 2 {
+			report("requires a source and a destination")
+			break
+		}
+		if _, err := os.Lstat(filepath.Join(pkg.Dir, filepath.FromSlash(args[0]))); err != nil {
+			report("source %s does not exist", args[0])
+		}
+		if !strings.HasPrefix(args[1], "/") {
+			report("destination %s is not absolute", args[1])
+		}
+		if l.dests[args[1]] {
+			report("destination %s is copied to twice", args[1])
+		}
+		l.dests[args[1]] = true
+	case "nocompress":
+		if len(args) != 0 {
+			report("takes no arguments")
+		}
+	case "volume":
+		if len(args) == 0 {
+			report("requires a path")
+		}
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "/") {
+				report("volume %s is not absolute", arg)
+			}
+		}
+	case "healthcheck":
+		if len(args) == 0 {
+			report("requires a command")
+			break
+		}
+		if err := checkHealthcheckURL(args[0]); err != nil {
+			report("%v", err)
+		}
+		if l.healthcheck {
+			report("more than one healthcheck")
+		}
+		l.healthcheck = true
+	case "depends":
+		if len(args) == 0 {
+			report("requires a service")
+		}
+	case "include":
+		if len(args) != 2 {
+			report("requires a point and a file")
+			break
+		}
+		if err := checkIncludePoint(args[0]); err != nil {
+			report("%v", err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, filepath.FromSlash(args[1])))
+		if err != nil {
+			report("file %s does not exist", args[1])
+			break
+		}
+		if _, err := parseFragment(string(data)); err != nil {
+			report("%s: %v", args[1], err)
+		}
+	default:
+		if err := directive.Validate(d); errors.Is(err, directive.ErrUnknown) {
+			if directiveHandler(d.Name) == nil {
+				report("unknown directive")
+			}
+		} else if err != nil {
+			report("%v", errors.Unwrap(err))
+		}
+	}
+	return nil
+}
+
+// checkPort returns what is wrong with the argument of //docker:expose, in
+// the form port[-port][/protocol], or the empty string.
+func checkPort(s string) string {
+	m := exposePattern.FindStringSubmatch(s)
+	if m == nil {
+		return fmt.Sprintf("invalid port %q, must be port[-port][/tcp|udp|sctp]", s)
+	}
+	from, _ := strconv.Atoi(m[1])
+	to := from
+	if m[3] != "" {
+		to, _ = strconv.Atoi(m[3])
+	}
+	if from < 1 || to > 65535 || to < from {
+		return fmt.Sprintf("port %q is out of range", s)
+	}
+	return ""
+}
+
+func validUser(s string) bool {
+	return isNumeric(s) || userNamePattern.MatchString(s)
+}
+
+// apkIndex checks package names against the APKINDEX of the Alpine release
+// of the base image, which is downloaded on first use.
+type apkIndex struct {
+	ctx  context.Context
+	base string
+	arch string
+
+	packages map[string]map[string]string // by release
+}
+
+// release returns the branch of the Alpine repositories for the base image,
+// e.g. v3.12 for alpine:3.12.3.
+func (x *apkIndex) release(edge bool) string {
+	_, tag := splitTag(x.base)
+	if edge || tag == "edge" {
+		return "edge"
+	}
+	parts := strings.Split(tag, ".")
+	if len(parts) < 2 || !isNumeric(parts[0]) || !isNumeric(parts[1]) {
+		return "latest-stable"
+	}
+	return "v" + parts[0] + "." + parts[1]
+}
+
+func (x *apkIndex) describe(edge bool) string {
+	return "Alpine " + x.release(edge) + " (" + x.arch + ")"
+}
+
+// lookup returns the version of the package name in the index, which is
+// empty for names that are only provided by other packages.
+func (x *apkIndex) lookup(name string, edge bool) (string, bool, error) {
+	release := x.release(edge)
+	if x.packages == nil {
+		x.packages = make(map[string]map[string]string)
+	}
+	if _, ok := x.packages[release]; !ok {
+		packages := make(map[string]string)
+		for _, repo := range []string{"main", "community"} {
+			u := "https://dl-cdn.alpinelinux.org/alpine/" + release + "/" + repo + "/" + x.arch + "/APKINDEX.tar.gz"
+			if err := x.fetch(u, packages); err != nil {
+				return "", false, fmt.Errorf("fetching Alpine package index: %v", err)
+			}
+		}
+		x.packages[release] = packages
+	}
+	version, ok := x.packages[release][name]
+	return version, ok, nil
+}
+
+// fetch adds the packages in the APKINDEX.tar.gz at u to packages with their
+// versions, including the names that they provide.
+func (x *apkIndex) fetch(u string, packages map[string]string) error {
+	req, err := http.NewRequestWithContext(x.ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s: no APKINDEX", u)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "APKINDEX" {
+			break
+		}
+	}
+	s := bufio.NewScanner(tr)
+	var name string
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "P:"):
+			name = line[2:]
+			packages[name] = ""
+		case strings.HasPrefix(line, "V:"):
+			packages[name] = line[2:]
+		case strings.HasPrefix(line, "p:"):
+			for _, p := range strings.Fields(line[2:]) {
+				if i := strings.IndexAny(p, "=<>~"); i != -1 {
+					p = p[:i]
+				}
+				if _, ok := packages[p]; !ok {
+					packages[p] = ""
+				}
+			}
+		}
+	}
+	return s.Err()
+}
+
+// apkArch is the name of the Alpine architecture for GOARCH.
+func apkArch(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "x86"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7"
+	}
+	return goarch
+}
@@ -0,0 +1,126 @@
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildMetadata is the machine-readable result of a build, written by
+// --metadata-file.
+type buildMetadata struct {
+	ImageID         string           `json:"imageID"`
+	Digest          string           `json:"digest,omitempty"`
+	Tags            []string         `json:"tags"`
+	Binaries        []binaryMetadata `json:"binaries"`
+	GoVersion       string           `json:"goVersion"`
+	BaseImage       string           `json:"baseImage"`
+	BaseImageDigest string           `json:"baseImageDigest,omitempty"`
+	SBOM            string           `json:"sbom,omitempty"` // file written by --sbom
+}
+
+type binaryMetadata struct {
+	Name       string `json:"name"`
+	ImportPath string `json:"importPath"`
+	Size       int64  `json:"size"`
+}
+
+// collectMetadata describes the image built from packages. The sizes of the
+// binaries are taken from bindir unless it is empty. goVersion defaults to
+// the version of the toolchain.
+func collectMetadata(tc *toolchain, imageID string, tags []string, base, bindir, goVersion string, packages []*goPackage) (*buildMetadata, error) {
+	md := &buildMetadata{
+		ImageID:   imageID,
+		Tags:      append([]string{}, tags...),
+		BaseImage: base,
+	}
+
+	for _, pkg := range packages {
+		bin := binaryMetadata{
+			Name:       pkg.binaryName(),
+			ImportPath: pkg.ImportPath,
+		}
+		if bindir != "" {
+			fi, err := os.Stat(filepath.Join(bindir, bin.Name))
+			if err != nil {
+				return nil, err
+			}
+			bin.Size = fi.Size()
+		}
+		md.Binaries = append(md.Binaries, bin)
+	}
+
+	var err error
+	md.GoVersion = goVersion
+	if md.GoVersion == "" {
+		if md.GoVersion, err = tc.goVersion(); err != nil {
+			return nil, err
+		}
+	}
+	if base != "scratch" { // not an actual image
+		if md.BaseImageDigest, err = repoDigest(tc, base, base); err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) != 0 {
+		if md.Digest, err = repoDigest(tc, imageID, tags[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return md, nil
+}
+
+// repoDigest returns the digest under which image is known in the repository
+// of ref. It is empty if the image was never pushed to or pulled from there.
+func repoDigest(tc *toolchain, image, ref string) (string, error) {
+	digests, err := repoDigests(tc, image)
+	if err != nil {
+		return "", err
+	}
+	repo := repository(ref)
+	for _, d := range digests {
+		if strings.HasPrefix(d, "sha256:") {
+			// not qualified by a repository
+			return d, nil
+		}
+		if i := strings.LastIndex(d, "@"); i != -1 && d[:i] == repo {
+			return d[i+1:], nil
+		}
+	}
+	return "", nil
+}
+
+// repository strips the tag and digest from an image reference.
+func repository(ref string) string {
+	if i := strings.Index(ref, "@"); i != -1 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+func repoDigests(tc *toolchain, image string) ([]string, error) {
+	if tc.engine.noStore {
+		return tc.pushed[image], nil
+	}
+	if tc.api != nil {
+		img, err := tc.api.inspectImage(tc.ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		return img.RepoDigests, nil
+	}
+	out, err := tc.dockerCmd("image", "inspect", "--format", tc.engine.repoDigestsFormat(), image).Output()
+	if err != nil {
+		return nil, err
+	}
+	var digests []string
+	if err := json.Unmarshal(out, &digests); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
@@ -0,0 +1,309 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// dockerInstruction is an instruction of a Dockerfile, with its line
+// continuations joined.
+type dockerInstruction struct {
+	line int    // where it starts
+	cmd  string // upper case, e.g. "RUN"
+	args string
+}
+
+func (inst *dockerInstruction) String() string {
+	return inst.cmd + " " + inst.args
+}
+
+// migration is the result of translating a Dockerfile to directives.
+type migration struct {
+	file       string
+	directives []string // without the //docker: prefix
+	notes      []string // instructions that were not translated and why
+}
+
+func doMigrate(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() != 2 {
+		return errors.New(`"godockerize migrate" requires a Dockerfile and a package`)
+	}
+	file := args.Get(0)
+	instructions, err := parseDockerfile(file)
+	if err != nil {
+		return err
+	}
+	tc := &toolchain{ctx: c.Context, goBin: c.String("go-bin")}
+	packages, err := tc.loadPackages(&goBuildOptions{goos: "linux", goarch: runtime.GOARCH}, args.Slice()[1:])
+	if err != nil {
+		return err
+	}
+	if len(packages) != 1 {
+		return fmt.Errorf("%s matches %d packages, the Dockerfile can only be migrated to one", args.Get(1), len(packages))
+	}
+
+	m := &migration{file: file}
+	for _, inst := range finalStage(instructions) {
+		m.translate(inst)
+	}
+	if len(m.directives) != 0 {
+		if err := insertDirectives(packages[0], m.directiveBlock(), c.Bool("dry-run")); err != nil {
+			return err
+		}
+	}
+	for _, note := range m.notes {
+		fmt.Printf("godockerize: %s\n", note)
+	}
+	if len(m.directives) == 0 {
+		return fmt.Errorf("nothing in %s could be translated to directives", file)
+	}
+	return nil
+}
+
+// parseDockerfile returns the instructions of a Dockerfile without comments
+// and parser directives.
+func parseDockerfile(file string) ([]*dockerInstruction, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var instructions []*dockerInstruction
+	var current *dockerInstruction
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		continued := strings.HasSuffix(line, "\\")
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+		if current != nil {
+			current.args = strings.TrimSpace(current.args + " " + line)
+		} else {
+			parts := strings.SplitN(line, " ", 2)
+			current = &dockerInstruction{line: n, cmd: strings.ToUpper(parts[0])}
+			if len(parts) == 2 {
+				current.args = strings.TrimSpace(parts[1])
+			}
+		}
+		if !continued {
+			instructions = append(instructions, current)
+			current = nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		instructions = append(instructions, current)
+	}
+	return instructions, nil
+}
+
+// finalStage returns the instructions of the last stage of a multi-stage
+// Dockerfile, starting with its FROM. Earlier stages build the binaries,
+// which godockerize does itself.
+func finalStage(instructions []*dockerInstruction) []*dockerInstruction {
+	for i := len(instructions) - 1; i >= 0; i-- {
+		if instructions[i].cmd == "FROM" {
+			return instructions[i:]
+		}
+	}
+	return instructions
+}
+
+func (m *migration) note(inst *dockerInstruction, format string, args ...interface{}) {
+	m.notes = append(m.notes, fmt.Sprintf("%s:%d: not translated: %s (%s)", m.file, inst.line, inst, fmt.Sprintf(format, args...)))
+}
+
+// translate adds the directives for inst or notes why there are none.
+func (m *migration) translate(inst *dockerInstruction) {
+	switch inst.cmd {
+	case "FROM":
+		base := strings.Fields(inst.args)
+		if len(base) != 0 && base[0] != "scratch" {
+			m.note(inst, "build with --base %s", base[0])
+		}
+	case "EXPOSE":
+		if strings.Contains(inst.args, "$") {
+			m.note(inst, "variables are not supported")
+			return
+		}
+		m.directives = append(m.directives, "expose "+strings.Join(strings.Fields(inst.args), " "))
+	case "ENV":
+		words, ok := shellWords(inst.args)
+		if !ok {
+			m.note(inst, "unbalanced quotes")
+			return
+		}
+		if len(words) == 2 && !strings.Contains(words[0], "=") {
+			words = []string{words[0] + "=" + words[1]} // the legacy ENV NAME value
+		}
+		var env []string
+		for _, w := range words {
+			if !strings.Contains(w, "=") || strings.ContainsAny(w, " \t") {
+				m.note(inst, "values with whitespace can't be expressed as directives")
+				return
+			}
+			env = append(env, w)
+		}
+		m.directives = append(m.directives, "env "+strings.Join(env, " "))
+	case "RUN":
+		m.translateRun(inst)
+	case "USER":
+		m.directives = append(m.directives, "user "+inst.args)
+	case "VOLUME":
+		paths := strings.Fields(inst.args)
+		if strings.HasPrefix(inst.args, "[") {
+			if err := json.Unmarshal([]byte(inst.args), &paths); err != nil {
+				m.note(inst, "invalid JSON array")
+				return
+			}
+		}
+		m.directives = append(m.directives, "volume "+strings.Join(paths, " "))
+	case "HEALTHCHECK":
+		m.translateHealthcheck(inst)
+	case "ENTRYPOINT", "CMD":
+		m.note(inst, "the entrypoint is the binary of the package")
+	case "COPY", "ADD":
+		m.note(inst, "use //docker:copy for files other than the binary")
+	default:
+		m.note(inst, "no directive for %s", inst.cmd)
+	}
+}
+
+// translateRun turns the package installations of a RUN instruction into
+// //docker:install and the rest into //docker:run. Updating the package
+// index and cleaning up after it is done by //docker:install itself.
+func (m *migration) translateRun(inst *dockerInstruction) {
+	if strings.HasPrefix(inst.args, "[") || strings.HasPrefix(inst.args, "--") {
+		m.note(inst, "only the shell form without options is supported")
+		return
+	}
+	var install, run []string
+	for _, cmd := range strings.Split(inst.args, "&&") {
+		words := strings.Fields(cmd)
+		for len(words) != 0 && strings.Contains(words[0], "=") {
+			words = words[1:] // e.g. DEBIAN_FRONTEND=noninteractive
+		}
+		switch {
+		case len(words) >= 2 && words[0] == "apk" && words[1] == "add",
+			len(words) >= 2 && (words[0] == "apt-get" || words[0] == "apt" || words[0] == "dnf" || words[0] == "microdnf" || words[0] == "yum") && words[1] == "install":
+			for _, w := range words[2:] {
+				if !strings.HasPrefix(w, "-") {
+					install = append(install, w)
+				}
+			}
+		case len(words) >= 2 && (words[0] == "apk" || words[0] == "apt-get" || words[0] == "apt") && words[1] == "update",
+			len(words) >= 2 && (words[0] == "dnf" || words[0] == "microdnf" || words[0] == "yum") && words[1] == "clean",
+			len(words) >= 3 && words[0] == "rm" && (strings.HasPrefix(words[len(words)-1], "/var/cache/apk") || strings.HasPrefix(words[len(words)-1], "/var/lib/apt/lists")):
+			// done by //docker:install
+		case len(words) != 0:
+			run = append(run, strings.TrimSpace(cmd))
+		}
+	}
+	if len(install) != 0 {
+		m.directives = append(m.directives, "install "+strings.Join(install, " "))
+	}
+	if len(run) != 0 {
+		m.directives = append(m.directives, "run "+strings.Join(run, " && "))
+	}
+}
+
+func (m *migration) translateHealthcheck(inst *dockerInstruction) {
+	words := strings.Fields(inst.args)
+	if len(words) == 0 || strings.ToUpper(words[0]) == "NONE" {
+		m.note(inst, "only HEALTHCHECK CMD is supported")
+		return
+	}
+	if strings.HasPrefix(words[0], "--") {
+		m.note(inst, "options of HEALTHCHECK are not supported")
+		return
+	}
+	if strings.ToUpper(words[0]) != "CMD" {
+		m.note(inst, "only HEALTHCHECK CMD is supported")
+		return
+	}
+	cmd := strings.TrimSpace(inst.args[len(words[0]):])
+	var args []string
+	if strings.HasPrefix(cmd, "[") {
+		if err := json.Unmarshal([]byte(cmd), &args); err != nil {
+			m.note(inst, "invalid JSON array")
+			return
+		}
+	} else {
+		args = strings.Fields(cmd)
+	}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t") {
+			m.note(inst, "arguments with whitespace can't be expressed as directives")
+			return
+		}
+	}
+	m.directives = append(m.directives, "healthcheck "+strings.Join(args, " "))
+}
+
+func (m *migration) directiveBlock() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Image settings for godockerize, migrated from %s by \"godockerize migrate\".\n", m.file)
+	for _, d := range m.directives {
+		fmt.Fprintf(&b, "//docker:%s\n", d)
+	}
+	return b.Bytes()
+}
+
+// shellWords splits s into words like a shell, with single and double quotes
+// and backslash escapes. It reports false for unbalanced quotes.
+func shellWords(s string) ([]string, bool) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, false
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, true
+}
@@ -0,0 +1,149 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// nomadOptions are the settings of the nomad command.
+type nomadOptions struct {
+	job         string
+	datacenters []string
+	count       int
+	cpu         int // MHz
+	memory      int // MB
+}
+
+func doNomad(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize nomad" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("nomad does not support path@version")
+	}
+	if len(c.StringSlice("tag")) == 0 {
+		return errors.New(`nomad requires a tag template like "repo/{{.Name}}:latest" for the images of the tasks`)
+	}
+	opts := &nomadOptions{
+		job:         c.String("job"),
+		datacenters: c.StringSlice("datacenter"),
+		count:       c.Int("count"),
+		cpu:         c.Int("cpu"),
+		memory:      c.Int("memory"),
+	}
+	if opts.count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	file := c.String("file")
+	stdout := os.Stdout
+	if file == "-" {
+		// messages like the selected base image must not end up in the job
+		os.Stdout = os.Stderr
+	}
+	data, err := b.nomadJob(patterns, opts)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Wrote %s\n", file)
+	return nil
+}
+
+// nomadJob returns a Nomad job with a group for each package matching
+// patterns, whose task runs the image that godockerize build
+// --separate-images would tag for it with the docker driver.
+func (b *builder) nomadJob(patterns []string, opts *nomadOptions) ([]byte, error) {
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	job := opts.job
+	if job == "" {
+		job = strings.TrimSuffix(packages[0].binaryName(), packages[0].Exe)
+	}
+	var out strings.Builder
+	out.WriteString("# Generated by godockerize nomad.\n")
+	fmt.Fprintf(&out, "job %s {\n", hclString(job))
+	fmt.Fprintf(&out, "  datacenters = %s\n", hclList(opts.datacenters))
+	out.WriteString("  type        = \"service\"\n")
+	for _, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return nil, err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return nil, err
+		}
+		writeNomadGroup(&out, spec, tags[0], opts)
+	}
+	out.WriteString("}\n")
+	return []byte(out.String()), nil
+}
+
+func writeNomadGroup(out *strings.Builder, spec *imageSpec, image string, opts *nomadOptions) {
+	name := strings.TrimSuffix(spec.name(), spec.packages[0].Exe)
+	// port labels can only have letters, digits and underscores
+	var labels []string
+	ports := k8sPorts(spec)
+	for _, p := range ports {
+		labels = append(labels, strings.Replace(p.name, "-", "_", -1))
+	}
+
+	fmt.Fprintf(out, "\n  group %s {\n", hclString(name))
+	fmt.Fprintf(out, "    count = %d\n", opts.count)
+	if len(ports) != 0 {
+		out.WriteString("\n    network {\n")
+		for i, p := range ports {
+			fmt.Fprintf(out, "      port %s {\n        to = %s\n      }\n", hclString(labels[i]), p.port)
+		}
+		out.WriteString("    }\n")
+	}
+
+	fmt.Fprintf(out, "\n    task %s {\n", hclString(name))
+	out.WriteString("      driver = \"docker\"\n\n")
+	out.WriteString("      config {\n")
+	fmt.Fprintf(out, "        image = %s\n", hclString(image))
+	if len(labels) != 0 {
+		fmt.Fprintf(out, "        ports = %s\n", hclList(labels))
+	}
+	out.WriteString("      }\n")
+
+	if len(spec.env) != 0 {
+		out.WriteString("\n      env {\n")
+		for _, v := range sortedStringSet(spec.env) {
+			if kv := strings.SplitN(v, "=", 2); len(kv) == 2 {
+				fmt.Fprintf(out, "        %s = %s\n", kv[0], hclString(kv[1]))
+			}
+		}
+		out.WriteString("      }\n")
+	}
+
+	out.WriteString("\n      resources {\n")
+	fmt.Fprintf(out, "        cpu    = %d\n", opts.cpu)
+	fmt.Fprintf(out, "        memory = %d\n", opts.memory)
+	out.WriteString("      }\n")
+	out.WriteString("    }\n  }\n")
+}
@@ -0,0 +1,34 @@
+package build
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// output is where the result of a build goes instead of the local image
+// store, as given by --output.
+type output struct {
+	kind string // "binaries", "oci" or "docker-archive"
+	dest string // absolute path
+}
+
+func parseOutput(s string) (*output, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid --output %q, must be type:destination", s)
+	}
+	switch parts[0] {
+	case "binaries", "oci", "docker-archive":
+	default:
+		return nil, fmt.Errorf("invalid --output %q, unknown type %s", s, parts[0])
+	}
+	dest, err := filepath.Abs(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &output{kind: parts[0], dest: dest}, nil
+}
@@ -0,0 +1,178 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// goPackage is the part of the output of "go list -json" that is used by
+// godockerize.
+type goPackage struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	GoFiles    []string
+	Module     *goModule
+	Match      []string // command-line patterns matching this package
+
+	TestGoFiles, XTestGoFiles []string
+
+	Test bool   `json:"-"` // compiled into a test binary with "go test -c"
+	Exe  string `json:"-"` // suffix of executables on the target, e.g. ".exe"
+}
+
+// binaryName is the name of the binary in the image, the last element of the
+// import path.
+func (pkg *goPackage) binaryName() string {
+	if pkg.Test {
+		return path.Base(pkg.ImportPath) + ".test" + pkg.Exe
+	}
+	return path.Base(pkg.ImportPath) + pkg.Exe
+}
+
+type goModule struct {
+	Path    string
+	Version string
+	Dir     string
+	Main    bool
+}
+
+// loadPackages resolves the package arguments with the go command, so that
+// they work the same as for "go build": in modules, in go.work workspaces
+// spanning several modules and in GOPATH mode.
+// Files are selected for the target platform of opts.
+func (t *toolchain) loadPackages(opts *goBuildOptions, args []string) ([]*goPackage, error) {
+	listArgs := append(append([]string{"list", "-json"}, opts.listFlags()...), "--")
+	cmd := t.goBuildCmd(opts, append(listArgs, args...)...)
+	cmd.Stderr = t.stderr()
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var packages []*goPackage
+	dec := json.NewDecoder(out)
+	for {
+		pkg := &goPackage{}
+		if err := dec.Decode(pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+		packages = append(packages, pkg)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+
+	if opts.tests {
+		return testPackages(packages, args)
+	}
+
+	// Patterns like ./cmd/... select their main packages, other packages
+	// must be main packages.
+	var mains []*goPackage
+	matched := make(map[string]bool)
+	for _, pkg := range packages {
+		if pkg.Name == "main" {
+			mains = append(mains, pkg)
+			for _, m := range pkg.Match {
+				matched[m] = true
+			}
+			continue
+		}
+		for _, m := range pkg.Match {
+			if !isPattern(m) {
+				return nil, fmt.Errorf("%s is not a main package", pkg.ImportPath)
+			}
+		}
+	}
+	for _, arg := range args {
+		if isPattern(arg) && !matched[arg] {
+			return nil, fmt.Errorf("pattern %s matches no main packages", arg)
+		}
+	}
+
+	if err := checkBinaryNames(mains); err != nil {
+		return nil, err
+	}
+	return mains, nil
+}
+
+// testPackages selects the packages that have tests. Patterns may match
+// packages without tests, other packages must have some.
+func testPackages(packages []*goPackage, args []string) ([]*goPackage, error) {
+	var tested []*goPackage
+	matched := make(map[string]bool)
+	for _, pkg := range packages {
+		if len(pkg.TestGoFiles) != 0 || len(pkg.XTestGoFiles) != 0 {
+			pkg.Test = true
+			tested = append(tested, pkg)
+			for _, m := range pkg.Match {
+				matched[m] = true
+			}
+			continue
+		}
+		for _, m := range pkg.Match {
+			if !isPattern(m) {
+				return nil, fmt.Errorf("%s has no tests", pkg.ImportPath)
+			}
+		}
+	}
+	for _, arg := range args {
+		if isPattern(arg) && !matched[arg] {
+			return nil, fmt.Errorf("pattern %s matches no packages with tests", arg)
+		}
+	}
+	if err := checkBinaryNames(tested); err != nil {
+		return nil, err
+	}
+	return tested, nil
+}
+
+// checkBinaryNames reports an error if two packages would have the same
+// binary name. Packages of different modules in a workspace can easily end
+// up with the same last element of the import path.
+func checkBinaryNames(packages []*goPackage) error {
+	names := make(map[string]string)
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("binaries of %s and %s would both be named %s", other, pkg.ImportPath, name)
+		}
+		names[name] = pkg.ImportPath
+	}
+	return nil
+}
+
+// deps returns the import paths of the packages and all their dependencies.
+func (t *toolchain) deps(opts *goBuildOptions, packages []*goPackage) (map[string]bool, error) {
+	args := append(append([]string{"list", "-deps", "-f", "{{.ImportPath}}"}, opts.listFlags()...), "--")
+	for _, pkg := range packages {
+		args = append(args, pkg.ImportPath)
+	}
+	cmd := t.goBuildCmd(opts, args...)
+	cmd.Stderr = t.stderr()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+	deps := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			deps[line] = true
+		}
+	}
+	return deps, nil
+}
+
+func isPattern(arg string) bool {
+	return strings.Contains(arg, "...")
+}
@@ -0,0 +1,113 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// pluginPrefix starts the names of the executables on PATH that handle
+// directives godockerize doesn't know, e.g. godockerize-directive-fetch for
+// //docker:fetch. The directives section of the configuration file takes
+// precedence.
+const pluginPrefix = "godockerize-directive-"
+
+// pluginRequest is written as JSON to the stdin of a directive handler. The
+// arguments of the directive are also its command line arguments.
+type pluginRequest struct {
+	Directive string `json:"directive"`
+	Args      string `json:"args"`
+	Package   string `json:"package"` // import path
+	Dir       string `json:"dir"`     // of the package
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+}
+
+// pluginResult is what a directive handler prints as JSON on stdout. Every
+// field is optional, no output at all changes nothing.
+type pluginResult struct {
+	Dockerfile string   `json:"dockerfile"` // instructions for the final stage, added after those of //docker:run
+	Env        []string `json:"env"`
+	Expose     []string `json:"expose"`
+	Install    []string `json:"install"`
+	Volumes    []string `json:"volumes"`
+	Labels     []string `json:"labels"`
+}
+
+// directiveHandler returns the command that handles //docker:name, or nil if
+// there is none.
+func directiveHandler(name string) []string {
+	if projectCfg != nil {
+		if args, ok := projectCfg.handlers[name]; ok {
+			return args
+		}
+	}
+	if path, err := exec.LookPath(pluginPrefix + name); err == nil {
+		return []string{path}
+	}
+	return nil
+}
+
+// runPlugin lets handler process d of pkg and adds its result to spec. The
+// handler runs with the context of tc.
+func (spec *imageSpec) runPlugin(tc *toolchain, handler []string, d *directive.Directive, pkg *goPackage) error {
+	req, err := json.Marshal(&pluginRequest{
+		Directive: d.Name,
+		Args:      d.Args,
+		Package:   pkg.ImportPath,
+		Dir:       pkg.Dir,
+		File:      d.Pos.Filename,
+		Line:      d.Pos.Line,
+	})
+	if err != nil {
+		return err
+	}
+	// like the other commands, the handler is killed on Ctrl-C and --timeout
+	cmd := exec.CommandContext(tc.ctx, handler[0], append(append([]string{}, handler[1:]...), d.Fields()...)...)
+	cmd.Dir = pkg.Dir
+	cmd.Stdin = bytes.NewReader(req)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = tc.stderr()
+	if err := cmd.Run(); err != nil {
+		return tc.checkTimeout(stageDirective, stageErrorf(stageDirective, "%s: handler %s of //docker:%s: %v", d.Pos, handler[0], d.Name, err))
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil
+	}
+	var r pluginResult
+	if err := json.Unmarshal(stdout.Bytes(), &r); err != nil {
+		return stageErrorf(stageDirective, "%s: invalid output of handler %s of //docker:%s: %v", d.Pos, handler[0], d.Name, err)
+	}
+	instructions, err := parseFragment(r.Dockerfile)
+	if err != nil {
+		return stageErrorf(stageDirective, "%s: handler %s of //docker:%s: %v", d.Pos, handler[0], d.Name, err)
+	}
+	spec.fragments = append(spec.fragments, instructions...)
+	spec.env = append(spec.env, r.Env...)
+	spec.expose = append(spec.expose, r.Expose...)
+	spec.install = append(spec.install, r.Install...)
+	spec.volumes = append(spec.volumes, r.Volumes...)
+	spec.labels = append(spec.labels, r.Labels...)
+	return nil
+}
+
+// parseFragment splits the Dockerfile fragment of a handler into
+// instructions. Only instructions of the final stage are allowed, the rest is
+// validated with the whole Dockerfile.
+func parseFragment(s string) ([]dockerfile.Instruction, error) {
+	instructions, err := dockerfile.ParseText(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range instructions {
+		if inst.Cmd == "FROM" {
+			return nil, fmt.Errorf("the Dockerfile may not start a stage: %s", inst)
+		}
+	}
+	return instructions, nil
+}
@@ -0,0 +1,28 @@
+package build
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neelance/godockerize/pkg/directive"
+)
+
+func TestPluginTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc, cancelTimeout := (&toolchain{ctx: ctx}).withTimeout("timeout", 100*time.Millisecond)
+	defer cancelTimeout()
+
+	d := directive.Parse("//docker:fetch data")
+	spec := &imageSpec{}
+	start := time.Now()
+	err := spec.runPlugin(tc, []string{"sh", "-c", "exec sleep 10", "sh"}, d, &goPackage{ImportPath: "example.com/app", Dir: "."})
+	if err == nil || !strings.Contains(err.Error(), "--timeout 100ms") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the handler was not killed")
+	}
+}
@@ -0,0 +1,351 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// inferredPort is a port that a package listens on, found by inferPorts.
+type inferredPort struct {
+	port    string // e.g. "8080" or "53/udp"
+	pos     token.Position
+	call    string // e.g. "http.ListenAndServe"
+	handler string // of an HTTP server, see handlerName
+}
+
+// defaultServeMux is the handlerName of http.DefaultServeMux, which HTTP
+// servers without a handler use.
+const defaultServeMux = "http.DefaultServeMux"
+
+// handlerName returns the name of the variable holding the handler e,
+// defaultServeMux if e is nil or http.DefaultServeMux, or "" if it is
+// neither.
+func handlerName(e ast.Expr, httpPkg string) string {
+	switch e := e.(type) {
+	case nil:
+		return defaultServeMux
+	case *ast.Ident:
+		if e.Name == "nil" {
+			return defaultServeMux
+		}
+		return e.Name
+	case *ast.SelectorExpr:
+		if x, ok := e.X.(*ast.Ident); ok && x.Name == httpPkg && e.Sel.Name == "DefaultServeMux" {
+			return defaultServeMux
+		}
+	}
+	return ""
+}
+
+// addInferredPorts exposes the ports that the packages of spec and their
+// dependencies in the same modules listen on, for --infer-ports.
+func (b *builder) addInferredPorts(spec *imageSpec) error {
+	packages, err := b.tc.sourcePackages(b.goOpts, spec.packages, true)
+	if err != nil {
+		return err
+	}
+	ports, err := inferPorts(packages)
+	if err != nil {
+		return err
+	}
+	exposed := make(map[string]bool)
+	for _, p := range spec.expose {
+		exposed[strings.TrimSuffix(p, "/tcp")] = true
+	}
+	for _, p := range ports {
+		if exposed[p.port] {
+			continue
+		}
+		b.tc.printf("godockerize: Exposing %s, the address of %s at %s\n", p.port, p.call, relPath(p.pos.String()))
+		spec.expose = append(spec.expose, p.port)
+		exposed[p.port] = true
+	}
+	return nil
+}
+
+// sourcePackages returns the packages and those they depend on outside of
+// the standard library. With local, only those are returned that belong to
+// the main modules, or to no module in GOPATH mode.
+func (t *toolchain) sourcePackages(opts *goBuildOptions, packages []*goPackage, local bool) ([]*goPackage, error) {
+	args := append(append([]string{"list", "-deps", "-json"}, opts.listFlags()...), "--")
+	for _, pkg := range packages {
+		args = append(args, pkg.ImportPath)
+	}
+	cmd := t.goBuildCmd(opts, args...)
+	cmd.Stderr = t.stderr()
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var deps []*goPackage
+	dec := json.NewDecoder(out)
+	for {
+		var pkg struct {
+			goPackage
+			Standard bool
+		}
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+		if pkg.Standard || (local && pkg.Module != nil && !pkg.Module.Main) {
+			continue
+		}
+		p := pkg.goPackage
+		deps = append(deps, &p)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+	return deps, nil
+}
+
+// inferPorts looks for calls of net.Listen, net.ListenPacket, tls.Listen,
+// http.ListenAndServe and http.ListenAndServeTLS and for http.Server
+// literals whose address is constant: string literals, constants and
+// variables of the package, defaults of flags and concatenations of those.
+// Addresses on the loopback interface are left out.
+func inferPorts(packages []*goPackage) ([]inferredPort, error) {
+	var ports []inferredPort
+	seen := make(map[string]bool)
+	for _, pkg := range packages {
+		a, err := analyzeSource(pkg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range a.files {
+			a.findListeners(f)
+		}
+		for _, p := range a.ports {
+			if !seen[p.port] {
+				seen[p.port] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// analyzeSource parses the Go files of pkg and collects the values of their
+// constants, variables and flag defaults.
+func analyzeSource(pkg *goPackage) (*sourceAnalyzer, error) {
+	a := &sourceAnalyzer{fset: token.NewFileSet(), values: make(map[string]ast.Expr)}
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(a.fset, filepath.Join(pkg.Dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		a.collectValues(f)
+		a.files = append(a.files, f)
+	}
+	return a, nil
+}
+
+// sourceAnalyzer finds constant strings like listen addresses in the files
+// of a package.
+type sourceAnalyzer struct {
+	fset   *token.FileSet
+	files  []*ast.File
+	values map[string]ast.Expr // constants, variables and flag defaults by name
+	ports  []inferredPort
+	env    []*envVar
+}
+
+// importName returns the name under which f imports path, or "".
+func importName(f *ast.File, path string) string {
+	for _, imp := range f.Imports {
+		if imp.Path.Value != strconv.Quote(path) {
+			continue
+		}
+		if imp.Name != nil {
+			return imp.Name.Name
+		}
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+	return ""
+}
+
+// isCall reports whether e calls the function fn of the package imported
+// as pkgName.
+func isCall(e ast.Expr, pkgName, fn string) (*ast.CallExpr, bool) {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || pkgName == "" {
+		return nil, false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != fn {
+		return nil, false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return call, ok && x.Name == pkgName
+}
+
+// collectValues records the values of the constants and variables of f and
+// the defaults of the string flags that it defines.
+func (a *sourceAnalyzer) collectValues(f *ast.File) {
+	flagPkg := importName(f, "flag")
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ValueSpec:
+			for i, name := range n.Names {
+				if i < len(n.Values) {
+					a.setValue(name.Name, n.Values[i], flagPkg)
+				}
+			}
+		case *ast.AssignStmt:
+			if len(n.Lhs) == len(n.Rhs) {
+				for i, lhs := range n.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok {
+						a.setValue(id.Name, n.Rhs[i], flagPkg)
+					}
+				}
+			}
+		case *ast.CallExpr:
+			if call, ok := isCall(n, flagPkg, "StringVar"); ok && len(call.Args) >= 3 {
+				if u, ok := call.Args[0].(*ast.UnaryExpr); ok && u.Op == token.AND {
+					if id, ok := u.X.(*ast.Ident); ok {
+						a.values[id.Name] = call.Args[2]
+					}
+				}
+			}
+		}
+		return true
+	})
+}
+
+func (a *sourceAnalyzer) setValue(name string, e ast.Expr, flagPkg string) {
+	if call, ok := isCall(e, flagPkg, "String"); ok {
+		if len(call.Args) >= 2 {
+			a.values[name] = call.Args[1]
+		}
+		return
+	}
+	a.values[name] = e
+}
+
+// findListeners records the constant addresses that f listens on.
+func (a *sourceAnalyzer) findListeners(f *ast.File) {
+	netPkg, tlsPkg, httpPkg := importName(f, "net"), importName(f, "crypto/tls"), importName(f, "net/http")
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			for _, fn := range []struct{ pkg, name string }{{netPkg, "net"}, {tlsPkg, "tls"}} {
+				for _, listen := range []string{"Listen", "ListenPacket"} {
+					if call, ok := isCall(n, fn.pkg, listen); ok && len(call.Args) >= 2 {
+						a.addAddress(call.Args[1], call.Args[0], fn.name+"."+listen, "", call.Pos())
+					}
+				}
+			}
+			for _, listen := range []string{"ListenAndServe", "ListenAndServeTLS"} {
+				if call, ok := isCall(n, httpPkg, listen); ok && len(call.Args) >= 1 {
+					a.addAddress(call.Args[0], nil, "http."+listen, handlerName(call.Args[len(call.Args)-1], httpPkg), call.Pos())
+				}
+			}
+		case *ast.CompositeLit:
+			sel, ok := n.Type.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Server" {
+				break
+			}
+			if x, ok := sel.X.(*ast.Ident); !ok || x.Name != httpPkg || httpPkg == "" {
+				break
+			}
+			var addr, handler ast.Expr
+			var pos token.Pos
+			for _, elt := range n.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if key, ok := kv.Key.(*ast.Ident); ok {
+						switch key.Name {
+						case "Addr":
+							addr, pos = kv.Value, kv.Pos()
+						case "Handler":
+							handler = kv.Value
+						}
+					}
+				}
+			}
+			if addr != nil {
+				a.addAddress(addr, nil, "http.Server", handlerName(handler, httpPkg), pos)
+			}
+		}
+		return true
+	})
+}
+
+// addAddress records the port of the address addr on network, which is TCP
+// if it is nil, unless they are not constant. handler is that of an HTTP
+// server.
+func (a *sourceAnalyzer) addAddress(addr, network ast.Expr, call, handler string, pos token.Pos) {
+	proto := ""
+	if network != nil {
+		s, ok := a.value(network, 0)
+		switch {
+		case !ok || strings.HasPrefix(s, "unix"):
+			return
+		case strings.HasPrefix(s, "udp"):
+			proto = "/udp"
+		}
+	}
+	s, ok := a.value(addr, 0)
+	if !ok {
+		return
+	}
+	m := listenAddrPattern.FindStringSubmatch(s)
+	if m == nil {
+		return
+	}
+	port, err := strconv.Atoi(m[2])
+	if err != nil || port < 1 || port > 65535 {
+		return
+	}
+	switch m[1] {
+	case "localhost", "127.0.0.1", "[::1]":
+		return
+	}
+	a.ports = append(a.ports, inferredPort{port: m[2] + proto, pos: a.fset.Position(pos), call: call, handler: handler})
+}
+
+// value returns the constant string e evaluates to.
+func (a *sourceAnalyzer) value(e ast.Expr, depth int) (string, bool) {
+	if depth > 10 {
+		return "", false
+	}
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		return stringLiteral(e)
+	case *ast.ParenExpr:
+		return a.value(e.X, depth+1)
+	case *ast.StarExpr:
+		return a.value(e.X, depth+1)
+	case *ast.Ident:
+		if v, ok := a.values[e.Name]; ok {
+			return a.value(v, depth+1)
+		}
+	case *ast.BinaryExpr:
+		if e.Op != token.ADD {
+			break
+		}
+		x, ok := a.value(e.X, depth+1)
+		if !ok {
+			break
+		}
+		y, ok := a.value(e.Y, depth+1)
+		if !ok {
+			break
+		}
+		return x + y, true
+	}
+	return "", false
+}
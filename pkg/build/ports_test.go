@@ -0,0 +1,103 @@
+package build
+
+import (
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sourcePackage returns a package with the file main.go containing src.
+func sourcePackage(t *testing.T, src string) *goPackage {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return &goPackage{ImportPath: "example.com/app", Name: "main", Dir: dir, GoFiles: []string{"main.go"}}
+}
+
+func TestInferPorts(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []inferredPort // without pos
+	}{
+		{
+			name: "ListenAndServe",
+			src: `package main
+import "net/http"
+func main() { http.ListenAndServe(":8080", nil) }`,
+			want: []inferredPort{{port: "8080", call: "http.ListenAndServe", handler: defaultServeMux}},
+		},
+		{
+			name: "constants and flags",
+			src: `package main
+import ("flag"; "net"; "net/http")
+const host = "0.0.0.0"
+var addr = flag.String("addr", host+":9000", "")
+func main() {
+	net.ListenPacket("udp", ":53")
+	mux := http.NewServeMux()
+	http.ListenAndServeTLS(*addr, "cert", "key", mux)
+}`,
+			want: []inferredPort{
+				{port: "53/udp", call: "net.ListenPacket"},
+				{port: "9000", call: "http.ListenAndServeTLS", handler: "mux"},
+			},
+		},
+		{
+			name: "http.Server",
+			src: `package main
+import "net/http"
+func main() {
+	s := &http.Server{Handler: http.DefaultServeMux, Addr: ":8081"}
+	s.ListenAndServe()
+	(&http.Server{Addr: ":8082", Handler: logging(r)}).ListenAndServe()
+}`,
+			want: []inferredPort{
+				{port: "8081", call: "http.Server", handler: defaultServeMux},
+				{port: "8082", call: "http.Server"},
+			},
+		},
+		{
+			name: "left out",
+			src: `package main
+import ("net"; "net/http"; "os")
+func main() {
+	net.Listen("tcp", "localhost:8080")
+	net.Listen("unix", "/run/app.sock")
+	http.ListenAndServe(os.Getenv("ADDR"), nil)
+	http.ListenAndServe(":99999", nil)
+}`,
+		},
+		{
+			name: "duplicates",
+			src: `package main
+import ("net"; "net/http")
+func main() {
+	net.Listen("tcp", ":8080")
+	http.ListenAndServe(":8080", nil)
+}`,
+			want: []inferredPort{{port: "8080", call: "net.Listen"}},
+		},
+	}
+	for _, test := range tests {
+		ports, err := inferPorts([]*goPackage{sourcePackage(t, test.src)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range ports {
+			ports[i].pos = token.Position{}
+		}
+		if !reflect.DeepEqual(ports, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, ports, test.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parsePrebuilt parses the name=path values of --prebuilt into a map from
+// binary name to absolute path.
+func parsePrebuilt(values []string) (map[string]string, error) {
+	prebuilt := make(map[string]string)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --prebuilt %q, must be name=path", v)
+		}
+		if _, ok := prebuilt[parts[0]]; ok {
+			return nil, fmt.Errorf("--prebuilt given twice for %s", parts[0])
+		}
+		file, err := filepath.Abs(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --prebuilt %q: %v", v, err)
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("invalid --prebuilt %q: %s is a directory", v, parts[1])
+		}
+		prebuilt[parts[0]] = file
+	}
+	return prebuilt, nil
+}
+
+// checkPrebuilt makes sure that every binary given by --prebuilt belongs to
+// one of packages.
+func checkPrebuilt(prebuilt map[string]string, packages []*goPackage) error {
+	names := make(map[string]bool)
+	for _, pkg := range packages {
+		names[pkg.binaryName()] = true
+	}
+	for name := range prebuilt {
+		if !names[name] {
+			return fmt.Errorf("--prebuilt %s does not match any of the packages", name)
+		}
+	}
+	return nil
+}
+
+// copyPrebuilt puts the binary file into dir under name. Its key is derived
+// from its contents.
+func copyPrebuilt(tc *toolchain, name, file, dir string) (builtBinary, error) {
+	tc.printf("godockerize: Using prebuilt binary %s from %s\n", name, file)
+	h := sha256.New()
+	if err := hashFile(h, file); err != nil {
+		return builtBinary{}, err
+	}
+	if err := copyFile(file, filepath.Join(dir, name)); err != nil {
+		return builtBinary{}, err
+	}
+	return builtBinary{key: "prebuilt-" + hex.EncodeToString(h.Sum(nil))}, nil
+}
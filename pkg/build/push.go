@@ -0,0 +1,156 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doPush(c *cli.Context) error {
+	file := c.String("metadata-file")
+	if c.Args().Len() == 0 && file == "" {
+		return errors.New(`"godockerize push" requires 1 or more tags or --metadata-file`)
+	}
+	if c.Int("retries") < 0 {
+		return errors.New("--retries must not be negative")
+	}
+
+	tc, err := newToolchain(c)
+	if err != nil {
+		return err
+	}
+	defer tc.close()
+	if tc.engine.noStore {
+		return fmt.Errorf("push is not supported by %s, which has no local image store", tc.engine.name)
+	}
+	tc, cancel := tc.withTimeout("push-timeout", c.Duration("push-timeout"))
+	defer cancel()
+
+	// the images recorded in the metadata file are pushed by ID, so that a
+	// tag that was moved in the meantime can't push another image
+	var results []*buildMetadata
+	var multiple bool
+	ids := make(map[string]string)
+	tags := c.Args().Slice()
+	if file != "" {
+		if results, multiple, err = readMetadataFile(file); err != nil {
+			return err
+		}
+		for _, md := range results {
+			for _, tag := range md.Tags {
+				ids[tag] = md.ImageID
+				if c.Args().Len() == 0 {
+					tags = append(tags, tag)
+				}
+			}
+		}
+		for _, tag := range c.Args().Slice() {
+			if _, ok := ids[tag]; !ok {
+				return fmt.Errorf("%s is not a tag of %s", tag, file)
+			}
+		}
+		if len(tags) == 0 {
+			return fmt.Errorf("%s records no tags", file)
+		}
+	}
+
+	var refs []string
+	digests := make(map[string]string)
+	for _, tag := range tags {
+		image := tag
+		if id, ok := ids[tag]; ok {
+			if !imageExists(tc, id) {
+				return stageErrorf(stagePush, "image %s of %s is not in the local image store", id, tag)
+			}
+			if err := tagImage(tc, id, tag); err != nil {
+				return stageErrorf(stagePush, "tagging %s: %v", tag, err)
+			}
+			image = id
+		}
+		if err := pushWithRetries(tc, tag, c.Int("retries")); err != nil {
+			return tc.checkTimeout(stagePush, err)
+		}
+		digest, err := repoDigest(tc, image, tag)
+		if err != nil {
+			return stageErrorf(stagePush, "resolving digest of %s: %v", tag, err)
+		}
+		if digest == "" {
+			fmt.Printf("godockerize: Pushed %s, its digest is unknown\n", tag)
+			continue
+		}
+		digests[tag] = digest
+		ref := repository(tag) + "@" + digest
+		refs = append(refs, ref)
+		fmt.Printf("godockerize: Pushed %s as %s\n", tag, ref)
+	}
+
+	if digestFile := c.String("digest-file"); digestFile != "" {
+		if err := ioutil.WriteFile(digestFile, []byte(strings.Join(refs, "\n")), 0666); err != nil {
+			return err
+		}
+	}
+	if file != "" {
+		// the digest of the first tag, like after godockerize build --push
+		for _, md := range results {
+			if len(md.Tags) != 0 && digests[md.Tags[0]] != "" {
+				md.Digest = digests[md.Tags[0]]
+			}
+		}
+		var v interface{} = results[0]
+		if multiple {
+			v = results
+		}
+		if err := writeJSONFile(file, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushWithRetries pushes tag and tries again up to retries times if that
+// fails, waiting twice as long before each attempt, starting with a second.
+func pushWithRetries(tc *toolchain, tag string, retries int) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := pushImage(tc, tag)
+		if err == nil || attempt == retries || tc.ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(tc.stderr(), "godockerize: %v, retrying in %v\n", err, delay)
+		select {
+		case <-tc.ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// readMetadataFile reads a file written by --metadata-file, which holds the
+// metadata of one image or, if multiple, a list of them.
+func readMetadataFile(file string) (results []*buildMetadata, multiple bool, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+	if multiple = bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")); multiple {
+		err = json.Unmarshal(data, &results)
+	} else {
+		var md buildMetadata
+		err = json.Unmarshal(data, &md)
+		results = []*buildMetadata{&md}
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("reading %s: %v", file, err)
+	}
+	if len(results) == 0 {
+		return nil, false, fmt.Errorf("%s records no images", file)
+	}
+	return results, multiple, nil
+}
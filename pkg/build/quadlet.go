@@ -0,0 +1,98 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doQuadlet(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 1 {
+		return errors.New(`"godockerize quadlet" requires 1 or more arguments`)
+	}
+	patterns := args.Slice()
+	if hasVersion(patterns) {
+		return errors.New("quadlet does not support path@version")
+	}
+	if len(c.StringSlice("tag")) == 0 {
+		return errors.New(`quadlet requires a tag template like "repo/{{.Name}}:latest" for the images of the units`)
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		spec, err := b.spec([]*goPackage{pkg})
+		if err != nil {
+			return err
+		}
+		tags, err := b.imageTags(spec)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(spec.name(), pkg.Exe)
+		file := filepath.Join(c.String("dir"), name+".container")
+		if err := ioutil.WriteFile(file, []byte(quadletUnit(spec, name, tags[0], c.String("restart"))), 0666); err != nil {
+			return err
+		}
+		fmt.Printf("godockerize: Wrote %s\n", file)
+	}
+	return nil
+}
+
+// quadletUnit returns the .container unit of podman's systemd generator that
+// runs the image of spec as the container name.
+func quadletUnit(spec *imageSpec, name, image, restart string) string {
+	var out strings.Builder
+	out.WriteString("# Generated by godockerize quadlet.\n")
+	out.WriteString("[Unit]\n")
+	fmt.Fprintf(&out, "Description=%s\n", spec.packages[0].ImportPath)
+	out.WriteString("Wants=network-online.target\nAfter=network-online.target\n\n")
+
+	out.WriteString("[Container]\n")
+	fmt.Fprintf(&out, "Image=%s\n", image)
+	fmt.Fprintf(&out, "ContainerName=%s\n", name)
+	for _, port := range sortedStringSet(spec.expose) {
+		hostPort := strings.SplitN(port, "/", 2)[0]
+		fmt.Fprintf(&out, "PublishPort=%s:%s\n", hostPort, port)
+	}
+	for _, v := range sortedStringSet(spec.env) {
+		fmt.Fprintf(&out, "Environment=%s\n", systemdQuote(v))
+	}
+	for _, v := range sortedStringSet(spec.volumes) {
+		fmt.Fprintf(&out, "Volume=%s:%s\n", name+strings.Replace(v, "/", "-", -1), v)
+	}
+	if user := spec.imageUser(); user != "" {
+		user, group := splitUser(user)
+		fmt.Fprintf(&out, "User=%s\n", user)
+		if group != "" {
+			fmt.Fprintf(&out, "Group=%s\n", group)
+		}
+	}
+	out.WriteString("\n[Service]\n")
+	fmt.Fprintf(&out, "Restart=%s\n\n", restart)
+	out.WriteString("[Install]\nWantedBy=default.target\n")
+	return out.String()
+}
+
+// systemdQuote quotes s for a setting of a systemd unit if necessary, and
+// escapes the % of specifiers.
+func systemdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,549 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// imageRef is a parsed image reference like "alpine:3.12" or
+// "ghcr.io/org/app@sha256:...".
+type imageRef struct {
+	registry string // host as used for the API, e.g. registry-1.docker.io
+	repo     string // e.g. library/alpine
+	tag      string
+	digest   string
+}
+
+// parseImageRef parses s with the same defaults as docker: the first
+// component is the registry only if it looks like a host, images without
+// registry are on Docker Hub and official images are in library/.
+func parseImageRef(s string) (*imageRef, error) {
+	ref := &imageRef{}
+	rest := s
+	if i := strings.Index(rest, "@"); i != -1 {
+		rest, ref.digest = rest[:i], rest[i+1:]
+		if !strings.HasPrefix(ref.digest, "sha256:") {
+			return nil, fmt.Errorf("invalid image reference %q: unsupported digest", s)
+		}
+	}
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		rest, ref.tag = rest[:i], rest[i+1:]
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, ref.repo = parts[0], parts[1]
+	} else {
+		ref.registry, ref.repo = "docker.io", rest
+	}
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = "registry-1.docker.io"
+		if !strings.Contains(ref.repo, "/") {
+			ref.repo = "library/" + ref.repo
+		}
+	}
+	if ref.repo == "" || strings.ToLower(ref.repo) != ref.repo {
+		return nil, fmt.Errorf("invalid image reference %q", s)
+	}
+	return ref, nil
+}
+
+// reference returns the tag or else the digest, as used in manifest URLs.
+func (r *imageRef) reference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+func (r *imageRef) String() string {
+	s := r.registry + "/" + r.repo
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// registryClient talks to registries with the distribution API. Tokens are
+// requested once per repository and action, and again when they expire,
+// which matters for long pushes.
+//
+// --daemonless, verify, diff and the SBOM artifacts use a handful of
+// endpoints: manifests, blobs, uploads with cross-repository mounts and the
+// token flow. github.com/google/go-containerregistry would cover them, but
+// it requires a Go version far newer than that of go.mod and brings more
+// dependencies than godockerize has code; registry_test.go tests the client
+// against a registry in memory instead.
+type registryClient struct {
+	ctx      context.Context
+	client   *http.Client
+	insecure *http.Client // for --insecure-registry, does not verify certificates
+	creds    *credentials
+	tokens   map[string]*registryToken // by registry, repository and actions
+
+	insecureHosts map[string]bool
+	schemes       map[string]string // of insecure registries, found by trying https first
+}
+
+// registryToken is the Authorization header for a repository, empty if the
+// registry needs none.
+type registryToken struct {
+	auth    string
+	expires time.Time // zero if unknown
+}
+
+// newRegistryClient returns a client with the credentials, certificate
+// authorities and insecure registries of tc.
+func newRegistryClient(tc *toolchain) *registryClient {
+	return &registryClient{
+		ctx: tc.ctx,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: tc.registryCAs},
+		}},
+		insecure: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}},
+		creds:         tc.creds,
+		tokens:        make(map[string]*registryToken),
+		insecureHosts: tc.insecureRegistries,
+		schemes:       make(map[string]string),
+	}
+}
+
+// scheme returns http for registries on the local machine, as docker does,
+// and for insecure registries that don't speak https.
+func (rc *registryClient) scheme(registry string) string {
+	if s, ok := rc.schemes[registry]; ok {
+		return s
+	}
+	host := registry
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "127.0.0.1" || host == "[::1]" {
+		return "http"
+	}
+	return "https"
+}
+
+// ping does the initial request to the API of registry, which tells if it
+// needs authentication. An insecure registry that fails with https is
+// tried again with http.
+func (rc *registryClient) ping(registry string) (*http.Response, error) {
+	resp, err := rc.get(rc.scheme(registry)+"://"+registry+"/v2/", "", nil)
+	if err != nil && rc.insecureHosts[registry] && rc.scheme(registry) == "https" && rc.ctx.Err() == nil {
+		rc.schemes[registry] = "http"
+		return rc.get("http://"+registry+"/v2/", "", nil)
+	}
+	return resp, err
+}
+
+var errNoToken = errors.New("no token")
+
+// authorize returns the Authorization header for actions ("pull" or
+// "pull,push") on the repository of ref, if the registry needs one.
+func (rc *registryClient) authorize(ref *imageRef, actions string) (string, error) {
+	key := ref.registry + "/" + ref.repo + " " + actions
+	if t, ok := rc.tokens[key]; ok && (t.expires.IsZero() || time.Until(t.expires) > 30*time.Second) {
+		return t.auth, nil
+	}
+	resp, err := rc.ping(ref.registry)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	t := &registryToken{}
+	if resp.StatusCode == http.StatusUnauthorized {
+		creds, err := rc.creds.lookup(ref.registry)
+		if err != nil {
+			return "", err
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		scheme, params := parseChallenge(challenge)
+		switch {
+		case scheme == "bearer":
+			if t, err = rc.fetchToken(params, "repository:"+ref.repo+":"+actions, creds); err != nil {
+				return "", fmt.Errorf("%s: %v", ref.registry, err)
+			}
+		case scheme == "basic" && creds != nil && creds.Username != "":
+			t.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password))
+		case scheme == "basic":
+			return "", fmt.Errorf("%s: no credentials, use docker login or --registry-username", ref.registry)
+		default:
+			return "", fmt.Errorf("%s: unsupported authentication %q", ref.registry, challenge)
+		}
+	}
+	rc.tokens[key] = t
+	return t.auth, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(h string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(h), " ", 2)
+	params := make(map[string]string)
+	if len(parts) == 2 {
+		for _, p := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return strings.ToLower(parts[0]), params
+}
+
+// fetchToken requests a bearer token for scope from the token server of
+// the challenge, anonymously if creds is nil. An identity token, as stored
+// by docker login for some registries, is exchanged with OAuth2.
+func (rc *registryClient) fetchToken(params map[string]string, scope string, creds *authConfig) (*registryToken, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return nil, errors.New("missing realm in authentication challenge")
+	}
+	q := url.Values{"scope": {scope}}
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	var resp *http.Response
+	var err error
+	switch {
+	case creds != nil && creds.IdentityToken != "":
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", creds.IdentityToken)
+		q.Set("client_id", "godockerize")
+		header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+		resp, err = rc.do("POST", realm, "", header, strings.NewReader(q.Encode()), -1)
+	case creds != nil && creds.Username != "":
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Password))
+		resp, err = rc.get(realm+"?"+q.Encode(), auth, nil)
+	default:
+		resp, err = rc.get(realm+"?"+q.Encode(), "", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting token: %s", resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("requesting token: %v", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return nil, errNoToken
+	}
+	token := &registryToken{auth: "Bearer " + t.Token}
+	if t.ExpiresIn > 0 {
+		token.expires = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// send does a request on the repository of ref that needs actions. If the
+// registry rejects the token, which happens when it expires during a long
+// push, a new one is requested and the request is repeated with a new body
+// from open, which may be nil for requests without body.
+func (rc *registryClient) send(ref *imageRef, actions, method, u string, header http.Header, open func() (io.ReadCloser, error), size int64) (*http.Response, error) {
+	key := ref.registry + "/" + ref.repo + " " + actions
+	for retry := false; ; retry = true {
+		auth, err := rc.authorize(ref, actions)
+		if err != nil {
+			return nil, err
+		}
+		var body io.ReadCloser
+		if open != nil {
+			if body, err = open(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := rc.do(method, u, auth, header, body, size)
+		if body != nil {
+			body.Close()
+		}
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || auth == "" || retry {
+			return resp, err
+		}
+		resp.Body.Close()
+		delete(rc.tokens, key)
+	}
+}
+
+func (rc *registryClient) get(u, auth string, header http.Header) (*http.Response, error) {
+	return rc.do("GET", u, auth, header, nil, -1)
+}
+
+func (rc *registryClient) do(method, u, auth string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(rc.ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	if rc.insecureHosts[req.URL.Host] {
+		return rc.insecure.Do(req)
+	}
+	return rc.client.Do(req)
+}
+
+// repoURL returns the URL of path below the repository of ref.
+func (rc *registryClient) repoURL(ref *imageRef, path string) string {
+	return rc.scheme(ref.registry) + "://" + ref.registry + "/v2/" + ref.repo + "/" + path
+}
+
+// checkResponse returns an error for unsuccessful responses, with the
+// message of the registry if there is one.
+func checkResponse(resp *http.Response, what string) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var e struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	msg := resp.Status
+	if json.Unmarshal(data, &e) == nil && len(e.Errors) != 0 && e.Errors[0].Message != "" {
+		msg = e.Errors[0].Message
+	}
+	return fmt.Errorf("%s: %s", what, msg)
+}
+
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIConfig      = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer       = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerConfig   = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCIEmpty       = "application/vnd.oci.empty.v1+json"
+)
+
+// getManifest returns the manifest of ref or, with digest, of the same
+// repository, with its media type and digest.
+func (rc *registryClient) getManifest(ref *imageRef, reference string) ([]byte, string, string, error) {
+	accept := strings.Join([]string{mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest}, ", ")
+	resp, err := rc.send(ref, "pull", "GET", rc.repoURL(ref, "manifests/"+reference), http.Header{"Accept": {accept}}, nil, -1)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "fetching manifest of "+ref.String()); err != nil {
+		return nil, "", "", err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	digest := sha256Digest(data)
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, "", "", fmt.Errorf("manifest of %s has digest %s", ref, digest)
+	}
+	mediaType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &m) == nil && m.MediaType != "" {
+		mediaType = m.MediaType
+	}
+	return data, mediaType, digest, nil
+}
+
+// getBlob returns the contents of the blob with digest. The caller has to
+// close it.
+func (rc *registryClient) getBlob(ref *imageRef, digest string) (io.ReadCloser, error) {
+	resp, err := rc.send(ref, "pull", "GET", rc.repoURL(ref, "blobs/"+digest), nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, "fetching blob "+digest+" of "+ref.String()); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// blobExists reports whether the repository of ref has the blob.
+func (rc *registryClient) blobExists(ref *imageRef, digest string) (bool, error) {
+	resp, err := rc.send(ref, "pull,push", "HEAD", rc.repoURL(ref, "blobs/"+digest), nil, nil, -1)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// uploadBlob pushes size bytes from open as the blob with digest to the
+// repository of ref. If from is in the same registry, the blob is mounted
+// from there instead if possible, and open is not called.
+func (rc *registryClient) uploadBlob(ref *imageRef, digest string, size int64, open func() (io.ReadCloser, error), from *imageRef) error {
+	q := url.Values{}
+	if from != nil && from.registry == ref.registry && from.repo != ref.repo {
+		q.Set("mount", digest)
+		q.Set("from", from.repo)
+	}
+	u := rc.repoURL(ref, "blobs/uploads/")
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := rc.send(ref, "pull,push", "POST", u, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil // mounted
+	}
+	if err := checkResponse(resp, "uploading "+digest+" to "+ref.String()); err != nil {
+		return err
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("uploading %s to %s: %v", digest, ref, err)
+	}
+	q = loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+	if open == nil {
+		return fmt.Errorf("uploading %s to %s: can't mount blob", digest, ref)
+	}
+	resp, err = rc.send(ref, "pull,push", "PUT", loc.String(), http.Header{"Content-Type": {"application/octet-stream"}}, open, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "uploading "+digest+" to "+ref.String())
+}
+
+// putManifest pushes the manifest data to the tag or digest of ref.
+func (rc *registryClient) putManifest(ref *imageRef, mediaType string, data []byte) error {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := rc.send(ref, "pull,push", "PUT", rc.repoURL(ref, "manifests/"+ref.reference()), header, openBytes(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "pushing manifest to "+ref.String()); err != nil {
+		return err
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != sha256Digest(data) {
+		return fmt.Errorf("pushing manifest to %s: registry reports digest %s instead of %s", ref, digest, sha256Digest(data))
+	}
+	return nil
+}
+
+// pushArtifact pushes data as an OCI artifact of artifactType that refers to
+// the manifest with digest in the repository of ref. Registries with the
+// referrers API find it through the subject, for others it is also tagged
+// sha256-<hex>.<suffix> as cosign does.
+func (rc *registryClient) pushArtifact(ref *imageRef, digest, artifactType, title string, data []byte, suffix string) (string, error) {
+	subjectRef := *ref
+	subjectRef.tag, subjectRef.digest = "", digest
+	subject, mediaType, _, err := rc.getManifest(&subjectRef, digest)
+	if err != nil {
+		return "", err
+	}
+	empty := []byte("{}")
+	m := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        ociDescriptor{MediaType: mediaTypeOCIEmpty, Digest: sha256Digest(empty), Size: int64(len(empty))},
+		Layers: []ociDescriptor{{
+			MediaType:   artifactType,
+			Digest:      sha256Digest(data),
+			Size:        int64(len(data)),
+			Annotations: map[string]string{"org.opencontainers.image.title": title},
+		}},
+		Subject: &ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(subject))},
+	}
+	for _, blob := range [][]byte{empty, data} {
+		exists, err := rc.blobExists(ref, sha256Digest(blob))
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			if err := rc.uploadBlob(ref, sha256Digest(blob), int64(len(blob)), openBytes(blob), nil); err != nil {
+				return "", err
+			}
+		}
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	h, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	tagRef := *ref
+	tagRef.tag, tagRef.digest = "sha256-"+h+"."+suffix, ""
+	if err := rc.putManifest(&tagRef, mediaTypeOCIManifest, manifest); err != nil {
+		return "", err
+	}
+	return tagRef.String(), nil
+}
+
+// openBytes returns a function that opens data for registryClient.send.
+func openBytes(data []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func sha256Digest(data []byte) string {
+	h := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// digestHex returns the hex part of a sha256 digest, which has been
+// validated to be safe as a file name.
+func digestHex(digest string) (string, error) {
+	hexPart := strings.TrimPrefix(digest, "sha256:")
+	if len(hexPart) != 64 || !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexPart); err != nil {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return hexPart, nil
+}
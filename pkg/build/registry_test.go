@@ -0,0 +1,413 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry implements the parts of the distribution API and of the token
+// authentication that registryClient uses, keeping everything in memory.
+type fakeRegistry struct {
+	username, password string // required for tokens, if set
+
+	mu        sync.Mutex
+	tokens    map[string]bool   // valid tokens
+	manifests map[string][]byte // by repository and tag or digest, e.g. "app:1"
+	types     map[string]string // media types of manifests
+	blobs     map[string][]byte // by repository and digest, e.g. "app@sha256:..."
+	uploads   int
+	mounts    int
+	scopes    []string // of the token requests
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		tokens:    make(map[string]bool),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		blobs:     make(map[string][]byte),
+	}
+}
+
+// startFakeRegistry returns the registry and its host, which registryClient
+// talks to with http as it is on the local machine.
+func startFakeRegistry(t *testing.T, r *fakeRegistry) string {
+	t.Helper()
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// expireTokens makes the registry reject the tokens it has issued, like
+// when they expire during a long push.
+func (r *fakeRegistry) expireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = make(map[string]bool)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		if r.username != "" {
+			user, password, ok := req.BasicAuth()
+			if !ok || user != r.username || password != r.password {
+				http.Error(w, "invalid credentials", http.StatusUnauthorized)
+				return
+			}
+		}
+		r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+		token := fmt.Sprintf("token-%d", len(r.scopes))
+		r.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_in": 300})
+		return
+	}
+	if !r.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"code": "UNAUTHORIZED", "message": "authentication required"}}})
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		i := strings.Index(path, "/manifests/")
+		repo, reference := path[:i], path[i+len("/manifests/"):]
+		if req.Method == "PUT" {
+			data, _ := ioutil.ReadAll(req.Body)
+			digest := sha256Digest(data)
+			for _, key := range []string{repo + ":" + reference, repo + ":" + digest} {
+				r.manifests[key] = data
+				r.types[key] = req.Header.Get("Content-Type")
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, ok := r.manifests[repo+":"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}}})
+			return
+		}
+		w.Header().Set("Content-Type", r.types[repo+":"+reference])
+		w.Header().Set("Docker-Content-Digest", sha256Digest(data))
+		w.Write(data)
+	case strings.HasSuffix(path, "/blobs/uploads/") && req.Method == "POST":
+		repo := strings.TrimSuffix(path, "/blobs/uploads/")
+		q := req.URL.Query()
+		if data, ok := r.blobs[q.Get("from")+"@"+q.Get("mount")]; ok && q.Get("mount") != "" {
+			r.blobs[repo+"@"+q.Get("mount")] = data
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d?state=x", repo, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && req.Method == "PUT":
+		repo := path[:strings.Index(path, "/blobs/uploads/")]
+		data, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if sha256Digest(data) != digest || req.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"code": "DIGEST_INVALID", "message": "digest invalid"}}})
+			return
+		}
+		r.blobs[repo+"@"+digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		i := strings.Index(path, "/blobs/")
+		data, ok := r.blobs[path[:i]+"@"+path[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// testRegistryClient returns a client that has no credentials but those of
+// username for pushing to the registry host.
+func testRegistryClient(t *testing.T, host, username, password string) *registryClient {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// no credentials of the docker config
+	setenv(t, "DOCKER_CONFIG", dir)
+	tc := &toolchain{ctx: context.Background(), creds: newCredentials(context.Background(), username, password)}
+	if username != "" {
+		if err := tc.creds.pushTo(host + "/app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newRegistryClient(tc)
+}
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		in   string
+		want imageRef
+	}{
+		{"alpine", imageRef{registry: "registry-1.docker.io", repo: "library/alpine", tag: "latest"}},
+		{"alpine:3.12", imageRef{registry: "registry-1.docker.io", repo: "library/alpine", tag: "3.12"}},
+		{"docker.io/org/app:1", imageRef{registry: "registry-1.docker.io", repo: "org/app", tag: "1"}},
+		{"ghcr.io/org/app@" + digest, imageRef{registry: "ghcr.io", repo: "org/app", digest: digest}},
+		{"localhost:5000/app:1@" + digest, imageRef{registry: "localhost:5000", repo: "app", tag: "1", digest: digest}},
+		{"localhost/app", imageRef{registry: "localhost", repo: "app", tag: "latest"}},
+		{"org/app", imageRef{registry: "registry-1.docker.io", repo: "org/app", tag: "latest"}},
+	}
+	for _, test := range tests {
+		got, err := parseImageRef(test.in)
+		if err != nil {
+			t.Errorf("parseImageRef(%q): %v", test.in, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("parseImageRef(%q) = %+v, want %+v", test.in, *got, test.want)
+		}
+	}
+	for _, in := range []string{"App", "ghcr.io/org/app@md5:00", "ghcr.io/"} {
+		if _, err := parseImageRef(in); err == nil {
+			t.Errorf("parseImageRef(%q) did not fail", in)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	want := map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"}
+	if scheme != "bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("got %q, %q", scheme, params)
+	}
+	if scheme, _ := parseChallenge(`Basic realm="registry"`); scheme != "basic" {
+		t.Errorf("got scheme %q, want basic", scheme)
+	}
+}
+
+func TestRegistryPushAndPull(t *testing.T) {
+	r := newFakeRegistry()
+	r.username, r.password = "user", "secret"
+	host := startFakeRegistry(t, r)
+	rc := testRegistryClient(t, host, "user", "secret")
+	ref, err := parseImageRef(host + "/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := []byte("layer")
+	if exists, err := rc.blobExists(ref, sha256Digest(layer)); err != nil || exists {
+		t.Fatalf("blobExists before the upload = %v, %v", exists, err)
+	}
+	if err := rc.uploadBlob(ref, sha256Digest(layer), int64(len(layer)), openBytes(layer), nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := rc.blobExists(ref, sha256Digest(layer)); err != nil || !exists {
+		t.Fatalf("blobExists after the upload = %v, %v", exists, err)
+	}
+
+	// the token is requested again when the registry rejects it
+	r.expireTokens()
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `"}`)
+	if err := rc.putManifest(ref, mediaTypeOCIManifest, manifest); err != nil {
+		t.Fatal(err)
+	}
+	data, mediaType, digest, err := rc.getManifest(ref, ref.reference())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(manifest) || mediaType != mediaTypeOCIManifest || digest != sha256Digest(manifest) {
+		t.Errorf("getManifest = %s, %s, %s", data, mediaType, digest)
+	}
+	blob, err := rc.getBlob(ref, sha256Digest(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(got) != "layer" {
+		t.Errorf("getBlob = %q, %v", got, err)
+	}
+
+	// blobs of another repository of the registry are mounted
+	other, err := parseImageRef(host + "/app/other:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.uploadBlob(other, sha256Digest(layer), int64(len(layer)), nil, ref); err != nil {
+		t.Fatal(err)
+	}
+	if r.mounts != 1 || r.uploads != 1 {
+		t.Errorf("got %d mounts and %d uploads, want 1 of each", r.mounts, r.uploads)
+	}
+
+	want := []string{"repository:app:pull,push", "repository:app:pull,push", "repository:app:pull", "repository:app/other:pull,push"}
+	if !reflect.DeepEqual(r.scopes, want) {
+		t.Errorf("got token scopes %q, want %q", r.scopes, want)
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	r := newFakeRegistry()
+	r.username, r.password = "user", "secret"
+	host := startFakeRegistry(t, r)
+	ref, err := parseImageRef(host + "/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = testRegistryClient(t, host, "user", "wrong").getManifest(ref, ref.reference())
+	if err == nil || !strings.Contains(err.Error(), "requesting token: 401") {
+		t.Errorf("with wrong credentials: got %v", err)
+	}
+	_, _, _, err = testRegistryClient(t, host, "user", "secret").getManifest(ref, ref.reference())
+	if err == nil || err.Error() != "fetching manifest of "+ref.String()+": manifest unknown" {
+		t.Errorf("missing manifest: got %v", err)
+	}
+	layer := []byte("layer")
+	err = testRegistryClient(t, host, "user", "secret").uploadBlob(ref, sha256Digest([]byte("other")), int64(len(layer)), openBytes(layer), nil)
+	if err == nil || !strings.Contains(err.Error(), "digest invalid") {
+		t.Errorf("upload with the wrong digest: got %v", err)
+	}
+}
+
+func TestRegistryBasicAuth(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+	ref, err := parseImageRef(host + "/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := testRegistryClient(t, host, "user", "secret").blobExists(ref, sha256Digest(nil)); err != nil || exists {
+		t.Errorf("blobExists = %v, %v", exists, err)
+	}
+	if _, err := testRegistryClient(t, host, "", "").blobExists(ref, sha256Digest(nil)); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("without credentials: got %v", err)
+	}
+}
+
+// addBaseImage stores an image with a single layer in r as repo:tag.
+func (r *fakeRegistry) addBaseImage(t *testing.T, repo, tag string) {
+	t.Helper()
+	var tarBuf, gzBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	content := []byte("base\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/base", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	layer := gzBuf.Bytes()
+
+	config, err := json.Marshal(&imageConfig{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Config:       containerConfig{Env: []string{"PATH=/usr/bin:/bin"}},
+		RootFS:       imageRootFS{Type: "layers", DiffIDs: []string{sha256Digest(tarBuf.Bytes())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: sha256Digest(config), Size: int64(len(config))},
+		Layers:        []ociDescriptor{{MediaType: mediaTypeOCILayer, Digest: sha256Digest(layer), Size: int64(len(layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.blobs[repo+"@"+sha256Digest(config)] = config
+	r.blobs[repo+"@"+sha256Digest(layer)] = layer
+	r.manifests[repo+":"+tag] = manifest
+	r.types[repo+":"+tag] = mediaTypeOCIManifest
+}
+
+func TestDaemonlessPush(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the base image is a linux image")
+	}
+	r := newFakeRegistry()
+	r.addBaseImage(t, "base", "1")
+	host := startFakeRegistry(t, r)
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setenv(t, "DOCKER_CONFIG", dir)
+
+	err = runInDir(t, filepath.Join("testdata", "app"), "build", "--daemonless", "--base", host+"/base:1", "--no-default-packages", "--tag", host+"/app:1", "--push", "./cmd/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m ociManifest
+	if err := json.Unmarshal(r.manifests["app:1"], &m); err != nil {
+		t.Fatalf("pushed manifest: %v", err)
+	}
+	if len(m.Layers) < 2 {
+		t.Fatalf("got %d layers, want the base layer and the binary", len(m.Layers))
+	}
+	var base ociManifest
+	json.Unmarshal(r.manifests["base:1"], &base)
+	if m.Layers[0].Digest != base.Layers[0].Digest {
+		t.Errorf("the first layer is %s, want the base layer %s", m.Layers[0].Digest, base.Layers[0].Digest)
+	}
+	if r.mounts != 1 {
+		t.Errorf("got %d mounts, want the base layer mounted", r.mounts)
+	}
+	for _, l := range append([]ociDescriptor{m.Config}, m.Layers...) {
+		if data, ok := r.blobs["app@"+l.Digest]; !ok || sha256Digest(data) != l.Digest {
+			t.Errorf("blob %s was not pushed", l.Digest)
+		}
+	}
+	var config imageConfig
+	if err := json.Unmarshal(r.blobs["app@"+m.Config.Digest], &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.RootFS.DiffIDs) != len(m.Layers) || len(config.Config.Entrypoint) == 0 || config.Config.Env[0] != "PATH=/usr/bin:/bin" {
+		t.Errorf("got config %+v", config)
+	}
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// hasVersion reports whether any of the package arguments is of the form
+// path@version.
+func hasVersion(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchRemote resolves package arguments of the form path@version like
+// "go install path@version" does: it creates a temporary module that
+// requires the packages' modules at the given versions and switches the go
+// commands of t to it. It returns the arguments without versions and the
+// temporary directory, which the caller has to remove.
+func (t *toolchain) fetchRemote(args []string) ([]string, string, error) {
+	var paths []string
+	for _, arg := range args {
+		i := strings.Index(arg, "@")
+		if i == -1 || strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/") {
+			return nil, "", fmt.Errorf("%s: all packages must be remote and have a version if one of them has", arg)
+		}
+		paths = append(paths, arg[:i])
+	}
+
+	dir, err := ioutil.TempDir("", "godockerize-remote")
+	if err != nil {
+		return nil, "", err
+	}
+	t.dir = dir
+	// neither a workspace nor the module mode flags of the current
+	// directory apply to the temporary module
+	t.goEnv = append(t.goEnv, "GOWORK=off", "GOFLAGS=-mod=mod")
+
+	for _, cmdArgs := range [][]string{
+		{"mod", "init", "godockerize-remote"},
+		append([]string{"get"}, args...),
+	} {
+		t.printf("godockerize: Running go %s...\n", strings.Join(cmdArgs, " "))
+		cmd := t.goCmd(cmdArgs...)
+		cmd.Stdout = t.stdout()
+		cmd.Stderr = t.stderr()
+		if err := cmd.Run(); err != nil {
+			os.RemoveAll(dir)
+			return nil, "", fmt.Errorf("go %s: %v", cmdArgs[0], err)
+		}
+	}
+	return paths, dir, nil
+}
@@ -0,0 +1,132 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doRun(c *cli.Context) error {
+	patterns, runArgs := splitRunArgs(c.Args().Slice())
+	if len(patterns) < 1 {
+		return errors.New(`"godockerize run" requires 1 or more packages`)
+	}
+	b, err := newRunBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	results, err := b.buildPatterns(c, patterns)
+	if err != nil {
+		return err
+	}
+	if err := writeResults(c, results, false); err != nil {
+		return err
+	}
+	id := results[0].ImageID
+
+	args := []string{"run", "--rm", "-i"}
+	if isTerminal(os.Stdin) {
+		args = append(args, "-t")
+	}
+	opts, err := b.runOptions(c, id, make(map[string]string))
+	if err != nil {
+		return err
+	}
+	args = append(append(append(args, opts...), id), runArgs...)
+
+	// The command is not bound to the context: the engine forwards signals
+	// to the container, which gets to shut down before it is removed.
+	fmt.Printf("godockerize: Running %s...\n", id)
+	cmd := exec.Command(b.tc.dockerBin, append(append([]string{}, b.tc.dockerOpts...), b.tc.engine.args(args)...)...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker run: %v", err)
+	}
+	return nil
+}
+
+// newRunBuilder returns the builder for commands that run the image they
+// build, which has to end up in the local image store.
+func newRunBuilder(c *cli.Context) (*builder, error) {
+	switch {
+	case c.Bool("dry-run"):
+		return nil, fmt.Errorf("%s does not support --dry-run", c.Command.Name)
+	case c.Bool("separate-images"), c.IsSet("go-versions"):
+		return nil, fmt.Errorf("%s builds only one image, --separate-images and --go-versions are not supported", c.Command.Name)
+	case c.IsSet("output"):
+		return nil, fmt.Errorf("%s does not support --output", c.Command.Name)
+	}
+	b, err := newBuilder(c)
+	if err != nil {
+		return nil, err
+	}
+	if e := b.tc.engine; e.noStore || e.noRun || e.api {
+		b.cancel()
+		return nil, fmt.Errorf("%s is not supported by %s", c.Command.Name, e.name)
+	}
+	return b, nil
+}
+
+// runOptions returns the options for running the image id: its exposed
+// ports are published on the same ports of the host and its volumes are
+// mounted from the directories in volumes, which gets new temporary
+// directories for the ones that are missing. --run-env and --run-opt are
+// added to them.
+func (b *builder) runOptions(c *cli.Context, id string, volumes map[string]string) ([]string, error) {
+	out, err := b.tc.dockerCmd("image", "inspect", "--format", "{{json .Config}}", id).Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting image: %v", err)
+	}
+	var config containerConfig
+	if err := json.Unmarshal(out, &config); err != nil {
+		return nil, fmt.Errorf("inspecting image: %v", err)
+	}
+
+	var opts []string
+	for _, port := range sortedStringSet(keys(config.ExposedPorts)) {
+		hostPort := strings.SplitN(port, "/", 2)[0]
+		opts = append(opts, "-p", hostPort+":"+port)
+	}
+	for _, v := range sortedStringSet(keys(config.Volumes)) {
+		dir, ok := volumes[v]
+		if !ok {
+			if dir, err = ioutil.TempDir("", "godockerize-volume"); err != nil {
+				return nil, err
+			}
+			volumes[v] = dir
+			fmt.Printf("godockerize: Mounting %s at %s\n", dir, v)
+		}
+		opts = append(opts, "-v", dir+":"+v)
+	}
+	for _, v := range c.StringSlice("run-env") {
+		opts = append(opts, "-e", v)
+	}
+	return append(opts, c.StringSlice("run-opt")...), nil
+}
+
+// splitRunArgs splits the arguments of run at "--" into the packages and the
+// arguments of the entrypoint.
+func splitRunArgs(args []string) (patterns, runArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// isTerminal reports whether f is a character device, e.g. a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
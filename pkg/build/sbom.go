@@ -0,0 +1,548 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sbomSPDX      = "spdx"
+	sbomCycloneDX = "cyclonedx"
+)
+
+// sbomOptions are the settings of --sbom.
+type sbomOptions struct {
+	format string // sbomSPDX or sbomCycloneDX
+	dir    string // where the files are written
+	attach bool   // push the SBOM as an artifact referring to the image
+}
+
+func parseSBOMOptions(format, dir string, attach bool) (*sbomOptions, error) {
+	switch format {
+	case "":
+		if attach {
+			return nil, errors.New("--attach-sbom requires --sbom")
+		}
+		return nil, nil
+	case sbomSPDX, sbomCycloneDX:
+		return &sbomOptions{format: format, dir: dir, attach: attach}, nil
+	default:
+		return nil, fmt.Errorf("invalid --sbom %q, must be spdx or cyclonedx", format)
+	}
+}
+
+// fileName is the name of the SBOM of the image with the entrypoint name.
+func (o *sbomOptions) fileName(name string) string {
+	if o.format == sbomCycloneDX {
+		return name + ".cdx.json"
+	}
+	return name + ".spdx.json"
+}
+
+// mediaType is the media type of the SBOM as a registry artifact.
+func (o *sbomOptions) mediaType() string {
+	if o.format == sbomCycloneDX {
+		return "application/vnd.cyclonedx+json"
+	}
+	return "application/spdx+json"
+}
+
+// goBinaryInfo is what "go version -m" tells about a binary: the modules it
+// was built from and the settings of the build, e.g. -ldflags and GOOS.
+type goBinaryInfo struct {
+	name      string
+	goVersion string
+	path      string // of the main package
+	main      goModuleInfo
+	deps      []goModuleInfo
+	settings  [][2]string
+}
+
+type goModuleInfo struct {
+	path, version string
+}
+
+func (m goModuleInfo) purl() string {
+	purl := "pkg:golang/" + m.path
+	if m.version != "" && m.version != "(devel)" {
+		purl += "@" + url.PathEscape(m.version)
+	}
+	return purl
+}
+
+// readBuildInfo reads the build information of the binary name in dir. It
+// has to be done before the binary is compressed.
+func (t *toolchain) readBuildInfo(dir, name string) (*goBinaryInfo, error) {
+	out, err := t.goCmd("version", "-m", filepath.Join(dir, name)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go version -m %s: %v", name, err)
+	}
+	info := &goBinaryInfo{name: name}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for first := true; s.Scan(); first = false {
+		if first {
+			if i := strings.LastIndex(s.Text(), ": "); i != -1 {
+				info.goVersion = s.Text()[i+2:]
+			}
+			continue
+		}
+		fields := strings.Split(strings.TrimPrefix(s.Text(), "\t"), "\t")
+		switch {
+		case fields[0] == "path" && len(fields) >= 2:
+			info.path = fields[1]
+		case fields[0] == "mod" && len(fields) >= 3:
+			info.main = goModuleInfo{fields[1], fields[2]}
+		case fields[0] == "dep" && len(fields) >= 3:
+			info.deps = append(info.deps, goModuleInfo{fields[1], fields[2]})
+		case fields[0] == "=>" && len(fields) >= 3 && len(info.deps) != 0:
+			// the module that replaces the previous dependency is in the binary
+			info.deps[len(info.deps)-1] = goModuleInfo{fields[1], fields[2]}
+		case fields[0] == "build" && len(fields) >= 2:
+			kv := strings.SplitN(fields[1], "=", 2)
+			if len(kv) == 2 && !strings.HasPrefix(kv[0], "DefaultGODEBUG") {
+				info.settings = append(info.settings, [2]string{kv[0], strings.Trim(kv[1], `"`)})
+			}
+		}
+	}
+	if info.goVersion == "" {
+		return nil, fmt.Errorf("go version -m %s: not a Go binary", name)
+	}
+	return info, nil
+}
+
+// osPackage is a package that the package manager of the base image
+// installed.
+type osPackage struct {
+	manager string // apk, deb or rpm
+	name    string
+	version string // empty if unknown
+	arch    string
+}
+
+func (p osPackage) purl(family *baseFamily) string {
+	namespace := map[string]string{"apk": family.name, "deb": "debian", "rpm": "redhat"}[p.manager]
+	purl := "pkg:" + p.manager + "/" + namespace + "/" + p.name
+	if p.version != "" {
+		purl += "@" + url.PathEscape(p.version)
+	}
+	if p.arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.arch)
+	}
+	return purl
+}
+
+// packageQueries are the commands that list the packages in images of a
+// family, with the function that parses their output. Families without a
+// shell or package manager, e.g. distroless and scratch, have none.
+var packageQueries = map[string]packageQuery{
+	"alpine":      apkQuery,
+	"wolfi":       apkQuery,
+	"debian":      {"deb", []string{"cat", "/var/lib/dpkg/status"}, parseDPKGStatus},
+	"ubi":         rpmQuery,
+	"ubi-minimal": rpmQuery,
+}
+
+type packageQuery struct {
+	manager string
+	cmd     []string
+	parse   func([]byte) []osPackage
+}
+
+var (
+	apkQuery = packageQuery{"apk", []string{"cat", "/lib/apk/db/installed"}, parseAPKInstalled}
+	rpmQuery = packageQuery{"rpm", []string{"rpm", "-qa", "--qf", `%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\n`}, parseRPMList}
+)
+
+// listOSPackages returns the packages installed in the image. If the engine
+// can't run the image, only the packages that godockerize installed are
+// known, without their versions.
+func listOSPackages(tc *toolchain, imageID string, spec *imageSpec) ([]osPackage, error) {
+	q, ok := packageQueries[spec.family.name]
+	if !ok {
+		return nil, nil
+	}
+	if tc.engine.noStore || tc.engine.api || tc.engine.noRun {
+		tc.printf("godockerize: %s can't run the image, the SBOM lists only the packages installed by godockerize\n", tc.engine.name)
+		var pkgs []osPackage
+		for _, name := range sortedStringSet(append(append([]string{}, spec.defaultPackages()...), spec.install...)) {
+			pkgs = append(pkgs, osPackage{manager: q.manager, name: name})
+		}
+		return pkgs, nil
+	}
+	out, err := tc.dockerCmd(append([]string{"run", "--rm", "--entrypoint", q.cmd[0], imageID}, q.cmd[1:]...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing packages of image: %v", err)
+	}
+	return q.parse(out), nil
+}
+
+// parseAPKInstalled parses the database of apk, which has a paragraph per
+// package with lines like "P:name".
+func parseAPKInstalled(data []byte) []osPackage {
+	var pkgs []osPackage
+	for _, para := range strings.Split(string(data), "\n\n") {
+		p := osPackage{manager: "apk"}
+		for _, line := range strings.Split(para, "\n") {
+			if len(line) < 2 || line[1] != ':' {
+				continue
+			}
+			switch line[0] {
+			case 'P':
+				p.name = line[2:]
+			case 'V':
+				p.version = line[2:]
+			case 'A':
+				p.arch = line[2:]
+			}
+		}
+		if p.name != "" {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs
+}
+
+// parseDPKGStatus parses /var/lib/dpkg/status, which lists packages in
+// paragraphs of RFC 822 style fields.
+func parseDPKGStatus(data []byte) []osPackage {
+	var pkgs []osPackage
+	for _, para := range strings.Split(string(data), "\n\n") {
+		p := osPackage{manager: "deb"}
+		installed := false
+		for _, line := range strings.Split(para, "\n") {
+			kv := strings.SplitN(line, ": ", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Package":
+				p.name = kv[1]
+			case "Version":
+				p.version = kv[1]
+			case "Architecture":
+				p.arch = kv[1]
+			case "Status":
+				installed = strings.HasSuffix(kv[1], " installed")
+			}
+		}
+		if p.name != "" && installed {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs
+}
+
+func parseRPMList(data []byte) []osPackage {
+	var pkgs []osPackage
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		pkgs = append(pkgs, osPackage{manager: "rpm", name: fields[0], version: fields[1], arch: fields[2]})
+	}
+	return pkgs
+}
+
+// imageSBOM is everything an SBOM describes about an image.
+type imageSBOM struct {
+	name     string // tag of the image, or its entrypoint
+	imageID  string
+	base     string
+	family   *baseFamily
+	binaries []*goBinaryInfo
+	packages []osPackage
+	created  time.Time
+}
+
+// uuid derives the identifier of the document from the image, so that it is
+// the same for the same image.
+func (s *imageSBOM) uuid() string {
+	h := sha256.Sum256([]byte(s.name + "\x00" + s.imageID))
+	h[6] = h[6]&0x0f | 0x50 // version 5 layout, name-based
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// modules returns the Go modules of all binaries, each once, sorted by
+// path.
+func (s *imageSBOM) modules() []goModuleInfo {
+	seen := make(map[goModuleInfo]bool)
+	var mods []goModuleInfo
+	for _, bin := range s.binaries {
+		for _, m := range append([]goModuleInfo{bin.main}, bin.deps...) {
+			if m.path != "" && !seen[m] {
+				seen[m] = true
+				mods = append(mods, m)
+			}
+		}
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		if mods[i].path != mods[j].path {
+			return mods[i].path < mods[j].path
+		}
+		return mods[i].version < mods[j].version
+	})
+	return mods
+}
+
+func (s *imageSBOM) encode(format string) ([]byte, error) {
+	var v interface{}
+	if format == sbomCycloneDX {
+		v = s.cycloneDX()
+	} else {
+		v = s.spdx()
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Purpose          string            `json:"primaryPackagePurpose,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+func (s *imageSBOM) spdx() *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.name,
+		DocumentNamespace: "https://github.com/neelance/godockerize/sbom/" + s.uuid(),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: godockerize"},
+		},
+	}
+	add := func(p spdxPackage, purl string) string {
+		p.SPDXID = fmt.Sprintf("SPDXRef-Package-%d", len(doc.Packages))
+		if p.DownloadLocation == "" {
+			p.DownloadLocation = "NOASSERTION"
+		}
+		if purl != "" {
+			p.ExternalRefs = []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: purl}}
+		}
+		doc.Packages = append(doc.Packages, p)
+		return p.SPDXID
+	}
+	relate := func(element, typ, related string) {
+		doc.Relationships = append(doc.Relationships, spdxRelationship{element, typ, related})
+	}
+
+	image := add(spdxPackage{Name: s.name, Purpose: "CONTAINER", Comment: "image " + s.imageID + " based on " + s.base}, "")
+	relate("SPDXRef-DOCUMENT", "DESCRIBES", image)
+
+	modules := make(map[goModuleInfo]string)
+	for _, m := range s.modules() {
+		modules[m] = add(spdxPackage{Name: m.path, VersionInfo: m.version, Purpose: "LIBRARY"}, m.purl())
+	}
+	for _, bin := range s.binaries {
+		var comment []string
+		comment = append(comment, "built with "+bin.goVersion+" from "+bin.path)
+		for _, kv := range bin.settings {
+			comment = append(comment, kv[0]+"="+kv[1])
+		}
+		id := add(spdxPackage{Name: bin.name, Purpose: "APPLICATION", Comment: strings.Join(comment, "\n")}, "")
+		relate(image, "CONTAINS", id)
+		if mod, ok := modules[bin.main]; ok {
+			relate(mod, "GENERATES", id)
+		}
+		for _, m := range bin.deps {
+			relate(id, "DEPENDS_ON", modules[m])
+		}
+	}
+	for _, p := range s.packages {
+		relate(image, "CONTAINS", add(spdxPackage{Name: p.name, VersionInfo: p.version, Purpose: "OPERATING-SYSTEM"}, p.purl(s.family)))
+	}
+	return doc
+}
+
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string `json:"timestamp"`
+	Tools     struct {
+		Components []cdxComponent `json:"components"`
+	} `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func (s *imageSBOM) cycloneDX() *cdxDocument {
+	doc := &cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + s.uuid(),
+		Version:      1,
+		Components:   []cdxComponent{},
+	}
+	doc.Metadata.Timestamp = s.created.UTC().Format(time.RFC3339)
+	doc.Metadata.Tools.Components = []cdxComponent{{Type: "application", Name: "godockerize"}}
+	doc.Metadata.Component = cdxComponent{
+		Type:   "container",
+		BOMRef: "image",
+		Name:   s.name,
+		Properties: []cdxProperty{
+			{"godockerize:image.id", s.imageID},
+			{"godockerize:image.base", s.base},
+		},
+	}
+	image := cdxDependency{Ref: "image", DependsOn: []string{}}
+
+	for _, m := range s.modules() {
+		doc.Components = append(doc.Components, cdxComponent{Type: "library", BOMRef: m.purl(), Name: m.path, Version: m.version, PURL: m.purl()})
+	}
+	var deps []cdxDependency
+	for _, bin := range s.binaries {
+		ref := "binary:" + bin.name
+		props := []cdxProperty{{"godockerize:go.version", bin.goVersion}, {"godockerize:go.package", bin.path}}
+		for _, kv := range bin.settings {
+			props = append(props, cdxProperty{"godockerize:go.build:" + kv[0], kv[1]})
+		}
+		doc.Components = append(doc.Components, cdxComponent{Type: "application", BOMRef: ref, Name: bin.name, Properties: props})
+		image.DependsOn = append(image.DependsOn, ref)
+		dep := cdxDependency{Ref: ref, DependsOn: []string{}}
+		if bin.main.path != "" {
+			dep.DependsOn = append(dep.DependsOn, bin.main.purl())
+		}
+		for _, m := range bin.deps {
+			dep.DependsOn = append(dep.DependsOn, m.purl())
+		}
+		deps = append(deps, dep)
+	}
+	for _, p := range s.packages {
+		purl := p.purl(s.family)
+		doc.Components = append(doc.Components, cdxComponent{Type: "library", BOMRef: purl, Name: p.name, Version: p.version, PURL: purl})
+		image.DependsOn = append(image.DependsOn, purl)
+	}
+	doc.Dependencies = append([]cdxDependency{image}, deps...)
+	return doc
+}
+
+// writeSBOM writes the SBOM of the image built from spec into the --sbom
+// directory and, with --attach-sbom, pushes it next to each of tags. The
+// build information of the binaries was read by compile. It returns the
+// file.
+func (b *builder) writeSBOM(spec *imageSpec, imageID string, tags []string) (string, error) {
+	pkgs, err := listOSPackages(b.tc, imageID, spec)
+	if err != nil {
+		return "", stageErrorf(stageDockerBuild, "%v", err)
+	}
+	sbom := &imageSBOM{
+		name:     spec.name(),
+		imageID:  imageID,
+		base:     spec.base,
+		family:   spec.family,
+		binaries: b.binaryInfo,
+		packages: pkgs,
+		created:  time.Now(),
+	}
+	if len(tags) != 0 {
+		sbom.name = tags[0]
+	}
+	data, err := sbom.encode(b.sbom.format)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(b.sbom.dir, b.sbom.fileName(spec.name()))
+	if err := os.MkdirAll(b.sbom.dir, 0777); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0666); err != nil {
+		return "", err
+	}
+	b.tc.printf("godockerize: Wrote SBOM %s\n", file)
+
+	if !b.sbom.attach {
+		return file, nil
+	}
+	return file, b.pushAll(tags, func(tc *toolchain, tag string) error {
+		digest, err := repoDigest(tc, imageID, tag)
+		if err != nil {
+			return err
+		}
+		if digest == "" {
+			return fmt.Errorf("attaching SBOM to %s: the digest of the pushed image is unknown", tag)
+		}
+		ref, err := parseImageRef(tag)
+		if err != nil {
+			return err
+		}
+		artifact, err := newRegistryClient(tc).pushArtifact(ref, digest, b.sbom.mediaType(), filepath.Base(file), data, "sbom")
+		if err != nil {
+			return fmt.Errorf("attaching SBOM to %s: %v", tag, err)
+		}
+		b.tc.printf("godockerize: Attached SBOM to %s as %s\n", tag, artifact)
+		return nil
+	})
+}
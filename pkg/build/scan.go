@@ -0,0 +1,187 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// severities are the levels of --severity-threshold, from lowest to highest.
+var severities = []string{"LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// scanOptions are the settings of --scan.
+type scanOptions struct {
+	scanner   string // trivy or grype
+	threshold int    // index in severities
+	dir       string // where the reports are written
+}
+
+func parseScanOptions(scanner, threshold, dir string) (*scanOptions, error) {
+	if scanner != "trivy" && scanner != "grype" {
+		return nil, fmt.Errorf("invalid --scanner %q, must be trivy or grype", scanner)
+	}
+	opts := &scanOptions{scanner: scanner, threshold: -1, dir: dir}
+	for i, s := range severities {
+		if strings.EqualFold(threshold, s) {
+			opts.threshold = i
+		}
+	}
+	if opts.threshold == -1 {
+		return nil, fmt.Errorf("invalid --severity-threshold %q, must be one of %s", threshold, strings.Join(severities, ", "))
+	}
+	return opts, nil
+}
+
+// localScanSource is the image store of the engine that the scanners can
+// read, empty if images have to be scanned in the registry after the push.
+func localScanSource(e *engine) string {
+	switch e.name {
+	case "docker", "docker-api":
+		return "docker"
+	case "podman":
+		return "podman"
+	}
+	return ""
+}
+
+// vulnerability is a finding of a scanner.
+type vulnerability struct {
+	id       string
+	severity string
+	pkg      string
+	version  string
+}
+
+// scanImage scans the image with the scanner of --scan and fails if there
+// are vulnerabilities of at least the threshold. ref is the image in the
+// registry if the engine's image store can't be scanned, the report of the
+// scanner is written to NAME.scan.json.
+func (b *builder) scanImage(spec *imageSpec, imageID, ref string) error {
+	report := filepath.Join(b.scan.dir, spec.name()+".scan.json")
+	if err := os.MkdirAll(b.scan.dir, 0777); err != nil {
+		return err
+	}
+	source := localScanSource(b.tc.engine)
+	var args []string
+	switch b.scan.scanner {
+	case "trivy":
+		args = []string{"image", "--quiet", "--format", "json", "--output", report}
+		if ref != "" {
+			args = append(args, "--image-src", "remote")
+			if b.tc.insecure(ref) {
+				args = append(args, "--insecure")
+			}
+			args = append(args, ref)
+		} else {
+			args = append(args, "--image-src", source, imageID)
+		}
+	case "grype":
+		args = []string{"--quiet", "-o", "json", "--file", report}
+		if ref != "" {
+			args = append(args, "registry:"+ref)
+		} else {
+			args = append(args, source+":"+imageID)
+		}
+	}
+	cmd := b.tc.command(b.scan.scanner, args...)
+	if ref != "" {
+		env, err := b.tc.creds.engineEnv(engines["docker"], ref)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	cmd.Stdout = b.tc.stdout()
+	cmd.Stderr = b.tc.stderr()
+	b.tc.printf("godockerize: Scanning image with %s...\n", b.scan.scanner)
+	if err := cmd.Run(); err != nil {
+		return stageErrorf(stageScan, "%s: %v", b.scan.scanner, err)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		return stageErrorf(stageScan, "%s: %v", b.scan.scanner, err)
+	}
+	vulns, err := parseScanReport(b.scan.scanner, data)
+	if err != nil {
+		return stageErrorf(stageScan, "%s: %v", report, err)
+	}
+	b.tc.printf("godockerize: Wrote scan report %s\n", report)
+
+	var found []vulnerability
+	for _, v := range vulns {
+		if severityIndex(v.severity) >= b.scan.threshold {
+			found = append(found, v)
+		}
+	}
+	if len(found) == 0 {
+		b.tc.printf("godockerize: No vulnerabilities of severity %s or higher (%d below)\n", severities[b.scan.threshold], len(vulns))
+		return nil
+	}
+	sort.SliceStable(found, func(i, j int) bool { return severityIndex(found[i].severity) > severityIndex(found[j].severity) })
+	for _, v := range found {
+		b.tc.printf("  %-8s  %s  %s %s\n", strings.ToUpper(v.severity), v.id, v.pkg, v.version)
+	}
+	return stageErrorf(stageScan, "%d vulnerabilities of severity %s or higher, see %s", len(found), severities[b.scan.threshold], report)
+}
+
+// severityIndex returns the index of severity in severities, -1 for
+// unknown and negligible ones.
+func severityIndex(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(severity, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseScanReport reads the JSON report of trivy or grype.
+func parseScanReport(scanner string, data []byte) ([]vulnerability, error) {
+	var vulns []vulnerability
+	if scanner == "trivy" {
+		var report struct {
+			Results []struct {
+				Vulnerabilities []struct {
+					VulnerabilityID  string
+					PkgName          string
+					InstalledVersion string
+					Severity         string
+				}
+			}
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, err
+		}
+		for _, r := range report.Results {
+			for _, v := range r.Vulnerabilities {
+				vulns = append(vulns, vulnerability{v.VulnerabilityID, v.Severity, v.PkgName, v.InstalledVersion})
+			}
+		}
+		return vulns, nil
+	}
+
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	for _, m := range report.Matches {
+		vulns = append(vulns, vulnerability{m.Vulnerability.ID, m.Vulnerability.Severity, m.Artifact.Name, m.Artifact.Version})
+	}
+	return vulns, nil
+}
@@ -0,0 +1,78 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// signOptions are the settings of --sign.
+type signOptions struct {
+	key    string // key file or KMS URI of cosign, empty for keyless signing
+	upload bool   // the signature is pushed next to the image, or else written to files
+}
+
+func parseSignOptions(sign bool, key string, noUpload, push bool) (*signOptions, error) {
+	if !sign {
+		if key != "" || noUpload {
+			return nil, errors.New("--sign-key and --no-sign-upload require --sign")
+		}
+		return nil, nil
+	}
+	if !push {
+		return nil, errors.New("--sign requires --push, only pushed images have a digest to sign")
+	}
+	return &signOptions{key: key, upload: !noUpload}, nil
+}
+
+// signImage signs the digest of the image that was pushed to each of tags
+// with cosign. Without upload, the signature of a repository goes to
+// REPO.sig in the current directory and, for keyless signing, the
+// certificate to REPO.crt, with slashes and colons of REPO replaced.
+func (b *builder) signImage(imageID string, tags []string) error {
+	return b.pushAll(tags, func(tc *toolchain, tag string) error {
+		digest, err := repoDigest(tc, imageID, tag)
+		if err != nil {
+			return err
+		}
+		if digest == "" {
+			return fmt.Errorf("signing %s: the digest of the pushed image is unknown", tag)
+		}
+		ref := repository(tag) + "@" + digest
+
+		args := []string{"sign", "--yes"}
+		if b.sign.key != "" {
+			args = append(args, "--key", b.sign.key)
+		}
+		if tc.insecure(tag) {
+			args = append(args, "--allow-insecure-registry")
+		}
+		var files []string
+		if !b.sign.upload {
+			name := strings.NewReplacer("/", "_", ":", "_").Replace(repository(tag))
+			files = append(files, name+".sig")
+			args = append(args, "--upload=false", "--output-signature", name+".sig")
+			if b.sign.key == "" {
+				files = append(files, name+".crt")
+				args = append(args, "--output-certificate", name+".crt")
+			}
+		}
+		cmd := tc.command("cosign", append(args, ref)...)
+		// cosign reads the docker config like docker itself
+		env, err := tc.creds.engineEnv(engines["docker"], tag)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, env...)
+		cmd.Stdout = b.tc.stdout()
+		cmd.Stderr = b.tc.stderr()
+		b.tc.printf("godockerize: Signing %s...\n", ref)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("cosign sign %s: %v", ref, err)
+		}
+		for _, file := range files {
+			b.tc.printf("godockerize: Wrote %s\n", file)
+		}
+		return nil
+	})
+}
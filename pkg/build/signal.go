@@ -0,0 +1,22 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// cancelOnSignal calls cancel on SIGINT or SIGTERM. This kills the running go
+// and docker commands and lets the build return, so that its temporary
+// files get removed. A second signal exits immediately.
+func cancelOnSignal(cancel context.CancelFunc) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	fmt.Fprintln(os.Stderr, "godockerize: Interrupted, cleaning up...")
+	cancel()
+	<-ch
+	os.Exit(exitCodes[stageInterrupted])
+}
@@ -0,0 +1,158 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// reportBinarySizes prints the size of every binary in dir and fails if one
+// exceeds max, unless max is 0.
+func reportBinarySizes(tc *toolchain, packages []*goPackage, bins []builtBinary, dir string, max int64) error {
+	var tooLarge []string
+	for i, pkg := range packages {
+		name := pkg.binaryName()
+		size, err := fileSize(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if u := bins[i].unstrippedSize; u != 0 {
+			tc.printf("godockerize: Binary %s: %s (unstripped %s, %+d%%)\n", name, formatSize(size), formatSize(u), (size-u)*100/u)
+		} else {
+			tc.printf("godockerize: Binary %s: %s\n", name, formatSize(size))
+		}
+		if max != 0 && size > max {
+			tooLarge = append(tooLarge, fmt.Sprintf("%s (%s)", name, formatSize(size)))
+		}
+	}
+	if len(tooLarge) != 0 {
+		return fmt.Errorf("binaries exceed --max-binary-size of %s: %s", formatSize(max), strings.Join(tooLarge, ", "))
+	}
+	return nil
+}
+
+func fileSize(name string) (int64, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// formatSize formats n bytes with a decimal unit, e.g. "12.3 MB".
+func formatSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// parseSize parses a size like "80MB", "1.5GiB" or "1024".
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"B", 1},
+	}
+	num, factor := strings.TrimSpace(s), 1.0
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, factor = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * factor), nil
+}
+
+// reportImageSize prints the size of every layer of the image and its total
+// size, and fails if that exceeds max, unless max is 0.
+func reportImageSize(tc *toolchain, id string, max int64) error {
+	if tc.engine.noHistory {
+		return nil
+	}
+	layers, err := imageHistory(tc, id)
+	if err != nil {
+		return err
+	}
+	tc.printf("godockerize: Image layers:\n")
+	// docker lists the most recent layer first
+	for i := len(layers) - 1; i >= 0; i-- {
+		if layers[i].Size == 0 {
+			continue
+		}
+		createdBy := strings.TrimPrefix(strings.TrimPrefix(layers[i].CreatedBy, "/bin/sh -c "), "#(nop) ")
+		if len(createdBy) > 80 {
+			createdBy = createdBy[:77] + "..."
+		}
+		tc.printf("  %10s  %s\n", formatSize(layers[i].Size), strings.TrimSpace(createdBy))
+	}
+
+	total, err := imageSize(tc, id)
+	if err != nil {
+		return err
+	}
+	tc.printf("godockerize: Image size: %s\n", formatSize(total))
+	if max != 0 && total > max {
+		return fmt.Errorf("image size of %s exceeds --max-image-size of %s", formatSize(total), formatSize(max))
+	}
+	return nil
+}
+
+// imageHistory returns the layers of the image, the most recent first.
+func imageHistory(tc *toolchain, id string) ([]imageLayer, error) {
+	if tc.api != nil {
+		layers, err := tc.api.history(tc.ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("docker history: %v", err)
+		}
+		return layers, nil
+	}
+	out, err := tc.dockerCmd("history", "--human=false", "--no-trunc", "--format", "{{.Size}}\t{{.CreatedBy}}", id).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker history: %v", err)
+	}
+	var layers []imageLayer
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected output of docker history: %q", line)
+		}
+		layers = append(layers, imageLayer{Size: size, CreatedBy: parts[1]})
+	}
+	return layers, nil
+}
+
+func imageSize(tc *toolchain, id string) (int64, error) {
+	if tc.api != nil {
+		img, err := tc.api.inspectImage(tc.ctx, id)
+		if err != nil {
+			return 0, fmt.Errorf("docker image inspect: %v", err)
+		}
+		return img.Size, nil
+	}
+	out, err := tc.dockerCmd("image", "inspect", "--format", "{{.Size}}", id).Output()
+	if err != nil {
+		return 0, fmt.Errorf("docker image inspect: %v", err)
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output of docker image inspect: %q", out)
+	}
+	return total, nil
+}
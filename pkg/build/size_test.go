@@ -0,0 +1,59 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"100B", 100},
+		{"1.5KiB", 1536},
+		{"20 MiB", 20 << 20},
+		{"2GiB", 2 << 30},
+		{"50MB", 50e6},
+		{"10kB", 10e3},
+		{"10KB", 10e3},
+		{"1GB", 1e9},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.in)
+		if err != nil || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", test.in, got, err, test.want)
+		}
+	}
+	for _, in := range []string{"", "MB", "-1MB", "10XB", "ten"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) did not fail", in)
+		}
+	}
+}
+
+func TestMaxImageSizeUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := "oci:" + filepath.Join(dir, "oci")
+	for _, engine := range [][]string{
+		{"--engine", "buildah"},
+		// any existing file stands in for buildctl, which is not run
+		{"--engine", "buildkit", "--docker-bin", os.Args[0]},
+		{"--daemonless"},
+	} {
+		args := append(append([]string{"build"}, engine...), "--output", out, "--max-image-size", "10MB", "./cmd/app")
+		err := runInDir(t, filepath.Join("testdata", "app"), args...)
+		if err == nil || !strings.Contains(err.Error(), "--max-image-size is not supported") {
+			t.Errorf("%v: got %v, want an error that --max-image-size is not supported", engine, err)
+		}
+	}
+}
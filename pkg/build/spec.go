@@ -0,0 +1,372 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// imageSpec describes an image: the binaries it contains and everything that
+// flags and //docker: directives add to it.
+type imageSpec struct {
+	packages    []*goPackage // the first one is the entrypoint
+	env         []string
+	expose      []string
+	install     []string
+	run         []string
+	volumes     []string
+	labels      []string
+	copies      []copyAsset
+	user        string                              // user[:group] that runs the entrypoint, empty for root
+	noCompress  map[string]bool                     // import paths of packages that opted out of --compress
+	depends     []string                            // services that godockerize compose starts before this one
+	healthcheck []string                            // command of //docker:healthcheck
+	directives  []foundDirective                    // as found by scanDirectives
+	fragments   []dockerfile.Instruction            // added by directive handlers
+	includes    map[string][]dockerfile.Instruction // by point, see includePoints
+
+	base      string
+	family    *baseFamily
+	defaults  []string // packages installed in addition to install, the family's defaults if nil
+	legacyAdd bool     // add the binaries with plain ADD instructions
+	noChmod   bool     // COPY --chmod is not supported, the binaries have to be executable in the context
+	layering  string   // one of the layering constants, empty means per-binary
+}
+
+// foundDirective is a //docker: comment and the package it was found in.
+type foundDirective struct {
+	*directive.Directive
+	pkg string // import path
+}
+
+// copyAsset is a file or directory that a //docker:copy directive puts into
+// the image.
+type copyAsset struct {
+	src     string // absolute path on the host
+	dest    string // path in the image
+	context string // slash-separated path in the build context, set by the builder
+}
+
+func newImageSpec(packages []*goPackage) *imageSpec {
+	return &imageSpec{
+		packages:   packages,
+		family:     alpineFamily,
+		noCompress: make(map[string]bool),
+		includes:   make(map[string][]dockerfile.Instruction),
+	}
+}
+
+// name is the name of the entrypoint binary.
+func (spec *imageSpec) name() string {
+	return spec.packages[0].binaryName()
+}
+
+// scanDirectives adds the //docker: comments of the packages to spec.
+// Directives of kinds registered by other tools are kept in spec.directives
+// but don't change the image. Unknown directives are passed to their
+// handler, see directiveHandler, which runs with tc.
+func (spec *imageSpec) scanDirectives(tc *toolchain) error {
+	fset := token.NewFileSet()
+	for _, pkg := range spec.packages {
+		files := pkg.GoFiles
+		if pkg.Test {
+			files = append(append(append([]string{}, files...), pkg.TestGoFiles...), pkg.XTestGoFiles...)
+		}
+		var paths []string
+		for _, name := range files {
+			paths = append(paths, filepath.Join(pkg.Dir, name))
+		}
+		directives, err := directive.ParseFiles(fset, paths)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range directives {
+			if err := directive.Validate(d); err != nil {
+				handler := directiveHandler(d.Name)
+				if !errors.Is(err, directive.ErrUnknown) || handler == nil {
+					return stageErrorf(stageDirective, "%v", err)
+				}
+				spec.directives = append(spec.directives, foundDirective{Directive: d, pkg: pkg.ImportPath})
+				if err := spec.runPlugin(tc, handler, d, pkg); err != nil {
+					return err
+				}
+				continue
+			}
+			spec.directives = append(spec.directives, foundDirective{Directive: d, pkg: pkg.ImportPath})
+			switch d.Name {
+			case "env":
+				spec.env = append(spec.env, d.Fields()...)
+			case "expose":
+				spec.expose = append(spec.expose, d.Fields()...)
+			case "install":
+				spec.install = append(spec.install, d.Fields()...)
+			case "run":
+				spec.run = append(spec.run, d.Args)
+			case "user":
+				if spec.user != "" && spec.user != d.Args {
+					return stageErrorf(stageDirective, "%s: conflicting //docker:user %s and %s", d.Pos, spec.user, d.Args)
+				}
+				spec.user = d.Args
+			case "copy":
+				args := d.Fields()
+				src := filepath.Join(pkg.Dir, filepath.FromSlash(args[0]))
+				if _, err := os.Lstat(src); err != nil {
+					return stageErrorf(stageDirective, "%s: %v", d.Pos, err)
+				}
+				spec.copies = append(spec.copies, copyAsset{src: src, dest: args[1]})
+			case "nocompress":
+				spec.noCompress[pkg.ImportPath] = true
+			case "volume":
+				spec.volumes = append(spec.volumes, d.Fields()...)
+			case "healthcheck":
+				if spec.healthcheck != nil {
+					return stageErrorf(stageDirective, "%s: more than one //docker:healthcheck", d.Pos)
+				}
+				if err := checkHealthcheckURL(d.Fields()[0]); err != nil {
+					return stageErrorf(stageDirective, "%s: //docker:healthcheck %v", d.Pos, err)
+				}
+				spec.healthcheck = d.Fields()
+			case "depends":
+				spec.depends = append(spec.depends, d.Fields()...)
+			case "include":
+				args := d.Fields()
+				if err := spec.addInclude(args[0], filepath.Join(pkg.Dir, filepath.FromSlash(args[1]))); err != nil {
+					return stageErrorf(stageDirective, "%s: //docker:include: %v", d.Pos, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dockerfile generates the Dockerfile of the image. The binaries are taken
+// from the build context or, if fromStage is set, from /out/ of that stage.
+func (spec *imageSpec) dockerfile(base, fromStage string) *dockerfile.Builder {
+	df := &dockerfile.Builder{}
+	var final []string
+	if spec.family.bootstrap != nil {
+		var stage []string
+		stage, final = spec.family.bootstrap(spec.imageUser())
+		for _, line := range stage {
+			df.Instructions = append(df.Instructions, dockerfile.Parse(line))
+		}
+	}
+	df.Add("FROM", base)
+	for _, line := range final {
+		df.Instructions = append(df.Instructions, dockerfile.Parse(line))
+	}
+	df.Instructions = append(df.Instructions, spec.includes[includeAfterFrom]...)
+
+	if install := append(append([]string{}, spec.defaultPackages()...), spec.install...); len(install) != 0 && spec.family.install != nil {
+		for _, cmd := range spec.family.install(sortedStringSet(install)) {
+			df.Add("RUN", cmd)
+		}
+	}
+
+	if user := spec.imageUser(); user != "" && spec.family.addUser != nil {
+		for _, cmd := range spec.family.addUser(user) {
+			df.Add("RUN", cmd)
+		}
+	}
+	for _, cmd := range spec.run {
+		df.Add("RUN", cmd)
+	}
+	df.Instructions = append(df.Instructions, spec.fragments...)
+	if len(spec.env) != 0 {
+		df.Add("ENV", strings.Join(sortedStringSet(spec.env), " "))
+	}
+	if len(spec.expose) != 0 {
+		df.Add("EXPOSE", strings.Join(sortedStringSet(spec.expose), " "))
+	}
+	if len(spec.volumes) != 0 {
+		df.Add("VOLUME", strings.Join(sortedStringSet(spec.volumes), " "))
+	}
+	if len(spec.labels) != 0 {
+		df.Add("LABEL", strings.Join(sortedStringSet(spec.labels), " "))
+	}
+	for _, a := range spec.copies {
+		df.Addf("COPY", "%s %s", a.context, a.dest)
+	}
+	df.Instructions = append(df.Instructions, spec.includes[includeBeforeUser]...)
+	if user := spec.imageUser(); user != "" {
+		df.Add("USER", user)
+	}
+	if cmd := spec.healthcheckCommand(); cmd != nil {
+		df.Add("HEALTHCHECK", "CMD "+execForm(cmd))
+	}
+	df.Add("ENTRYPOINT", execForm(spec.entrypoint()))
+	if spec.packages[0].Test {
+		df.Instructions = append(df.Instructions, dockerfile.Parse(fmt.Sprintf("%s %s %s", spec.binaryCopy(""), testRunner, spec.family.binDir())))
+	}
+	if spec.usesHealthcheckHelper() {
+		df.Instructions = append(df.Instructions, dockerfile.Parse(spec.healthcheckCopy(fromStage)))
+	}
+	for _, layer := range spec.binaryLayers() {
+		var srcs []string
+		for _, pkg := range layer {
+			if fromStage != "" {
+				srcs = append(srcs, "/out/"+pkg.binaryName())
+				continue
+			}
+			srcs = append(srcs, pkg.binaryName())
+		}
+		df.Instructions = append(df.Instructions, dockerfile.Parse(fmt.Sprintf("%s %s %s", spec.binaryCopy(fromStage), strings.Join(srcs, " "), spec.family.binDir())))
+	}
+	df.Instructions = append(df.Instructions, spec.includes[includeAfterBinaries]...)
+	return df
+}
+
+// Values of --layering.
+const (
+	layeringSingle    = "single"     // all binaries in one layer
+	layeringPerBinary = "per-binary" // one layer per binary
+	layeringGrouped   = "grouped"    // one layer per module
+)
+
+// binaryLayers splits the packages into the layers for their binaries
+// according to spec.layering. The layers are in the order of the packages
+// on the command line, so listing those that change least often first lets
+// more of the image be reused from the Docker cache and registry. The order
+// does not depend on the checkout, e.g. the modification times of files,
+// as godockerize check compares the Dockerfile with a committed one.
+func (spec *imageSpec) binaryLayers() [][]*goPackage {
+	if spec.layering == layeringSingle {
+		return [][]*goPackage{spec.packages}
+	}
+
+	var layers [][]*goPackage
+	switch spec.layering {
+	case layeringGrouped:
+		index := make(map[string]int)
+		for _, pkg := range spec.packages {
+			var mod string
+			if pkg.Module != nil {
+				mod = pkg.Module.Path
+			}
+			i, ok := index[mod]
+			if !ok {
+				i = len(layers)
+				index[mod] = i
+				layers = append(layers, nil)
+			}
+			layers[i] = append(layers[i], pkg)
+		}
+	default:
+		for _, pkg := range spec.packages {
+			layers = append(layers, []*goPackage{pkg})
+		}
+	}
+	return layers
+}
+
+func (spec *imageSpec) defaultPackages() []string {
+	if spec.defaults != nil {
+		return spec.defaults
+	}
+	return spec.family.defaultPackages()
+}
+
+// entrypoint returns the ENTRYPOINT of the image.
+func (spec *imageSpec) entrypoint() []string {
+	name := spec.name()
+	if spec.packages[0].Test {
+		name = testRunner
+	}
+	if spec.useTini() {
+		return []string{spec.family.tini, "--", spec.family.binPath(name)}
+	}
+	return []string{spec.family.binPath(name)}
+}
+
+// useTini reports whether the entrypoint is started by tini, which is the
+// case if it is installed.
+func (spec *imageSpec) useTini() bool {
+	if spec.family.tini == "" {
+		return false
+	}
+	for _, pkg := range spec.defaultPackages() {
+		if pkg == spec.family.tiniPackage {
+			return true
+		}
+	}
+	for _, pkg := range spec.install {
+		if pkg == spec.family.tiniPackage {
+			return true
+		}
+	}
+	return false
+}
+
+// healthcheckCommand returns the command of //docker:healthcheck, or nil.
+// A command that is the name of one of the binaries refers to the binary in
+// the image, so that images without a shell can check themselves. A URL is
+// requested by healthcheckHelper.
+func (spec *imageSpec) healthcheckCommand() []string {
+	if spec.healthcheck == nil {
+		return nil
+	}
+	if u := healthcheckURL(spec.healthcheck); u != "" {
+		return []string{spec.family.binPath(healthcheckHelper), u}
+	}
+	cmd := append([]string{}, spec.healthcheck...)
+	for _, pkg := range spec.packages {
+		if cmd[0] == pkg.binaryName() || cmd[0]+pkg.Exe == pkg.binaryName() {
+			cmd[0] = spec.family.binPath(pkg.binaryName())
+		}
+	}
+	return cmd
+}
+
+// execForm returns args as the JSON array of the exec form of RUN, CMD,
+// ENTRYPOINT and HEALTHCHECK.
+func execForm(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		// Go's %q escapes differ from JSON's, e.g. \x00 and \a
+		b, _ := json.Marshal(arg)
+		quoted[i] = string(b)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// imageUser returns the user that runs the entrypoint, translated for the
+// base image.
+func (spec *imageSpec) imageUser() string {
+	if spec.user != "" && spec.family.nonroot != "" {
+		return spec.family.nonroot
+	}
+	return spec.user
+}
+
+// binaryCopy returns the instruction that puts a binary into the image,
+// taken from fromStage if it is set. Binaries are owned by the user of the
+// image and executable regardless of their mode in the build context, unless
+// the builder does not support --chmod.
+func (spec *imageSpec) binaryCopy(fromStage string) string {
+	if spec.legacyAdd && fromStage == "" {
+		return "ADD"
+	}
+	var b strings.Builder
+	b.WriteString("COPY")
+	if fromStage != "" {
+		fmt.Fprintf(&b, " --from=%s", fromStage)
+	}
+	if spec.legacyAdd || spec.family.windows {
+		return b.String()
+	}
+	if user := spec.imageUser(); user != "" {
+		fmt.Fprintf(&b, " --chown=%s", user)
+	}
+	if !spec.noChmod {
+		b.WriteString(" --chmod=0755")
+	}
+	return b.String()
+}
@@ -0,0 +1,28 @@
+package build
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExecForm(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/app", "-v"}, `["/app", "-v"]`},
+		{[]string{"sh", "-c", `echo "a\b"`}, `["sh", "-c", "echo \"a\\b\""]`},
+		{[]string{"\x00\a"}, `["\u0000\u0007"]`},
+	}
+	for _, test := range tests {
+		got := execForm(test.args)
+		if got != test.want {
+			t.Errorf("execForm(%q) = %s, want %s", test.args, got, test.want)
+		}
+		var decoded []string
+		if err := json.Unmarshal([]byte(got), &decoded); err != nil || !reflect.DeepEqual(decoded, test.args) {
+			t.Errorf("execForm(%q) = %s does not decode to the arguments: %v", test.args, got, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/neelance/godockerize/pkg/dockerfile"
+)
+
+// templateData is what the template of --template is executed with: the
+// image after all directives and flags are applied.
+type templateData struct {
+	Base            string
+	Install         []string // packages, including the default ones
+	InstallCommands []string // that install them with the package manager of the base image
+	AddUserCommands []string // that create User if the base image has no such user
+	Env             []string // NAME=value
+	Expose          []string
+	Volumes         []string
+	Labels          []string            // name=value
+	Run             []string            // of //docker:run
+	Fragments       []string            // instructions of directive handlers
+	Includes        map[string][]string // instructions of --include and //docker:include by point
+	User            string              // user[:group], empty for root
+	Copies          []templateCopy
+	Healthcheck     []string // exec form of HEALTHCHECK CMD, nil for none
+	HealthcheckCopy string   // instruction that copies the helper of an http:// health check, empty if there is none
+	Entrypoint      []string
+	BinDir          string           // where the binaries go in the image
+	BinaryCopy      string           // instruction that copies binaries, e.g. "COPY --chmod=0755"
+	Binaries        []templateBinary // in the order of their layers
+	BuildStage      string           // stage with the binaries in /out/, empty if they are in the build context
+	Dockerfile      string           // the Dockerfile that godockerize generates without --template
+}
+
+type templateCopy struct {
+	Source      string // in the build context
+	Destination string
+}
+
+type templateBinary struct {
+	Name       string
+	ImportPath string
+	Source     string // in the build context or BuildStage
+	Path       string // in the image
+}
+
+// templateFuncs are the functions of --template in addition to those of
+// text/template.
+var templateFuncs = template.FuncMap{
+	"join":     strings.Join,
+	"execForm": execForm,
+}
+
+// parseTemplate reads the template of --template.
+func parseTemplate(name string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(filepath.Base(name)).Option("missingkey=error").Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --template: %v", err)
+	}
+	return t, nil
+}
+
+// imageDockerfile returns the instructions of the image of spec: those of
+// --template if it is given, else the generated ones. The binaries are
+// taken from the build context or, if fromStage is set, from /out/ of that
+// stage, in which case the health check helper is built in a stage of its
+// own.
+func (b *builder) imageDockerfile(spec *imageSpec, fromStage string) (*dockerfile.Builder, error) {
+	df := spec.dockerfile(spec.base, fromStage)
+	if b.template != nil {
+		data := spec.templateData(fromStage)
+		data.Dockerfile = string(df.Render(""))
+		var buf bytes.Buffer
+		if err := b.template.Execute(&buf, data); err != nil {
+			return nil, stageErrorf(stageGenerate, "--template: %v", err)
+		}
+		instructions, err := dockerfile.ParseText(buf.String())
+		if err != nil {
+			return nil, stageErrorf(stageGenerate, "--template: %v", err)
+		}
+		df = &dockerfile.Builder{Instructions: instructions}
+	}
+	if fromStage != "" && spec.usesHealthcheckHelper() {
+		stage := healthcheckBuildStage(b.builderImage, b.goOpts)
+		stage.Append(df)
+		df = stage
+	}
+	return df, nil
+}
+
+func (spec *imageSpec) templateData(fromStage string) *templateData {
+	data := &templateData{
+		Base:        spec.base,
+		Env:         sortedStringSet(spec.env),
+		Expose:      sortedStringSet(spec.expose),
+		Volumes:     sortedStringSet(spec.volumes),
+		Labels:      sortedStringSet(spec.labels),
+		Run:         spec.run,
+		User:        spec.imageUser(),
+		Healthcheck: spec.healthcheckCommand(),
+		Entrypoint:  spec.entrypoint(),
+		BinDir:      spec.family.binDir(),
+		BinaryCopy:  spec.binaryCopy(fromStage),
+		BuildStage:  fromStage,
+	}
+	if spec.family.install != nil {
+		data.Install = sortedStringSet(append(append([]string{}, spec.defaultPackages()...), spec.install...))
+		if len(data.Install) != 0 {
+			data.InstallCommands = spec.family.install(data.Install)
+		}
+	}
+	if spec.usesHealthcheckHelper() {
+		data.HealthcheckCopy = spec.healthcheckCopy(fromStage)
+	}
+	if data.User != "" && spec.family.addUser != nil {
+		data.AddUserCommands = spec.family.addUser(data.User)
+	}
+	for _, inst := range spec.fragments {
+		data.Fragments = append(data.Fragments, inst.String())
+	}
+	data.Includes = make(map[string][]string)
+	for point, instructions := range spec.includes {
+		for _, inst := range instructions {
+			data.Includes[point] = append(data.Includes[point], inst.String())
+		}
+	}
+	for _, a := range spec.copies {
+		data.Copies = append(data.Copies, templateCopy{Source: a.context, Destination: a.dest})
+	}
+	for _, layer := range spec.binaryLayers() {
+		for _, pkg := range layer {
+			bin := templateBinary{
+				Name:       pkg.binaryName(),
+				ImportPath: pkg.ImportPath,
+				Source:     pkg.binaryName(),
+				Path:       spec.family.binPath(pkg.binaryName()),
+			}
+			if fromStage != "" {
+				bin.Source = "/out/" + pkg.binaryName()
+			}
+			data.Binaries = append(data.Binaries, bin)
+		}
+	}
+	return data
+}
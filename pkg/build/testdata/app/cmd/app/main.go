@@ -0,0 +1,17 @@
+// Command app is the program of the tests of the dockerfile and check
+// commands.
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+//docker:expose 8080
+//docker:env MODE=production
+//docker:install git
+
+func main() {
+	_ = os.Getenv("MODE")
+	http.ListenAndServe(":8080", nil)
+}
@@ -0,0 +1,15 @@
+// Command health handles /health on the default mux of a server on another
+// port than a listener of the program.
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+func main() {
+	l, _ := net.Listen("tcp", "0.0.0.0:7070")
+	defer l.Close()
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	http.ListenAndServe(":9090", nil)
+}
@@ -0,0 +1,15 @@
+package build
+
+// testRunner is the entrypoint of images with test binaries. It runs each
+// of them with the arguments of the container, e.g. "-test.v", and fails if
+// any of them fails.
+const testRunner = "godockerize-run-tests"
+
+var testRunnerScript = []byte(`#!/bin/sh
+status=0
+for t in /usr/local/bin/*.test; do
+  echo "=== $(basename "$t")"
+  "$t" "$@" || status=1
+done
+exit $status
+`)
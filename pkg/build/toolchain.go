@@ -0,0 +1,348 @@
+package build
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// toolchain holds the external commands godockerize drives.
+type toolchain struct {
+	ctx        context.Context // kills running commands when done
+	timeout    string          // the flag that set the deadline of ctx, if any
+	goBin      string
+	dir        string   // working directory of go commands, empty for the current one
+	goEnv      []string // additional environment for every go command
+	engine     *engine
+	api        *dockerAPI          // set for the docker-api engine
+	pushed     map[string][]string // repo digests of the images pushed by builds of an engine without image store
+	creds      *credentials
+	dockerBin  string
+	dockerOpts []string // global options passed before every docker command
+
+	insecureRegistries map[string]bool // by host, from --insecure-registry
+	registryCAs        *x509.CertPool  // the system's and --registry-ca, nil for the system's only
+	caDir              string          // temporary directory with the certificate of --registry-ca for caFlag
+
+	out    io.Writer // for messages and the output of commands, os.Stdout if nil
+	errOut io.Writer // for the errors of commands, os.Stderr if nil
+}
+
+// printf prints a message of godockerize to t.out.
+func (t *toolchain) printf(format string, a ...interface{}) {
+	fmt.Fprintf(t.stdout(), format, a...)
+}
+
+// stdout returns the writer for messages and the output of commands.
+func (t *toolchain) stdout() io.Writer {
+	if t.out == nil {
+		return os.Stdout
+	}
+	return t.out
+}
+
+// stderr returns the writer for the errors of commands.
+func (t *toolchain) stderr() io.Writer {
+	if t.errOut == nil {
+		return os.Stderr
+	}
+	return t.errOut
+}
+
+func newToolchain(c *cli.Context) (*toolchain, error) {
+	reproducible := c.Bool("reproducible") || c.Command.Name == "verify"
+	if reproducible && c.IsSet("engine") {
+		return nil, errors.New("--reproducible can't be combined with --engine, the image is assembled without container engine")
+	}
+	e, err := selectEngine(c.String("engine"), c.String("docker-bin"), c.IsSet("docker-bin"), c.Bool("daemonless") || reproducible)
+	if err != nil {
+		return nil, err
+	}
+	t := &toolchain{
+		ctx:       c.Context,
+		goBin:     c.String("go-bin"),
+		engine:    e,
+		dockerBin: e.command(),
+		pushed:    make(map[string][]string),
+	}
+	if c.App != nil {
+		// the writers of Options for the API
+		t.out, t.errOut = c.App.Writer, c.App.ErrWriter
+	}
+	if c.IsSet("docker-bin") {
+		t.dockerBin = c.String("docker-bin")
+	}
+	username := c.String("registry-username")
+	password, err := readPassword(c.Bool("registry-password-stdin"), c.String("registry-password"))
+	if err != nil {
+		return nil, err
+	}
+	if (username == "") != (password == "") {
+		return nil, errors.New("--registry-username and --registry-password (or --registry-password-stdin) must be given together")
+	}
+	t.creds = newCredentials(c.Context, username, password)
+	t.creds.errOut = t.errOut
+	if err := t.initRegistryTLS(c); err != nil {
+		return nil, err
+	}
+	// The go command runs with the user's environment, so git configuration,
+	// SSH agent and ~/.netrc keep working for private modules. The flags
+	// override their environment variable counterparts.
+	for _, v := range []struct {
+		flag, env string
+		isPath    bool
+	}{
+		{"goprivate", "GOPRIVATE", false},
+		{"gonosumdb", "GONOSUMDB", false},
+		{"goflags", "GOFLAGS", false},
+		{"netrc", "NETRC", true},
+		{"goproxy", "GOPROXY", false},
+		{"gomodcache", "GOMODCACHE", true},
+		{"gowork", "GOWORK", true},
+	} {
+		if !c.IsSet(v.flag) {
+			continue
+		}
+		value := c.String(v.flag)
+		if v.isPath && value != "off" {
+			// the go command requires absolute paths
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, err
+			}
+			value = abs
+		}
+		t.goEnv = append(t.goEnv, v.env+"="+value)
+	}
+	for _, v := range []struct {
+		flag, env, option string
+	}{
+		{"docker-host", "DOCKER_HOST", e.hostFlag},
+		{"docker-context", "DOCKER_CONTEXT", e.contextFlag},
+		{"containerd-namespace", "CONTAINERD_NAMESPACE", e.namespaceFlag},
+	} {
+		value := engineOption(c, e, v.flag, v.env)
+		if e.api && v.flag == "docker-host" {
+			if t.api, err = newDockerAPI(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if v.option == "" {
+			return nil, fmt.Errorf("--%s is not supported by %s", v.flag, e.name)
+		}
+		t.dockerOpts = append(t.dockerOpts, v.option, value)
+	}
+	return t, nil
+}
+
+// initRegistryTLS sets up --insecure-registry and --registry-ca. Engines
+// with a daemon have their own configuration for that, which can't be
+// changed per build.
+func (t *toolchain) initRegistryTLS(c *cli.Context) error {
+	e := t.engine
+	t.insecureRegistries = make(map[string]bool)
+	for _, v := range c.StringSlice("insecure-registry") {
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				t.insecureRegistries[registryHost(host)] = true
+			}
+		}
+	}
+	if len(t.insecureRegistries) != 0 && e.insecureFlag == "" && !e.noStore {
+		return fmt.Errorf("--insecure-registry is not supported by %s, add the registry to insecure-registries of the daemon instead", e.name)
+	}
+
+	file := c.String("registry-ca")
+	if file == "" {
+		return nil
+	}
+	if e.caFlag == "" && !e.daemonless {
+		return fmt.Errorf("--registry-ca is not supported by %s, whose daemon has to trust the certificate instead", e.name)
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("--registry-ca: %v", err)
+	}
+	if t.registryCAs, err = x509.SystemCertPool(); err != nil {
+		t.registryCAs = x509.NewCertPool()
+	}
+	if !t.registryCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("--registry-ca: no certificates in %s", file)
+	}
+	if e.caFlag != "" {
+		// podman and buildah load the *.crt files of a directory
+		if t.caDir, err = ioutil.TempDir("", "godockerize-certs"); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(t.caDir, "ca.crt"), pem, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close removes the temporary configuration of t.
+func (t *toolchain) close() {
+	t.creds.close()
+	if t.caDir != "" {
+		os.RemoveAll(t.caDir)
+	}
+}
+
+// engineOption returns the value of flag. A value that only comes from the
+// environment variable env is ignored if it is meant for another engine,
+// e.g. DOCKER_HOST when building with podman.
+func engineOption(c *cli.Context, e *engine, flag, env string) string {
+	value := c.String(flag)
+	if value == os.Getenv(env) && !(e.dockerEnv && strings.HasPrefix(env, "DOCKER_")) {
+		return ""
+	}
+	return value
+}
+
+// withTimeout returns a copy of t whose commands are killed after d, which
+// was set by flag. A zero d or an earlier existing deadline leave t as is.
+func (t *toolchain) withTimeout(flag string, d time.Duration) (*toolchain, context.CancelFunc) {
+	if d <= 0 {
+		return t, func() {}
+	}
+	if deadline, ok := t.ctx.Deadline(); ok && time.Until(deadline) < d {
+		return t, func() {}
+	}
+	t2 := *t
+	var cancel context.CancelFunc
+	t2.ctx, cancel = context.WithTimeout(t.ctx, d)
+	t2.timeout = fmt.Sprintf("--%s %v", flag, d)
+	return &t2, cancel
+}
+
+// checkTimeout replaces err with a message naming stage and the timeout if
+// the deadline of t was exceeded.
+func (t *toolchain) checkTimeout(stage string, err error) error {
+	if err != nil && t.ctx.Err() == context.DeadlineExceeded {
+		return stageErrorf(stage, "%s timed out (%s)", stage, t.timeout)
+	}
+	return err
+}
+
+func (t *toolchain) goCmd(args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(t.ctx, t.goBin, args...)
+	cmd.Dir = t.dir
+	cmd.Env = append(os.Environ(), t.goEnv...)
+	return cmd
+}
+
+func (t *toolchain) dockerCmd(args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(t.ctx, t.dockerBin, append(append([]string{}, t.dockerOpts...), t.engine.args(args)...)...)
+	cmd.Env = os.Environ()
+	return cmd
+}
+
+// pushCmd is dockerCmd for a command that pushes image, with the
+// credentials of --registry-username and the options for --insecure-registry
+// and --registry-ca after the subcommand.
+func (t *toolchain) pushCmd(image string, args ...string) (*exec.Cmd, error) {
+	env, err := t.creds.engineEnv(t.engine, image)
+	if err != nil {
+		return nil, err
+	}
+	var opts []string
+	if t.insecure(image) && t.engine.insecureFlag != "" {
+		opts = append(opts, t.engine.insecureFlag)
+	}
+	if t.caDir != "" {
+		opts = append(opts, t.engine.caFlag, t.caDir)
+	}
+	if len(opts) != 0 {
+		args = append(append(append([]string{}, args[0]), opts...), args[1:]...)
+	}
+	cmd := t.dockerCmd(args...)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd, nil
+}
+
+// insecure reports whether image is in a registry of --insecure-registry.
+func (t *toolchain) insecure(image string) bool {
+	ref, err := parseImageRef(image)
+	return err == nil && t.insecureRegistries[ref.registry]
+}
+
+// command returns a command for any other tool.
+func (t *toolchain) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(t.ctx, name, args...)
+	cmd.Env = os.Environ()
+	return cmd
+}
+
+func (t *toolchain) goVersion() (string, error) {
+	out, err := t.goCmd("env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s env GOVERSION: %v", t.goBin, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// requireGoVersion makes sure that the go command matches pattern, e.g.
+// "1.22.x" or "1.22.5". An exact version that is not installed is
+// downloaded by the go command itself via GOTOOLCHAIN.
+func (t *toolchain) requireGoVersion(pattern string) error {
+	version, err := t.goVersion()
+	if err != nil {
+		return err
+	}
+	if matchGoVersion(pattern, version) {
+		return nil
+	}
+
+	fields := strings.Split(pattern, ".")
+	if len(fields) == 3 && !strings.Contains(pattern, "x") {
+		t.goEnv = append(t.goEnv, "GOTOOLCHAIN=go"+pattern)
+		t.printf("godockerize: Switching from %s to go%s...\n", version, pattern)
+		if version, err = t.goVersion(); err != nil {
+			return err
+		}
+		if matchGoVersion(pattern, version) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("go version %s does not match required version %s", version, pattern)
+}
+
+// matchGoVersion reports whether a version as reported by "go env GOVERSION"
+// matches pattern. Components of pattern that are "x" or missing match
+// anything. Experiments such as " X:boringcrypto" are ignored, and a
+// development version matches every pattern, as its release is unknown.
+func matchGoVersion(pattern, version string) bool {
+	if strings.HasPrefix(version, "devel ") {
+		return true
+	}
+	if i := strings.IndexByte(version, ' '); i != -1 {
+		version = version[:i]
+	}
+	want := strings.Split(strings.TrimPrefix(pattern, "go"), ".")
+	have := strings.Split(strings.TrimPrefix(version, "go"), ".")
+	for i, w := range want {
+		if w == "x" {
+			continue
+		}
+		if i >= len(have) || have[i] != w {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package build
+
+import "testing"
+
+func TestMatchGoVersion(t *testing.T) {
+	tests := []struct {
+		pattern, version string
+		want             bool
+	}{
+		{"1.22.x", "go1.22.1", true},
+		{"1.22", "go1.22.1", true},
+		{"1.22.1", "go1.22.1", true},
+		{"1.22.2", "go1.22.1", false},
+		{"1.21.x", "go1.22.1", false},
+		{"1.22.1", "go1.22", false},
+		{"1.22.1", "go1.22.1 X:boringcrypto", true},
+		{"1.22.x", "go1.22.1 X:loopvar,rangefunc", true},
+		{"1.21.x", "go1.22.1 X:boringcrypto", false},
+		{"1.22.x", "devel go1.23-7ae6caf Mon Jan 1 00:00:00 2024 +0000", true},
+		{"1.20.5", "devel go1.23-7ae6caf Mon Jan 1 00:00:00 2024 +0000", true},
+	}
+	for _, test := range tests {
+		if got := matchGoVersion(test.pattern, test.version); got != test.want {
+			t.Errorf("matchGoVersion(%q, %q) = %v, want %v", test.pattern, test.version, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package build
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// externalProgram is a program that a package runs, found by
+// detectPrograms.
+type externalProgram struct {
+	name string // as given, e.g. "git" or "/usr/bin/git"
+	pos  token.Position
+	call string // e.g. "exec.Command"
+}
+
+// alpinePackages maps commands to the Alpine packages that provide them.
+var alpinePackages = map[string]string{
+	"bash":       "bash",
+	"bzip2":      "bzip2",
+	"convert":    "imagemagick",
+	"curl":       "curl",
+	"dig":        "bind-tools",
+	"docker":     "docker-cli",
+	"exiftool":   "exiftool",
+	"ffmpeg":     "ffmpeg",
+	"ffprobe":    "ffmpeg",
+	"git":        "git",
+	"gpg":        "gnupg",
+	"gs":         "ghostscript",
+	"helm":       "helm",
+	"identify":   "imagemagick",
+	"iptables":   "iptables",
+	"jq":         "jq",
+	"magick":     "imagemagick",
+	"make":       "make",
+	"mysql":      "mysql-client",
+	"mysqldump":  "mysql-client",
+	"node":       "nodejs",
+	"openssl":    "openssl",
+	"pdftotext":  "poppler-utils",
+	"pg_dump":    "postgresql-client",
+	"pg_restore": "postgresql-client",
+	"psql":       "postgresql-client",
+	"python3":    "python3",
+	"redis-cli":  "redis",
+	"rsync":      "rsync",
+	"scp":        "openssh-client",
+	"sqlite3":    "sqlite",
+	"ssh":        "openssh-client",
+	"tesseract":  "tesseract-ocr",
+	"xz":         "xz",
+	"zip":        "zip",
+	"zstd":       "zstd",
+}
+
+// busyboxCommands are commands of BusyBox that Alpine images have without
+// installing anything.
+var busyboxCommands = map[string]bool{
+	"ash": true, "awk": true, "base64": true, "cat": true, "chmod": true, "chown": true, "cp": true,
+	"cut": true, "date": true, "env": true, "find": true, "grep": true, "gunzip": true, "gzip": true,
+	"head": true, "hostname": true, "id": true, "ip": true, "kill": true, "ln": true, "ls": true,
+	"mkdir": true, "mv": true, "nslookup": true, "ping": true, "ps": true, "rm": true, "sed": true,
+	"sh": true, "sha256sum": true, "sleep": true, "sort": true, "tail": true, "tar": true, "tr": true,
+	"unzip": true, "wc": true, "wget": true, "which": true, "xargs": true,
+}
+
+// suggestPrograms prints the programs that the packages of spec and their
+// dependencies run, for --detect-binaries, with the //docker:install
+// directives that provide them on Alpine based images.
+func (b *builder) suggestPrograms(spec *imageSpec) error {
+	packages, err := b.tc.sourcePackages(b.goOpts, spec.packages, false)
+	if err != nil {
+		return err
+	}
+	programs, err := detectPrograms(packages)
+	if err != nil {
+		return err
+	}
+	installed := make(map[string]bool)
+	for _, pkg := range append(append([]string{}, spec.defaultPackages()...), spec.install...) {
+		installed[strings.TrimSuffix(pkg, "@edge")] = true
+	}
+	own := make(map[string]bool)
+	for _, pkg := range spec.packages {
+		own[strings.TrimSuffix(pkg.binaryName(), pkg.Exe)] = true
+	}
+	apk := spec.family == alpineFamily || spec.family == wolfiFamily
+	for _, p := range programs {
+		cmd := path.Base(p.name)
+		if own[cmd] || (spec.family == alpineFamily && busyboxCommands[cmd]) {
+			continue
+		}
+		where := fmt.Sprintf("%s with %s at %s", p.name, p.call, relPath(p.pos.String()))
+		pkg, known := alpinePackages[cmd]
+		switch {
+		case spec.family.install == nil:
+			b.tc.printf("godockerize: %s runs %s, which can't be installed on the %s base image %s\n", spec.name(), where, spec.family.name, spec.base)
+		case !apk || !known:
+			b.tc.printf("godockerize: %s runs %s, consider installing the package that provides it\n", spec.name(), where)
+		case !installed[pkg]:
+			b.tc.printf("godockerize: %s runs %s, consider:\n  //docker:install %s\n", spec.name(), where, pkg)
+		}
+	}
+	return nil
+}
+
+// detectPrograms looks for calls of exec.Command, exec.CommandContext,
+// exec.LookPath and os.StartProcess with constant program names.
+func detectPrograms(packages []*goPackage) ([]externalProgram, error) {
+	var programs []externalProgram
+	seen := make(map[string]bool)
+	for _, pkg := range packages {
+		a, err := analyzeSource(pkg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range a.files {
+			for _, p := range a.findPrograms(f) {
+				if !seen[p.name] {
+					seen[p.name] = true
+					programs = append(programs, p)
+				}
+			}
+		}
+	}
+	return programs, nil
+}
+
+// findPrograms returns the programs that f runs.
+func (a *sourceAnalyzer) findPrograms(f *ast.File) []externalProgram {
+	var programs []externalProgram
+	calls := []struct {
+		pkg, name, fn string
+		arg           int // of the program
+	}{
+		{importName(f, "os/exec"), "Command", "exec.Command", 0},
+		{importName(f, "os/exec"), "CommandContext", "exec.CommandContext", 1},
+		{importName(f, "os/exec"), "LookPath", "exec.LookPath", 0},
+		{importName(f, "os"), "StartProcess", "os.StartProcess", 0},
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		e, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		for _, c := range calls {
+			call, ok := isCall(e, c.pkg, c.name)
+			if !ok || len(call.Args) <= c.arg {
+				continue
+			}
+			name, ok := a.value(call.Args[c.arg], 0)
+			if !ok || name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, " \t") {
+				continue
+			}
+			programs = append(programs, externalProgram{name: name, pos: a.fset.Position(call.Pos()), call: c.fn})
+		}
+		return true
+	})
+	return programs
+}
@@ -0,0 +1,92 @@
+package build
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ociAnnotationPrefix = "org.opencontainers.image."
+
+// vcsLabels returns the OCI annotations that trace the image of packages back
+// to its source: the repository, the commit with its time and the tag of the
+// commit, if any. The source is only added for a remote named origin, as
+// the module path need not be the URL of the repository; //docker:label
+// org.opencontainers.image.source=... sets it otherwise. The time of the
+// commit is used instead of the time of the build, so that an unchanged
+// image stays the same; SOURCE_DATE_EPOCH overrides it.
+func (t *toolchain) vcsLabels(packages []*goPackage) []string {
+	pkg := packages[0]
+	git := func(args ...string) string {
+		out, err := t.command("git", append([]string{"-C", pkg.Dir}, args...)...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	var labels []string
+	add := func(key, value string) {
+		if value != "" {
+			labels = append(labels, ociAnnotationPrefix+key+"="+value)
+		}
+	}
+	add("source", sourceURL(git("remote", "get-url", "origin")))
+
+	revision := git("rev-parse", "HEAD")
+	if revision == "" {
+		return labels
+	}
+	add("revision", revision)
+	created := os.Getenv("SOURCE_DATE_EPOCH")
+	if created == "" {
+		created = git("show", "-s", "--format=%ct", "HEAD")
+	}
+	if sec, err := strconv.ParseInt(created, 10, 64); err == nil {
+		add("created", time.Unix(sec, 0).UTC().Format(time.RFC3339))
+	}
+	add("version", git("describe", "--tags", "--exact-match", "HEAD"))
+	return labels
+}
+
+// sourceURL turns the URL of a git remote into a URL for browsers, without
+// credentials, e.g. git@github.com:org/repo.git becomes
+// https://github.com/org/repo.
+func sourceURL(remote string) string {
+	remote = strings.TrimSuffix(remote, ".git")
+	if strings.HasPrefix(remote, "git@") {
+		// scp-like syntax
+		return "https://" + strings.Replace(strings.TrimPrefix(remote, "git@"), ":", "/", 1)
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return "" // e.g. a local path
+	}
+	u.User = nil
+	switch u.Scheme {
+	case "http", "https":
+	case "ssh", "git":
+		// a port is not the one of the web interface
+		u.Scheme, u.Host = "https", u.Hostname()
+	default:
+		return ""
+	}
+	return u.String()
+}
+
+// addMissingLabels appends the key=value labels to labels unless they have
+// a value for the key, e.g. from //docker:label.
+func addMissingLabels(labels []string, add []string) []string {
+	keys := make(map[string]bool)
+	for _, l := range labels {
+		keys[strings.SplitN(l, "=", 2)[0]] = true
+	}
+	for _, l := range add {
+		if !keys[strings.SplitN(l, "=", 2)[0]] {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
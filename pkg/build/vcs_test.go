@@ -0,0 +1,35 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestVCSLabelsSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godockerize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tc := &toolchain{ctx: context.Background()}
+	packages := []*goPackage{{ImportPath: "example.com/app", Dir: dir, Module: &goModule{Path: "example.com/app"}}}
+
+	// the module path is not taken as the repository
+	if labels := tc.vcsLabels(packages); len(labels) != 0 {
+		t.Errorf("outside of a git checkout got %q, want no labels", labels)
+	}
+
+	for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", "git@github.com:org/app.git"}} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	want := []string{"org.opencontainers.image.source=https://github.com/org/app"}
+	if labels := tc.vcsLabels(packages); !reflect.DeepEqual(labels, want) {
+		t.Errorf("got %q, want %q", labels, want)
+	}
+}
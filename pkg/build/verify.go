@@ -0,0 +1,138 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+func doVerify(c *cli.Context) error {
+	args := c.Args()
+	if args.Len() < 2 {
+		return errors.New(`"godockerize verify" requires an image and 1 or more packages`)
+	}
+	image := args.First()
+	patterns := args.Tail()
+	if hasVersion(patterns) {
+		return errors.New("verify does not support path@version")
+	}
+
+	b, err := newBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	packages, err := b.loadPatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "godockerize")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	rc := newRegistryClient(b.tc)
+	img, err := b.openExistingImage(rc, image, tmpdir)
+	if err != nil {
+		return err
+	}
+	if !c.IsSet("base") {
+		labels := img.config.Config.Labels
+		b.base = labels[ociAnnotationPrefix+"base.name"]
+		b.baseDigest = labels[ociAnnotationPrefix+"base.digest"]
+		if b.base == "" {
+			fmt.Printf("godockerize: %s records no base image, rebuilding it from scratch\n", image)
+			b.base = "scratch"
+		}
+	}
+	spec, err := b.spec(packages)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(tmpdir, "build")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	if b.goOpts.tests {
+		if err := ioutil.WriteFile(filepath.Join(dir, testRunner), testRunnerScript, 0777); err != nil {
+			return err
+		}
+	}
+	if _, err := b.compile(packages, spec, dir); err != nil {
+		return err
+	}
+	fmt.Println("godockerize: Assembling image...")
+	rebuilt, err := b.assembleImage(rc, packages, spec, dir)
+	if err != nil {
+		return stageErrorf(stageDockerBuild, "assembling image: %v", err)
+	}
+	var config imageConfig
+	if err := json.Unmarshal(rebuilt.config, &config); err != nil {
+		return err
+	}
+
+	if !printLayerComparison(img.config, &config) {
+		return stageErrorf(stageCheck, "%s is not reproducible from the source, its layers differ", image)
+	}
+	if img.id != rebuilt.configDigest() {
+		return stageErrorf(stageCheck, "%s is not reproducible from the source: the layers match, but its config %s differs from %s", image, img.id, rebuilt.configDigest())
+	}
+	fmt.Printf("godockerize: %s is reproducible from the source, image %s\n", image, img.id)
+	return nil
+}
+
+// printLayerComparison prints a row for each layer of the existing and the
+// rebuilt image and reports whether all of them match.
+func printLayerComparison(existing, rebuilt *imageConfig) bool {
+	existingIDs, rebuiltIDs := existing.RootFS.DiffIDs, rebuilt.RootFS.DiffIDs
+	n := len(existingIDs)
+	if len(rebuiltIDs) > n {
+		n = len(rebuiltIDs)
+	}
+	createdBy := layerHistory(rebuilt)
+	if len(existingIDs) > len(rebuiltIDs) {
+		createdBy = layerHistory(existing)
+	}
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i := 0; i < n; i++ {
+		result := "match"
+		switch {
+		case i >= len(existingIDs):
+			result = "missing in the image"
+		case i >= len(rebuiltIDs):
+			result = "missing in the rebuild"
+		case existingIDs[i] != rebuiltIDs[i]:
+			result = "differs"
+		}
+		if result != "match" {
+			ok = false
+		}
+		fmt.Fprintf(w, "layer %d\t%s\t%s\n", i+1, result, createdBy[i])
+	}
+	w.Flush()
+	return ok
+}
+
+// layerHistory returns the created_by of the history items that have a
+// layer, with one entry for each of the layers of config.
+func layerHistory(config *imageConfig) []string {
+	var createdBy []string
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	for len(createdBy) < len(config.RootFS.DiffIDs) {
+		createdBy = append(createdBy, "")
+	}
+	return createdBy
+}
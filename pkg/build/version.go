@@ -0,0 +1,70 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/neelance/godockerize/pkg/directive"
+	"github.com/urfave/cli/v2"
+)
+
+// Stamped at build time, e.g.
+//
+//	pkg=github.com/neelance/godockerize/pkg/build
+//	go build -ldflags "-X $pkg.version=v0.1.0 -X $pkg.commit=$(git rev-parse HEAD) -X $pkg.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// versionInfo describes the build of godockerize itself.
+type versionInfo struct {
+	Version                string `json:"version"`
+	Commit                 string `json:"commit,omitempty"`
+	Date                   string `json:"date,omitempty"`
+	GoVersion              string `json:"goVersion"`
+	Platform               string `json:"platform"`
+	DirectiveSchemaVersion int    `json:"directiveSchemaVersion"`
+}
+
+func currentVersion() *versionInfo {
+	v := &versionInfo{
+		Version:                version,
+		Commit:                 commit,
+		Date:                   date,
+		GoVersion:              runtime.Version(),
+		Platform:               runtime.GOOS + "/" + runtime.GOARCH,
+		DirectiveSchemaVersion: directive.SchemaVersion,
+	}
+	if v.Version == "" {
+		// not stamped, but "go install ...@version" records the version
+		v.Version = "devel"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			v.Version = bi.Main.Version
+		}
+	}
+	return v
+}
+
+func doVersion(c *cli.Context) error {
+	v := currentVersion()
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	fmt.Printf("godockerize %s\n", v.Version)
+	if v.Commit != "" {
+		fmt.Printf("commit:           %s\n", v.Commit)
+	}
+	if v.Date != "" {
+		fmt.Printf("built:            %s\n", v.Date)
+	}
+	fmt.Printf("go:               %s %s\n", v.GoVersion, v.Platform)
+	fmt.Printf("directive schema: %d\n", v.DirectiveSchemaVersion)
+	return nil
+}
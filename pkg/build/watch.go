@@ -0,0 +1,270 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// fileState is what watch compares to notice that a file changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func doWatch(c *cli.Context) error {
+	patterns, runArgs := splitRunArgs(c.Args().Slice())
+	if len(patterns) < 1 {
+		return errors.New(`"godockerize watch" requires 1 or more packages`)
+	}
+	if hasVersion(patterns) {
+		return errors.New("watch does not support path@version")
+	}
+	b, err := newRunBuilder(c)
+	if err != nil {
+		return err
+	}
+	defer b.cancel()
+	hotCopy := c.Bool("hot-copy")
+	if hotCopy && b.inDocker {
+		return errors.New("--hot-copy can't be combined with --build-in-docker")
+	}
+
+	w := &watcher{
+		b:       b,
+		c:       c,
+		args:    runArgs,
+		volumes: make(map[string]string),
+	}
+	defer w.stop()
+	if err := w.rebuild(patterns); err != nil {
+		return err
+	}
+	files, err := b.tc.sourceFiles(b.goOpts, patterns)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Watching %d files...\n", len(files))
+	for {
+		select {
+		case <-c.Context.Done():
+			return nil
+		case <-time.After(c.Duration("interval")):
+		}
+		if !filesChanged(files) {
+			continue
+		}
+		// wait until e.g. an editor has written all files
+		for {
+			files = statFiles(files)
+			time.Sleep(c.Duration("interval"))
+			if !filesChanged(files) {
+				break
+			}
+		}
+
+		if hotCopy {
+			err = w.hotCopy(patterns)
+		} else {
+			err = w.rebuild(patterns)
+		}
+		if c.Context.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			// keep the last working container until the next change
+			fmt.Fprintf(os.Stderr, "godockerize: %v\n", err)
+		}
+		if newFiles, err := b.tc.sourceFiles(b.goOpts, patterns); err == nil {
+			files = newFiles
+		}
+	}
+}
+
+// watcher keeps a container of the image that watch builds running.
+type watcher struct {
+	b       *builder
+	c       *cli.Context
+	args    []string          // of the entrypoint
+	volumes map[string]string // mounted into each container
+
+	container string // ID of the running container, if any
+	logs      *exec.Cmd
+}
+
+// rebuild builds the image and replaces the container with one of the new
+// image. Thanks to the binary cache and per-binary layers only what changed
+// is compiled and added to the image.
+func (w *watcher) rebuild(patterns []string) error {
+	results, err := w.b.buildPatterns(w.c, patterns)
+	if err != nil {
+		return err
+	}
+	id := results[0].ImageID
+	opts, err := w.b.runOptions(w.c, id, w.volumes)
+	if err != nil {
+		return err
+	}
+	w.stop()
+	args := append(append(append([]string{"run", "-d", "--rm"}, opts...), id), w.args...)
+	out, err := w.b.tc.dockerCmd(args...).Output()
+	if err != nil {
+		return fmt.Errorf("docker run: %v", err)
+	}
+	w.container = strings.TrimSpace(string(out))
+	fmt.Printf("godockerize: Started container %s\n", shortID(w.container))
+
+	w.logs = w.b.tc.dockerCmd("logs", "-f", w.container)
+	w.logs.Stdout = os.Stdout
+	w.logs.Stderr = os.Stderr
+	if err := w.logs.Start(); err != nil {
+		return err
+	}
+	go w.logs.Wait()
+	return nil
+}
+
+// hotCopy compiles the binaries and copies them into the running container,
+// which is then restarted, without building an image.
+func (w *watcher) hotCopy(patterns []string) error {
+	if w.container == "" {
+		return w.rebuild(patterns)
+	}
+	packages, err := w.b.loadPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	spec, err := w.b.spec(packages)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "godockerize")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := w.b.compile(packages, spec, dir); err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		name := pkg.binaryName()
+		// "docker cp" copies links as links, which could point into the cache
+		file := filepath.Join(dir, name+".copy")
+		if err := copyFileContents(filepath.Join(dir, name), file); err != nil {
+			return err
+		}
+		if err := os.Chmod(file, 0755); err != nil {
+			return err
+		}
+		if out, err := w.b.tc.dockerCmd("cp", file, w.container+":"+spec.family.binPath(name)).CombinedOutput(); err != nil {
+			return fmt.Errorf("docker cp: %v: %s", err, out)
+		}
+	}
+	fmt.Printf("godockerize: Restarting container %s\n", shortID(w.container))
+	if out, err := w.b.tc.dockerCmd("restart", w.container).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker restart: %v: %s", err, out)
+	}
+	return nil
+}
+
+// stop stops the running container, which removes it. It is not bound to
+// the context, so that it also works after an interrupt.
+func (w *watcher) stop() {
+	if w.container == "" {
+		return
+	}
+	fmt.Printf("godockerize: Stopping container %s\n", shortID(w.container))
+	tc := w.b.tc
+	cmd := exec.Command(tc.dockerBin, append(append([]string{}, tc.dockerOpts...), tc.engine.args([]string{"stop", w.container})...)...)
+	cmd.Env = os.Environ()
+	cmd.Run()
+	w.container = ""
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// sourceFiles returns the files that the binaries of the packages matching
+// patterns are compiled from: the Go and embedded files of all packages
+// outside of the standard library that they depend on, and the go.mod files
+// of their modules.
+func (t *toolchain) sourceFiles(opts *goBuildOptions, patterns []string) (map[string]fileState, error) {
+	args := append(append([]string{"list", "-deps", "-json"}, opts.listFlags()...), "--")
+	cmd := t.goBuildCmd(opts, append(args, patterns...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]fileState)
+	dec := json.NewDecoder(out)
+	for {
+		var pkg struct {
+			Dir                           string
+			Standard                      bool
+			GoFiles, CgoFiles, EmbedFiles []string
+			Module                        *struct{ GoMod string }
+		}
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+		if pkg.Standard {
+			continue
+		}
+		for _, names := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.EmbedFiles} {
+			for _, name := range names {
+				files[filepath.Join(pkg.Dir, name)] = fileState{}
+			}
+		}
+		if pkg.Module != nil && pkg.Module.GoMod != "" {
+			files[pkg.Module.GoMod] = fileState{}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+	return statFiles(files), nil
+}
+
+// statFiles returns the current state of files. Files that don't exist have
+// the zero state.
+func statFiles(files map[string]fileState) map[string]fileState {
+	current := make(map[string]fileState, len(files))
+	for name := range files {
+		var s fileState
+		if fi, err := os.Stat(name); err == nil {
+			s = fileState{fi.ModTime(), fi.Size()}
+		}
+		current[name] = s
+	}
+	return current
+}
+
+func filesChanged(files map[string]fileState) bool {
+	for name, s := range statFiles(files) {
+		if s != files[name] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// wizard asks for the settings of build --interactive.
+type wizard struct {
+	in      *bufio.Reader
+	answers [][2]string // key and value, in the order they were asked
+}
+
+// runWizard asks for the tag, base image and user unless flags, environment
+// variables, the configuration file or directives give them, sets the flags
+// to the answers and adds them to the configuration file.
+func runWizard(c *cli.Context, patterns []string) error {
+	tc := &toolchain{ctx: c.Context, goBin: c.String("go-bin")}
+	packages, err := tc.loadPackages(&goBuildOptions{goos: c.String("goos"), goarch: c.String("goarch")}, patterns)
+	if err != nil {
+		return err
+	}
+	spec := newImageSpec(packages)
+	if err := spec.scanDirectives(tc); err != nil {
+		return err
+	}
+	w := &wizard{in: bufio.NewReader(os.Stdin)}
+
+	if !c.IsSet("tag") {
+		suggestion := "{{.Name}}:latest"
+		if m := packages[0].Module; m != nil {
+			suggestion = strings.ToLower(filepath.Base(m.Path)) + "/{{.Name}}:latest"
+		}
+		if err := w.ask(c, "tag", fmt.Sprintf("Tag of the image, {{.Name}} is the name of the binary (%s)", spec.name()), suggestion); err != nil {
+			return err
+		}
+	}
+
+	base := c.String("base")
+	if !c.IsSet("base") {
+		suggestion := autoBase(spec, &goBuildOptions{})
+		fmt.Printf("godockerize: Base images: %s has a shell and a package manager, gcr.io/distroless/static has CA certificates and a nonroot user, scratch only the binaries; %s picks one for each image.\n", baseDockerImage, autoBaseImage)
+		if err := w.ask(c, "base", "Base image", suggestion); err != nil {
+			return err
+		}
+		base = c.String("base")
+	}
+
+	if !c.IsSet("user") && spec.user == "" && baseFamilyOf(base).nonroot == "" {
+		if err := w.ask(c, "user", "User that runs the entrypoint, root for none", "app"); err != nil {
+			return err
+		}
+	}
+
+	if len(w.answers) == 0 {
+		return nil
+	}
+	return w.save(packages[0])
+}
+
+// ask prompts for the value of the flag key and sets it.
+func (w *wizard) ask(c *cli.Context, key, prompt, suggestion string) error {
+	fmt.Printf("godockerize: %s [%s]: ", prompt, suggestion)
+	line, err := w.in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err == io.EOF {
+		fmt.Println()
+	}
+	value := strings.TrimSpace(line)
+	if value == "" {
+		value = suggestion
+	}
+	if err := c.Set(key, value); err != nil {
+		return fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	w.answers = append(w.answers, [2]string{key, value})
+	return nil
+}
+
+// save adds the answers to the configuration file, which is created in the
+// root of the module of pkg if there is none.
+func (w *wizard) save(pkg *goPackage) error {
+	file := findProjectConfig()
+	if file == "" {
+		dir := "."
+		if m := pkg.Module; m != nil && m.Dir != "" {
+			dir = m.Dir
+		}
+		file = filepath.Join(dir, configFile)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var b bytes.Buffer
+	b.Write(data)
+	if len(data) != 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	if len(data) != 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("# Answers of godockerize build --interactive.\n")
+	for _, a := range w.answers {
+		fmt.Fprintf(&b, "%s: %s\n", a[0], strconv.Quote(a[1]))
+	}
+	if err := ioutil.WriteFile(file, b.Bytes(), 0666); err != nil {
+		return err
+	}
+	fmt.Printf("godockerize: Saved the answers to %s\n", file)
+	return nil
+}
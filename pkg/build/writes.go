@@ -0,0 +1,193 @@
+package build
+
+import (
+	"go/ast"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// writtenDir is a directory that a package writes to, found by detectWrites.
+type writtenDir struct {
+	dir  string
+	pos  token.Position
+	call string // e.g. "os.MkdirAll"
+}
+
+// writeCalls are the functions that write to the path of their first
+// argument, and whether that path is the directory itself rather than a
+// file in it.
+var writeCalls = []struct {
+	pkg, name string
+	dir       bool
+}{
+	{"os", "Create", false},
+	{"os", "WriteFile", false},
+	{"os", "Mkdir", true},
+	{"os", "MkdirAll", true},
+	{"os", "MkdirTemp", true},
+	{"os", "CreateTemp", true},
+	{"io/ioutil", "WriteFile", false},
+	{"io/ioutil", "TempDir", true},
+	{"io/ioutil", "TempFile", true},
+}
+
+// writeFlags are the flags of os.OpenFile that open a file for writing.
+var writeFlags = map[string]bool{"O_WRONLY": true, "O_RDWR": true, "O_CREATE": true, "O_APPEND": true, "O_TRUNC": true}
+
+// suggestWritableDirs prints the directories that the packages of spec
+// write to, for --detect-writes, with the directives that let the image
+// run with a read-only root filesystem and as a user other than root.
+// Directories that are volumes already and temporary directories are left
+// out.
+func (b *builder) suggestWritableDirs(spec *imageSpec) error {
+	if spec.family.windows {
+		return nil
+	}
+	packages, err := b.tc.sourcePackages(b.goOpts, spec.packages, true)
+	if err != nil {
+		return err
+	}
+	dirs, err := detectWrites(packages)
+	if err != nil {
+		return err
+	}
+	user := spec.imageUser()
+	for _, d := range dirs {
+		if isVolumeDir(d.dir, spec.volumes) || d.dir == "/tmp" || strings.HasPrefix(d.dir, "/tmp/") {
+			continue
+		}
+		b.tc.printf("godockerize: %s writes to %s with %s at %s, consider:\n", spec.name(), d.dir, d.call, relPath(d.pos.String()))
+		b.tc.printf("  //docker:volume %s\n", d.dir)
+		switch {
+		case user == "":
+		case !spec.family.shell:
+			b.tc.printf("  a directory %s owned by %s, which %s images can't create with //docker:run\n", d.dir, user, spec.family.name)
+		case !createsDir(spec.run, d.dir):
+			b.tc.printf("  //docker:run mkdir -p %s && chown %s %s\n", d.dir, user, d.dir)
+		}
+	}
+	return nil
+}
+
+// isVolumeDir reports whether dir is one of volumes or in one of them.
+func isVolumeDir(dir string, volumes []string) bool {
+	for _, v := range volumes {
+		v = strings.TrimSuffix(v, "/")
+		if dir == v || strings.HasPrefix(dir, v+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// createsDir reports whether one of the commands of //docker:run mentions
+// dir, assuming that it creates it.
+func createsDir(run []string, dir string) bool {
+	for _, cmd := range run {
+		for _, field := range strings.Fields(cmd) {
+			if strings.TrimSuffix(field, "/") == dir {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectWrites looks for calls that create or write files or directories at
+// constant absolute paths: os.Create, os.WriteFile, os.OpenFile with a flag
+// for writing, os.Mkdir, os.MkdirAll, the temporary files and directories of
+// os and their io/ioutil equivalents. Paths may be joined with filepath.Join
+// or path.Join.
+func detectWrites(packages []*goPackage) ([]writtenDir, error) {
+	var dirs []writtenDir
+	seen := make(map[string]bool)
+	for _, pkg := range packages {
+		a, err := analyzeSource(pkg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range a.files {
+			for _, d := range a.findWrites(f) {
+				if !seen[d.dir] {
+					seen[d.dir] = true
+					dirs = append(dirs, d)
+				}
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// findWrites returns the directories that f writes to.
+func (a *sourceAnalyzer) findWrites(f *ast.File) []writtenDir {
+	var dirs []writtenDir
+	add := func(e ast.Expr, isDir bool, call string, pos token.Pos) {
+		p, ok := a.pathValue(f, e)
+		if !ok || !strings.HasPrefix(p, "/") {
+			return
+		}
+		p = path.Clean(p)
+		if !isDir {
+			p = path.Dir(p)
+		}
+		if p == "/" {
+			return
+		}
+		dirs = append(dirs, writtenDir{dir: p, pos: a.fset.Position(pos), call: call})
+	}
+	osPkg := importName(f, "os")
+	ast.Inspect(f, func(n ast.Node) bool {
+		e, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		for _, fn := range writeCalls {
+			if call, ok := isCall(e, importName(f, fn.pkg), fn.name); ok && len(call.Args) >= 1 {
+				add(call.Args[0], fn.dir, path.Base(fn.pkg)+"."+fn.name, call.Pos())
+			}
+		}
+		if call, ok := isCall(e, osPkg, "OpenFile"); ok && len(call.Args) >= 2 && opensForWriting(call.Args[1]) {
+			add(call.Args[0], false, "os.OpenFile", call.Pos())
+		}
+		return true
+	})
+	return dirs
+}
+
+// opensForWriting reports whether the flag of os.OpenFile contains one of
+// writeFlags.
+func opensForWriting(flag ast.Expr) bool {
+	found := false
+	ast.Inspect(flag, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			found = found || writeFlags[n.Sel.Name]
+		case *ast.Ident:
+			found = found || writeFlags[n.Name]
+		}
+		return !found
+	})
+	return found
+}
+
+// pathValue returns the constant path e evaluates to, including calls of
+// filepath.Join and path.Join with constant arguments.
+func (a *sourceAnalyzer) pathValue(f *ast.File, e ast.Expr) (string, bool) {
+	for _, join := range []string{importName(f, "path/filepath"), importName(f, "path")} {
+		call, ok := isCall(e, join, "Join")
+		if !ok {
+			continue
+		}
+		var elems []string
+		for _, arg := range call.Args {
+			s, ok := a.value(arg, 0)
+			if !ok {
+				return "", false
+			}
+			elems = append(elems, s)
+		}
+		return path.Join(elems...), true
+	}
+	return a.value(e, 0)
+}
@@ -0,0 +1,123 @@
+package directive
+
+import "errors"
+
+// SchemaVersion is incremented whenever the directives of godockerize are
+// added or their arguments change, so that tools consuming the schema can
+// tell.
+const SchemaVersion = 4
+
+func init() {
+	for _, k := range builtin {
+		Register(k)
+	}
+}
+
+// builtin lists the directives that godockerize build acts on.
+var builtin = []*Kind{
+	{
+		Name:        "env",
+		Args:        "NAME=value...",
+		Repeatable:  true,
+		Description: "Sets environment variables of the image.",
+		Examples:    []string{"//docker:env GIN_MODE=release", "//docker:env LISTEN=:8080 DATA_DIR=/data"},
+		Check:       requiresArgs("NAME=value"),
+	},
+	{
+		Name:        "expose",
+		Args:        "port[-port][/tcp|udp|sctp]...",
+		Repeatable:  true,
+		Description: "Exposes ports of the image.",
+		Examples:    []string{"//docker:expose 8080", "//docker:expose 53/udp 8000-8010"},
+		Check:       requiresArgs("a port"),
+	},
+	{
+		Name:        "install",
+		Args:        "package[@edge][=version]...",
+		Repeatable:  true,
+		Description: "Installs packages with the package manager of the base image; @edge takes an Alpine package from the edge repository.",
+		Examples:    []string{"//docker:install git openssh-client", "//docker:install ffmpeg@edge"},
+		Check:       requiresArgs("a package"),
+	},
+	{
+		Name:        "run",
+		Args:        "command",
+		Repeatable:  true,
+		Description: "Runs a shell command while building the image, after the packages are installed.",
+		Examples:    []string{"//docker:run mkdir -p /data && chown app /data"},
+		Check:       requiresArgs("a command"),
+	},
+	{
+		Name:        "user",
+		Args:        "user[:group]",
+		Description: "Runs the entrypoint as the user, which is created if it does not exist.",
+		Examples:    []string{"//docker:user app", "//docker:user 1000:1000"},
+		Check:       requiresFields(1, "exactly one user"),
+	},
+	{
+		Name:        "copy",
+		Args:        "source destination",
+		Repeatable:  true,
+		Description: "Copies a file or directory, relative to the package, to an absolute path in the image.",
+		Examples:    []string{"//docker:copy templates /usr/share/app/templates"},
+		Check:       requiresFields(2, "a source and a destination"),
+	},
+	{
+		Name:        "volume",
+		Args:        "path...",
+		Repeatable:  true,
+		Description: "Declares absolute paths in the image as volumes, which get named volumes in godockerize compose and quadlet.",
+		Examples:    []string{"//docker:volume /data"},
+		Check:       requiresArgs("a path"),
+	},
+	{
+		Name:        "nocompress",
+		Description: "Excludes the binary of the package from --compress.",
+		Examples:    []string{"//docker:nocompress"},
+	},
+	{
+		Name:        "healthcheck",
+		Args:        "command [args...] | http://host:port/path",
+		Description: "Sets the command that checks the health of the container; a command that is the name of one of the binaries runs that binary. An http:// URL is requested by a small helper binary that is added to the image.",
+		Examples:    []string{"//docker:healthcheck server -healthcheck", "//docker:healthcheck http://localhost:8080/healthz"},
+		Check:       requiresArgs("a command"),
+	},
+	{
+		Name:        "depends",
+		Args:        "service...",
+		Repeatable:  true,
+		Description: "Makes the service of the package depend on the services of other packages in godockerize compose.",
+		Examples:    []string{"//docker:depends db cache"},
+		Check:       requiresArgs("a service"),
+	},
+	{
+		Name:        "include",
+		Args:        "after-from|before-user|after-binaries file",
+		Repeatable:  true,
+		Description: "Inserts the Dockerfile instructions of a file, relative to the package, into the image stage: after FROM, before USER or after the binaries are copied.",
+		Examples:    []string{"//docker:include after-from docker/repositories.Dockerfile"},
+		Check:       requiresFields(2, "a point and a file"),
+	},
+}
+
+// requiresArgs returns a Check for directives that need at least one
+// argument.
+func requiresArgs(what string) func(*Directive) error {
+	return func(d *Directive) error {
+		if len(d.Fields()) == 0 {
+			return errors.New("requires " + what)
+		}
+		return nil
+	}
+}
+
+// requiresFields returns a Check for directives that need exactly n
+// arguments.
+func requiresFields(n int, what string) func(*Directive) error {
+	return func(d *Directive) error {
+		if len(d.Fields()) != n {
+			return errors.New("requires " + what)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+// Package directive scans Go source files for //docker: comments, the
+// directives that godockerize builds images from. It is the parser of the
+// builder, so that other tools like linters read directives exactly the same
+// way. Kinds of directives are registered with Register; those of godockerize
+// are registered by the package itself.
+package directive
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prefix starts every directive.
+const Prefix = "//docker:"
+
+// Directive is a //docker: comment and where it was found.
+type Directive struct {
+	Pos  token.Position
+	Name string // e.g. "expose"
+	Args string // everything after the name, trimmed
+	Text string // the whole comment
+}
+
+// Fields returns the arguments split at white space.
+func (d *Directive) Fields() []string {
+	return strings.Fields(d.Args)
+}
+
+func (d *Directive) String() string {
+	return d.Text
+}
+
+// Parse returns the directive of a comment, or nil if it is not a directive.
+// The position is left to the caller.
+func Parse(text string) *Directive {
+	if !strings.HasPrefix(text, Prefix) {
+		return nil
+	}
+	parts := strings.SplitN(text[len(Prefix):], " ", 2)
+	d := &Directive{Name: parts[0], Text: text}
+	if len(parts) == 2 {
+		d.Args = strings.TrimSpace(parts[1])
+	}
+	return d
+}
+
+// ScanFile returns the directives in the comments of f, which must have been
+// parsed with parser.ParseComments.
+func ScanFile(fset *token.FileSet, f *ast.File) []*Directive {
+	var directives []*Directive
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if d := Parse(c.Text); d != nil {
+				d.Pos = fset.Position(c.Pos())
+				directives = append(directives, d)
+			}
+		}
+	}
+	return directives
+}
+
+// ParseFiles parses the files and returns their directives in order.
+func ParseFiles(fset *token.FileSet, filenames []string) ([]*Directive, error) {
+	var directives []*Directive
+	for _, name := range filenames {
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, ScanFile(fset, f)...)
+	}
+	return directives, nil
+}
+
+// Kind describes a kind of directive. Its fields other than Check are
+// printed by "godockerize directives".
+type Kind struct {
+	Name        string   `json:"name"`
+	Args        string   `json:"args"` // grammar of the arguments, empty if there are none
+	Repeatable  bool     `json:"repeatable"`
+	Description string   `json:"description"`
+	Examples    []string `json:"examples"`
+
+	// Check, if set, returns what is wrong with the arguments of a
+	// directive, e.g. "requires a path". Conflicts between directives are
+	// left to the tools that act on them.
+	Check func(d *Directive) error `json:"-"`
+}
+
+var (
+	mu    sync.RWMutex
+	kinds []*Kind
+)
+
+// Register adds a kind of directive. It panics if the name is empty or
+// already registered.
+func Register(k *Kind) {
+	mu.Lock()
+	defer mu.Unlock()
+	if k.Name == "" {
+		panic("directive: Register of a kind without name")
+	}
+	for _, other := range kinds {
+		if other.Name == k.Name {
+			panic("directive: Register called twice for " + k.Name)
+		}
+	}
+	kinds = append(kinds, k)
+}
+
+// Lookup returns the registered kind with the name, or nil.
+func Lookup(name string) *Kind {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, k := range kinds {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// Kinds returns the registered kinds in the order of registration.
+func Kinds() []*Kind {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]*Kind{}, kinds...)
+}
+
+// Names returns the names of the registered kinds, sorted.
+func Names() []string {
+	var names []string
+	for _, k := range Kinds() {
+		names = append(names, k.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ErrUnknown is returned by Validate for directives of no registered kind.
+var ErrUnknown = errors.New("unknown directive")
+
+// Validate checks d against its kind. The error starts with the position
+// of d and can be tested for ErrUnknown with errors.Is.
+func Validate(d *Directive) error {
+	k := Lookup(d.Name)
+	if k == nil {
+		return &Error{Directive: d, Err: ErrUnknown}
+	}
+	if k.Check != nil {
+		if err := k.Check(d); err != nil {
+			return &Error{Directive: d, Err: err}
+		}
+	}
+	return nil
+}
+
+// Error is a problem with a directive.
+type Error struct {
+	Directive *Directive
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Err == ErrUnknown {
+		return fmt.Sprintf("%s: invalid docker comment: %s", e.Directive.Pos, e.Directive.Text)
+	}
+	return fmt.Sprintf("%s: %s%s %v: %s", e.Directive.Pos, Prefix, e.Directive.Name, e.Err, e.Directive.Text)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
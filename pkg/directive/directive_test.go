@@ -0,0 +1,182 @@
+package directive
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want *Directive
+	}{
+		{"//docker:expose 8080 9090", &Directive{Name: "expose", Args: "8080 9090", Text: "//docker:expose 8080 9090"}},
+		{"//docker:nocompress", &Directive{Name: "nocompress", Text: "//docker:nocompress"}},
+		{"//docker:run  echo  hi ", &Directive{Name: "run", Args: "echo  hi", Text: "//docker:run  echo  hi "}},
+		{"// docker:expose 8080", nil},
+		{"/*docker:expose 8080*/", nil},
+		{"//go:generate stringer", nil},
+	}
+	for _, test := range tests {
+		if got := Parse(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+	}
+	d := Parse("//docker:env A=1  B=2")
+	if got, want := d.Fields(), []string{"A=1", "B=2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %q, want %q", got, want)
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.go": "// Command app serves.\npackage main\n\n//docker:expose 8080\n//docker:user app\n\nfunc main() {\n\t//docker:env MODE=production\n}\n",
+		"b.go": "package main\n\n// not a //docker:volume /data\n//docker:volume /data\n",
+	}
+	var names []string
+	for name, src := range files {
+		names = append(names, filepath.Join(dir, name))
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(names)
+
+	directives, err := ParseFiles(token.NewFileSet(), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range directives {
+		got = append(got, fmt.Sprintf("%s:%d:%d %s %s", filepath.Base(d.Pos.Filename), d.Pos.Line, d.Pos.Column, d.Name, d.Args))
+	}
+	want := []string{"a.go:4:1 expose 8080", "a.go:5:1 user app", "a.go:8:2 env MODE=production", "b.go:4:1 volume /data"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(names[0], []byte("package"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseFiles(token.NewFileSet(), names); err == nil {
+		t.Error("ParseFiles of a file with a syntax error did not fail")
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", "package main\n\n//docker:expose 8080\n", parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directives := ScanFile(fset, f)
+	if len(directives) != 1 || directives[0].Pos.String() != "main.go:3:1" {
+		t.Errorf("got %v", directives)
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	names := Names()
+	if !sort.StringsAreSorted(names) || len(names) < len(builtin) {
+		t.Errorf("Names() = %q", names)
+	}
+	for i, k := range Kinds()[:len(builtin)] {
+		if k != builtin[i] {
+			t.Errorf("kind %d is %s, want %s in the order of registration", i, k.Name, builtin[i].Name)
+		}
+		if Lookup(k.Name) != k {
+			t.Errorf("Lookup(%q) did not return the kind", k.Name)
+		}
+		for _, example := range k.Examples {
+			d := Parse(example)
+			if d == nil || d.Name != k.Name {
+				t.Errorf("example %q of %s is not a directive of it", example, k.Name)
+				continue
+			}
+			if err := Validate(d); err != nil {
+				t.Errorf("example %q: %v", example, err)
+			}
+		}
+	}
+	if Lookup("missing") != nil {
+		t.Error("Lookup of an unregistered name returned a kind")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	pos := token.Position{Filename: "main.go", Line: 3, Column: 1}
+	tests := []struct {
+		text string
+		want string // error, "" if valid
+	}{
+		{"//docker:expose 8080", ""},
+		{"//docker:expose", "main.go:3:1: //docker:expose requires a port: //docker:expose"},
+		{"//docker:user app extra", "main.go:3:1: //docker:user requires exactly one user: //docker:user app extra"},
+		{"//docker:copy templates", "main.go:3:1: //docker:copy requires a source and a destination: //docker:copy templates"},
+		{"//docker:nocompress", ""},
+		{"//docker:exposee 8080", "main.go:3:1: invalid docker comment: //docker:exposee 8080"},
+	}
+	for _, test := range tests {
+		d := Parse(test.text)
+		d.Pos = pos
+		err := Validate(d)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("Validate(%q): %v", test.text, err)
+		case test.want != "" && (err == nil || err.Error() != test.want):
+			t.Errorf("Validate(%q) = %v, want %s", test.text, err, test.want)
+		}
+	}
+
+	d := Parse("//docker:exposee 8080")
+	var derr *Error
+	if err := Validate(d); !errors.Is(err, ErrUnknown) || !errors.As(err, &derr) || derr.Directive != d {
+		t.Errorf("Validate of an unknown directive returned %v", err)
+	}
+	if err := Validate(Parse("//docker:expose")); errors.Is(err, ErrUnknown) {
+		t.Errorf("Validate of a known directive returned ErrUnknown")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	checked := errors.New("requires a test")
+	Register(&Kind{Name: "test-register", Check: func(d *Directive) error {
+		if d.Args == "" {
+			return checked
+		}
+		return nil
+	}})
+	if k := Kinds(); k[len(k)-1].Name != "test-register" {
+		t.Errorf("the last kind is %s, want the registered one", k[len(k)-1].Name)
+	}
+	if err := Validate(Parse("//docker:test-register x")); err != nil {
+		t.Error(err)
+	}
+	if err := Validate(Parse("//docker:test-register")); !errors.Is(err, checked) {
+		t.Errorf("got %v, want the error of Check", err)
+	}
+
+	for _, k := range []*Kind{{Name: "test-register"}, {Name: "expose"}, {}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) did not panic", k.Name)
+				}
+			}()
+			Register(k)
+		}()
+	}
+}
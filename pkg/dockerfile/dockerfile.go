@@ -0,0 +1,199 @@
+// Package dockerfile builds Dockerfiles from structured instructions, so that
+// they can be changed before they are rendered instead of spliced as text.
+package dockerfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Instruction is a line of a Dockerfile, e.g. {"RUN", "apk add git"}.
+type Instruction struct {
+	Cmd  string // upper case, e.g. "COPY"
+	Args string // everything after the command, including options like --from
+}
+
+func (inst Instruction) String() string {
+	return inst.Cmd + " " + inst.Args
+}
+
+// Parse splits a line of a Dockerfile into its instruction.
+func Parse(line string) Instruction {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	inst := Instruction{Cmd: strings.ToUpper(parts[0])}
+	if len(parts) == 2 {
+		inst.Args = strings.TrimSpace(parts[1])
+	}
+	return inst
+}
+
+// ParseText splits the text of a Dockerfile, or of a part of one, into its
+// instructions. Lines ending with a backslash are continued, comments and
+// empty lines are skipped, also between continued lines as Docker does.
+func ParseText(s string) ([]Instruction, error) {
+	var instructions []Instruction
+	var line string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasSuffix(l, "\\") {
+			line += strings.TrimSpace(strings.TrimSuffix(l, "\\")) + " "
+			continue
+		}
+		instructions = append(instructions, Parse(line+l))
+		line = ""
+	}
+	if line != "" {
+		return nil, fmt.Errorf("unterminated line continuation: %s", line)
+	}
+	return instructions, nil
+}
+
+// commands are the instructions that Docker knows.
+var commands = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+	"ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true,
+	"MAINTAINER": true, "ONBUILD": true, "RUN": true, "SHELL": true,
+	"STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// Builder collects the instructions of a Dockerfile. The zero value is an
+// empty Dockerfile.
+type Builder struct {
+	Instructions []Instruction
+}
+
+// Add appends an instruction.
+func (b *Builder) Add(cmd, args string) {
+	b.Instructions = append(b.Instructions, Instruction{Cmd: cmd, Args: args})
+}
+
+// Addf appends an instruction with arguments formatted like fmt.Sprintf.
+func (b *Builder) Addf(cmd, format string, args ...interface{}) {
+	b.Add(cmd, fmt.Sprintf(format, args...))
+}
+
+// Append appends the instructions of other, e.g. the stages of another
+// Builder.
+func (b *Builder) Append(other *Builder) {
+	b.Instructions = append(b.Instructions, other.Instructions...)
+}
+
+// Insert inserts instructions before the i-th one.
+func (b *Builder) Insert(i int, insts ...Instruction) {
+	b.Instructions = append(b.Instructions[:i], append(append([]Instruction{}, insts...), b.Instructions[i:]...)...)
+}
+
+// Remove removes the i-th instruction.
+func (b *Builder) Remove(i int) {
+	b.Instructions = append(b.Instructions[:i], b.Instructions[i+1:]...)
+}
+
+// Index returns the index of the first instruction with cmd, or -1.
+func (b *Builder) Index(cmd string) int {
+	for i, inst := range b.Instructions {
+		if inst.Cmd == cmd {
+			return i
+		}
+	}
+	return -1
+}
+
+// LastIndex returns the index of the last instruction with cmd, or -1. The
+// last FROM starts the stage of the image.
+func (b *Builder) LastIndex(cmd string) int {
+	for i := len(b.Instructions) - 1; i >= 0; i-- {
+		if b.Instructions[i].Cmd == cmd {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate checks that Docker can parse the Dockerfile: it starts with FROM,
+// possibly after ARG, and has only known instructions on single lines with
+// arguments, in valid JSON if they are in the exec form.
+func (b *Builder) Validate() error {
+	from := false
+	for i, inst := range b.Instructions {
+		errorf := func(format string, args ...interface{}) error {
+			return fmt.Errorf("instruction %d (%s): %s", i+1, inst.Cmd, fmt.Sprintf(format, args...))
+		}
+		if !commands[inst.Cmd] {
+			return errorf("unknown instruction")
+		}
+		if strings.TrimSpace(inst.Args) == "" {
+			return errorf("missing arguments")
+		}
+		if strings.ContainsAny(inst.Args, "\r\n") {
+			return errorf("arguments must be on a single line")
+		}
+		if !from && inst.Cmd != "ARG" && inst.Cmd != "FROM" {
+			return errorf("the Dockerfile must start with FROM")
+		}
+		if inst.Cmd == "FROM" {
+			from = true
+		}
+		switch inst.Cmd {
+		case "CMD", "ENTRYPOINT", "RUN", "SHELL":
+			if strings.HasPrefix(inst.Args, "[") {
+				var args []string
+				if err := json.Unmarshal([]byte(inst.Args), &args); err != nil {
+					return errorf("invalid exec form: %v", err)
+				}
+			}
+		}
+	}
+	if !from {
+		return fmt.Errorf("the Dockerfile has no FROM")
+	}
+	return nil
+}
+
+// buildKitOptions are the options of instructions that only BuildKit knows.
+var buildKitOptions = map[string][]string{
+	"ADD":  {"chmod", "link", "keep-git-dir", "checksum", "exclude"},
+	"COPY": {"chmod", "link", "parents", "exclude"},
+	"RUN":  {"mount", "network", "security"},
+}
+
+// ValidateClassic checks that the legacy builder, which Docker uses without
+// BuildKit, can build the Dockerfile: it has none of buildKitOptions.
+func (b *Builder) ValidateClassic() error {
+	for i, inst := range b.Instructions {
+		for _, opt := range inst.Options() {
+			for _, name := range buildKitOptions[inst.Cmd] {
+				if opt == name {
+					return fmt.Errorf("instruction %d (%s): --%s requires BuildKit", i+1, inst.Cmd, opt)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Options returns the names of the options that the arguments of inst start
+// with, e.g. "from" and "chmod" for "--from=build --chmod=0755 /out/app /".
+func (inst Instruction) Options() []string {
+	var names []string
+	for _, field := range strings.Fields(inst.Args) {
+		if !strings.HasPrefix(field, "--") {
+			break
+		}
+		names = append(names, strings.SplitN(field[2:], "=", 2)[0])
+	}
+	return names
+}
+
+// Render returns the Dockerfile with each line prefixed by indent.
+func (b *Builder) Render(indent string) []byte {
+	var buf bytes.Buffer
+	for _, inst := range b.Instructions {
+		fmt.Fprintf(&buf, "%s%s\n", indent, inst)
+	}
+	return buf.Bytes()
+}
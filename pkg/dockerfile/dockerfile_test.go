@@ -0,0 +1,171 @@
+package dockerfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"COPY --from=build --chmod=0755 /out/app /usr/local/bin/", []string{"from", "chmod"}},
+		{"RUN --mount=type=cache,target=/root/.cache go build", []string{"mount"}},
+		{"RUN echo --mount", nil},
+		{"FROM --platform=$BUILDPLATFORM golang AS build", []string{"platform"}},
+		{"USER app", nil},
+	}
+	for _, test := range tests {
+		if got := Parse(test.line).Options(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Options of %q = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestValidateClassic(t *testing.T) {
+	tests := []struct {
+		text string
+		want string // error, "" if valid
+	}{
+		{"FROM alpine\nCOPY --chown=app app /usr/local/bin/\nRUN apk add git\n", ""},
+		{"FROM golang AS build\nFROM alpine\nCOPY --from=build /out/app /\n", ""},
+		{"FROM alpine\nCOPY --chmod=0755 app /\n", "instruction 2 (COPY): --chmod requires BuildKit"},
+		{"FROM alpine\nADD --link app.tar /\n", "instruction 2 (ADD): --link requires BuildKit"},
+		{"FROM alpine\nRUN --network=none true\n", "instruction 2 (RUN): --network requires BuildKit"},
+		{"FROM alpine\nRUN --mount=type=secret,id=netrc \\\n  go mod download\n", "instruction 2 (RUN): --mount requires BuildKit"},
+	}
+	for _, test := range tests {
+		insts, err := ParseText(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = (&Builder{Instructions: insts}).ValidateClassic()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("ValidateClassic of %q: got %q, want %q", strings.Replace(test.text, "\n", "; ", -1), got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want Instruction
+	}{
+		{"FROM alpine:3.12", Instruction{"FROM", "alpine:3.12"}},
+		{"  run  apk add git  ", Instruction{"RUN", "apk add git"}},
+		{"USER", Instruction{"USER", ""}},
+		{`ENTRYPOINT ["/app", "-v"]`, Instruction{"ENTRYPOINT", `["/app", "-v"]`}},
+	}
+	for _, test := range tests {
+		if got := Parse(test.line); got != test.want {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseText(t *testing.T) {
+	text := `# syntax=docker/dockerfile:1
+
+FROM alpine
+RUN apk add \
+      git \
+    # a comment between continued lines
+
+      curl
+  # indented comment
+ENV A=1
+`
+	got, err := ParseText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Instruction{
+		{"FROM", "alpine"},
+		{"RUN", "apk add git curl"},
+		{"ENV", "A=1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	if insts, err := ParseText("\n# only a comment\n"); err != nil || len(insts) != 0 {
+		t.Errorf("ParseText of a comment = %v, %v", insts, err)
+	}
+	if _, err := ParseText("FROM alpine\nRUN true \\\n"); err == nil || err.Error() != "unterminated line continuation: RUN true " {
+		t.Errorf("ParseText of an unterminated continuation: got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		insts []Instruction
+		want  string // error, "" if valid
+	}{
+		{[]Instruction{{"FROM", "alpine"}, {"CMD", `["/app"]`}}, ""},
+		{[]Instruction{{"ARG", "BASE=alpine"}, {"FROM", "$BASE"}, {"RUN", "true"}}, ""},
+		{nil, "the Dockerfile has no FROM"},
+		{[]Instruction{{"ARG", "BASE=alpine"}}, "the Dockerfile has no FROM"},
+		{[]Instruction{{"RUN", "true"}, {"FROM", "alpine"}}, "instruction 1 (RUN): the Dockerfile must start with FROM"},
+		{[]Instruction{{"FROM", "alpine"}, {"COPYY", "a /"}}, "instruction 2 (COPYY): unknown instruction"},
+		{[]Instruction{{"FROM", "alpine"}, {"USER", " "}}, "instruction 2 (USER): missing arguments"},
+		{[]Instruction{{"FROM", "alpine"}, {"RUN", "true\nfalse"}}, "instruction 2 (RUN): arguments must be on a single line"},
+		{[]Instruction{{"FROM", "alpine"}, {"ENTRYPOINT", `["/app",]`}}, "instruction 2 (ENTRYPOINT): invalid exec form: invalid character ']' looking for beginning of value"},
+	}
+	for _, test := range tests {
+		err := (&Builder{Instructions: test.insts}).Validate()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("Validate of %v: got %q, want %q", test.insts, got, test.want)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	b := &Builder{}
+	b.Add("FROM", "golang AS build")
+	b.Addf("RUN", "go build -o %s .", "/out/app")
+	stage := &Builder{}
+	stage.Add("FROM", "alpine")
+	stage.Add("COPY", "--from=build /out/app /usr/local/bin/")
+	b.Append(stage)
+
+	if i := b.Index("FROM"); i != 0 {
+		t.Errorf("Index(FROM) = %d, want 0", i)
+	}
+	if i := b.LastIndex("FROM"); i != 2 {
+		t.Errorf("LastIndex(FROM) = %d, want 2", i)
+	}
+	if i, j := b.Index("USER"), b.LastIndex("USER"); i != -1 || j != -1 {
+		t.Errorf("Index and LastIndex of a missing instruction = %d, %d", i, j)
+	}
+
+	b.Insert(3, Instruction{"RUN", "apk add git"}, Instruction{"USER", "app"})
+	b.Remove(1)
+	b.Insert(len(b.Instructions), Instruction{"ENTRYPOINT", `["/usr/local/bin/app"]`})
+	if err := b.Validate(); err != nil {
+		t.Error(err)
+	}
+	want := `  FROM golang AS build
+  FROM alpine
+  RUN apk add git
+  USER app
+  COPY --from=build /out/app /usr/local/bin/
+  ENTRYPOINT ["/usr/local/bin/app"]
+`
+	if got := string(b.Render("  ")); got != want {
+		t.Errorf("Render:\n%s\nwant:\n%s", got, want)
+	}
+	// the appended Builder is not changed by the insertions
+	if len(stage.Instructions) != 2 || stage.Instructions[1].Cmd != "COPY" {
+		t.Errorf("the appended Builder changed: %v", stage.Instructions)
+	}
+}